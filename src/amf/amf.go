@@ -1,48 +1,105 @@
-package amf
-
-import (
-	"bytes"
-	"io"
-
-	"github.com/himananiito/livedl/amf/amf0"
-	"github.com/himananiito/livedl/amf/amf_t"
-)
-
-func SwitchToAmf3() amf_t.SwitchToAmf3 {
-	return amf_t.SwitchToAmf3{}
-}
-
-func EncodeAmf0(data []interface{}, asEcmaArray bool) ([]byte, error) {
-	return amf0.Encode(data, asEcmaArray)
-}
-
-func Amf0EcmaArray(data map[string]interface{}) amf_t.AMF0EcmaArray {
-	return amf_t.AMF0EcmaArray{
-		Data: data,
-	}
-}
-
-// paddingHint: zero padded before AMF data
-func DecodeAmf0(data []byte, paddingHint ...bool) (res []interface{}, err error) {
-	rdr := bytes.NewReader(data)
-	var seek1 bool
-	for _, h := range paddingHint {
-		if h {
-			seek1 = true
-			break
-		}
-	}
-	if seek1 {
-		rdr.Seek(1, io.SeekStart)
-	}
-	res, err = amf0.DecodeAll(rdr)
-	if err != nil {
-		if seek1 {
-			// retry
-			rdr.Seek(0, io.SeekStart)
-			res, err = amf0.DecodeAll(rdr)
-		}
-	}
-
-	return
-}
+package amf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/himananiito/livedl/amf/amf0"
+	"github.com/himananiito/livedl/amf/amf3"
+	"github.com/himananiito/livedl/amf/amf_t"
+)
+
+func SwitchToAmf3() amf_t.SwitchToAmf3 {
+	return amf_t.SwitchToAmf3{}
+}
+
+func EncodeAmf0(data []interface{}, asEcmaArray bool) ([]byte, error) {
+	return amf0.Encode(data, asEcmaArray)
+}
+
+func Amf0EcmaArray(data map[string]interface{}) amf_t.AMF0EcmaArray {
+	return amf_t.AMF0EcmaArray{
+		Data: data,
+	}
+}
+
+// paddingHint: zero padded before AMF data
+func DecodeAmf0(data []byte, paddingHint ...bool) (res []interface{}, err error) {
+	rdr := bytes.NewReader(data)
+	var seek1 bool
+	for _, h := range paddingHint {
+		if h {
+			seek1 = true
+			break
+		}
+	}
+	if seek1 {
+		rdr.Seek(1, io.SeekStart)
+	}
+	res, err = amf0.DecodeAll(rdr)
+	if err != nil {
+		if seek1 {
+			// retry
+			rdr.Seek(0, io.SeekStart)
+			res, err = amf0.DecodeAll(rdr)
+		}
+	}
+
+	return
+}
+
+// 値を1つAMF0で書く。構造体はタグ`amf:"name,omitempty"`に従ってオブジェクトにする
+func Marshal(v interface{}) ([]byte, error) {
+	return amf0.Encode([]interface{}{v}, false)
+}
+
+// AMF0の値を1つvに読む
+func Unmarshal(data []byte, v interface{}) (err error) {
+	rdr := bytes.NewReader(data)
+	res, err := amf0.Decode(rdr)
+	if err != nil {
+		return
+	}
+	if rdr.Len() > 0 {
+		return fmt.Errorf("amf: %d bytes of trailing data", rdr.Len())
+	}
+	return assign(v, res)
+}
+
+// AMF3の値を順に書く、読む
+func EncodeAmf3(data []interface{}) ([]byte, error) {
+	return amf3.Encode(data)
+}
+func DecodeAmf3(data []byte) ([]interface{}, error) {
+	return amf3.DecodeAll(bytes.NewReader(data))
+}
+
+func MarshalAmf3(v interface{}) ([]byte, error) {
+	return amf3.EncodeValue(v)
+}
+func UnmarshalAmf3(data []byte, v interface{}) (err error) {
+	rdr := bytes.NewReader(data)
+	res, err := amf3.Decode(rdr)
+	if err != nil {
+		return
+	}
+	if rdr.Len() > 0 {
+		return fmt.Errorf("amf: %d bytes of trailing data", rdr.Len())
+	}
+	return assign(v, res)
+}
+
+// デコード済みの値(DecodeAmf0の結果など)をvに入れる
+func Convert(data interface{}, v interface{}) error {
+	return assign(v, data)
+}
+
+func assign(v interface{}, data interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("amf: non-pointer or nil: %T", v)
+	}
+	return amf_t.Assign(rv.Elem(), data)
+}
@@ -1,319 +1,498 @@
-package amf0
-
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-	"io"
-	"log"
-	"math"
-
-	"github.com/himananiito/livedl/amf/amf3"
-	"github.com/himananiito/livedl/amf/amf_t"
-)
-
-func encodeNumber(num float64, buff *bytes.Buffer) (err error) {
-	if err = buff.WriteByte(0); err != nil {
-		return
-	}
-
-	bits := math.Float64bits(num)
-	bytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(bytes, bits)
-	if _, err = buff.Write(bytes); err != nil {
-		return
-	}
-	return
-}
-func encodeBoolean(b bool, buff *bytes.Buffer) (err error) {
-	if err = buff.WriteByte(1); err != nil {
-		return
-	}
-
-	var val byte
-	if b {
-		val = 1
-	}
-
-	if err = buff.WriteByte(val); err != nil {
-		return
-	}
-
-	return
-}
-func encodeUtf8(s string, buff *bytes.Buffer) (err error) {
-	bs := []byte(s)
-	if len(bs) > 0xffff {
-		err = fmt.Errorf("string too large")
-		return
-	}
-
-	b0 := make([]byte, 2)
-	binary.BigEndian.PutUint16(b0, uint16(len(bs)))
-	if _, err = buff.Write(b0); err != nil {
-		return
-	}
-	if _, err = buff.Write(bs); err != nil {
-		return
-	}
-	return
-}
-func encodeString(s string, buff *bytes.Buffer) (err error) {
-	if err = buff.WriteByte(2); err != nil {
-		return
-	}
-	err = encodeUtf8(s, buff)
-	return
-}
-func encodeObject(obj map[string]interface{}, buff *bytes.Buffer) (err error) {
-	if err = buff.WriteByte(3); err != nil {
-		return
-	}
-
-	for k, v := range obj {
-		if err = encodeUtf8(k, buff); err != nil {
-			return
-		}
-		if _, err = encode(v, false, buff); err != nil {
-			return
-		}
-	}
-	if _, err = buff.Write([]byte{0, 0, 9}); err != nil {
-		return
-	}
-	return
-}
-
-func encodeNull(buff *bytes.Buffer) error {
-	return buff.WriteByte(5)
-}
-func encodeSwitchToAmf3(buff *bytes.Buffer) error {
-	return buff.WriteByte(0x11)
-}
-func encodeEcmaArray(data map[string]interface{}, buff *bytes.Buffer) (err error) {
-	if err = buff.WriteByte(8); err != nil {
-		return
-	}
-	buf4 := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf4, uint32(len(data)))
-	if _, err = buff.Write(buf4); err != nil {
-		return
-	}
-
-	for k, v := range data {
-		if err = encodeUtf8(k, buff); err != nil {
-			return
-		}
-		if _, err = encode(v, true, buff); err != nil {
-			return
-		}
-	}
-	if _, err = buff.Write([]byte{0, 0, 9}); err != nil {
-		return
-	}
-
-	return
-}
-func encode(data interface{}, asEcmaArray bool, buff *bytes.Buffer) (toAmf3 bool, err error) {
-	switch data.(type) {
-	case string:
-		err = encodeString(data.(string), buff)
-	case float64:
-		err = encodeNumber(data.(float64), buff)
-	case int:
-		err = encodeNumber(float64(data.(int)), buff)
-	case bool:
-		err = encodeBoolean(data.(bool), buff)
-	case map[string]interface{}:
-		if asEcmaArray {
-			err = encodeEcmaArray(data.(map[string]interface{}), buff)
-		} else {
-			err = encodeObject(data.(map[string]interface{}), buff)
-		}
-	case []interface{}:
-		m := make(map[string]interface{})
-		for i, d := range data.([]interface{}) {
-			k := fmt.Sprintf("%d", i)
-			m[k] = d
-		}
-		err = encodeEcmaArray(m, buff)
-	case nil:
-		err = encodeNull(buff)
-	case amf_t.SwitchToAmf3:
-		toAmf3 = true
-		err = encodeSwitchToAmf3(buff)
-	default:
-		log.Fatalf("amf0/encode %#v", data)
-	}
-	return
-}
-
-func Encode(data []interface{}, asEcmaArray bool) (b []byte, err error) {
-	buff := bytes.NewBuffer(nil)
-	for i, d := range data {
-		var toAmf3 bool
-		if toAmf3, err = encode(d, asEcmaArray, buff); err != nil {
-			return
-		}
-		if toAmf3 {
-			b2, e := amf3.Encode(data[i+1:])
-			if e != nil {
-				err = e
-				return
-			}
-			b = append(b, buff.Bytes()...)
-			b = append(b, b2...)
-			return
-		}
-	}
-	b = buff.Bytes()
-	return
-}
-
-type objectEnd struct{}
-
-func decodeString(rdr *bytes.Reader) (str string, err error) {
-	buf := make([]byte, 2)
-	if _, err = io.ReadFull(rdr, buf); err != nil {
-		return
-	}
-	len := (int(buf[0]) << 8) | int(buf[1])
-	if len > 0 {
-		buf := make([]byte, len)
-		if _, err = io.ReadFull(rdr, buf); err != nil {
-			return
-		}
-		str = string(buf)
-	}
-	return
-}
-func decodeNumber(rdr *bytes.Reader) (res float64, err error) {
-	buf := make([]byte, 8)
-	if _, err = io.ReadFull(rdr, buf); err != nil {
-		return
-	}
-
-	u64 := binary.BigEndian.Uint64(buf)
-	res = math.Float64frombits(u64)
-	return
-}
-func decodeBoolean(rdr *bytes.Reader) (res bool, err error) {
-	buf := make([]byte, 1)
-	if _, err = io.ReadFull(rdr, buf); err != nil {
-		return
-	}
-	if buf[0] == 0 {
-		res = false
-	} else {
-		res = true
-	}
-	return
-}
-func decodeObject(rdr *bytes.Reader) (res map[string]interface{}, err error) {
-	res = make(map[string]interface{})
-	for {
-		key, e := decodeString(rdr)
-		if e != nil {
-			err = e
-			return
-		}
-
-		val, e := decodeOne(rdr)
-		if e != nil {
-			err = e
-			return
-		}
-		if key == "" {
-			switch val.(type) {
-			case objectEnd:
-				return
-			default:
-				log.Fatalf("decodeObject: parse error; Not object-end, %+s", val)
-			}
-		}
-		res[key] = val
-	}
-	return
-}
-func decodeEcmaArray(rdr *bytes.Reader) (res map[string]interface{}, err error) {
-	buf := make([]byte, 4)
-	if _, err = io.ReadFull(rdr, buf); err != nil {
-		return
-	}
-	//count := binary.BigEndian.Uint32(buf)
-	//log.Printf("decodeEcmaArray: Count: %v", count)
-	res, err = decodeObject(rdr)
-
-	return
-}
-func decodeStrictArray(rdr *bytes.Reader) (res []interface{}, err error) {
-	buf := make([]byte, 4)
-	if _, err = io.ReadFull(rdr, buf); err != nil {
-		return
-	}
-	count := binary.BigEndian.Uint32(buf)
-	for i := uint32(0); i < count; i++ {
-		re, e := decodeOne(rdr)
-		if e != nil {
-			err = e
-			return
-		}
-		res = append(res, re)
-	}
-	return
-}
-
-func decodeOne(rdr *bytes.Reader) (res interface{}, err error) {
-	buf := make([]byte, 1)
-	if _, err = io.ReadFull(rdr, buf); err != nil {
-		return
-	}
-	switch buf[0] {
-	case 0: // Number
-		res, err = decodeNumber(rdr)
-	case 1: // Boolean
-		res, err = decodeBoolean(rdr)
-	case 2: // String
-		res, err = decodeString(rdr)
-	case 3:
-		res, err = decodeObject(rdr)
-	case 5: // Null
-		res = nil
-	case 6: // undefined
-		res = nil
-	case 8: // ECMA Array
-		res, err = decodeEcmaArray(rdr)
-
-	case 9: // Object End
-		res = objectEnd{}
-	case 10:
-		res, err = decodeStrictArray(rdr)
-	case 0x11: // Switch to AMF3
-		dat, e := amf3.DecodeAll(rdr)
-		if e != nil {
-			err = e
-			return
-		}
-		res = amf_t.AMF3{Data: dat}
-	default:
-		err = fmt.Errorf("Not implemented: type=%d", buf[0])
-	}
-	return
-}
-
-func DecodeAll(rdr *bytes.Reader) (res []interface{}, err error) {
-	for rdr.Len() > 0 {
-		re, e := decodeOne(rdr)
-		if e != nil {
-			err = e
-			return
-		}
-		switch re.(type) {
-		case amf_t.AMF3:
-			res = append(res, re.(amf_t.AMF3).Data...)
-		default:
-			res = append(res, re)
-		}
-	}
-	return
-}
+package amf0
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/himananiito/livedl/amf/amf3"
+	"github.com/himananiito/livedl/amf/amf_t"
+)
+
+const (
+	markerNumber      = 0x00
+	markerBoolean     = 0x01
+	markerString      = 0x02
+	markerObject      = 0x03
+	markerMovieclip   = 0x04
+	markerNull        = 0x05
+	markerUndefined   = 0x06
+	markerReference   = 0x07
+	markerEcmaArray   = 0x08
+	markerObjectEnd   = 0x09
+	markerStrictArray = 0x0a
+	markerDate        = 0x0b
+	markerLongString  = 0x0c
+	markerUnsupported = 0x0d
+	markerRecordset   = 0x0e
+	markerXMLDocument = 0x0f
+	markerTypedObject = 0x10
+	markerAvmplus     = 0x11
+)
+
+// 入れ子の深さの上限
+const maxDepth = 256
+
+type encoder struct {
+	buff        *bytes.Buffer
+	asEcmaArray bool
+	objs        map[objKey]int
+	nobjs       int // デコーダの参照テーブルと同じく、参照にできないものも数える
+	depth       int
+}
+
+// 参照にするための、スライスやマップの場所
+type objKey struct {
+	kind byte
+	ptr  uintptr
+	len  int
+}
+
+// スライスとマップは中身の場所で同じものか調べる。空のものは区別できないので毎回書く
+func keyOf(kind byte, v interface{}) *objKey {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Len() == 0 {
+			return nil
+		}
+		return &objKey{kind, rv.Pointer(), rv.Len()}
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		return &objKey{kind, rv.Pointer(), 0}
+	}
+	return nil
+}
+
+// 既に書いたものならreference-typeを書いてtrueを返す
+// そうでなければmarkerを書いて参照テーブルに入れるので、続けて中身を書くこと
+func (e *encoder) ref(marker byte, key *objKey) bool {
+	if key != nil {
+		if idx, ok := e.objs[*key]; ok {
+			e.buff.WriteByte(markerReference)
+			e.u16(idx)
+			return true
+		}
+		// 参照は16bitまで
+		if e.nobjs <= 0xffff {
+			e.objs[*key] = e.nobjs
+		}
+	}
+	e.buff.WriteByte(marker)
+	e.nobjs++
+	return false
+}
+
+func (e *encoder) u16(n int) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(n))
+	e.buff.Write(b)
+}
+func (e *encoder) u32(n int) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	e.buff.Write(b)
+}
+func (e *encoder) number(num float64) {
+	e.buff.WriteByte(markerNumber)
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(num))
+	e.buff.Write(b)
+}
+
+// マーカー無しのUTF-8
+func (e *encoder) utf8(s string) (err error) {
+	if len(s) > 0xffff {
+		return fmt.Errorf("amf0: key too long: %d", len(s))
+	}
+	e.u16(len(s))
+	e.buff.WriteString(s)
+	return
+}
+func (e *encoder) string(s string) {
+	if len(s) > 0xffff {
+		e.buff.WriteByte(markerLongString)
+		e.u32(len(s))
+	} else {
+		e.buff.WriteByte(markerString)
+		e.u16(len(s))
+	}
+	e.buff.WriteString(s)
+}
+
+// キーの順番を固定する
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+func (e *encoder) properties(m map[string]interface{}) (err error) {
+	for _, k := range sortedKeys(m) {
+		if k == "" {
+			// 空のキーはobject-endと区別できない
+			continue
+		}
+		if err = e.utf8(k); err != nil {
+			return
+		}
+		if err = e.encode(m[k]); err != nil {
+			return
+		}
+	}
+	e.buff.Write([]byte{0, 0, markerObjectEnd})
+	return
+}
+
+// AMF3の値をavmplus-object-markerを付けて書く
+func (e *encoder) avmplus(data interface{}) (err error) {
+	b, err := amf3.EncodeValue(data)
+	if err != nil {
+		return
+	}
+	e.buff.WriteByte(markerAvmplus)
+	e.buff.Write(b)
+	return
+}
+
+func (e *encoder) encode(data interface{}) (err error) {
+	e.depth++
+	defer func() { e.depth-- }()
+	if e.depth > maxDepth {
+		return fmt.Errorf("amf0: nested too deeply")
+	}
+
+	switch d := data.(type) {
+	case nil:
+		e.buff.WriteByte(markerNull)
+	case bool:
+		e.buff.WriteByte(markerBoolean)
+		if d {
+			e.buff.WriteByte(1)
+		} else {
+			e.buff.WriteByte(0)
+		}
+	case string:
+		e.string(d)
+	case float64:
+		e.number(d)
+	case float32:
+		e.number(float64(d))
+	case int:
+		e.number(float64(d))
+	case int8:
+		e.number(float64(d))
+	case int16:
+		e.number(float64(d))
+	case int32:
+		e.number(float64(d))
+	case int64:
+		e.number(float64(d))
+	case uint:
+		e.number(float64(d))
+	case uint8:
+		e.number(float64(d))
+	case uint16:
+		e.number(float64(d))
+	case uint32:
+		e.number(float64(d))
+	case uint64:
+		e.number(float64(d))
+	case time.Time:
+		e.buff.WriteByte(markerDate)
+		ms := d.Unix()*1000 + int64(d.Nanosecond()/1000000)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(float64(ms)))
+		e.buff.Write(b)
+		e.u16(0) // time-zone
+	case map[string]interface{}:
+		if e.asEcmaArray {
+			err = e.ecmaArray(d)
+		} else if !e.ref(markerObject, keyOf('o', d)) {
+			err = e.properties(d)
+		}
+	case amf_t.AMF0EcmaArray:
+		err = e.ecmaArray(d.Data)
+	case amf_t.TypedObject:
+		if e.ref(markerTypedObject, keyOf('t', d.Data)) {
+			return
+		}
+		if err = e.utf8(d.ClassName); err != nil {
+			return
+		}
+		err = e.properties(d.Data)
+	case []interface{}:
+		if e.ref(markerStrictArray, keyOf('a', d)) {
+			return
+		}
+		e.u32(len(d))
+		for _, v := range d {
+			if err = e.encode(v); err != nil {
+				return
+			}
+		}
+	case amf_t.XMLDocument:
+		e.buff.WriteByte(markerXMLDocument)
+		e.u32(len(d))
+		e.buff.WriteString(string(d))
+	case []byte, amf_t.XML, amf_t.MixedArray, amf_t.VectorObject, amf_t.Dictionary:
+		// AMF0には無いのでAMF3で書く
+		err = e.avmplus(d)
+	case amf_t.SwitchToAmf3:
+		err = fmt.Errorf("amf0: SwitchToAmf3 must be a top level value")
+	default:
+		g, e2 := amf_t.Generic(data)
+		if e2 != nil {
+			return e2
+		}
+		err = e.encode(g)
+	}
+	return
+}
+func (e *encoder) ecmaArray(data map[string]interface{}) (err error) {
+	if e.ref(markerEcmaArray, keyOf('e', data)) {
+		return
+	}
+	e.u32(len(data))
+	return e.properties(data)
+}
+
+// SwitchToAmf3より後の値はAMF3で書く
+func Encode(data []interface{}, asEcmaArray bool) (b []byte, err error) {
+	e := &encoder{
+		buff:        bytes.NewBuffer(nil),
+		asEcmaArray: asEcmaArray,
+		objs:        make(map[objKey]int),
+	}
+	var toAmf3 bool
+	for _, d := range data {
+		if _, ok := d.(amf_t.SwitchToAmf3); ok {
+			toAmf3 = true
+			continue
+		}
+		if toAmf3 {
+			err = e.avmplus(d)
+		} else {
+			err = e.encode(d)
+		}
+		if err != nil {
+			return
+		}
+	}
+	b = e.buff.Bytes()
+	return
+}
+
+type decoder struct {
+	rdr   *bytes.Reader
+	refs  []interface{}
+	depth int
+}
+
+func (d *decoder) read(n int) (b []byte, err error) {
+	if n > d.rdr.Len() {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b = make([]byte, n)
+	_, err = io.ReadFull(d.rdr, b)
+	return
+}
+func (d *decoder) u16() (n int, err error) {
+	b, err := d.read(2)
+	if err != nil {
+		return
+	}
+	n = int(binary.BigEndian.Uint16(b))
+	return
+}
+func (d *decoder) u32() (n int, err error) {
+	b, err := d.read(4)
+	if err != nil {
+		return
+	}
+	n = int(binary.BigEndian.Uint32(b))
+	return
+}
+func (d *decoder) number() (res float64, err error) {
+	b, err := d.read(8)
+	if err != nil {
+		return
+	}
+	res = math.Float64frombits(binary.BigEndian.Uint64(b))
+	return
+}
+func (d *decoder) utf8() (str string, err error) {
+	n, err := d.u16()
+	if err != nil {
+		return
+	}
+	b, err := d.read(n)
+	str = string(b)
+	return
+}
+func (d *decoder) longUtf8() (str string, err error) {
+	n, err := d.u32()
+	if err != nil {
+		return
+	}
+	b, err := d.read(n)
+	str = string(b)
+	return
+}
+
+// object-endまでのプロパティ
+func (d *decoder) properties(res map[string]interface{}) (err error) {
+	for {
+		key, e := d.utf8()
+		if e != nil {
+			return e
+		}
+		if key == "" {
+			m, e := d.rdr.ReadByte()
+			if e != nil {
+				return io.ErrUnexpectedEOF
+			}
+			if m != markerObjectEnd {
+				return fmt.Errorf("amf0: object-end expected, got %d", m)
+			}
+			return
+		}
+		val, e := d.decode()
+		if e != nil {
+			return e
+		}
+		res[key] = val
+	}
+}
+
+func (d *decoder) decode() (res interface{}, err error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxDepth {
+		err = fmt.Errorf("amf0: nested too deeply")
+		return
+	}
+
+	marker, err := d.rdr.ReadByte()
+	if err != nil {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	switch marker {
+	case markerNumber:
+		res, err = d.number()
+	case markerBoolean:
+		var b []byte
+		if b, err = d.read(1); err == nil {
+			res = b[0] != 0
+		}
+	case markerString:
+		res, err = d.utf8()
+	case markerLongString:
+		res, err = d.longUtf8()
+	case markerObject:
+		m := make(map[string]interface{})
+		d.refs = append(d.refs, m)
+		err = d.properties(m)
+		res = m
+	case markerNull, markerUndefined, markerUnsupported:
+		res = nil
+	case markerReference:
+		var idx int
+		if idx, err = d.u16(); err != nil {
+			return
+		}
+		if idx >= len(d.refs) {
+			err = fmt.Errorf("amf0: invalid reference: %d", idx)
+			return
+		}
+		res = d.refs[idx]
+	case markerEcmaArray:
+		// 個数は当てにならないので読み捨てる
+		if _, err = d.u32(); err != nil {
+			return
+		}
+		m := make(map[string]interface{})
+		d.refs = append(d.refs, m)
+		err = d.properties(m)
+		res = m
+	case markerStrictArray:
+		var count int
+		if count, err = d.u32(); err != nil {
+			return
+		}
+		if count > d.rdr.Len() {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		list := make([]interface{}, count)
+		d.refs = append(d.refs, list)
+		for i := range list {
+			if list[i], err = d.decode(); err != nil {
+				return
+			}
+		}
+		res = list
+	case markerDate:
+		var ms float64
+		if ms, err = d.number(); err != nil {
+			return
+		}
+		if _, err = d.u16(); err != nil {
+			return
+		}
+		res = msToTime(ms)
+	case markerXMLDocument:
+		var s string
+		s, err = d.longUtf8()
+		res = amf_t.XMLDocument(s)
+	case markerTypedObject:
+		var name string
+		if name, err = d.utf8(); err != nil {
+			return
+		}
+		obj := amf_t.TypedObject{ClassName: name, Data: make(map[string]interface{})}
+		d.refs = append(d.refs, obj)
+		err = d.properties(obj.Data)
+		res = obj
+	case markerAvmplus:
+		res, err = amf3.Decode(d.rdr)
+	default:
+		err = fmt.Errorf("amf0: unsupported type: %d", marker)
+	}
+	return
+}
+
+func msToTime(ms float64) time.Time {
+	n := int64(ms)
+	return time.Unix(n/1000, (n%1000)*1000000).UTC()
+}
+
+func DecodeAll(rdr *bytes.Reader) (res []interface{}, err error) {
+	d := &decoder{rdr: rdr}
+	for rdr.Len() > 0 {
+		re, e := d.decode()
+		if e != nil {
+			err = e
+			return
+		}
+		res = append(res, re)
+	}
+	return
+}
+
+// 値を1つ
+func Decode(rdr *bytes.Reader) (res interface{}, err error) {
+	d := &decoder{rdr: rdr}
+	return d.decode()
+}
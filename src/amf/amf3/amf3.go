@@ -1,256 +1,889 @@
-package amf3
-
-import (
-	"bytes"
-	"io"
-	"log"
-	"fmt"
-)
-
-func decodeU29(rdr *bytes.Reader) (res int, err error) {
-	for i := 0; i < 4; i++ {
-		var num byte
-		if num, err = rdr.ReadByte(); err != nil {
-			return
-		}
-		var flg bool
-		var val uint8
-		if i == 3 {
-			val = num
-		} else {
-			flg = (num & 0x80) == 0x80
-			val = (num & 0x7f)
-		}
-
-		switch i {
-			case 0:
-				res = int(val)
-			case 3:
-				res = (res << 8) | int(val)
-			default:
-				res = (res << 7) | int(val)
-		}
-		if (! flg) {
-			break
-		}
-	}
-	return
-}
-
-// UTF-8-vr
-func decodeString(rdr *bytes.Reader) (str string, err error) {
-	// UTF-8-vr = U29S-ref
-	// UTF-8-vr = U29S-value *(UTF8-char)
-	u29, err := decodeU29(rdr)
-	if err != nil {
-		return
-	}
-	flag := (u29 & 1) != 0
-	len := u29 >> 1
-
-	if (! flag) {
-		// string reference table index
-		log.Fatalf("[FIXME] not implemented: UTF-8-vr = U29S-ref")
-	} else {
-		buf := make([]byte, len)
-		if _, err = io.ReadFull(rdr, buf); err != nil {
-			return
-		}
-		str = string(buf)
-	}
-	return
-}
-
-func assocOrUtf8Empty(rdr *bytes.Reader) (key string, val interface{}, err error) {
-	key, err = decodeString(rdr)
-	if err != nil {
-		return
-	}
-	if key == "" {
-		//fmt.Printf("assocOrUtf8Empty: string is empty\n")
-		return
-	}
-	val, err = decodeOne(rdr)
-	if err != nil {
-		return
-	}
-	//log.Fatalf("assocOrUtf8Empty: key=%v, val=%v", key, val)
-	return
-}
-
-func decodeOne(rdr *bytes.Reader) (res interface{}, err error) {
-	format, err := rdr.ReadByte()
-	if err != nil {
-		return
-	}
-	switch format {
-		case 6: // string-marker
-			res, err = decodeString(rdr)
-			if err != nil {
-				return
-			}
-		case 9: // array-marker
-		// array-marker U29O-ref
-		// # array-marker U29A-value (UTF-8-empty | * (assoc-value) UTF-8-empty) * (value-type)
-		// array-marker U29A-value * (assoc-value) UTF-8-empty * (value-type)
-		// array-marker U29A-value UTF-8-empty * (value-type)
-			u29, _ := decodeU29(rdr)
-			flag := u29 & 1 != 0
-			count := u29 >> 1
-			if (! flag) {
-				log.Fatalf("[FIXME] not implemented: array-type = array-marker U29O-ref")
-			}
-			if count == 0 { // [FIXME] condition OK?
-				// associative, terminated by empty string
-				assoc := make(map[string]interface{})
-				for {
-					k, v, e := assocOrUtf8Empty(rdr)
-					if e != nil {
-						//fmt.Printf("## amf3 associative: %+v\n", e)
-						err = e
-						return
-					}
-					if k == "" {
-						break
-					}
-					assoc[k] = v
-					//log.Printf("AMF3 array: %v = %v", k, v)
-				}
-				res = assoc
-			}
-			//log.Fatalf("AMF3 array: len: %d", count)
-		default:
-		log.Printf("%v\n", res)
-		log.Fatalf("Not implemented: %d", format)
-	}
-	return
-}
-
-func DecodeAll(rdr *bytes.Reader) (res []interface{}, err error) {
-	for rdr.Len() > 0 {
-		re, e := decodeOne(rdr)
-		if e != nil {
-			err = e
-			return
-		}
-		res = append(res, re)
-	}
-	return
-}
-
-
-func encodeU29(num int, buff *bytes.Buffer) (err error) {
-	if (0 <= num && num <= 0x7f) {
-		if err = buff.WriteByte( byte(num & 0x7f) ); err != nil {
-			return
-		}
-	} else if (0x80 <= num && num <= 0x3fff) {
-		if err = buff.WriteByte( byte(0x80 | ((num >> 7) & 0x7f)) ); err != nil {
-			return
-		}
-		if err = buff.WriteByte( byte(num & 0x7f) ); err != nil {
-			return
-		}
-	} else if (0x4000 <= num && num <= 0x1fffff) {
-		if err = buff.WriteByte( byte(0x80 | ((num >> 14) & 0x7f)) ); err != nil {
-			return
-		}
-		if err = buff.WriteByte( byte(0x80 | ((num >> 7) & 0x7f)) ); err != nil {
-			return
-		}
-		if err = buff.WriteByte( byte(num & 0x7f) ); err != nil {
-			return
-		}
-	} else if (0x200000 <= num && num <= 0x3fffffff) {
-		if err = buff.WriteByte( byte(0x80 | ((num >> 22) & 0x7f)) ); err != nil {
-			return
-		}
-		if err = buff.WriteByte( byte(0x80 | ((num >> 15) & 0x7f)) ); err != nil {
-			return
-		}
-		if err = buff.WriteByte( byte(0x80 | ((num >> 7) & 0x7f)) ); err != nil {
-			return
-		}
-		if err = buff.WriteByte( byte(num & 0xff) ); err != nil {
-			return
-		}
-	} else {
-		err = fmt.Errorf("u29 overflow")
-	}
-	return
-}
-
-func encodeU28Flag(num int, flag bool, buff *bytes.Buffer) (err error) {
-	if flag {
-		err = encodeU29(((num << 1) | 1), buff)
-	} else {
-		err = encodeU29((num << 1), buff)
-	}
-	return
-}
-
-
-func encodeArray(data []interface {}, buff *bytes.Buffer) (err error) {
-	// array-marker
-	if err = buff.WriteByte(9); err != nil {
-		return
-	}
-	// U29A-value; count of the dense portin of the Array
-	if err = encodeU28Flag(len(data), true, buff); err != nil {
-		return
-	}
-	// UTF-8-empty
-	if err = buff.WriteByte(1); err != nil {
-		return
-	}
-	for _, v := range data {
-		if err = encode(v, buff); err != nil {
-			return
-		}
-	}
-	return
-}
-
-func encodeStringArray(data []string, buff *bytes.Buffer) error {
-	var list []interface{}
-	for _, v := range data {
-		list = append(list, v)
-	}
-	return encodeArray(list, buff)
-}
-func encodeString(data string, buff *bytes.Buffer) (err error) {
-	if err = buff.WriteByte(6); err != nil {
-		return
-	}
-	bstr := []byte(data)
-	// U29S-value
-	if err = encodeU28Flag(len(bstr), true, buff); err != nil {
-		return
-	}
-	if _, err = buff.Write(bstr); err != nil {
-		return
-	}
-	return
-}
-
-func encode(data interface{}, buff *bytes.Buffer) (err error) {
-	switch data.(type) {
-		case string:
-			err = encodeString(data.(string), buff)
-		case []string:
-			err = encodeStringArray(data.([]string), buff)
-		default:
-			log.Fatalf("amf0/encode %#v", data)
-	}
-	return
-}
-func Encode(data []interface{}) (b []byte, err error) {
-	buff := bytes.NewBuffer(nil)
-	for _, data := range data {
-		if err = encode(data, buff); err != nil {
-			return
-		}
-	}
-	b = buff.Bytes()
-	return
+package amf3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/himananiito/livedl/amf/amf_t"
+)
+
+const (
+	markerUndefined    = 0x00
+	markerNull         = 0x01
+	markerFalse        = 0x02
+	markerTrue         = 0x03
+	markerInteger      = 0x04
+	markerDouble       = 0x05
+	markerString       = 0x06
+	markerXMLDoc       = 0x07
+	markerDate         = 0x08
+	markerArray        = 0x09
+	markerObject       = 0x0a
+	markerXML          = 0x0b
+	markerByteArray    = 0x0c
+	markerVectorInt    = 0x0d
+	markerVectorUint   = 0x0e
+	markerVectorDouble = 0x0f
+	markerVectorObject = 0x10
+	markerDictionary   = 0x11
+)
+
+// 入れ子の深さの上限
+const maxDepth = 256
+
+// U29で表せる整数の範囲
+const (
+	minInt = -1 << 28
+	maxInt = 1<<28 - 1
+)
+
+type traits struct {
+	className      string
+	dynamic        bool
+	externalizable bool
+	members        []string
+}
+
+type decoder struct {
+	rdr    *bytes.Reader
+	strs   []string
+	objs   []interface{}
+	traits []traits
+	depth  int
+}
+
+func (d *decoder) read(n int) (b []byte, err error) {
+	if n < 0 || n > d.rdr.Len() {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	b = make([]byte, n)
+	_, err = io.ReadFull(d.rdr, b)
+	return
+}
+
+func (d *decoder) u29() (res int, err error) {
+	for i := 0; i < 4; i++ {
+		b, e := d.rdr.ReadByte()
+		if e != nil {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		if i == 3 {
+			res = (res << 8) | int(b)
+			break
+		}
+		res = (res << 7) | int(b&0x7f)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return
+}
+
+func (d *decoder) double() (res float64, err error) {
+	b, err := d.read(8)
+	if err != nil {
+		return
+	}
+	res = math.Float64frombits(binary.BigEndian.Uint64(b))
+	return
+}
+
+// UTF-8-vr
+func (d *decoder) string() (str string, err error) {
+	u29, err := d.u29()
+	if err != nil {
+		return
+	}
+	if u29&1 == 0 {
+		idx := u29 >> 1
+		if idx >= len(d.strs) {
+			err = fmt.Errorf("amf3: invalid string reference: %d", idx)
+			return
+		}
+		str = d.strs[idx]
+		return
+	}
+	b, err := d.read(u29 >> 1)
+	if err != nil {
+		return
+	}
+	str = string(b)
+	// 空文字列は参照テーブルに入れない
+	if str != "" {
+		d.strs = append(d.strs, str)
+	}
+	return
+}
+
+// 参照ならその値。そうでなければ長さなど
+func (d *decoder) ref() (res interface{}, n int, isRef bool, err error) {
+	u29, err := d.u29()
+	if err != nil {
+		return
+	}
+	n = u29 >> 1
+	if u29&1 == 0 {
+		isRef = true
+		if n >= len(d.objs) {
+			err = fmt.Errorf("amf3: invalid object reference: %d", n)
+			return
+		}
+		res = d.objs[n]
+	}
+	return
+}
+
+// 参照テーブルの場所を確保する
+func (d *decoder) reserve() int {
+	d.objs = append(d.objs, nil)
+	return len(d.objs) - 1
+}
+
+func (d *decoder) object() (res interface{}, err error) {
+	u29, err := d.u29()
+	if err != nil {
+		return
+	}
+	if u29&1 == 0 {
+		idx := u29 >> 1
+		if idx >= len(d.objs) {
+			err = fmt.Errorf("amf3: invalid object reference: %d", idx)
+			return
+		}
+		res = d.objs[idx]
+		return
+	}
+
+	var tr traits
+	if u29&3 == 1 {
+		idx := u29 >> 2
+		if idx >= len(d.traits) {
+			err = fmt.Errorf("amf3: invalid traits reference: %d", idx)
+			return
+		}
+		tr = d.traits[idx]
+	} else {
+		tr.externalizable = u29&4 != 0
+		tr.dynamic = u29&8 != 0
+		count := u29 >> 4
+		if tr.className, err = d.string(); err != nil {
+			return
+		}
+		if count > d.rdr.Len() {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		for i := 0; i < count; i++ {
+			var name string
+			if name, err = d.string(); err != nil {
+				return
+			}
+			tr.members = append(tr.members, name)
+		}
+		d.traits = append(d.traits, tr)
+	}
+
+	idx := d.reserve()
+	if tr.externalizable {
+		// 中身が1つの値であるFlexのクラスのみ
+		switch tr.className {
+		case "flex.messaging.io.ArrayCollection", "flex.messaging.io.ObjectProxy":
+			res, err = d.decode()
+			d.objs[idx] = res
+		default:
+			err = fmt.Errorf("amf3: unsupported externalizable class: %s", tr.className)
+		}
+		return
+	}
+
+	m := make(map[string]interface{})
+	if tr.className == "" {
+		res = m
+	} else {
+		res = amf_t.TypedObject{ClassName: tr.className, Data: m}
+	}
+	d.objs[idx] = res
+
+	for _, name := range tr.members {
+		if m[name], err = d.decode(); err != nil {
+			return
+		}
+	}
+	if tr.dynamic {
+		for {
+			var key string
+			if key, err = d.string(); err != nil {
+				return
+			}
+			if key == "" {
+				break
+			}
+			if m[key], err = d.decode(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (d *decoder) array() (res interface{}, err error) {
+	res, count, isRef, err := d.ref()
+	if err != nil || isRef {
+		return
+	}
+	idx := d.reserve()
+
+	assoc := make(map[string]interface{})
+	for {
+		var key string
+		if key, err = d.string(); err != nil {
+			return
+		}
+		if key == "" {
+			break
+		}
+		if assoc[key], err = d.decode(); err != nil {
+			return
+		}
+	}
+
+	if count > d.rdr.Len() {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	dense := make([]interface{}, count)
+	if len(assoc) == 0 {
+		res = dense
+	} else if count == 0 {
+		res = assoc
+	} else {
+		res = amf_t.MixedArray{Dense: dense, Assoc: assoc}
+	}
+	d.objs[idx] = res
+
+	for i := range dense {
+		if dense[i], err = d.decode(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (d *decoder) vector(marker byte) (res interface{}, err error) {
+	res, count, isRef, err := d.ref()
+	if err != nil || isRef {
+		return
+	}
+	idx := d.reserve()
+
+	var fixed bool
+	if b, e := d.read(1); e != nil {
+		err = e
+		return
+	} else {
+		fixed = b[0] != 0
+	}
+
+	size := 1
+	switch marker {
+	case markerVectorInt, markerVectorUint:
+		size = 4
+	case markerVectorDouble:
+		size = 8
+	}
+	if count > d.rdr.Len()/size {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+
+	switch marker {
+	case markerVectorInt:
+		list := make([]int32, count)
+		for i := range list {
+			b, _ := d.read(4)
+			list[i] = int32(binary.BigEndian.Uint32(b))
+		}
+		res = list
+	case markerVectorUint:
+		list := make([]uint32, count)
+		for i := range list {
+			b, _ := d.read(4)
+			list[i] = binary.BigEndian.Uint32(b)
+		}
+		res = list
+	case markerVectorDouble:
+		list := make([]float64, count)
+		for i := range list {
+			list[i], _ = d.double()
+		}
+		res = list
+	case markerVectorObject:
+		vec := amf_t.VectorObject{Fixed: fixed}
+		if vec.TypeName, err = d.string(); err != nil {
+			return
+		}
+		vec.Data = make([]interface{}, count)
+		d.objs[idx] = vec
+		for i := range vec.Data {
+			if vec.Data[i], err = d.decode(); err != nil {
+				return
+			}
+		}
+		res = vec
+	}
+	d.objs[idx] = res
+	return
+}
+
+func (d *decoder) decode() (res interface{}, err error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxDepth {
+		err = fmt.Errorf("amf3: nested too deeply")
+		return
+	}
+
+	marker, err := d.rdr.ReadByte()
+	if err != nil {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	switch marker {
+	case markerUndefined, markerNull:
+		res = nil
+	case markerFalse:
+		res = false
+	case markerTrue:
+		res = true
+	case markerInteger:
+		var n int
+		if n, err = d.u29(); err != nil {
+			return
+		}
+		if n&0x10000000 != 0 {
+			n -= 0x20000000
+		}
+		res = n
+	case markerDouble:
+		res, err = d.double()
+	case markerString:
+		res, err = d.string()
+	case markerXMLDoc, markerXML:
+		var n int
+		var isRef bool
+		if res, n, isRef, err = d.ref(); err != nil || isRef {
+			return
+		}
+		var b []byte
+		if b, err = d.read(n); err != nil {
+			return
+		}
+		if marker == markerXML {
+			res = amf_t.XML(b)
+		} else {
+			res = amf_t.XMLDocument(b)
+		}
+		d.objs = append(d.objs, res)
+	case markerDate:
+		var isRef bool
+		if res, _, isRef, err = d.ref(); err != nil || isRef {
+			return
+		}
+		var ms float64
+		if ms, err = d.double(); err != nil {
+			return
+		}
+		n := int64(ms)
+		res = time.Unix(n/1000, (n%1000)*1000000).UTC()
+		d.objs = append(d.objs, res)
+	case markerArray:
+		res, err = d.array()
+	case markerObject:
+		res, err = d.object()
+	case markerByteArray:
+		var n int
+		var isRef bool
+		if res, n, isRef, err = d.ref(); err != nil || isRef {
+			return
+		}
+		if res, err = d.read(n); err != nil {
+			return
+		}
+		d.objs = append(d.objs, res)
+	case markerVectorInt, markerVectorUint, markerVectorDouble, markerVectorObject:
+		res, err = d.vector(marker)
+	case markerDictionary:
+		var count int
+		var isRef bool
+		if res, count, isRef, err = d.ref(); err != nil || isRef {
+			return
+		}
+		idx := d.reserve()
+		var b []byte
+		if b, err = d.read(1); err != nil {
+			return
+		}
+		if count > d.rdr.Len()/2 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		dict := amf_t.Dictionary{WeakKeys: b[0] != 0, Entries: make([]amf_t.DictionaryEntry, count)}
+		d.objs[idx] = dict
+		for i := range dict.Entries {
+			if dict.Entries[i].Key, err = d.decode(); err != nil {
+				return
+			}
+			if dict.Entries[i].Value, err = d.decode(); err != nil {
+				return
+			}
+		}
+		res = dict
+	default:
+		err = fmt.Errorf("amf3: unsupported type: %d", marker)
+	}
+	return
+}
+
+// 値を1つ読む。参照テーブルはこの値の中だけで使われる
+func Decode(rdr *bytes.Reader) (res interface{}, err error) {
+	d := &decoder{rdr: rdr}
+	return d.decode()
+}
+
+func DecodeAll(rdr *bytes.Reader) (res []interface{}, err error) {
+	d := &decoder{rdr: rdr}
+	for rdr.Len() > 0 {
+		re, e := d.decode()
+		if e != nil {
+			err = e
+			return
+		}
+		res = append(res, re)
+	}
+	return
+}
+
+type encoder struct {
+	buff    *bytes.Buffer
+	strs    map[string]int
+	traits  map[string]int
+	ntraits int // 匿名のオブジェクトのtraitsも数える
+	objs    map[objKey]int
+	nobjs   int // デコーダの参照テーブルと同じく、参照にしない日付なども数える
+	depth   int
+}
+
+// 参照にするための、スライスやマップの場所
+type objKey struct {
+	kind byte
+	ptr  uintptr
+	len  int
+}
+
+// スライスとマップは中身の場所で同じものか調べる。空のものは区別できないので毎回書く
+func keyOf(kind byte, v interface{}) *objKey {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Len() == 0 {
+			return nil
+		}
+		return &objKey{kind, rv.Pointer(), rv.Len()}
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+		return &objKey{kind, rv.Pointer(), 0}
+	}
+	return nil
+}
+
+// markerと、既に書いたものなら参照を書く
+// そうでなければ参照テーブルに入れ、falseを返すので続けて中身を書くこと
+func (e *encoder) ref(marker byte, key *objKey) (isRef bool, err error) {
+	e.buff.WriteByte(marker)
+	if key != nil {
+		if idx, ok := e.objs[*key]; ok {
+			return true, e.u29(idx << 1)
+		}
+		e.objs[*key] = e.nobjs
+	}
+	e.nobjs++
+	return
+}
+
+func (e *encoder) u29(num int) (err error) {
+	switch {
+	case 0 <= num && num <= 0x7f:
+		e.buff.WriteByte(byte(num))
+	case 0x80 <= num && num <= 0x3fff:
+		e.buff.Write([]byte{
+			byte(0x80 | (num >> 7)),
+			byte(num & 0x7f),
+		})
+	case 0x4000 <= num && num <= 0x1fffff:
+		e.buff.Write([]byte{
+			byte(0x80 | (num >> 14)),
+			byte(0x80 | ((num >> 7) & 0x7f)),
+			byte(num & 0x7f),
+		})
+	case 0x200000 <= num && num <= 0x1fffffff:
+		e.buff.Write([]byte{
+			byte(0x80 | (num >> 22)),
+			byte(0x80 | ((num >> 15) & 0x7f)),
+			byte(0x80 | ((num >> 8) & 0x7f)),
+			byte(num & 0xff),
+		})
+	default:
+		err = fmt.Errorf("amf3: u29 overflow: %d", num)
+	}
+	return
+}
+
+// 値であることを示すフラグを付けたU29
+func (e *encoder) u28Flag(num int) error {
+	return e.u29((num << 1) | 1)
+}
+
+// UTF-8-vr。2回目からは参照にする
+func (e *encoder) string(s string) (err error) {
+	if s == "" {
+		e.buff.WriteByte(1)
+		return
+	}
+	if idx, ok := e.strs[s]; ok {
+		return e.u29(idx << 1)
+	}
+	if err = e.u28Flag(len(s)); err != nil {
+		return
+	}
+	e.strs[s] = len(e.strs)
+	e.buff.WriteString(s)
+	return
+}
+
+func (e *encoder) double(num float64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(num))
+	e.buff.Write(b)
+}
+
+func (e *encoder) integer(num int64) {
+	if num < minInt || maxInt < num {
+		e.buff.WriteByte(markerDouble)
+		e.double(float64(num))
+		return
+	}
+	e.buff.WriteByte(markerInteger)
+	e.u29(int(num) & 0x1fffffff)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 動的なプロパティ(空文字列で終わる)
+func (e *encoder) assoc(m map[string]interface{}) (err error) {
+	for _, k := range sortedKeys(m) {
+		if k == "" {
+			continue
+		}
+		if err = e.string(k); err != nil {
+			return
+		}
+		if err = e.encode(m[k]); err != nil {
+			return
+		}
+	}
+	e.buff.WriteByte(1)
+	return
+}
+
+func (e *encoder) encode(data interface{}) (err error) {
+	e.depth++
+	defer func() { e.depth-- }()
+	if e.depth > maxDepth {
+		return fmt.Errorf("amf3: nested too deeply")
+	}
+
+	switch d := data.(type) {
+	case nil:
+		e.buff.WriteByte(markerNull)
+	case bool:
+		if d {
+			e.buff.WriteByte(markerTrue)
+		} else {
+			e.buff.WriteByte(markerFalse)
+		}
+	case int:
+		e.integer(int64(d))
+	case int8:
+		e.integer(int64(d))
+	case int16:
+		e.integer(int64(d))
+	case int32:
+		e.integer(int64(d))
+	case int64:
+		e.integer(d)
+	case uint8:
+		e.integer(int64(d))
+	case uint16:
+		e.integer(int64(d))
+	case uint32:
+		e.integer(int64(d))
+	case uint:
+		e.buff.WriteByte(markerDouble)
+		e.double(float64(d))
+	case uint64:
+		e.buff.WriteByte(markerDouble)
+		e.double(float64(d))
+	case float32:
+		e.buff.WriteByte(markerDouble)
+		e.double(float64(d))
+	case float64:
+		e.buff.WriteByte(markerDouble)
+		e.double(d)
+	case string:
+		e.buff.WriteByte(markerString)
+		err = e.string(d)
+	case amf_t.XMLDocument:
+		e.ref(markerXMLDoc, nil)
+		if err = e.u28Flag(len(d)); err == nil {
+			e.buff.WriteString(string(d))
+		}
+	case amf_t.XML:
+		e.ref(markerXML, nil)
+		if err = e.u28Flag(len(d)); err == nil {
+			e.buff.WriteString(string(d))
+		}
+	case time.Time:
+		e.ref(markerDate, nil)
+		e.u28Flag(0)
+		e.double(float64(d.Unix()*1000 + int64(d.Nanosecond()/1000000)))
+	case []interface{}:
+		err = e.array(keyOf('a', d), d, nil)
+	case []string:
+		list := make([]interface{}, len(d))
+		for i, s := range d {
+			list[i] = s
+		}
+		err = e.array(keyOf('s', d), list, nil)
+	case amf_t.MixedArray:
+		err = e.array(keyOf('m', d.Assoc), d.Dense, d.Assoc)
+	case map[string]interface{}:
+		// 匿名の動的なオブジェクト
+		var isRef bool
+		if isRef, err = e.ref(markerObject, keyOf('o', d)); err != nil || isRef {
+			return
+		}
+		e.u29(0x0b)
+		e.ntraits++
+		e.string("")
+		err = e.assoc(d)
+	case amf_t.TypedObject:
+		err = e.typedObject(d)
+	case []byte:
+		var isRef bool
+		if isRef, err = e.ref(markerByteArray, keyOf('b', d)); err != nil || isRef {
+			return
+		}
+		if err = e.u28Flag(len(d)); err == nil {
+			e.buff.Write(d)
+		}
+	case []int32:
+		var isRef bool
+		if isRef, err = e.ref(markerVectorInt, keyOf('i', d)); err != nil || isRef {
+			return
+		}
+		if err = e.u28Flag(len(d)); err != nil {
+			return
+		}
+		e.buff.WriteByte(0)
+		b := make([]byte, 4)
+		for _, n := range d {
+			binary.BigEndian.PutUint32(b, uint32(n))
+			e.buff.Write(b)
+		}
+	case []uint32:
+		var isRef bool
+		if isRef, err = e.ref(markerVectorUint, keyOf('u', d)); err != nil || isRef {
+			return
+		}
+		if err = e.u28Flag(len(d)); err != nil {
+			return
+		}
+		e.buff.WriteByte(0)
+		b := make([]byte, 4)
+		for _, n := range d {
+			binary.BigEndian.PutUint32(b, n)
+			e.buff.Write(b)
+		}
+	case []float64:
+		var isRef bool
+		if isRef, err = e.ref(markerVectorDouble, keyOf('d', d)); err != nil || isRef {
+			return
+		}
+		if err = e.u28Flag(len(d)); err != nil {
+			return
+		}
+		e.buff.WriteByte(0)
+		for _, n := range d {
+			e.double(n)
+		}
+	case amf_t.VectorObject:
+		var isRef bool
+		if isRef, err = e.ref(markerVectorObject, keyOf('v', d.Data)); err != nil || isRef {
+			return
+		}
+		if err = e.u28Flag(len(d.Data)); err != nil {
+			return
+		}
+		if d.Fixed {
+			e.buff.WriteByte(1)
+		} else {
+			e.buff.WriteByte(0)
+		}
+		if err = e.string(d.TypeName); err != nil {
+			return
+		}
+		for _, v := range d.Data {
+			if err = e.encode(v); err != nil {
+				return
+			}
+		}
+	case amf_t.Dictionary:
+		var isRef bool
+		if isRef, err = e.ref(markerDictionary, keyOf('t', d.Entries)); err != nil || isRef {
+			return
+		}
+		if err = e.u28Flag(len(d.Entries)); err != nil {
+			return
+		}
+		if d.WeakKeys {
+			e.buff.WriteByte(1)
+		} else {
+			e.buff.WriteByte(0)
+		}
+		for _, entry := range d.Entries {
+			if err = e.encode(entry.Key); err != nil {
+				return
+			}
+			if err = e.encode(entry.Value); err != nil {
+				return
+			}
+		}
+	case amf_t.AMF0EcmaArray:
+		err = e.encode(d.Data)
+	case amf_t.SwitchToAmf3:
+		err = fmt.Errorf("amf3: unexpected SwitchToAmf3")
+	default:
+		g, e2 := amf_t.Generic(data)
+		if e2 != nil {
+			return e2
+		}
+		err = e.encode(g)
+	}
+	return
+}
+
+func (e *encoder) array(key *objKey, dense []interface{}, assoc map[string]interface{}) (err error) {
+	var isRef bool
+	if isRef, err = e.ref(markerArray, key); err != nil || isRef {
+		return
+	}
+	if err = e.u28Flag(len(dense)); err != nil {
+		return
+	}
+	if err = e.assoc(assoc); err != nil {
+		return
+	}
+	for _, v := range dense {
+		if err = e.encode(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 封印されたメンバーだけのクラス。同じクラスは2回目からtraitsを参照にする
+func (e *encoder) typedObject(obj amf_t.TypedObject) (err error) {
+	keys := sortedKeys(obj.Data)
+	if len(keys) > 0 && keys[0] == "" {
+		keys = keys[1:]
+	}
+	var isRef bool
+	if isRef, err = e.ref(markerObject, keyOf('c', obj.Data)); err != nil || isRef {
+		return
+	}
+
+	id := obj.ClassName + "\x00" + strings.Join(keys, "\x00")
+	if idx, ok := e.traits[id]; ok {
+		if err = e.u29(idx<<2 | 1); err != nil {
+			return
+		}
+	} else {
+		if err = e.u29(len(keys)<<4 | 3); err != nil {
+			return
+		}
+		e.traits[id] = e.ntraits
+		e.ntraits++
+		if err = e.string(obj.ClassName); err != nil {
+			return
+		}
+		for _, k := range keys {
+			if err = e.string(k); err != nil {
+				return
+			}
+		}
+	}
+	for _, k := range keys {
+		if err = e.encode(obj.Data[k]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func newEncoder() *encoder {
+	return &encoder{
+		buff:   bytes.NewBuffer(nil),
+		strs:   make(map[string]int),
+		traits: make(map[string]int),
+		objs:   make(map[objKey]int),
+	}
+}
+
+// 値を1つ書く
+func EncodeValue(data interface{}) (b []byte, err error) {
+	e := newEncoder()
+	if err = e.encode(data); err != nil {
+		return
+	}
+	b = e.buff.Bytes()
+	return
+}
+
+func Encode(data []interface{}) (b []byte, err error) {
+	e := newEncoder()
+	for _, d := range data {
+		if err = e.encode(d); err != nil {
+			return
+		}
+	}
+	b = e.buff.Bytes()
+	return
 }
\ No newline at end of file
@@ -1,13 +1,47 @@
-package amf_t
-
-type AMF3 struct {
-	Data []interface{}
-}
-
-type SwitchToAmf3 struct {
-
-}
-
-type AMF0EcmaArray struct {
-	Data map[string]interface {}
-}
+package amf_t
+
+type AMF3 struct {
+	Data []interface{}
+}
+
+type SwitchToAmf3 struct {
+}
+
+type AMF0EcmaArray struct {
+	Data map[string]interface{}
+}
+
+// クラス名のあるオブジェクト(AMF0のtyped object、AMF3のtraitsにクラス名があるもの)
+type TypedObject struct {
+	ClassName string
+	Data      map[string]interface{}
+}
+
+// AMF0のXML document、AMF3のXMLDocument(flash.xml.XMLDocument)
+type XMLDocument string
+
+// AMF3のXML(E4X)
+type XML string
+
+// AMF3の密な部分と連想配列の部分が両方あるArray
+type MixedArray struct {
+	Dense []interface{}
+	Assoc map[string]interface{}
+}
+
+// AMF3のVector.<Object>
+type VectorObject struct {
+	TypeName string
+	Fixed    bool
+	Data     []interface{}
+}
+
+// AMF3のDictionary。キーは文字列とは限らない
+type Dictionary struct {
+	WeakKeys bool
+	Entries  []DictionaryEntry
+}
+type DictionaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
@@ -0,0 +1,319 @@
+package amf_t
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// 構造体のフィールド。タグは`amf:"name,omitempty"`、`amf:"-"`で無視
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+func fields(t reflect.Type) (list []field) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("amf")
+		if tag == "-" {
+			continue
+		}
+		name := f.Name
+		var omitEmpty bool
+		if tag != "" {
+			opts := strings.Split(tag, ",")
+			if opts[0] != "" {
+				name = opts[0]
+			}
+			for _, o := range opts[1:] {
+				if o == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+		// 埋め込みの構造体は展開する
+		if f.Anonymous && tag == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for _, sub := range fields(ft) {
+					sub.index = append([]int{i}, sub.index...)
+					list = append(list, sub)
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		list = append(list, field{name: name, index: []int{i}, omitEmpty: omitEmpty})
+	}
+	return
+}
+
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (res reflect.Value, ok bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// エンコーダがそのまま扱えない値(構造体、ポインタ、型付きのmapやスライスなど)を
+// map[string]interface{}、[]interface{}、基本の型にする。中の値はそのまま
+func Generic(data interface{}) (res interface{}, err error) {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		res = v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		res = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		res = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		res = v.Float()
+	case reflect.String:
+		res = v.String()
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			res = t
+			return
+		}
+		m := make(map[string]interface{})
+		for _, f := range fields(v.Type()) {
+			fv, ok := fieldByIndex(v, f.index, false)
+			if !ok || (f.omitEmpty && isEmpty(fv)) {
+				continue
+			}
+			m[f.name] = fv.Interface()
+		}
+		res = m
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			err = fmt.Errorf("amf: unsupported map key: %s", v.Type())
+			return
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = iter.Value().Interface()
+		}
+		res = m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			res = v.Bytes()
+			return
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = v.Index(i).Interface()
+		}
+		res = list
+	default:
+		err = fmt.Errorf("amf: unsupported type: %s", v.Type())
+	}
+	return
+}
+
+// デコードした値をdstに入れる(Unmarshal)
+func Assign(dst reflect.Value, src interface{}) (err error) {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return
+	}
+	sv := reflect.ValueOf(src)
+	if dst.Kind() == reflect.Interface && dst.NumMethod() == 0 {
+		dst.Set(sv)
+		return
+	}
+	if sv.Type().AssignableTo(dst.Type()) {
+		dst.Set(sv)
+		return
+	}
+	mismatch := func() error {
+		return fmt.Errorf("amf: cannot unmarshal %T into %s", src, dst.Type())
+	}
+
+	switch dst.Kind() {
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return Assign(dst.Elem(), src)
+
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetBool(b)
+
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case XML:
+			dst.SetString(string(s))
+		case XMLDocument:
+			dst.SetString(string(s))
+		default:
+			return mismatch()
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		var f float64
+		switch n := src.(type) {
+		case float64:
+			f = n
+		case int:
+			f = float64(n)
+		case int32:
+			f = float64(n)
+		case uint32:
+			f = float64(n)
+		default:
+			return mismatch()
+		}
+		switch dst.Kind() {
+		case reflect.Float32, reflect.Float64:
+			dst.SetFloat(f)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if dst.OverflowInt(int64(f)) {
+				return fmt.Errorf("amf: %v overflows %s", f, dst.Type())
+			}
+			dst.SetInt(int64(f))
+		default:
+			if f < 0 || dst.OverflowUint(uint64(f)) {
+				return fmt.Errorf("amf: %v overflows %s", f, dst.Type())
+			}
+			dst.SetUint(uint64(f))
+		}
+
+	case reflect.Struct:
+		var m map[string]interface{}
+		switch o := src.(type) {
+		case map[string]interface{}:
+			m = o
+		case TypedObject:
+			m = o.Data
+		case MixedArray:
+			m = o.Assoc
+		default:
+			return mismatch()
+		}
+		for _, f := range fields(dst.Type()) {
+			val, ok := m[f.name]
+			if !ok {
+				for k, v := range m {
+					if strings.EqualFold(k, f.name) {
+						val, ok = v, true
+						break
+					}
+				}
+			}
+			if !ok {
+				continue
+			}
+			fv, _ := fieldByIndex(dst, f.index, true)
+			if err = Assign(fv, val); err != nil {
+				return
+			}
+		}
+
+	case reflect.Map:
+		if dst.Type().Key().Kind() != reflect.String {
+			return mismatch()
+		}
+		var m map[string]interface{}
+		switch o := src.(type) {
+		case map[string]interface{}:
+			m = o
+		case TypedObject:
+			m = o.Data
+		case MixedArray:
+			m = o.Assoc
+		default:
+			return mismatch()
+		}
+		res := reflect.MakeMapWithSize(dst.Type(), len(m))
+		for k, v := range m {
+			ev := reflect.New(dst.Type().Elem()).Elem()
+			if err = Assign(ev, v); err != nil {
+				return
+			}
+			res.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), ev)
+		}
+		dst.Set(res)
+
+	case reflect.Slice, reflect.Array:
+		var list reflect.Value
+		switch o := src.(type) {
+		case VectorObject:
+			list = reflect.ValueOf(o.Data)
+		case MixedArray:
+			list = reflect.ValueOf(o.Dense)
+		default:
+			switch sv.Kind() {
+			case reflect.Slice, reflect.Array:
+				list = sv
+			default:
+				return mismatch()
+			}
+		}
+		n := list.Len()
+		if dst.Kind() == reflect.Slice {
+			dst.Set(reflect.MakeSlice(dst.Type(), n, n))
+		} else if n > dst.Len() {
+			n = dst.Len()
+		}
+		for i := 0; i < n; i++ {
+			if err = Assign(dst.Index(i), list.Index(i).Interface()); err != nil {
+				return
+			}
+		}
+
+	default:
+		return mismatch()
+	}
+	return
+}
@@ -0,0 +1,270 @@
+package amf
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/himananiito/livedl/amf/amf_t"
+)
+
+func encodeAmf0(v []interface{}) ([]byte, error) { return EncodeAmf0(v, false) }
+func decodeAmf0(b []byte) ([]interface{}, error) { return DecodeAmf0(b) }
+
+// デコードできたものは、エンコードしてデコードしてエンコードすると同じになること
+// go test -fuzz=FuzzDecode ./amf
+func FuzzDecode(f *testing.F) {
+	for _, v := range [][]interface{}{
+		{"connect", 1.0, map[string]interface{}{"app": "live", "tcUrl": "rtmp://localhost/live"}},
+		{nil, true, "str", []interface{}{1.0, "two"}, amf_t.AMF0EcmaArray{Data: map[string]interface{}{"k": "v"}}},
+	} {
+		if b, err := encodeAmf0(v); err == nil {
+			f.Add(b)
+		}
+	}
+	for _, v := range [][]interface{}{
+		{1, "a", "a", []byte{1, 2}, []interface{}{"a", map[string]interface{}{"a": 1}}},
+		{amf_t.TypedObject{ClassName: "A", Data: map[string]interface{}{"x": 1}}, amf_t.Dictionary{Entries: []amf_t.DictionaryEntry{{Key: 1, Value: "one"}}}},
+	} {
+		if b, err := EncodeAmf3(v); err == nil {
+			f.Add(b)
+		}
+	}
+	f.Add(sharedArrays(40))
+	f.Add(sharedArrays0(40))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if res, err := DecodeAmf0(data); err == nil {
+			roundTrip(t, "amf0", res, encodeAmf0, decodeAmf0)
+		}
+		if res, err := DecodeAmf3(data); err == nil {
+			roundTrip(t, "amf3", res, EncodeAmf3, DecodeAmf3)
+		}
+	})
+}
+
+// 前の配列を2回参照する配列をn個並べたAMF3。参照を展開すると2^n個になる
+func sharedArrays(n int) []byte {
+	b := []byte{0x09, 0x03, 0x01, 0x04, 0x01}
+	for i := 1; i < n; i++ {
+		ref := byte((i - 1) << 1)
+		b = append(b, 0x09, 0x05, 0x01, 0x09, ref, 0x09, ref)
+	}
+	return b
+}
+
+// sharedArraysのAMF0版。strict-arrayをreference-typeで参照する
+func sharedArrays0(n int) []byte {
+	b := []byte{0x0a, 0, 0, 0, 1, 0x00, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}
+	for i := 1; i < n; i++ {
+		ref := byte(i - 1)
+		b = append(b, 0x0a, 0, 0, 0, 2, 0x07, 0, ref, 0x07, 0, ref)
+	}
+	return b
+}
+
+// 共有されたものは参照としてエンコードする
+func TestSharedReference(t *testing.T) {
+	// 循環参照も参照になる
+	list := []interface{}{1, nil}
+	list[1] = list
+
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		cycle []byte
+		enc   func([]interface{}) ([]byte, error)
+		dec   func([]byte) ([]interface{}, error)
+	}{
+		{"amf0", sharedArrays0(40), []byte{0x0a, 0, 0, 0, 2, 0x00, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, 0x07, 0, 0}, encodeAmf0, decodeAmf0},
+		{"amf3", sharedArrays(40), []byte{0x09, 0x05, 0x01, 0x04, 0x01, 0x09, 0x00}, EncodeAmf3, DecodeAmf3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.dec(tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				b, err := tc.enc(res)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(b, tc.data) {
+					t.Errorf("encode mismatch\n%x\n%x", b, tc.data)
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("encode did not finish")
+			}
+
+			b, err := tc.enc([]interface{}{list})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tc.cycle) {
+				t.Errorf("cycle: %x, want %x", b, tc.cycle)
+			}
+		})
+	}
+}
+
+func roundTrip(t *testing.T, name string, res []interface{}, enc func([]interface{}) ([]byte, error), dec func([]byte) ([]interface{}, error)) {
+	b1, err := enc(res)
+	if err != nil {
+		// 循環参照など
+		return
+	}
+	res2, err := dec(b1)
+	if err != nil {
+		t.Fatalf("%s: decode of encoded data failed: %v", name, err)
+	}
+	b2, err := enc(res2)
+	if err != nil {
+		t.Fatalf("%s: encode failed: %v", name, err)
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Fatalf("%s: round trip mismatch\n%x\n%x", name, b1, b2)
+	}
+}
+
+// 型ごとの往復
+func TestRoundTrip(t *testing.T) {
+	type inner struct {
+		N float64 `amf:"n"`
+	}
+	type sample struct {
+		Name    string            `amf:"name"`
+		Count   int               `amf:"count"`
+		Flag    bool              `amf:"flag"`
+		When    time.Time         `amf:"when"`
+		List    []string          `amf:"list"`
+		Map     map[string]int    `amf:"map"`
+		Inner   *inner            `amf:"inner"`
+		Skip    string            `amf:"-"`
+		Empty   string            `amf:"empty,omitempty"`
+		Any     interface{}       `amf:"any"`
+		Nested  []inner           `amf:"nested"`
+		Strings map[string]string `amf:"strings,omitempty"`
+	}
+	in := sample{
+		Name:   "livedl",
+		Count:  -123,
+		Flag:   true,
+		When:   time.Unix(1500000000, 123000000).UTC(),
+		List:   []string{"a", "b", "a"},
+		Map:    map[string]int{"x": 1, "y": 2},
+		Inner:  &inner{N: 1.5},
+		Skip:   "skip",
+		Any:    "any",
+		Nested: []inner{{1}, {2}},
+	}
+
+	values := []interface{}{
+		nil, true, false, 0.5, math.Inf(-1), "", "str",
+		string(make([]byte, 70000)),
+		time.Unix(-1, 0).UTC(),
+		map[string]interface{}{"a": 1.0, "b": []interface{}{"c", nil}},
+		amf_t.AMF0EcmaArray{Data: map[string]interface{}{"0": "x"}},
+		amf_t.TypedObject{ClassName: "com.example.Obj", Data: map[string]interface{}{"k": "v"}},
+		amf_t.XMLDocument("<a/>"),
+		[]interface{}{1.0, "two", []interface{}{}},
+	}
+	values3 := append(values,
+		1, -1, 1<<28-1, -1<<28, 1<<28,
+		amf_t.XML("<b/>"),
+		[]byte{1, 2, 3},
+		[]int32{-1, 2}, []uint32{3, 4}, []float64{0.5, 1.5},
+		amf_t.VectorObject{TypeName: "String", Data: []interface{}{"a", "b"}},
+		amf_t.Dictionary{Entries: []amf_t.DictionaryEntry{{Key: 1, Value: "one"}, {Key: "k", Value: nil}}},
+		amf_t.MixedArray{Dense: []interface{}{"a"}, Assoc: map[string]interface{}{"k": "v"}},
+		[]interface{}{
+			amf_t.TypedObject{ClassName: "A", Data: map[string]interface{}{"x": 1}},
+			map[string]interface{}{},
+			amf_t.TypedObject{ClassName: "A", Data: map[string]interface{}{"x": 2}},
+		},
+	)
+
+	check := func(name string, vals []interface{}, enc func([]interface{}) ([]byte, error), dec func([]byte) ([]interface{}, error)) {
+		for _, v := range vals {
+			b, err := enc([]interface{}{v})
+			if err != nil {
+				t.Errorf("%s: encode %#v: %v", name, v, err)
+				continue
+			}
+			res, err := dec(b)
+			if err != nil {
+				t.Errorf("%s: decode %#v: %v", name, v, err)
+				continue
+			}
+			if len(res) != 1 || !reflect.DeepEqual(normalize(res[0]), normalize(v)) {
+				t.Errorf("%s: mismatch %#v != %#v", name, res, v)
+			}
+		}
+	}
+	check("amf0", values, encodeAmf0, decodeAmf0)
+	check("amf3", values3, EncodeAmf3, DecodeAmf3)
+
+	for _, m := range []struct {
+		name      string
+		marshal   func(interface{}) ([]byte, error)
+		unmarshal func([]byte, interface{}) error
+	}{
+		{"amf0", Marshal, Unmarshal},
+		{"amf3", MarshalAmf3, UnmarshalAmf3},
+	} {
+		b, err := m.marshal(in)
+		if err != nil {
+			t.Errorf("%s: marshal: %v", m.name, err)
+			continue
+		}
+		var out sample
+		if err := m.unmarshal(b, &out); err != nil {
+			t.Errorf("%s: unmarshal: %v", m.name, err)
+			continue
+		}
+		want := in
+		want.Skip = ""
+		if !reflect.DeepEqual(out, want) {
+			t.Errorf("%s: struct mismatch\n%#v\n%#v", m.name, out, want)
+		}
+	}
+}
+
+// 数値の型の違いを無視する
+func normalize(v interface{}) interface{} {
+	switch d := v.(type) {
+	case int:
+		return float64(d)
+	case []interface{}:
+		res := make([]interface{}, len(d))
+		for i, x := range d {
+			res[i] = normalize(x)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(d))
+		for k, x := range d {
+			res[k] = normalize(x)
+		}
+		return res
+	case amf_t.AMF0EcmaArray:
+		return normalize(d.Data)
+	case amf_t.TypedObject:
+		d.Data = normalize(d.Data).(map[string]interface{})
+		return d
+	case amf_t.Dictionary:
+		entries := make([]amf_t.DictionaryEntry, len(d.Entries))
+		for i, e := range d.Entries {
+			entries[i] = amf_t.DictionaryEntry{Key: normalize(e.Key), Value: normalize(e.Value)}
+		}
+		d.Entries = entries
+		return d
+	}
+	return v
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/himananiito/livedl/options"
+)
+
+type batchJob struct {
+	lineNo int
+	line   string
+	opt    options.Option
+}
+
+type batchResult struct {
+	job      batchJob
+	outFiles []string
+	err      error
+	elapsed  time.Duration
+}
+
+// -batch: リストに書かれたものを-jobsの数ずつ処理して、最後に結果をまとめる
+func runBatch(opt options.Option) (err error) {
+	f, err := os.Open(opt.BatchFile)
+	if err != nil {
+		return
+	}
+	var jobs []batchJob
+	var results []batchResult
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		jobOpt, ok, e := options.ParseBatchLine(opt, line)
+		if e != nil {
+			// 解析できない行は失敗として記録して続ける
+			results = append(results, batchResult{job: batchJob{lineNo: lineNo, line: line}, err: e})
+			continue
+		}
+		if ok {
+			jobs = append(jobs, batchJob{lineNo: lineNo, line: line, opt: jobOpt})
+		}
+	}
+	f.Close()
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	fmt.Printf("batch: %d jobs (jobs: %d)\n", len(jobs), opt.BatchJobs)
+
+	chJob := make(chan batchJob)
+	chResult := make(chan batchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < opt.BatchJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range chJob {
+				fmt.Printf("batch: start(line %d): %s\n", job.lineNo, job.line)
+				start := time.Now()
+				outFiles, e := run(job.opt)
+				chResult <- batchResult{
+					job:      job,
+					outFiles: outFiles,
+					err:      e,
+					elapsed:  time.Since(start),
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, job := range jobs {
+			chJob <- job
+		}
+		close(chJob)
+		wg.Wait()
+		close(chResult)
+	}()
+
+	for res := range chResult {
+		if res.err != nil {
+			fmt.Printf("batch: failed(line %d): %v\n", res.job.lineNo, res.err)
+		} else {
+			fmt.Printf("batch: done(line %d)\n", res.job.lineNo)
+		}
+		results = append(results, res)
+	}
+
+	report := batchReport(results)
+	fmt.Print(report)
+	if opt.BatchReport != "" {
+		if e := ioutil.WriteFile(opt.BatchReport, []byte(report), 0644); e != nil {
+			fmt.Println(e)
+		} else {
+			fmt.Printf("batch report: %s\n", opt.BatchReport)
+		}
+	}
+
+	for _, res := range results {
+		if res.err != nil {
+			err = fmt.Errorf("batch: some jobs failed")
+			break
+		}
+	}
+	return
+}
+
+func batchReport(results []batchResult) string {
+	// 行の順に並べる
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].job.lineNo < results[j].job.lineNo
+	})
+
+	var nOk, nFail int
+	var buf bytes.Buffer
+	for _, res := range results {
+		if res.err != nil {
+			nFail++
+			fmt.Fprintf(&buf, "[FAIL] line %d: %s\n", res.job.lineNo, res.job.line)
+			fmt.Fprintf(&buf, "       error: %v\n", res.err)
+		} else {
+			nOk++
+			fmt.Fprintf(&buf, "[OK]   line %d: %s (%v)\n", res.job.lineNo, res.job.line, res.elapsed.Round(time.Second))
+		}
+		for _, name := range res.outFiles {
+			fmt.Fprintf(&buf, "       -> %s\n", name)
+		}
+	}
+
+	return fmt.Sprintf("\nbatch summary: %d succeeded, %d failed (%s)\n%s",
+		nOk, nFail, time.Now().Format("2006/01/02 15:04:05"), buf.String())
+}
@@ -1,16 +1,16 @@
-package buildno
-
-import (
-	"fmt"
-	"runtime"
-)
-
-func GetBuildNo() string {
-	return fmt.Sprintf(
-		"%v.%v-%s-%s",
-		BuildDate,
-		BuildNo,
-		runtime.GOOS,
-		runtime.GOARCH,
-	)
-}
+package buildno
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func GetBuildNo() string {
+	return fmt.Sprintf(
+		"%v.%v-%s-%s",
+		BuildDate,
+		BuildNo,
+		runtime.GOOS,
+		runtime.GOARCH,
+	)
+}
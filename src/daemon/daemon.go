@@ -0,0 +1,452 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/himananiito/livedl/gorman"
+	"github.com/himananiito/livedl/niconico"
+	"github.com/himananiito/livedl/options"
+)
+
+// 録画や変換を実行する関数。outFilesは書き出したファイル
+type RunFunc func(opt options.Option) (outFiles []string, err error)
+
+const (
+	StatusQueued     = "queued"
+	StatusRunning    = "running"
+	StatusCancelling = "cancelling"
+	StatusDone       = "done"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+)
+
+type Job struct {
+	ID       int               `json:"id"`
+	Service  string            `json:"service"`
+	Target   string            `json:"target"`
+	Options  map[string]string `json:"options,omitempty"`
+	Status   string            `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	OutFiles []string          `json:"outFiles,omitempty"`
+	Created  time.Time         `json:"created"`
+	Started  *time.Time        `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Stats    *niconico.Stats   `json:"stats,omitempty"` // ニコ生の録画中のみ
+
+	opt       options.Option
+	interrupt chan struct{}
+	stdout    *jobWriter
+}
+
+type JobRequest struct {
+	Service string            `json:"service"` // nico, tcas, yt, d2m, z2m
+	Target  string            `json:"target"`  // lvXXX, ユーザ名, 動画ID, ファイル名
+	Options map[string]string `json:"options"` // "nico-format": "?PID?" など
+}
+
+type Daemon struct {
+	base options.Option
+	run  RunFunc
+
+	mtx    sync.Mutex
+	jobs   map[int]*Job
+	nextID int
+	wg     sync.WaitGroup
+	sem    chan struct{}
+
+	logs *logBuffer
+}
+
+func New(base options.Option, run RunFunc) *Daemon {
+	d := &Daemon{
+		base: base,
+		run:  run,
+		jobs: map[int]*Job{},
+		logs: &logBuffer{max: 10000},
+	}
+	if base.BatchJobs > 0 {
+		d.sem = make(chan struct{}, base.BatchJobs)
+	}
+	return d
+}
+
+// ジョブを作成して実行を開始する
+func (d *Daemon) Submit(req JobRequest) (job *Job, err error) {
+	if req.Service == "" || req.Target == "" {
+		err = fmt.Errorf("service and target required")
+		return
+	}
+
+	args := []string{"-" + req.Service, req.Target}
+	var keys []string
+	for k := range req.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, fmt.Sprintf("-%s=%s", k, req.Options[k]))
+	}
+	opt, err := options.ParseJobArgs(d.base, args)
+	if err != nil {
+		return
+	}
+	interrupt := make(chan struct{})
+	opt.Interrupt = interrupt
+
+	d.mtx.Lock()
+	d.nextID++
+	stdout := &jobWriter{b: d.logs, job: d.nextID}
+	opt.Stdout = stdout
+	job = &Job{
+		ID:        d.nextID,
+		Service:   req.Service,
+		Target:    req.Target,
+		Options:   req.Options,
+		Status:    StatusQueued,
+		Created:   time.Now(),
+		opt:       opt,
+		interrupt: interrupt,
+		stdout:    stdout,
+	}
+	d.jobs[job.ID] = job
+	d.mtx.Unlock()
+
+	d.wg.Add(1)
+	go d.start(job)
+	return
+}
+
+func (d *Daemon) start(job *Job) {
+	defer d.wg.Done()
+
+	if d.sem != nil {
+		select {
+		case d.sem <- struct{}{}:
+			defer func() { <-d.sem }()
+		case <-job.interrupt:
+			d.finish(job, nil, nil)
+			return
+		}
+	}
+
+	d.mtx.Lock()
+	if job.Status != StatusQueued {
+		// 開始前に停止された
+		d.mtx.Unlock()
+		d.finish(job, nil, nil)
+		return
+	}
+	now := time.Now()
+	job.Started = &now
+	job.Status = StatusRunning
+	d.mtx.Unlock()
+
+	fmt.Fprintf(job.stdout, "start: %s %s\n", job.Service, job.Target)
+	outFiles, err := d.run(job.opt)
+	d.finish(job, outFiles, err)
+}
+
+func (d *Daemon) finish(job *Job, outFiles []string, err error) {
+	if err != nil {
+		fmt.Fprintf(job.stdout, "failed: %v\n", err)
+	} else {
+		fmt.Fprintf(job.stdout, "finished\n")
+	}
+	job.stdout.Flush()
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := time.Now()
+	job.Finished = &now
+	job.OutFiles = outFiles
+	switch {
+	case job.Status == StatusCancelling || job.Status == StatusQueued:
+		job.Status = StatusCancelled
+	case err != nil:
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	default:
+		job.Status = StatusDone
+	}
+}
+
+// 録画を停止させる。書き込み済みのデータは保存される
+func (d *Daemon) Cancel(id int) (job *Job, err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	job, ok := d.jobs[id]
+	if !ok {
+		err = fmt.Errorf("job not found: %d", id)
+		return
+	}
+	switch job.Status {
+	case StatusQueued, StatusRunning:
+		job.Status = StatusCancelling
+		close(job.interrupt)
+	}
+	return
+}
+
+func (d *Daemon) CancelAll() {
+	d.mtx.Lock()
+	var ids []int
+	for id := range d.jobs {
+		ids = append(ids, id)
+	}
+	d.mtx.Unlock()
+
+	for _, id := range ids {
+		d.Cancel(id)
+	}
+}
+
+// 状態を返す(コピー)
+func (d *Daemon) Job(id int) (job Job, ok bool) {
+	d.mtx.Lock()
+	j, ok := d.jobs[id]
+	if ok {
+		job = *j
+	}
+	d.mtx.Unlock()
+
+	if ok {
+		job.withStats()
+	}
+	return
+}
+
+func (d *Daemon) Jobs() (jobs []Job) {
+	d.mtx.Lock()
+	jobs = []Job{}
+	for _, j := range d.jobs {
+		jobs = append(jobs, *j)
+	}
+	d.mtx.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	for i := range jobs {
+		jobs[i].withStats()
+	}
+	return
+}
+
+func (job *Job) withStats() {
+	if job.opt.Command != "NICOLIVE" || job.Finished != nil {
+		return
+	}
+	if stats, ok := niconico.GetStats(job.opt.NicoLiveId); ok {
+		job.Stats = &stats
+	}
+}
+
+// ジョブが出力したログ
+func (d *Daemon) Logs(id int, since int64) (lines []LogLine, ok bool) {
+	if _, ok = d.Job(id); !ok {
+		return
+	}
+	lines = d.logs.get(since, id)
+	return
+}
+
+// 他のサイトのページから録画の開始や停止をさせない(CSRF)
+// 変更するリクエストは、Originがあれば同じホストであること
+// POSTはapplication/jsonに限る。text/plainなどはブラウザが確認(preflight)なしに送れるため
+func checkOrigin(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	if origin := c.GetHeader("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != c.Request.Host {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "cross-origin request not allowed"})
+			return
+		}
+	}
+	if c.Request.Method == http.MethodPost {
+		if mt, _, err := mime.ParseMediaType(c.GetHeader("Content-Type")); err != nil || mt != "application/json" {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/json"})
+			return
+		}
+	}
+	c.Next()
+}
+
+func (d *Daemon) router() *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultErrorWriter = ioutil.Discard
+	gin.DefaultWriter = ioutil.Discard
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(checkOrigin)
+
+	jobID := func(c *gin.Context) (id int, ok bool) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		ok = true
+		return
+	}
+
+	api := router.Group("/api")
+
+	api.POST("/jobs", func(c *gin.Context) {
+		var req JobRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		job, err := d.Submit(req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		j, _ := d.Job(job.ID)
+		c.JSON(http.StatusCreated, j)
+	})
+
+	api.GET("/jobs", func(c *gin.Context) {
+		c.JSON(http.StatusOK, d.Jobs())
+	})
+
+	api.GET("/jobs/:id", func(c *gin.Context) {
+		id, ok := jobID(c)
+		if !ok {
+			return
+		}
+		job, ok := d.Job(id)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	})
+
+	cancel := func(c *gin.Context) {
+		id, ok := jobID(c)
+		if !ok {
+			return
+		}
+		if _, err := d.Cancel(id); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		job, _ := d.Job(id)
+		c.JSON(http.StatusAccepted, job)
+	}
+	api.DELETE("/jobs/:id", cancel)
+	api.POST("/jobs/:id/cancel", cancel)
+
+	api.GET("/jobs/:id/logs", func(c *gin.Context) {
+		id, ok := jobID(c)
+		if !ok {
+			return
+		}
+		since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+		lines, ok := d.Logs(id, since)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+			return
+		}
+		c.JSON(http.StatusOK, lines)
+	})
+
+	d.dashboard(router)
+
+	api.GET("/logs", func(c *gin.Context) {
+		since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+		c.JSON(http.StatusOK, d.logs.get(since, 0))
+	})
+
+	// 動いているgoroutine。?stack=1でスタックも(SIGQUITと同じ)
+	api.GET("/goroutines", func(c *gin.Context) {
+		if c.Query("stack") != "" {
+			var b bytes.Buffer
+			gorman.Dump(&b)
+			c.Data(http.StatusOK, "text/plain; charset=utf-8", b.Bytes())
+			return
+		}
+		c.JSON(http.StatusOK, gorman.Routines())
+	})
+
+	return router
+}
+
+// APIを開始して、シグナルを受けるまで待つ
+// シグナルを受けたら全てのジョブを停止させ、終了を待ってから戻る
+func (d *Daemon) Serve(addr string) (err error) {
+	if host, _, e := net.SplitHostPort(addr); e == nil {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			fmt.Printf("[警告] API is not bound to loopback address: %s\n", addr)
+		}
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	if err = d.logs.capture(); err != nil {
+		ln.Close()
+		return
+	}
+
+	srv := &http.Server{
+		Handler:        d.router(),
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	chErr := make(chan error, 1)
+	go func() {
+		if e := srv.Serve(ln); e != http.ErrServerClosed {
+			chErr <- e
+		}
+	}()
+	fmt.Printf("daemon: listening on http://%s/\n", ln.Addr())
+
+	chInterrupt := make(chan os.Signal, 10)
+	signal.Notify(chInterrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(chInterrupt)
+
+	select {
+	case err = <-chErr:
+	case <-chInterrupt:
+		fmt.Println("daemon: stopping jobs")
+	}
+
+	d.CancelAll()
+	chWait := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(chWait)
+	}()
+	select {
+	case <-chWait:
+	case <-chInterrupt:
+		fmt.Println("daemon: interrupted twice, exit")
+	}
+
+	srv.Shutdown(context.Background())
+	return
+}
@@ -0,0 +1,204 @@
+package daemon
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/himananiito/livedl/mp42ts"
+	"github.com/himananiito/livedl/niconico"
+	"github.com/himananiito/livedl/outname"
+)
+
+// ダッシュボードの画面。バイナリに埋め込む
+//
+//go:embed static
+var staticFiles embed.FS
+
+type Recording struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// 出力先にある録画済みのdb
+func listRecordings() (list []Recording, err error) {
+	root := outname.GetRootDir()
+	if root == "" {
+		root = "."
+	}
+
+	list = []Recording{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			// 出力先の下の階層は3つまで
+			if rel, e := filepath.Rel(root, path); e == nil && strings.Count(rel, string(filepath.Separator)) >= 3 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(strings.ToLower(info.Name()), ".sqlite3") {
+			list = append(list, Recording{
+				Name:     path,
+				Size:     info.Size(),
+				Modified: info.ModTime(),
+			})
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Modified.After(list[j].Modified) })
+	return
+}
+
+// ニコ生の録画中のジョブの番組ID
+func (d *Daemon) nicoProgramId(id int) (programId string, ok bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	job, ok := d.jobs[id]
+	if !ok || job.opt.Command != "NICOLIVE" {
+		ok = false
+		return
+	}
+	programId = job.opt.NicoLiveId
+	return
+}
+
+func (d *Daemon) dashboard(router *gin.Engine) {
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	router.StaticFS("/static", http.FS(static))
+
+	router.GET("/", func(c *gin.Context) {
+		b, err := fs.ReadFile(static, "index.html")
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", b)
+	})
+
+	api := router.Group("/api")
+
+	api.GET("/recordings", func(c *gin.Context) {
+		list, err := listRecordings()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	api.GET("/jobs/:id/stats", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		programId, ok := d.nicoProgramId(id)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not a niconico job"})
+			return
+		}
+		stats, ok := niconico.GetStats(programId)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not recording"})
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	})
+
+	// 録画中のプレビュー(HLS)
+	api.GET("/jobs/:id/preview/index.m3u8", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		programId, ok := d.nicoProgramId(id)
+		if !ok {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		body, ok := niconico.PreviewPlaylist(programId, "ts/%d.ts")
+		if !ok {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/x-mpegURL", []byte(body))
+	})
+
+	api.GET("/jobs/:id/preview/ts/:name", func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+		programId, ok := d.nicoProgramId(id)
+		if !ok {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		seqno, err := strconv.Atoi(strings.TrimSuffix(c.Param("name"), ".ts"))
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		data, ok := niconico.PreviewMedia(programId, seqno)
+		if !ok || len(data) == 0 {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Data(http.StatusOK, "video/MP2T", data)
+	})
+
+	// HLSを再生できないブラウザ向けに、チャンクをfragmented MP4にしてMediaSourceで再生する
+	api.GET("/jobs/:id/preview/init/:seqno", func(c *gin.Context) {
+		chunk, ok := d.previewChunk(c)
+		if !ok {
+			return
+		}
+		c.Header("X-Preview-Init", chunk.ConfigId())
+		c.Data(http.StatusOK, chunk.Codecs(), chunk.Init())
+	})
+
+	api.GET("/jobs/:id/preview/mp4/:seqno", func(c *gin.Context) {
+		chunk, ok := d.previewChunk(c)
+		if !ok {
+			return
+		}
+		seqno, _ := strconv.Atoi(c.Param("seqno"))
+		c.Header("X-Preview-Init", chunk.ConfigId())
+		c.Data(http.StatusOK, "video/mp4", chunk.Fragment(uint32(seqno)))
+	})
+}
+
+// プレビューのチャンクを読む。無ければ404を返してok = false
+func (d *Daemon) previewChunk(c *gin.Context) (chunk *mp42ts.TsChunk, ok bool) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	programId, ok := d.nicoProgramId(id)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	seqno, err := strconv.Atoi(c.Param("seqno"))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		ok = false
+		return
+	}
+	data, ok := niconico.PreviewMedia(programId, seqno)
+	if !ok || len(data) == 0 {
+		c.Status(http.StatusNotFound)
+		ok = false
+		return
+	}
+	chunk, err = mp42ts.ParseTs(data)
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		ok = false
+		return
+	}
+	return
+}
@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLine struct {
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	Job  int       `json:"job,omitempty"` // 出力したジョブ。ジョブ以外なら0
+	Text string    `json:"text"`
+}
+
+// 標準出力の行を保持する。古いものから捨てる
+type logBuffer struct {
+	mtx   sync.Mutex
+	lines []LogLine
+	next  int64
+	max   int
+	orig  io.Writer // 横取りする前の標準出力
+}
+
+func (b *logBuffer) add(job int, text string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.next++
+	b.lines = append(b.lines, LogLine{Seq: b.next, Time: time.Now(), Job: job, Text: text})
+	if len(b.lines) > b.max {
+		b.lines = b.lines[len(b.lines)-b.max:]
+	}
+}
+
+// from < Seq のもの。jobが0でなければそのジョブの出力だけ
+func (b *logBuffer) get(from int64, job int) (res []LogLine) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	res = []LogLine{}
+	for _, l := range b.lines {
+		if l.Seq <= from {
+			continue
+		}
+		if job != 0 && l.Job != job {
+			continue
+		}
+		res = append(res, l)
+	}
+	return
+}
+
+// ジョブの出力先。行ごとにジョブの番号を付けて保存し、元の標準出力にも流す
+type jobWriter struct {
+	b   *logBuffer
+	job int
+
+	mtx  sync.Mutex
+	rest []byte // 改行がまだ来ていない部分
+}
+
+func (w *jobWriter) Write(p []byte) (n int, err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.rest = append(w.rest, p...)
+	for {
+		i := bytes.IndexByte(w.rest, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.rest[:i]))
+		w.rest = w.rest[i+1:]
+	}
+	return len(p), nil
+}
+
+// 改行で終わっていない残りを書き出す
+func (w *jobWriter) Flush() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if len(w.rest) > 0 {
+		w.line(string(w.rest))
+		w.rest = nil
+	}
+}
+
+func (w *jobWriter) line(text string) {
+	text = strings.TrimRight(text, "\r")
+	w.b.mtx.Lock()
+	orig := w.b.orig
+	w.b.mtx.Unlock()
+	if orig == nil {
+		orig = os.Stdout
+	}
+	fmt.Fprintf(orig, "[job %d] %s\n", w.job, text)
+	w.b.add(w.job, text)
+}
+
+// os.Stdoutとlogの出力を横取りして、元の標準出力に流しつつ保存する
+func (b *logBuffer) capture() (err error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	log.SetOutput(w)
+
+	b.mtx.Lock()
+	b.orig = orig
+	b.mtx.Unlock()
+
+	go func() {
+		rdr := bufio.NewReader(r)
+		for {
+			line, err := rdr.ReadString('\n')
+			if len(line) > 0 {
+				orig.WriteString(line)
+				for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+					line = line[:len(line)-1]
+				}
+				b.add(0, line)
+			}
+			if err != nil {
+				if err != io.EOF {
+					orig.WriteString(err.Error() + "\n")
+				}
+				return
+			}
+		}
+	}()
+	return
+}
@@ -0,0 +1,54 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestJobWriter(t *testing.T) {
+	b := &logBuffer{max: 100, orig: ioutil.Discard}
+	w1 := &jobWriter{b: b, job: 1}
+	w2 := &jobWriter{b: b, job: 2}
+
+	var wg sync.WaitGroup
+	for _, w := range []*jobWriter{w1, w2} {
+		wg.Add(1)
+		go func(w *jobWriter) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				// 行の途中で分かれて書かれても1行にする
+				fmt.Fprintf(w, "job%d ", w.job)
+				fmt.Fprintf(w, "line%d\r\n", i)
+			}
+			fmt.Fprintf(w, "rest%d", w.job)
+			w.Flush()
+		}(w)
+	}
+	wg.Wait()
+	b.add(0, "other")
+
+	for _, job := range []int{1, 2} {
+		lines := b.get(0, job)
+		if len(lines) != 11 {
+			t.Fatalf("job %d: %d lines", job, len(lines))
+		}
+		for i, l := range lines[:10] {
+			if want := fmt.Sprintf("job%d line%d", job, i); l.Job != job || l.Text != want {
+				t.Errorf("job %d: line %d: %#v, want %q", job, i, l, want)
+			}
+		}
+		if want := fmt.Sprintf("rest%d", job); lines[10].Text != want {
+			t.Errorf("job %d: last line: %q, want %q", job, lines[10].Text, want)
+		}
+	}
+
+	all := b.get(0, 0)
+	if len(all) != 23 || all[22].Text != "other" || all[22].Job != 0 {
+		t.Errorf("all: %d lines, last %#v", len(all), all[len(all)-1])
+	}
+	if lines := b.get(all[10].Seq, 0); len(lines) != 12 || lines[0].Seq != all[11].Seq {
+		t.Errorf("since: %d lines", len(lines))
+	}
+}
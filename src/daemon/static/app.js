@@ -0,0 +1,385 @@
+(function () {
+  "use strict";
+
+  var selected = 0;   // ログを表示するジョブ
+  var logSeq = 0;
+
+  function $(sel) {
+    return document.querySelector(sel);
+  }
+
+  function api(method, path, body) {
+    var init = {method: method, headers: {}};
+    if (body !== undefined) {
+      init.headers["Content-Type"] = "application/json";
+      init.body = JSON.stringify(body);
+    }
+    return fetch(path, init).then(function (res) {
+      return res.json().then(function (data) {
+        if (!res.ok) {
+          throw new Error(data.error || res.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  function text(s) {
+    return document.createTextNode(s === undefined || s === null ? "" : String(s));
+  }
+
+  function cell(tr, s) {
+    var td = document.createElement("td");
+    if (s instanceof Node) {
+      td.appendChild(s);
+    } else {
+      td.appendChild(text(s));
+    }
+    tr.appendChild(td);
+    return td;
+  }
+
+  function button(label, onclick) {
+    var b = document.createElement("button");
+    b.textContent = label;
+    b.addEventListener("click", function (ev) {
+      ev.stopPropagation();
+      onclick();
+    });
+    return b;
+  }
+
+  function formatTime(s) {
+    if (!s) {
+      return "";
+    }
+    return new Date(s).toLocaleString();
+  }
+
+  function formatSize(n) {
+    var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+    var i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+      n /= 1024;
+      i++;
+    }
+    return n.toFixed(i ? 1 : 0) + units[i];
+  }
+
+  function showMessage(s) {
+    $("#message").textContent = s || "";
+  }
+
+  // ジョブ一覧
+  function refreshJobs() {
+    return api("GET", "/api/jobs").then(function (jobs) {
+      var tbody = $("#jobs tbody");
+      tbody.innerHTML = "";
+      jobs.slice().reverse().forEach(function (job) {
+        var st = job.stats || {};
+        var tr = document.createElement("tr");
+        if (job.id === selected) {
+          tr.className = "selected";
+        }
+        tr.addEventListener("click", function () {
+          selectJob(job.id);
+        });
+        cell(tr, job.id);
+        cell(tr, job.service + " " + job.target);
+        var status = cell(tr, job.status + (job.error ? ": " + job.error : ""));
+        status.className = "status-" + job.status;
+        cell(tr, job.stats ? st.seqno : "");
+        cell(tr, job.stats ? st.bandwidth : "");
+        cell(tr, job.stats ? st.chunks + " (" + formatSize(st.bytes) + ")" : "");
+        cell(tr, job.stats ? [st.errors403, st.errors404, st.errors500, st.networkErrors].join("/") : "");
+        cell(tr, job.stats ? st.commentRate : "");
+        cell(tr, formatTime(job.started));
+
+        var ops = document.createElement("span");
+        if (job.status === "queued" || job.status === "running") {
+          ops.appendChild(button("停止", function () {
+            api("DELETE", "/api/jobs/" + job.id).then(refreshJobs, function (e) {
+              showMessage(e.message);
+            });
+          }));
+        }
+        if (job.stats) {
+          ops.appendChild(button("プレビュー", function () {
+            startPreview(job);
+          }));
+        }
+        cell(tr, ops);
+        tbody.appendChild(tr);
+      });
+    });
+  }
+
+  // 録画済み
+  function refreshRecordings() {
+    return api("GET", "/api/recordings").then(function (list) {
+      var tbody = $("#recordings tbody");
+      tbody.innerHTML = "";
+      list.forEach(function (rec) {
+        var tr = document.createElement("tr");
+        cell(tr, rec.name);
+        cell(tr, formatSize(rec.size));
+        cell(tr, formatTime(rec.modified));
+        cell(tr, button("変換(-d2m)", function () {
+          api("POST", "/api/jobs", {service: "d2m", target: rec.name}).then(function (job) {
+            selectJob(job.id);
+            refreshJobs();
+          }, function (e) {
+            showMessage(e.message);
+          });
+        }));
+        tbody.appendChild(tr);
+      });
+    });
+  }
+
+  function selectJob(id) {
+    if (selected !== id) {
+      selected = id;
+      logSeq = 0;
+      $("#logs").textContent = "";
+      $("#log-title").textContent = "(job " + id + ")";
+    }
+    refreshLogs();
+    refreshJobs();
+  }
+
+  function refreshLogs() {
+    if (!selected) {
+      return Promise.resolve();
+    }
+    return api("GET", "/api/jobs/" + selected + "/logs?since=" + logSeq).then(function (lines) {
+      var pre = $("#logs");
+      var bottom = pre.scrollTop + pre.clientHeight >= pre.scrollHeight - 4;
+      lines.forEach(function (l) {
+        pre.appendChild(text(l.text + "\n"));
+        logSeq = l.seq;
+      });
+      if (bottom) {
+        pre.scrollTop = pre.scrollHeight;
+      }
+    });
+  }
+
+  // HLSを再生できるブラウザ(Safari, Edgeなど)はそのまま、それ以外はMediaSourceで再生する
+  var previewGen = 0;
+
+  function startPreview(job) {
+    var video = $("#player");
+    var base = "/api/jobs/" + job.id + "/preview/";
+    var gen = ++previewGen;
+    $("#preview").hidden = false;
+    $("#preview-title").textContent = "(job " + job.id + ": " + job.target + ")";
+    $("#preview-note").textContent = "";
+
+    if (video.canPlayType("application/vnd.apple.mpegurl")) {
+      video.src = base + "index.m3u8";
+      video.play();
+    } else if (window.MediaSource) {
+      playMse(video, base, gen);
+    } else {
+      video.removeAttribute("src");
+      var note = $("#preview-note");
+      note.textContent = "このブラウザはHLSを再生できません。VLCなどで次のURLを開いてください: ";
+      var a = document.createElement("a");
+      a.href = base + "index.m3u8";
+      a.textContent = location.origin + base + "index.m3u8";
+      note.appendChild(a);
+    }
+  }
+
+  function sleep(ms) {
+    return new Promise(function (resolve) {
+      setTimeout(resolve, ms);
+    });
+  }
+
+  function fetchPreview(url) {
+    return fetch(url, {credentials: "same-origin", cache: "no-store"}).then(function (res) {
+      if (!res.ok) {
+        var e = new Error(url + ": " + res.status);
+        e.status = res.status;
+        throw e;
+      }
+      return res.arrayBuffer().then(function (buf) {
+        return {
+          data: buf,
+          type: res.headers.get("Content-Type"),
+          init: res.headers.get("X-Preview-Init")
+        };
+      });
+    });
+  }
+
+  // プレイリストの最後のチャンクのseqno
+  function latestSeqno(base) {
+    return fetch(base + "index.m3u8", {credentials: "same-origin", cache: "no-store"}).then(function (res) {
+      if (!res.ok) {
+        throw new Error("index.m3u8: " + res.status);
+      }
+      return res.text();
+    }).then(function (body) {
+      var m = body.match(/#EXT-X-MEDIA-SEQUENCE:(\d+)/);
+      if (!m) {
+        throw new Error("index.m3u8: no media sequence");
+      }
+      return parseInt(m[1], 10) + 2;
+    });
+  }
+
+  function appendBuffer(sb, data) {
+    return new Promise(function (resolve, reject) {
+      function done() {
+        sb.removeEventListener("updateend", done);
+        sb.removeEventListener("error", fail);
+        resolve();
+      }
+      function fail() {
+        sb.removeEventListener("updateend", done);
+        sb.removeEventListener("error", fail);
+        reject(new Error("SourceBuffer error"));
+      }
+      sb.addEventListener("updateend", done);
+      sb.addEventListener("error", fail);
+      if (data) {
+        sb.appendBuffer(data);
+      } else {
+        // 30秒より前は捨てる
+        sb.remove(0, sb.buffered.end(sb.buffered.length - 1) - 30);
+      }
+    });
+  }
+
+  // チャンクをfragmented MP4にしたものを順に追加する。別のプレビューを始めたら止める
+  function playMse(video, base, gen) {
+    var ms = new MediaSource();
+    var sb = null, init = null, seqno = 0, started = false;
+    video.src = URL.createObjectURL(ms);
+
+    function alive() {
+      return gen === previewGen;
+    }
+
+    function loadInit(n) {
+      return fetchPreview(base + "init/" + n).then(function (r) {
+        if (!sb) {
+          if (!MediaSource.isTypeSupported(r.type)) {
+            throw new Error("このブラウザは再生できません: " + r.type);
+          }
+          sb = ms.addSourceBuffer(r.type);
+        } else if (sb.changeType) {
+          sb.changeType(r.type);
+        }
+        init = r.init;
+        return appendBuffer(sb, r.data);
+      });
+    }
+
+    function next() {
+      if (!alive()) {
+        return;
+      }
+      fetchPreview(base + "mp4/" + seqno).then(function (r) {
+        if (!alive()) {
+          return;
+        }
+        var p = Promise.resolve();
+        if (r.init !== init) {
+          p = loadInit(seqno);
+        }
+        return p.then(function () {
+          return appendBuffer(sb, r.data);
+        }).then(function () {
+          var b = sb.buffered;
+          if (b.length === 0) {
+            return;
+          }
+          var end = b.end(b.length - 1);
+          if (!started) {
+            started = true;
+            video.currentTime = b.start(0);
+            video.play();
+          } else if (end - video.currentTime > 10) {
+            // 遅れたらライブに追いつく
+            video.currentTime = end - 3;
+          }
+          if (end - b.start(0) > 60) {
+            return appendBuffer(sb, null);
+          }
+        }).then(function () {
+          seqno++;
+          next();
+        });
+      }, function (e) {
+        if (e.status !== 404) {
+          throw e;
+        }
+        // まだ無いか、飛ばされたチャンク
+        return sleep(1000).then(function () {
+          return latestSeqno(base);
+        }).then(function (last) {
+          if (last > seqno + 3 || last < seqno - 1) {
+            seqno = last;
+          }
+          next();
+        });
+      }).catch(function (e) {
+        if (alive()) {
+          $("#preview-note").textContent = e.message;
+        }
+      });
+    }
+
+    ms.addEventListener("sourceopen", function () {
+      latestSeqno(base).then(function (last) {
+        seqno = last - 1;
+        next();
+      }).catch(function (e) {
+        if (alive()) {
+          $("#preview-note").textContent = e.message;
+        }
+      });
+    });
+  }
+
+  $("#new-job").addEventListener("submit", function (ev) {
+    ev.preventDefault();
+    var form = ev.target;
+    var options = {};
+    form.options.value.split(/\s+/).forEach(function (kv) {
+      if (!kv) {
+        return;
+      }
+      var i = kv.indexOf("=");
+      var k = (i < 0 ? kv : kv.slice(0, i)).replace(/^-+/, "");
+      options[k] = i < 0 ? "on" : kv.slice(i + 1);
+    });
+    api("POST", "/api/jobs", {
+      service: form.service.value,
+      target: form.target.value.trim(),
+      options: options
+    }).then(function (job) {
+      showMessage("");
+      form.target.value = "";
+      selectJob(job.id);
+    }, function (e) {
+      showMessage(e.message);
+    });
+  });
+
+  function tick() {
+    Promise.all([refreshJobs(), refreshLogs()]).catch(function (e) {
+      showMessage(e.message);
+    }).then(function () {
+      setTimeout(tick, 2000);
+    });
+  }
+
+  refreshRecordings();
+  setInterval(refreshRecordings, 30000);
+  tick();
+})();
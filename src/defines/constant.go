@@ -1,5 +1,5 @@
-
-package defines
-
-var Twitter = "@himananiito"
-var Email = "himananiito@yahoo.co.jp"
+
+package defines
+
+var Twitter = "@himananiito"
+var Email = "himananiito@yahoo.co.jp"
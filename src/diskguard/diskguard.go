@@ -0,0 +1,137 @@
+package diskguard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/himananiito/livedl/log4gui"
+)
+
+// 空き容量がminFreeを下回ったときに返す
+var ErrLowSpace = errors.New("free disk space is too low")
+
+var minFree int64
+var altDir string
+
+// 同じディレクトリを頻繁にstatfsしないように、結果をしばらく使い回す
+var checkInterval = 5 * time.Second
+
+type checked struct {
+	time time.Time
+	free int64
+}
+
+var mtx sync.Mutex
+var cache = map[string]checked{}
+
+func SetMinFree(n int64) {
+	minFree = n
+}
+func GetMinFree() int64 {
+	return minFree
+}
+func SetAltDir(dir string) (err error) {
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return
+	}
+	altDir = dir
+	return
+}
+func Enabled() bool {
+	return minFree > 0
+}
+
+func freeOf(fileName string) (free int64, err error) {
+	dir, err := filepath.Abs(filepath.Dir(fileName))
+	if err != nil {
+		return
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if c, ok := cache[dir]; ok && time.Since(c.time) < checkInterval {
+		free = c.free
+		return
+	}
+
+	// まだ作られていないディレクトリなら、存在する親で調べる
+	d := dir
+	for {
+		if _, e := os.Stat(d); e == nil {
+			break
+		}
+		p := filepath.Dir(d)
+		if p == d {
+			break
+		}
+		d = p
+	}
+
+	free, err = diskFree(d)
+	if err != nil {
+		return
+	}
+	cache[dir] = checked{time: time.Now(), free: free}
+	return
+}
+
+// fileNameを書き込むディレクトリに十分な空きがあるかどうか
+// 無効時、または空き容量が取得できない時はokとする
+func Check(fileName string) (ok bool, free int64, err error) {
+	if minFree <= 0 {
+		ok = true
+		return
+	}
+	free, err = freeOf(fileName)
+	if err != nil {
+		ok = true
+		return
+	}
+	ok = free >= minFree
+	return
+}
+
+// 予備の出力先が設定されていて空きがあれば、そちらでのファイル名を返す
+func Alternative(fileName string) (name string, ok bool) {
+	if altDir == "" {
+		return
+	}
+	alt, err := filepath.Abs(altDir)
+	if err != nil {
+		return
+	}
+	if cur, err := filepath.Abs(filepath.Dir(fileName)); err == nil && cur == alt {
+		// 既に切り替え済み
+		return
+	}
+	name = filepath.Join(altDir, filepath.Base(fileName))
+	if ok, _, _ = Check(name); !ok {
+		name = ""
+	}
+	return
+}
+
+func Warn(fileName string, free int64) {
+	msg := fmt.Sprintf("[WARN] free disk space is low: %s (%s < %s)",
+		filepath.Dir(fileName), FormatSize(free), FormatSize(minFree))
+	fmt.Println(msg)
+	log4gui.Warn(msg)
+}
+
+func FormatSize(n int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	f := float64(n)
+	var i int
+	for i = 0; i < len(units)-1 && f >= 1024; i++ {
+		f /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
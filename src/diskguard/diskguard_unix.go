@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package diskguard
+
+import (
+	"syscall"
+)
+
+func diskFree(dir string) (free int64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return
+	}
+	free = int64(st.Bavail) * int64(st.Bsize)
+	return
+}
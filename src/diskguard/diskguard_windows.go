@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package diskguard
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func diskFree(dir string) (free int64, err error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return
+	}
+	var avail, total, totalFree uint64
+	r, _, e := procGetDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&avail)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&totalFree)),
+	)
+	if r == 0 {
+		err = e
+		return
+	}
+	free = int64(avail)
+	return
+}
@@ -0,0 +1,225 @@
+package flvs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/himananiito/livedl/amf"
+)
+
+// onMetaDataにduration, filesize, keyframesを書き込んでシークできるようにする
+// 元のonMetaDataは全て取り除き、最初のものの値を引き継ぐ
+func AddKeyframes(fileName string) (err error) {
+	meta, tags, err := scanTags(fileName)
+	if err != nil {
+		return
+	}
+
+	var times, positions []float64
+	var lastTs, lastKeyTs int
+	var hasAudio, hasVideo bool
+	for _, t := range tags {
+		switch t.typ {
+		case TagAudio:
+			hasAudio = true
+		case TagVideo:
+			hasVideo = true
+			if t.key {
+				times = append(times, float64(t.ts)/1000)
+				positions = append(positions, 0)
+				lastKeyTs = t.ts
+			}
+		}
+		if t.ts > lastTs {
+			lastTs = t.ts
+		}
+	}
+
+	if meta == nil {
+		meta = make(map[string]interface{})
+	}
+	meta["duration"] = float64(lastTs) / 1000
+	meta["lasttimestamp"] = float64(lastTs) / 1000
+	meta["lastkeyframetimestamp"] = float64(lastKeyTs) / 1000
+	meta["hasAudio"] = hasAudio
+	meta["hasVideo"] = hasVideo
+	meta["hasKeyframes"] = len(times) > 0
+	meta["hasMetadata"] = true
+	meta["filesize"] = float64(0)
+	keyframes := map[string]interface{}{
+		"times":         times,
+		"filepositions": positions,
+	}
+	meta["keyframes"] = keyframes
+
+	// 数値の大きさは変わらないので、仮の値で書いてonMetaDataのサイズを決める
+	body, err := amf.EncodeAmf0([]interface{}{"onMetaData", meta}, true)
+	if err != nil {
+		return
+	}
+	offset := int64(9 + 4 + 11 + len(body) + 4)
+	var i int
+	var size int64
+	for _, t := range tags {
+		if t.key {
+			positions[i] = float64(offset + size)
+			i++
+		}
+		size += int64(11 + t.size + 4)
+	}
+	meta["filesize"] = float64(offset + size)
+	if body, err = amf.EncodeAmf0([]interface{}{"onMetaData", meta}, true); err != nil {
+		return
+	}
+
+	// 一時ファイルに書いてから置き換える
+	src, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	tmpName := fileName + ".tmp"
+	dst, err := os.Create(tmpName)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmpName)
+
+	if err = writeWithMeta(dst, src, body, tags); err != nil {
+		dst.Close()
+		return
+	}
+	if err = dst.Close(); err != nil {
+		return
+	}
+	src.Close()
+
+	err = os.Rename(tmpName, fileName)
+	return
+}
+
+type tagInfo struct {
+	typ    byte
+	ts     int
+	offset int64
+	size   int
+	key    bool
+}
+
+// onMetaData以外のタグの位置と、最初のonMetaDataの値
+func scanTags(fileName string) (meta map[string]interface{}, tags []tagInfo, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	rdr, err := NewReader(f)
+	if err != nil {
+		return
+	}
+	for {
+		tag, e := rdr.Next()
+		if e != nil {
+			if e == io.ErrUnexpectedEOF {
+				fmt.Printf("[warn] %s: last tag is truncated\n", fileName)
+			} else if e != io.EOF {
+				err = e
+			}
+			break
+		}
+		if tag.Type == TagScript {
+			data, _ := amf.DecodeAmf0(tag.Data)
+			if len(data) > 1 {
+				if name, _ := data[0].(string); name == "onMetaData" {
+					if meta == nil {
+						meta = copyMeta(data[1])
+					}
+					continue
+				}
+			}
+		}
+		tags = append(tags, tagInfo{
+			typ:    tag.Type,
+			ts:     tag.Timestamp,
+			offset: tag.Offset,
+			size:   len(tag.Data),
+			key:    tag.IsKeyFrame(),
+		})
+	}
+	return
+}
+
+// 書き戻せる値のみ残す
+func copyMeta(data interface{}) (meta map[string]interface{}) {
+	meta = make(map[string]interface{})
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for k, v := range m {
+		switch v.(type) {
+		case string, float64, bool:
+			meta[k] = v
+		}
+	}
+	return
+}
+
+func writeWithMeta(w io.Writer, src *os.File, body []byte, tags []tagInfo) (err error) {
+	wr := bufio.NewWriterSize(w, 256*1024)
+
+	// 音声、映像の有無
+	var flags byte
+	for _, t := range tags {
+		switch t.typ {
+		case TagAudio:
+			flags |= 4
+		case TagVideo:
+			flags |= 1
+		}
+	}
+	if _, err = wr.Write([]byte{
+		'F', 'L', 'V',
+		1,
+		flags,
+		0, 0, 0, 9,
+		0, 0, 0, 0,
+	}); err != nil {
+		return
+	}
+
+	if _, err = wr.Write(tagHeader(TagScript, len(body), 0)); err != nil {
+		return
+	}
+	if _, err = wr.Write(body); err != nil {
+		return
+	}
+	if _, err = wr.Write(intToBE32(11 + len(body))); err != nil {
+		return
+	}
+
+	for _, t := range tags {
+		if _, err = io.Copy(wr, io.NewSectionReader(src, t.offset, int64(11+t.size))); err != nil {
+			return
+		}
+		if _, err = wr.Write(intToBE32(11 + t.size)); err != nil {
+			return
+		}
+	}
+	err = wr.Flush()
+	return
+}
+
+func tagHeader(tag byte, size, ts int) (b []byte) {
+	tsBytes := intToBE32(ts)
+	b = append(b, tag)
+	b = append(b, intToBE24(size)...)
+	b = append(b, tsBytes[1:4]...)
+	b = append(b, tsBytes[0])
+	b = append(b, 0, 0, 0)
+	return
+}
@@ -0,0 +1,449 @@
+package flvs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/himananiito/livedl/mp42ts"
+)
+
+// H.264/AACのFLVをffmpegを使わずにMP4にする
+
+var ErrUnsupportedCodec = errors.New("flv: unsupported codec (H.264/AAC only)")
+
+type mp4Sample struct {
+	offset int64 // 元のFLVでのデータの位置
+	size   int
+	dts    int
+	cto    int
+	key    bool
+}
+
+type mp4Track struct {
+	id      int
+	video   bool
+	config  []byte // avcC or AudioSpecificConfig
+	samples []mp4Sample
+	width   int
+	height  int
+	rate    int
+	chans   int
+	mdatPos []int64
+}
+
+func ConvertMp4(src, dst string) (err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	video, audio, err := scanSamples(f)
+	if err != nil {
+		return
+	}
+	var tracks []*mp4Track
+	for _, t := range []*mp4Track{video, audio} {
+		if t.config != nil && len(t.samples) > 0 {
+			t.id = len(tracks) + 1
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		err = fmt.Errorf("%s: no samples", src)
+		return
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+	w := bufio.NewWriterSize(out, 256*1024)
+
+	ftyp := box("ftyp", []byte("isom"), u32(512), []byte("isomiso2avc1mp41"))
+	if _, err = w.Write(ftyp); err != nil {
+		return
+	}
+
+	// サンプルはFLVの順番のまま書く
+	type ref struct {
+		track *mp4Track
+		index int
+	}
+	var order []ref
+	var mdatSize int64
+	for _, t := range tracks {
+		for i, s := range t.samples {
+			order = append(order, ref{t, i})
+			mdatSize += int64(s.size)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return order[i].track.samples[order[i].index].offset < order[j].track.samples[order[j].index].offset
+	})
+
+	// mdat(largesize)
+	pos := int64(len(ftyp)) + 16
+	if _, err = w.Write(append(append(u32(1), "mdat"...), u64(uint64(16+mdatSize))...)); err != nil {
+		return
+	}
+	for _, r := range order {
+		s := r.track.samples[r.index]
+		r.track.mdatPos = append(r.track.mdatPos, pos)
+		if _, err = io.Copy(w, io.NewSectionReader(f, s.offset, int64(s.size))); err != nil {
+			return
+		}
+		pos += int64(s.size)
+	}
+
+	if _, err = w.Write(moov(tracks)); err != nil {
+		return
+	}
+	err = w.Flush()
+	return
+}
+
+func scanSamples(f *os.File) (video, audio *mp4Track, err error) {
+	video = &mp4Track{video: true}
+	audio = &mp4Track{}
+
+	rdr, err := NewReader(f)
+	if err != nil {
+		return
+	}
+	for {
+		tag, e := rdr.Next()
+		if e != nil {
+			if e != io.EOF && e != io.ErrUnexpectedEOF {
+				err = e
+			}
+			break
+		}
+		if len(tag.Data) < 2 {
+			continue
+		}
+		// タグのヘッダを除いたデータの位置
+		offset := tag.Offset + 11
+
+		switch tag.Type {
+		case TagVideo:
+			if tag.Data[0]&0x0f != 7 {
+				err = ErrUnsupportedCodec
+				return
+			}
+			if len(tag.Data) < 5 {
+				continue
+			}
+			switch tag.Data[1] {
+			case 0:
+				if video.config == nil {
+					video.config = append([]byte{}, tag.Data[5:]...)
+					video.width, video.height = mp42ts.AvcSize(video.config)
+				} else if !bytes.Equal(video.config, tag.Data[5:]) {
+					fmt.Printf("[warn] flv: AVC sequence header changed at %d\n", tag.Timestamp)
+				}
+			case 1:
+				if video.config == nil {
+					continue
+				}
+				cto := int(tag.Data[2])<<16 | int(tag.Data[3])<<8 | int(tag.Data[4])
+				if cto&0x800000 != 0 {
+					cto -= 0x1000000
+				}
+				video.samples = append(video.samples, mp4Sample{
+					offset: offset + 5,
+					size:   len(tag.Data) - 5,
+					dts:    tag.Timestamp,
+					cto:    cto,
+					key:    tag.IsKeyFrame(),
+				})
+			}
+
+		case TagAudio:
+			if tag.Data[0]>>4 != 10 {
+				err = ErrUnsupportedCodec
+				return
+			}
+			switch tag.Data[1] {
+			case 0:
+				if audio.config == nil {
+					audio.config = append([]byte{}, tag.Data[2:]...)
+					audio.rate, audio.chans = aacConfig(audio.config)
+				}
+			case 1:
+				if audio.config == nil {
+					continue
+				}
+				audio.samples = append(audio.samples, mp4Sample{
+					offset: offset + 2,
+					size:   len(tag.Data) - 2,
+					dts:    tag.Timestamp,
+					key:    true,
+				})
+			}
+		}
+	}
+	return
+}
+
+// AudioSpecificConfigのサンプリング周波数とチャンネル数
+func aacConfig(asc []byte) (rate, chans int) {
+	rate, chans = 44100, 2
+	if len(asc) < 2 {
+		return
+	}
+	rates := []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+	idx := int(asc[0]&0x07)<<1 | int(asc[1]>>7)
+	if idx < len(rates) {
+		rate = rates[idx]
+	}
+	if c := int(asc[1]>>3) & 0x0f; c > 0 {
+		chans = c
+	}
+	return
+}
+
+func u16(n int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(n))
+	return b
+}
+func u32(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+func u64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+func box(typ string, payload ...[]byte) []byte {
+	var size int
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, 8+size)
+	b = append(b, u32(8+size)...)
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+func fullBox(typ string, version byte, flags int, payload ...[]byte) []byte {
+	head := u32(flags)
+	head[0] = version
+	return box(typ, append([][]byte{head}, payload...)...)
+}
+
+// 全てのトラックのタイムスケールは1000(FLVのタイムスタンプのまま)
+const mp4Timescale = 1000
+
+var matrix = [][]byte{
+	u32(0x10000), u32(0), u32(0),
+	u32(0), u32(0x10000), u32(0),
+	u32(0), u32(0), u32(0x40000000),
+}
+
+func moov(tracks []*mp4Track) []byte {
+	// 最初のサンプルが一番早いトラックを0とする
+	start := -1
+	for _, t := range tracks {
+		if dts := t.samples[0].dts; start < 0 || dts < start {
+			start = dts
+		}
+	}
+
+	var traks [][]byte
+	var duration int
+	for _, t := range tracks {
+		trak, d := t.trak(start)
+		traks = append(traks, trak)
+		if d > duration {
+			duration = d
+		}
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation, modification
+		u32(mp4Timescale), u32(duration),
+		u32(0x10000),       // rate
+		u16(0x100), u16(0), // volume, reserved
+		u32(0), u32(0), // reserved
+		bytes.Join(matrix, nil),
+		make([]byte, 24), // pre_defined
+		u32(len(tracks)+1),
+	)
+	return box("moov", append([][]byte{mvhd}, traks...)...)
+}
+
+// サンプルの長さは次のサンプルとの差。最後は1つ前と同じ
+func (t *mp4Track) durations() (d []int) {
+	d = make([]int, len(t.samples))
+	for i := range t.samples {
+		if i+1 < len(t.samples) {
+			d[i] = t.samples[i+1].dts - t.samples[i].dts
+		} else if i > 0 {
+			d[i] = d[i-1]
+		}
+		if d[i] < 0 {
+			d[i] = 0
+		}
+	}
+	return
+}
+
+func (t *mp4Track) trak(start int) (trak []byte, duration int) {
+	durs := t.durations()
+	var mediaDuration int
+	for _, d := range durs {
+		mediaDuration += d
+	}
+	delay := t.samples[0].dts - start
+	duration = delay + mediaDuration
+
+	var volume int
+	if !t.video {
+		volume = 0x100
+	}
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0),
+		u32(t.id), u32(0),
+		u32(duration),
+		make([]byte, 8),
+		u16(0), u16(0), // layer, alternate_group
+		u16(volume), u16(0),
+		bytes.Join(matrix, nil),
+		u32(t.width<<16), u32(t.height<<16),
+	)
+
+	// 開始の遅れと、先頭のコンポジションオフセット
+	var entries [][]byte
+	if delay > 0 {
+		entries = append(entries, u32(delay), u32(-1), u32(0x10000))
+	}
+	entries = append(entries, u32(mediaDuration), u32(t.samples[0].cto), u32(0x10000))
+	elst := fullBox("elst", 0, 0, append([][]byte{u32(len(entries) / 3)}, entries...)...)
+	edts := box("edts", elst)
+
+	mdhd := fullBox("mdhd", 0, 0,
+		u32(0), u32(0),
+		u32(mp4Timescale), u32(mediaDuration),
+		u16(0x55c4), u16(0), // und
+	)
+	var hdlr, xmhd, entry []byte
+	if t.video {
+		hdlr = fullBox("hdlr", 0, 0, u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+		xmhd = fullBox("vmhd", 0, 1, make([]byte, 8))
+		entry = box("avc1",
+			make([]byte, 6), u16(1), // reserved, data_reference_index
+			make([]byte, 16),
+			u16(t.width), u16(t.height),
+			u32(0x480000), u32(0x480000),
+			u32(0), u16(1),
+			make([]byte, 32), // compressorname
+			u16(0x18), u16(0xffff),
+			box("avcC", t.config),
+		)
+	} else {
+		hdlr = fullBox("hdlr", 0, 0, u32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+		xmhd = fullBox("smhd", 0, 0, make([]byte, 4))
+		entry = box("mp4a",
+			make([]byte, 6), u16(1),
+			make([]byte, 8),
+			u16(t.chans), u16(16),
+			u16(0), u16(0),
+			u32(t.rate<<16),
+			esds(t.id, t.config),
+		)
+	}
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+
+	var stts, ctts, stss, stsz, co64 [][]byte
+	var sttsCount, cttsCount int
+	var hasCto, negCto bool
+	for i, s := range t.samples {
+		if n := len(stts); n > 0 && int(binary.BigEndian.Uint32(stts[n-1])) == durs[i] {
+			stts[n-2] = u32(int(binary.BigEndian.Uint32(stts[n-2])) + 1)
+		} else {
+			stts = append(stts, u32(1), u32(durs[i]))
+			sttsCount++
+		}
+		if n := len(ctts); n > 0 && int(int32(binary.BigEndian.Uint32(ctts[n-1]))) == s.cto {
+			ctts[n-2] = u32(int(binary.BigEndian.Uint32(ctts[n-2])) + 1)
+		} else {
+			ctts = append(ctts, u32(1), u32(s.cto))
+			cttsCount++
+		}
+		if s.cto != 0 {
+			hasCto = true
+		}
+		if s.cto < 0 {
+			negCto = true
+		}
+		if s.key {
+			stss = append(stss, u32(i+1))
+		}
+		stsz = append(stsz, u32(s.size))
+		co64 = append(co64, u64(uint64(t.mdatPos[i])))
+	}
+
+	stbl := [][]byte{
+		fullBox("stsd", 0, 0, u32(1), entry),
+		fullBox("stts", 0, 0, append([][]byte{u32(sttsCount)}, stts...)...),
+	}
+	if hasCto {
+		var version byte
+		if negCto {
+			version = 1
+		}
+		stbl = append(stbl, fullBox("ctts", version, 0, append([][]byte{u32(cttsCount)}, ctts...)...))
+	}
+	if t.video {
+		stbl = append(stbl, fullBox("stss", 0, 0, append([][]byte{u32(len(stss))}, stss...)...))
+	}
+	stbl = append(stbl,
+		// 1サンプルを1チャンクとする
+		fullBox("stsc", 0, 0, u32(1), u32(1), u32(1), u32(1)),
+		fullBox("stsz", 0, 0, append([][]byte{u32(0), u32(len(stsz))}, stsz...)...),
+		fullBox("co64", 0, 0, append([][]byte{u32(len(co64))}, co64...)...),
+	)
+
+	minf := box("minf", xmhd, dinf, box("stbl", stbl...))
+	mdia := box("mdia", mdhd, hdlr, minf)
+	trak = box("trak", tkhd, edts, mdia)
+	return
+}
+
+func descriptor(tag byte, payload ...[]byte) []byte {
+	var size int
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := []byte{tag, 0x80 | byte(size>>21), 0x80 | byte(size>>14), 0x80 | byte(size>>7), byte(size & 0x7f)}
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func esds(id int, asc []byte) []byte {
+	return fullBox("esds", 0, 0,
+		descriptor(3, u16(id), []byte{0},
+			descriptor(4,
+				[]byte{0x40, 0x15, 0, 0, 0}, // AAC, AudioStream, bufferSizeDB
+				u32(0), u32(0),              // maxBitrate, avgBitrate
+				descriptor(5, asc),
+			),
+			descriptor(6, []byte{2}),
+		),
+	)
+}
@@ -0,0 +1,197 @@
+package flvs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/himananiito/livedl/amf"
+	"github.com/himananiito/livedl/mp42ts"
+)
+
+// 1280x720 Baseline
+var testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe4}
+var testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+
+func testAvcC(sps, pps []byte) []byte {
+	b := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+	b = append(b, u16(len(sps))...)
+	b = append(b, sps...)
+	b = append(b, 1)
+	b = append(b, u16(len(pps))...)
+	return append(b, pps...)
+}
+
+type testTag struct {
+	typ  byte
+	ts   int
+	data []byte
+}
+
+// H.264/AACのFLV。映像はsequence header, キーフレーム, Pフレーム, キーフレーム
+var testTags = []testTag{
+	{TagScript, 0, nil},
+	{TagVideo, 0, append([]byte{0x17, 0, 0, 0, 0}, testAvcC(testSPS, testPPS)...)},
+	{TagAudio, 0, []byte{0xaf, 0, 0x11, 0x90}},
+	{TagVideo, 0, []byte{0x17, 1, 0, 0, 40, 0, 0, 0, 2, 0x65, 0x88}},
+	{TagAudio, 0, []byte{0xaf, 1, 0x21, 0x10}},
+	{TagVideo, 33, []byte{0x27, 1, 0xff, 0xff, 0xf0, 0, 0, 0, 2, 0x41, 0x9a}},
+	{TagAudio, 21, []byte{0xaf, 1, 0x21, 0x11}},
+	{TagVideo, 1000, []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x89}},
+}
+
+func writeTestFlv(t *testing.T, meta map[string]interface{}) string {
+	t.Helper()
+	b := []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}
+	for _, tag := range testTags {
+		data := tag.data
+		if tag.typ == TagScript {
+			var err error
+			if data, err = amf.EncodeAmf0([]interface{}{"onMetaData", meta}, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b = append(b, tagHeader(tag.typ, len(data), tag.ts)...)
+		b = append(b, data...)
+		b = append(b, intToBE32(11+len(data))...)
+	}
+	name := filepath.Join(t.TempDir(), "test.flv")
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestConvertMp4(t *testing.T) {
+	src := writeTestFlv(t, map[string]interface{}{"duration": 1.0})
+	dst := filepath.Join(t.TempDir(), "test.mp4")
+	if err := ConvertMp4(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := mp42ts.Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("%d tracks", len(tracks))
+	}
+	for _, tr := range tracks {
+		var want []mp42ts.Sample
+		switch tr.Codec {
+		case "avc1":
+			if len(tr.SPS) != 1 || !bytes.Equal(tr.SPS[0], testSPS) || len(tr.PPS) != 1 || !bytes.Equal(tr.PPS[0], testPPS) {
+				t.Errorf("avc1: SPS/PPS %x %x", tr.SPS, tr.PPS)
+			}
+			want = []mp42ts.Sample{
+				{DTS: 0, CTO: 40, Key: true, Data: []byte{0, 0, 0, 2, 0x65, 0x88}},
+				{DTS: 33, CTO: -16, Data: []byte{0, 0, 0, 2, 0x41, 0x9a}},
+				{DTS: 1000, CTO: 0, Key: true, Data: []byte{0, 0, 0, 2, 0x65, 0x89}},
+			}
+		case "mp4a":
+			if !bytes.Equal(tr.ASC, []byte{0x11, 0x90}) {
+				t.Errorf("mp4a: ASC %x", tr.ASC)
+			}
+			want = []mp42ts.Sample{
+				{DTS: 0, Key: true, Data: []byte{0x21, 0x10}},
+				{DTS: 21, Key: true, Data: []byte{0x21, 0x11}},
+			}
+		default:
+			t.Fatalf("codec %q", tr.Codec)
+		}
+		if len(tr.Samples) != len(want) {
+			t.Fatalf("%s: %d samples, want %d", tr.Codec, len(tr.Samples), len(want))
+		}
+		for i, s := range tr.Samples {
+			// ミリ秒にする
+			dts := s.DTS * 1000 / int64(tr.Timescale)
+			cto := s.CTO * 1000 / int64(tr.Timescale)
+			if w := want[i]; dts != w.DTS || cto != w.CTO || s.Key != w.Key || !bytes.Equal(s.Data, w.Data) {
+				t.Errorf("%s[%d]: dts %d cto %d key %v data %x, want %+v", tr.Codec, i, dts, cto, s.Key, s.Data, w)
+			}
+		}
+	}
+}
+
+func TestAddKeyframes(t *testing.T) {
+	name := writeTestFlv(t, map[string]interface{}{"width": 1280.0, "encoder": "test"})
+	if err := AddKeyframes(name); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var meta map[string]interface{}
+	var keyOffsets []float64
+	var n int
+	for {
+		tag, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.Type == TagScript {
+			data, err := amf.DecodeAmf0(tag.Data)
+			if err != nil || len(data) != 2 || data[0] != "onMetaData" || meta != nil {
+				t.Fatalf("script tag %v %v", data, err)
+			}
+			meta, _ = data[1].(map[string]interface{})
+			continue
+		}
+		if tag.IsKeyFrame() {
+			keyOffsets = append(keyOffsets, float64(tag.Offset))
+		}
+		n++
+	}
+	if n != len(testTags)-1 {
+		t.Errorf("%d tags, want %d", n, len(testTags)-1)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]interface{}{
+		"width":                 1280.0,
+		"encoder":               "test",
+		"duration":              1.0,
+		"lastkeyframetimestamp": 1.0,
+		"hasVideo":              true,
+		"hasAudio":              true,
+		"hasKeyframes":          true,
+		"filesize":              float64(fi.Size()),
+	} {
+		if meta[k] != want {
+			t.Errorf("%s: %v, want %v", k, meta[k], want)
+		}
+	}
+	keyframes, _ := meta["keyframes"].(map[string]interface{})
+	times, _ := keyframes["times"].([]interface{})
+	positions, _ := keyframes["filepositions"].([]interface{})
+	if len(times) != 2 || times[0] != 0.0 || times[1] != 1.0 {
+		t.Errorf("times %v", times)
+	}
+	if len(positions) != len(keyOffsets) {
+		t.Fatalf("filepositions %v, want %v", positions, keyOffsets)
+	}
+	for i, p := range positions {
+		if p != keyOffsets[i] {
+			t.Errorf("filepositions %v, want %v", positions, keyOffsets)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package flvs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	TagAudio  = 8
+	TagVideo  = 9
+	TagScript = 18
+)
+
+type Tag struct {
+	Type      byte  // TagAudio, TagVideo, TagScript
+	Timestamp int   // ミリ秒
+	Offset    int64 // ファイル先頭からのタグの位置
+	Data      []byte
+}
+
+// 映像のキーフレーム(AVCのsequence headerは除く)
+func (tag *Tag) IsKeyFrame() bool {
+	if tag.Type != TagVideo || len(tag.Data) < 2 || (tag.Data[0]>>4) != 1 {
+		return false
+	}
+	return tag.Data[0]&0x0f != 7 || tag.Data[1] == 1
+}
+
+// FLVのタグを先頭から順に読む
+type Reader struct {
+	rdr    *bufio.Reader
+	offset int64
+	Flags  byte // 4: 音声あり 1: 映像あり
+}
+
+func NewReader(r io.Reader) (reader *Reader, err error) {
+	reader = &Reader{
+		rdr: bufio.NewReaderSize(r, 256*1024),
+	}
+
+	b := make([]byte, 9)
+	if _, err = io.ReadFull(reader.rdr, b); err != nil {
+		return
+	}
+	if "FLV" != string(b[0:3]) {
+		err = fmt.Errorf("magic number is not FLV")
+		return
+	}
+	reader.Flags = b[4]
+
+	// DataOffsetとPreviousTagSize0を読み飛ばす
+	offset := int64(binary.BigEndian.Uint32(b[5:9]))
+	if offset < 9 {
+		err = fmt.Errorf("invalid FLV header")
+		return
+	}
+	if _, err = reader.rdr.Discard(int(offset-9) + 4); err != nil {
+		return
+	}
+	reader.offset = offset + 4
+	return
+}
+
+// 次のタグ。最後まで読んだらio.EOF
+// 途中で切れているタグはio.ErrUnexpectedEOF
+func (reader *Reader) Next() (tag *Tag, err error) {
+	b := make([]byte, 11)
+	if _, err = io.ReadFull(reader.rdr, b); err != nil {
+		return
+	}
+
+	size := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	tag = &Tag{
+		Type: b[0] & 0x1f,
+		Timestamp: (int(b[7]) << 24) |
+			(int(b[4]) << 16) |
+			(int(b[5]) << 8) |
+			(int(b[6])),
+		Offset: reader.offset,
+		Data:   make([]byte, size),
+	}
+
+	if _, err = io.ReadFull(reader.rdr, tag.Data); err != nil {
+		tag = nil
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	// PreviousTagSize
+	if _, err = reader.rdr.Discard(4); err != nil {
+		// 最後のPreviousTagSizeが無いものは読めたことにする
+		err = nil
+	}
+	reader.offset += int64(11 + size + 4)
+	return
+}
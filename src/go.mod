@@ -6,7 +6,10 @@ require (
 	github.com/gin-gonic/gin v1.7.1
 	github.com/gorilla/websocket v1.4.2
 	github.com/mattn/go-sqlite3 v1.14.7
-	golang.org/x/crypto v0.0.0-20210503195802-e9a32991a82e
+	golang.org/x/crypto v0.15.0
+	golang.org/x/net v0.18.0
+	golang.org/x/term v0.14.0
+	gopkg.in/yaml.v2 v2.2.8
 )
 
 replace github.com/himananiito/livedl => ./
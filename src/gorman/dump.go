@@ -0,0 +1,90 @@
+package gorman
+
+import (
+	"fmt"
+	"io"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cancelからこれだけ経っても終わらないものは止まっていないとみなす
+const stuckAfter = 30 * time.Second
+
+var allMtx sync.Mutex
+var all = map[*routine]struct{}{}
+
+func register(r *routine) {
+	allMtx.Lock()
+	defer allMtx.Unlock()
+	all[r] = struct{}{}
+}
+
+func unregister(r *routine) {
+	allMtx.Lock()
+	defer allMtx.Unlock()
+	delete(all, r)
+}
+
+// 動いているgoroutine
+type Routine struct {
+	Name     string     `json:"name"`
+	Started  time.Time  `json:"started"`
+	Canceled *time.Time `json:"canceled,omitempty"` // Cancelされた時刻
+	Cause    string     `json:"cause,omitempty"`
+	Stuck    bool       `json:"stuck"` // Cancelの後も終わらない
+}
+
+func (r *routine) info() Routine {
+	i := Routine{Name: r.name, Started: r.started}
+	if cause, at := r.gen.stopped(); cause != nil {
+		i.Canceled = &at
+		i.Cause = cause.Error()
+		i.Stuck = time.Since(at) > stuckAfter
+	}
+	return i
+}
+
+func (r Routine) String() string {
+	s := fmt.Sprintf("%s (%v)", r.Name, time.Since(r.Started).Round(time.Second))
+	if r.Canceled != nil {
+		s += fmt.Sprintf(" canceled %v ago: %s", time.Since(*r.Canceled).Round(time.Second), r.Cause)
+		if r.Stuck {
+			s += " [STUCK]"
+		}
+	}
+	return s
+}
+
+func sortRoutines(rs []Routine) []Routine {
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Name != rs[j].Name {
+			return rs[i].Name < rs[j].Name
+		}
+		return rs[i].Started.Before(rs[j].Started)
+	})
+	return rs
+}
+
+// 全てのマネージャーで動いているgoroutine
+func Routines() []Routine {
+	allMtx.Lock()
+	rs := make([]Routine, 0, len(all))
+	for r := range all {
+		rs = append(rs, r.info())
+	}
+	allMtx.Unlock()
+	return sortRoutines(rs)
+}
+
+// Routinesと、全てのgoroutineのスタック(名前のラベル付き)
+func Dump(w io.Writer) {
+	rs := Routines()
+	fmt.Fprintf(w, "gorman: %d goroutine(s)\n", len(rs))
+	for _, r := range rs {
+		fmt.Fprintf(w, "  %s\n", r)
+	}
+	fmt.Fprintln(w)
+	pprof.Lookup("goroutine").WriteTo(w, 1)
+}
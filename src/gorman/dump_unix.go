@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package gorman
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGQUIT(Ctrl+\)でDumpを標準エラーに出す。終了はしない
+func NotifyDump() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGQUIT)
+	go func() {
+		for range ch {
+			Dump(os.Stderr)
+		}
+	}()
+}
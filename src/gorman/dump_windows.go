@@ -0,0 +1,8 @@
+//go:build windows
+// +build windows
+
+package gorman
+
+// WindowsにはSIGQUITが無いので-daemonの/api/goroutinesを使う
+func NotifyDump() {
+}
@@ -1,70 +1,277 @@
-package gorman
-
-import (
-	"sync"
-)
-
-type GoroutineManager struct {
-	channels map[chan struct{}] struct{}
-	mtxChan sync.Mutex
-
-	mtxWg sync.Mutex
-	wg sync.WaitGroup
-
-	codeChecker func(code int)
-}
-
-func NewManager() *GoroutineManager {
-	return &GoroutineManager{
-		channels: map[chan struct{}] struct{}{},
-	}
-}
-func WithChecker(f func(int)) *GoroutineManager {
-	return &GoroutineManager{
-		channels: map[chan struct{}] struct{}{},
-		codeChecker: f,
-	}
-}
-func (gm *GoroutineManager) addChan(c chan struct{}) {
-	gm.mtxChan.Lock()
-	defer gm.mtxChan.Unlock()
-	gm.channels[c] = struct{}{}
-}
-func (gm *GoroutineManager) delChan(c chan struct{}) {
-	gm.mtxChan.Lock()
-	defer gm.mtxChan.Unlock()
-	delete(gm.channels, c)
-}
-func (gm *GoroutineManager) Cancel() {
-	gm.mtxChan.Lock()
-	defer gm.mtxChan.Unlock()
-	for c, _ := range gm.channels {
-		close(c)
-		delete(gm.channels, c)
-	}
-}
-func (gm *GoroutineManager) Count() int {
-	gm.mtxChan.Lock()
-	defer gm.mtxChan.Unlock()
-	return len(gm.channels)
-}
-func (gm *GoroutineManager) Go(f func(<-chan struct{}) int) {
-	gm.wg.Add(1)
-	stopChan := make(chan struct{}, 1)
-	gm.addChan(stopChan)
-
-	go func(){
-		defer gm.wg.Done()
-		code := f(stopChan)
-		gm.delChan(stopChan)
-		if gm.codeChecker != nil {
-			gm.codeChecker(code)
-		}
-	}()
-}
-func (gm *GoroutineManager) RegisterCodeChecker(f func(int)) {
-	gm.codeChecker = f
-}
-func (gm *GoroutineManager) Wait() {
-	gm.wg.Wait()
-}
+// goroutineを名前を付けて起動し、まとめて止めて待つ
+//
+// Goに渡す関数はctxが終わったら戻ること。戻り値はcheckerに*Errorとして渡す
+// Childで作ったものは親のCancelで一緒に止まる(main > playlist, commentなど)
+// Cancelの後にGoしたものは新しいctxで動く
+package gorman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// Goの関数が返すエラー。Failで毎回作ること
+type Error struct {
+	Code int    // 呼び出し側で決める値(niconicoのPLAYLIST_403など)
+	Name string // goroutineの名前(親/子/関数)
+	Err  error  // 原因。無ければnil
+}
+
+// *Errorでないエラーのcode
+const Unknown = -1
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("code %d", e.Code)
+	if e.Name != "" {
+		s = e.Name + ": " + s
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// codeと原因(nil可)からエラーを作る
+func Fail(code int, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+// errのcode。nilは0、*Errorを含まなければUnknown
+func Code(err error) int {
+	if err == nil {
+		return 0
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Unknown
+}
+
+// 理由を付けずにCancelした時の原因
+var Canceled = errors.New("canceled")
+
+// Cancelまでに起動したgoroutineが共有するctx
+type gen struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	parent *gen
+
+	mtx   sync.Mutex
+	cause error
+	at    time.Time
+}
+
+type genKey struct{}
+
+func (g *gen) stop(cause error) {
+	g.mtx.Lock()
+	if g.cause == nil {
+		g.cause = cause
+		g.at = time.Now()
+	}
+	g.mtx.Unlock()
+	g.cancel()
+}
+
+// 止めた原因と時刻。親が止まった時は親のもの
+func (g *gen) stopped() (cause error, at time.Time) {
+	for ; g != nil; g = g.parent {
+		g.mtx.Lock()
+		cause, at = g.cause, g.at
+		g.mtx.Unlock()
+		if cause != nil {
+			return
+		}
+	}
+	return
+}
+
+// ctxを止めたCancelの原因。止まっていなければnil
+func Cause(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	if g, ok := ctx.Value(genKey{}).(*gen); ok {
+		if cause, _ := g.stopped(); cause != nil {
+			return cause
+		}
+	}
+	return ctx.Err()
+}
+
+type routine struct {
+	name    string
+	started time.Time
+	gen     *gen
+}
+
+type GoroutineManager struct {
+	name   string
+	parent *GoroutineManager
+
+	mtx     sync.Mutex
+	gen     *gen
+	running map[*routine]struct{}
+
+	wg sync.WaitGroup
+
+	checker func(err error)
+}
+
+func NewManager(name string) *GoroutineManager {
+	return &GoroutineManager{
+		name:    name,
+		running: map[*routine]struct{}{},
+	}
+}
+
+// 終わったgoroutineのエラー(正常ならnil)をfに渡す
+func WithChecker(name string, f func(error)) *GoroutineManager {
+	gm := NewManager(name)
+	gm.checker = f
+	return gm
+}
+
+// 親のCancelで一緒に止まるもの
+func (gm *GoroutineManager) Child(name string, f func(error)) *GoroutineManager {
+	c := WithChecker(name, f)
+	c.parent = gm
+	return c
+}
+
+func (gm *GoroutineManager) Name() string {
+	if gm.parent != nil {
+		return gm.parent.Name() + "/" + gm.name
+	}
+	return gm.name
+}
+
+func (gm *GoroutineManager) current() *gen {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	if gm.gen == nil || gm.gen.ctx.Err() != nil {
+		base := context.Background()
+		var pg *gen
+		if gm.parent != nil {
+			pg = gm.parent.current()
+			base = pg.ctx
+		}
+		g := &gen{parent: pg}
+		g.ctx, g.cancel = context.WithCancel(base)
+		g.ctx = context.WithValue(g.ctx, genKey{}, g)
+		gm.gen = g
+	}
+	return gm.gen
+}
+
+// 動いているgoroutineを止める。causeはCauseで取れる(nilならCanceled)
+func (gm *GoroutineManager) Cancel(cause error) {
+	if cause == nil {
+		cause = Canceled
+	}
+	gm.mtx.Lock()
+	g := gm.gen
+	gm.mtx.Unlock()
+	if g != nil {
+		g.stop(cause)
+	}
+}
+
+// 動いているgoroutineの数(子は含まない)
+func (gm *GoroutineManager) Count() int {
+	gm.mtx.Lock()
+	defer gm.mtx.Unlock()
+	return len(gm.running)
+}
+
+func (gm *GoroutineManager) Go(name string, f func(ctx context.Context) error) {
+	g := gm.current()
+	r := &routine{
+		name:    gm.Name() + "/" + name,
+		started: time.Now(),
+		gen:     g,
+	}
+	gm.mtx.Lock()
+	gm.running[r] = struct{}{}
+	gm.mtx.Unlock()
+	register(r)
+
+	gm.wg.Add(1)
+	go func() {
+		defer gm.wg.Done()
+		var err error
+		// スタックのダンプ(debug=1)にも名前が出る
+		pprof.Do(g.ctx, pprof.Labels("gorman", r.name), func(ctx context.Context) {
+			err = f(ctx)
+		})
+		gm.mtx.Lock()
+		delete(gm.running, r)
+		gm.mtx.Unlock()
+		unregister(r)
+
+		if err != nil {
+			var e *Error
+			if !errors.As(err, &e) {
+				e = &Error{Code: Unknown, Err: err}
+			}
+			if e.Name == "" {
+				e.Name = r.name
+			}
+			err = e
+		}
+		if gm.checker != nil {
+			gm.checker(err)
+		}
+	}()
+}
+
+func (gm *GoroutineManager) SetChecker(f func(error)) {
+	gm.checker = f
+}
+
+// Cancelの後stuckAfter経っても終わらないものがあれば、stuckAfter毎にログに出す
+// Cancelしていなければ終わるまで黙って待つ
+func (gm *GoroutineManager) Wait() {
+	done := make(chan struct{})
+	go func() {
+		gm.wg.Wait()
+		close(done)
+	}()
+	var logged time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Second):
+		}
+		if time.Since(logged) < stuckAfter {
+			continue
+		}
+		gm.mtx.Lock()
+		var rs []Routine
+		for r := range gm.running {
+			if i := r.info(); i.Stuck {
+				rs = append(rs, i)
+			}
+		}
+		gm.mtx.Unlock()
+		if len(rs) == 0 {
+			continue
+		}
+		logged = time.Now()
+		log.Printf("gorman: %s: still waiting for %d goroutine(s) after cancel\n", gm.Name(), len(rs))
+		for _, r := range sortRoutines(rs) {
+			log.Printf("gorman:   %s\n", r)
+		}
+	}
+}
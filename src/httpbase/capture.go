@@ -0,0 +1,654 @@
+package httpbase
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/himananiito/livedl/buildno"
+)
+
+// -capture: HTTPのリクエストとレスポンス、websocketのフレームをHAR(1.2)に書き出す
+// websocketはChromeと同じ_webSocketMessagesに入れる
+// Cookie、user_session、パスワードなどはREDACTEDに置き換える
+
+const redacted = "REDACTED"
+
+// 1つのレスポンス(websocketはバイナリの合計)で記録する最大の大きさ
+const captureLimit = 16 * 1024 * 1024
+
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Headers     []harNV      `json:"headers"`
+	QueryString []harNV      `json:"queryString"`
+	Cookies     []harNV      `json:"cookies"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+	PostData    *harPostData `json:"postData,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Headers     []harNV    `json:"headers"`
+	Cookies     []harNV    `json:"cookies"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int        `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harWsMessage struct {
+	Type   string  `json:"type"` // send, receive
+	Time   float64 `json:"time"` // UNIX時間(秒)
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"` // バイナリはbase64
+}
+
+type harEntry struct {
+	StartedDateTime string         `json:"startedDateTime"`
+	Time            float64        `json:"time"`
+	Request         harRequest     `json:"request"`
+	Response        harResponse    `json:"response"`
+	Cache           struct{}       `json:"cache"`
+	Timings         harTimings     `json:"timings"`
+	Error           string         `json:"_error,omitempty"`     // ネットワークエラー
+	Truncated       bool           `json:"_truncated,omitempty"` // captureLimitを超えた
+	Closed          string         `json:"_closed,omitempty"`    // websocketを閉じた側(client, server)
+	WsMessages      []harWsMessage `json:"_webSocketMessages,omitempty"`
+
+	started time.Time
+	wsBytes int
+}
+
+type capture struct {
+	mu   sync.Mutex
+	f    *os.File
+	n    int
+	open map[*harEntry]bool // 閉じていないwebsocket
+}
+
+var capt *capture
+
+// 値で消すもの。-capture, -replayで共通
+var secretMtx sync.Mutex
+var secrets []string
+
+// 名前で消すもの(クエリ、フォーム、Cookie、JSON)
+var secretNames = []string{
+	"user_session", "user_session_secure", "password", "mail_tel", "passcode",
+	"SID", "HSID", "SSID", "APISID", "SAPISID", "__Secure-1PSID", "__Secure-3PSID", "LOGIN_INFO",
+}
+var reSecretParam *regexp.Regexp
+var reSecretJson *regexp.Regexp
+
+func init() {
+	var names []string
+	for _, n := range secretNames {
+		names = append(names, regexp.QuoteMeta(n))
+	}
+	list := strings.Join(names, "|")
+	reSecretParam = regexp.MustCompile(`(\b(?:` + list + `)=)[^;&\s"'<>]+`)
+	reSecretJson = regexp.MustCompile(`("(?:` + list + `)"\s*:\s*")[^"]*(")`)
+}
+
+// -capture。fileにHARを書き出す。StopCaptureで閉じる
+func StartCapture(file string) (err error) {
+	if capt != nil {
+		return fmt.Errorf("capture: already started")
+	}
+	if !checkTransport() {
+		return fmt.Errorf("capture: check failed")
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return
+	}
+	creator, _ := json.Marshal(map[string]string{"name": "livedl", "version": buildno.GetBuildNo()})
+	if _, err = fmt.Fprintf(f, "{\"log\":{\"version\":\"1.2\",\"creator\":%s,\"entries\":[\n", creator); err != nil {
+		f.Close()
+		return
+	}
+	c := &capture{f: f, open: map[*harEntry]bool{}}
+	Jar.mtx.Lock()
+	for _, ck := range Jar.cookies {
+		AddSecret(ck.Value)
+	}
+	Jar.mtx.Unlock()
+	capt = c
+	Client.Transport = &captureTransport{base: Client.Transport}
+	return
+}
+
+// 閉じていないwebsocketを書き出してファイルを閉じる
+func StopCapture() (err error) {
+	c := capt
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	var list []*harEntry
+	for e := range c.open {
+		list = append(list, e)
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].started.Before(list[j].started) })
+	for _, e := range list {
+		c.finishWs(e, "")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	if _, err = fmt.Fprint(c.f, "\n]}}\n"); err == nil {
+		fmt.Printf("capture: %d entries written to %s\n", c.n, c.f.Name())
+	}
+	if e := c.f.Close(); err == nil {
+		err = e
+	}
+	c.f = nil
+	return
+}
+
+// 記録から消す値(セッションなど)を加える。短いものは他の文字列を壊すので除く
+func AddSecret(values ...string) {
+	secretMtx.Lock()
+	defer secretMtx.Unlock()
+	for _, v := range values {
+		if len(v) < 8 || v == redacted {
+			continue
+		}
+		var found bool
+		for _, s := range secrets {
+			if s == v {
+				found = true
+			}
+		}
+		if !found {
+			// redactが古いものを使っているかもしれないので作り直す
+			list := append(append([]string{}, secrets...), v)
+			sort.Slice(list, func(i, j int) bool { return len(list[i]) > len(list[j]) })
+			secrets = list
+		}
+	}
+}
+
+func redact(s string) string {
+	secretMtx.Lock()
+	list := secrets
+	secretMtx.Unlock()
+	for _, v := range list {
+		s = strings.Replace(s, v, redacted, -1)
+		if q := url.QueryEscape(v); q != v {
+			s = strings.Replace(s, q, redacted, -1)
+		}
+	}
+	s = reSecretParam.ReplaceAllString(s, "${1}"+redacted)
+	s = reSecretJson.ReplaceAllString(s, "${1}"+redacted+"${2}")
+	return s
+}
+
+func (c *capture) headers(h http.Header) (list []harNV) {
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			switch strings.ToLower(k) {
+			case "cookie":
+				var kv []string
+				for _, ck := range strings.Split(v, ";") {
+					ck = strings.TrimSpace(ck)
+					if i := strings.Index(ck, "="); i >= 0 {
+						AddSecret(ck[i+1:])
+						ck = ck[:i+1] + redacted
+					}
+					kv = append(kv, ck)
+				}
+				v = strings.Join(kv, "; ")
+			case "set-cookie":
+				if i := strings.Index(v, "="); i >= 0 {
+					val := v[i+1:]
+					if j := strings.Index(val, ";"); j >= 0 {
+						AddSecret(val[:j])
+						v = v[:i+1] + redacted + val[j:]
+					} else {
+						AddSecret(val)
+						v = v[:i+1] + redacted
+					}
+				}
+			case "authorization", "proxy-authorization":
+				v = redacted
+			default:
+				v = redact(v)
+			}
+			list = append(list, harNV{Name: k, Value: v})
+		}
+	}
+	if list == nil {
+		list = []harNV{}
+	}
+	return
+}
+
+func queryList(u string) (list []harNV) {
+	list = []harNV{}
+	if p, err := url.Parse(u); err == nil {
+		for k, vs := range p.Query() {
+			for _, v := range vs {
+				list = append(list, harNV{Name: k, Value: v})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+	return
+}
+
+func isText(mimeType string, data []byte) bool {
+	mt, _, _ := mime.ParseMediaType(mimeType)
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "json"),
+		strings.HasSuffix(mt, "xml"),
+		strings.HasSuffix(mt, "javascript"),
+		strings.HasSuffix(mt, "mpegurl"),
+		mt == "application/x-www-form-urlencoded":
+		return true
+	case mt == "":
+		return utf8.Valid(data) && !bytes.ContainsRune(data, 0)
+	}
+	return false
+}
+
+func (c *capture) content(mimeType string, data []byte) harContent {
+	ct := harContent{Size: len(data), MimeType: mimeType}
+	if isText(mimeType, data) {
+		ct.Text = redact(string(data))
+	} else if len(data) > 0 {
+		ct.Text = base64.StdEncoding.EncodeToString(data)
+		ct.Encoding = "base64"
+	}
+	return ct
+}
+
+func msec(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (c *capture) newEntry(req *http.Request, body []byte) *harEntry {
+	now := time.Now()
+	u := redact(req.URL.String())
+	h := req.Header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	if req.Host != "" && req.Host != req.URL.Host {
+		h.Set("Host", req.Host)
+	}
+	e := &harEntry{
+		StartedDateTime: now.Format("2006-01-02T15:04:05.000Z07:00"),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         u,
+			HTTPVersion: "HTTP/1.1",
+			Headers:     c.headers(h),
+			QueryString: queryList(u),
+			Cookies:     []harNV{},
+			HeadersSize: -1,
+			BodySize:    len(body),
+		},
+		started: now,
+	}
+	if body != nil {
+		e.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     redact(string(body)),
+		}
+	}
+	return e
+}
+
+func (c *capture) setResponse(e *harEntry, resp *http.Response) {
+	e.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Headers:     c.headers(resp.Header),
+		Cookies:     []harNV{},
+		Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: redact(resp.Header.Get("Location")),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+}
+
+func (c *capture) write(e *harEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Printf("capture: %v\n", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	if c.n > 0 {
+		c.f.WriteString(",\n")
+	}
+	c.f.Write(data)
+	c.n++
+}
+
+// Client.Transportを包んで記録する
+type captureTransport struct {
+	base http.RoundTripper
+}
+
+func (t *captureTransport) unwrap() http.RoundTripper {
+	return t.base
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	c := capt
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			req.Body.Close()
+			return
+		}
+		req.Body.Close()
+		orig := req
+		req = orig.Clone(orig.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	e := c.newEntry(req, body)
+	resp, err = t.base.RoundTrip(req)
+	if err != nil {
+		e.Time = msec(time.Since(e.started))
+		e.Error = err.Error()
+		e.Response = harResponse{Headers: []harNV{}, Cookies: []harNV{}, HeadersSize: -1, BodySize: -1}
+		c.write(e)
+		return
+	}
+	e.Timings.Wait = msec(time.Since(e.started))
+	c.setResponse(e, resp)
+	resp.Body = &captureBody{rc: resp.Body, c: c, e: e}
+	return
+}
+
+// 読み終わるか閉じた時に書き出す
+type captureBody struct {
+	rc   io.ReadCloser
+	c    *capture
+	e    *harEntry
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (n int, err error) {
+	n, err = b.rc.Read(p)
+	if n > 0 {
+		if b.buf.Len()+n <= captureLimit {
+			b.buf.Write(p[:n])
+		} else {
+			b.e.Truncated = true
+		}
+	}
+	if err != nil {
+		b.finish(err)
+	}
+	return
+}
+
+func (b *captureBody) Close() error {
+	b.finish(nil)
+	return b.rc.Close()
+}
+
+func (b *captureBody) finish(err error) {
+	b.once.Do(func() {
+		e := b.e
+		e.Time = msec(time.Since(e.started))
+		e.Timings.Receive = e.Time - e.Timings.Wait
+		e.Response.Content = b.c.content(e.Response.Content.MimeType, b.buf.Bytes())
+		e.Response.BodySize = b.buf.Len()
+		if err != nil && err != io.EOF {
+			e.Error = err.Error()
+		}
+		b.c.write(e)
+	})
+}
+
+// websocket。記録はHandshakeの後にまとめて書き出す
+func (c *capture) newWsEntry(rawurl string, header http.Header) *harEntry {
+	req, _ := http.NewRequest("GET", rawurl, nil)
+	req.Header = header.Clone()
+	e := c.newEntry(req, nil)
+	c.mu.Lock()
+	c.open[e] = true
+	c.mu.Unlock()
+	return e
+}
+
+func (c *capture) wsDialed(e *harEntry, resp *http.Response, err error) {
+	if resp != nil {
+		c.setResponse(e, resp)
+	}
+	e.Timings.Wait = msec(time.Since(e.started))
+	if err != nil {
+		e.Time = e.Timings.Wait
+		e.Error = err.Error()
+		c.mu.Lock()
+		delete(c.open, e)
+		c.mu.Unlock()
+		c.write(e)
+	}
+}
+
+func (c *capture) wsMessage(e *harEntry, typ string, opcode int, data []byte) {
+	m := harWsMessage{
+		Type:   typ,
+		Time:   float64(time.Now().UnixNano()) / 1e9,
+		Opcode: opcode,
+	}
+	if opcode == 1 {
+		m.Data = redact(string(data))
+	} else {
+		m.Data = base64.StdEncoding.EncodeToString(data)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.open[e] {
+		return
+	}
+	if opcode != 1 {
+		if e.wsBytes+len(data) > captureLimit {
+			e.Truncated = true
+			return
+		}
+		e.wsBytes += len(data)
+	}
+	e.WsMessages = append(e.WsMessages, m)
+}
+
+func (c *capture) finishWs(e *harEntry, closed string) {
+	c.mu.Lock()
+	if !c.open[e] {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.open, e)
+	c.mu.Unlock()
+	e.Time = msec(time.Since(e.started))
+	e.Closed = closed
+	c.write(e)
+}
+
+// TLSの内側で読み書きされるwebsocketのフレームを記録する
+type wsCaptureConn struct {
+	net.Conn
+	c      *capture
+	e      *harEntry
+	rd, wr wsParser
+}
+
+func (c *capture) wrapWs(conn net.Conn, e *harEntry) net.Conn {
+	w := &wsCaptureConn{Conn: conn, c: c, e: e}
+	w.rd.emit = func(op int, data []byte) { c.wsMessage(e, "receive", op, data) }
+	w.wr.emit = func(op int, data []byte) { c.wsMessage(e, "send", op, data) }
+	return w
+}
+
+func (w *wsCaptureConn) Read(b []byte) (n int, err error) {
+	n, err = w.Conn.Read(b)
+	if n > 0 {
+		w.rd.feed(b[:n])
+	}
+	if err != nil {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			w.c.finishWs(w.e, "server")
+		}
+	}
+	return
+}
+
+func (w *wsCaptureConn) Write(b []byte) (n int, err error) {
+	n, err = w.Conn.Write(b)
+	if n > 0 {
+		w.wr.feed(b[:n])
+	}
+	return
+}
+
+func (w *wsCaptureConn) Close() error {
+	w.c.finishWs(w.e, "client")
+	return w.Conn.Close()
+}
+
+// HTTPのヘッダの後に続くwebsocketのフレームを取り出す
+// 分割されたメッセージはつなげる。制御フレームは記録しない
+type wsParser struct {
+	buf    []byte
+	body   bool
+	opcode int
+	msg    []byte
+	emit   func(opcode int, data []byte)
+}
+
+func (p *wsParser) feed(b []byte) {
+	p.buf = append(p.buf, b...)
+	if !p.body {
+		i := bytes.Index(p.buf, []byte("\r\n\r\n"))
+		if i < 0 {
+			return
+		}
+		p.buf = p.buf[i+4:]
+		p.body = true
+	}
+	for len(p.buf) >= 2 {
+		fin := p.buf[0]&0x80 != 0
+		op := int(p.buf[0] & 0x0f)
+		masked := p.buf[1]&0x80 != 0
+		n := uint64(p.buf[1] & 0x7f)
+		pos := 2
+		switch n {
+		case 126:
+			if len(p.buf) < 4 {
+				return
+			}
+			n = uint64(binary.BigEndian.Uint16(p.buf[2:]))
+			pos = 4
+		case 127:
+			if len(p.buf) < 10 {
+				return
+			}
+			n = binary.BigEndian.Uint64(p.buf[2:])
+			pos = 10
+		}
+		var key []byte
+		if masked {
+			if len(p.buf) < pos+4 {
+				return
+			}
+			key = p.buf[pos : pos+4]
+			pos += 4
+		}
+		if uint64(len(p.buf)-pos) < n {
+			return
+		}
+		payload := append([]byte{}, p.buf[pos:pos+int(n)]...)
+		for i := range payload {
+			if key != nil {
+				payload[i] ^= key[i%4]
+			}
+		}
+		p.buf = p.buf[pos+int(n):]
+
+		if op >= 8 {
+			continue
+		}
+		if op != 0 {
+			p.opcode = op
+			p.msg = payload
+		} else {
+			p.msg = append(p.msg, payload...)
+		}
+		if fin {
+			p.emit(p.opcode, p.msg)
+			p.msg = nil
+		}
+	}
+	if len(p.buf) == 0 {
+		p.buf = nil
+	}
+}
@@ -0,0 +1,354 @@
+package httpbase
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// 全てのHTTPとwebsocketで共有するCookie
+// net/http/cookiejarは中身を取り出せないので保存できるものを用意する
+
+type storedCookie struct {
+	Name     string
+	Value    string
+	Domain   string // 先頭の"."は付けない
+	Path     string
+	Expires  time.Time // ゼロならセッションCookie
+	Secure   bool      `json:",omitempty"`
+	HttpOnly bool      `json:",omitempty"`
+	HostOnly bool      `json:",omitempty"` // Domain属性が無かったもの
+}
+
+type CookieJar struct {
+	mtx     sync.Mutex
+	cookies []*storedCookie
+	changed bool
+}
+
+var Jar = &CookieJar{}
+
+func init() {
+	Client.Jar = Jar
+}
+
+func (c *storedCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+func (c *storedCookie) domainMatch(host string) bool {
+	if c.HostOnly {
+		return host == c.Domain
+	}
+	return host == c.Domain || strings.HasSuffix(host, "."+c.Domain)
+}
+func pathMatch(cookiePath, reqPath string) bool {
+	if reqPath == "" {
+		reqPath = "/"
+	}
+	if cookiePath == reqPath {
+		return true
+	}
+	if strings.HasPrefix(reqPath, cookiePath) {
+		return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+	}
+	return false
+}
+func defaultPath(u *url.URL) string {
+	p := u.Path
+	if p == "" || p[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(p, "/")
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
+func canonicalHost(u *url.URL) string {
+	return strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+}
+func isSecure(u *url.URL) bool {
+	switch u.Scheme {
+	case "https", "wss":
+		return true
+	}
+	return false
+}
+
+// com、co.jpなどのpublic suffixか
+func isPublicSuffix(domain string) bool {
+	ps, _ := publicsuffix.PublicSuffix(domain)
+	return ps == domain
+}
+
+// 同じものがあれば置き換える。mtxを取ってから呼ぶ
+func (j *CookieJar) set(c *storedCookie, now time.Time) {
+	for i, old := range j.cookies {
+		if old.Name == c.Name && old.Domain == c.Domain && old.Path == c.Path {
+			if c.expired(now) {
+				j.cookies = append(j.cookies[:i], j.cookies[i+1:]...)
+			} else {
+				j.cookies[i] = c
+			}
+			j.changed = true
+			return
+		}
+	}
+	if !c.expired(now) {
+		j.cookies = append(j.cookies, c)
+		j.changed = true
+	}
+}
+
+// http.CookieJar
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := canonicalHost(u)
+	now := time.Now()
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	for _, hc := range cookies {
+		c := &storedCookie{
+			Name:     hc.Name,
+			Value:    hc.Value,
+			Path:     hc.Path,
+			Secure:   hc.Secure,
+			HttpOnly: hc.HttpOnly,
+		}
+		if c.Path == "" || c.Path[0] != '/' {
+			c.Path = defaultPath(u)
+		}
+		d := strings.ToLower(strings.TrimPrefix(hc.Domain, "."))
+		switch {
+		case d == "":
+			c.Domain = host
+			c.HostOnly = true
+		// 他のドメインのものは受け付けない
+		case host != d && !strings.HasSuffix(host, "."+d):
+			continue
+		case net.ParseIP(host) != nil:
+			if host != d {
+				continue
+			}
+			c.Domain = d
+		// com、co.jpなどには設定させない。ホストそのものならそのホストだけに設定する
+		case isPublicSuffix(d):
+			if host != d {
+				continue
+			}
+			c.Domain = host
+			c.HostOnly = true
+		default:
+			c.Domain = d
+		}
+		switch {
+		case hc.MaxAge < 0:
+			c.Expires = now.Add(-time.Second)
+		case hc.MaxAge > 0:
+			c.Expires = now.Add(time.Duration(hc.MaxAge) * time.Second)
+		case !hc.Expires.IsZero():
+			c.Expires = hc.Expires
+			if !c.Expires.After(now) {
+				c.Expires = now.Add(-time.Second)
+			}
+		}
+		j.set(c, now)
+	}
+}
+
+// http.CookieJar
+func (j *CookieJar) Cookies(u *url.URL) (res []*http.Cookie) {
+	host := canonicalHost(u)
+	secure := isSecure(u)
+	now := time.Now()
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	for _, c := range j.cookies {
+		if c.expired(now) || !c.domainMatch(host) || !pathMatch(c.Path, u.Path) {
+			continue
+		}
+		if c.Secure && !secure {
+			continue
+		}
+		res = append(res, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return
+}
+
+// ドメイン全体(サブドメインを含む)にCookieを設定する。valueが空なら削除する
+func (j *CookieJar) SetDomainCookie(domain, name, value string) {
+	c := &storedCookie{
+		Name:   name,
+		Value:  value,
+		Domain: strings.ToLower(strings.TrimPrefix(domain, ".")),
+		Path:   "/",
+	}
+	now := time.Now()
+	if value == "" {
+		c.Expires = now.Add(-time.Second)
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.set(c, now)
+}
+
+// ドメインにその名前のCookieがあるか
+func (j *CookieJar) HasCookie(domain, name string) bool {
+	host := strings.ToLower(strings.TrimPrefix(domain, "."))
+	now := time.Now()
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	for _, c := range j.cookies {
+		if c.Name == name && !c.expired(now) && c.domainMatch(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// 前回のSave(またはLoad)から変わったか
+func (j *CookieJar) Changed() bool {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.changed
+}
+
+// 保存用。セッションCookieと期限切れのものは含めない
+func (j *CookieJar) Save() (data []byte, err error) {
+	now := time.Now()
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	list := []*storedCookie{}
+	for _, c := range j.cookies {
+		if c.Expires.IsZero() || c.expired(now) {
+			continue
+		}
+		list = append(list, c)
+	}
+	if data, err = json.Marshal(list); err != nil {
+		return
+	}
+	j.changed = false
+	return
+}
+
+// Saveしたものを読み込む
+func (j *CookieJar) Load(data []byte) (err error) {
+	var list []*storedCookie
+	if err = json.Unmarshal(data, &list); err != nil {
+		return
+	}
+	now := time.Now()
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	for _, c := range list {
+		j.set(c, now)
+	}
+	j.changed = false
+	return
+}
+
+// ブラウザから書き出したcookies.txt(Netscape形式)を読み込む。読み込んだ数を返す
+// domain includeSubdomains path secure expires name value をタブで区切ったもの
+func (j *CookieJar) ImportNetscape(r io.Reader) (n int, err error) {
+	now := time.Now()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimRight(scanner.Text(), "\r")
+		var httpOnly bool
+		if strings.HasPrefix(s, "#HttpOnly_") {
+			s = strings.TrimPrefix(s, "#HttpOnly_")
+			httpOnly = true
+		}
+		if strings.TrimSpace(s) == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		f := strings.Split(s, "\t")
+		if len(f) == 6 {
+			// 値が空
+			f = append(f, "")
+		}
+		if len(f) != 7 {
+			err = fmt.Errorf("cookies.txt:%d: invalid format", line)
+			return
+		}
+		c := &storedCookie{
+			Name:     f[5],
+			Value:    f[6],
+			Domain:   strings.ToLower(strings.TrimPrefix(f[0], ".")),
+			Path:     f[2],
+			Secure:   strings.EqualFold(f[3], "TRUE"),
+			HttpOnly: httpOnly,
+			HostOnly: !strings.EqualFold(f[1], "TRUE"),
+		}
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		exp, e := strconv.ParseFloat(f[4], 64)
+		if e != nil {
+			err = fmt.Errorf("cookies.txt:%d: invalid expires: %s", line, f[4])
+			return
+		}
+		if exp > 0 {
+			c.Expires = time.Unix(int64(exp), 0)
+		}
+		if c.expired(now) || (!c.HostOnly && isPublicSuffix(c.Domain)) {
+			continue
+		}
+		j.set(c, now)
+		n++
+	}
+	err = scanner.Err()
+	return
+}
+
+// domain(サブドメインを含む)のCookieをcookies.txt(Netscape形式)で書き出す
+// youtube-dlなどの外部コマンドに渡す用
+func (j *CookieJar) ExportNetscape(w io.Writer, domain string) (n int, err error) {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	now := time.Now()
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if _, err = fmt.Fprint(w, "# Netscape HTTP Cookie File\n"); err != nil {
+		return
+	}
+	for _, c := range j.cookies {
+		if c.expired(now) || (c.Domain != domain && !strings.HasSuffix(c.Domain, "."+domain)) {
+			continue
+		}
+		d, sub := c.Domain, "FALSE"
+		if !c.HostOnly {
+			d, sub = "."+c.Domain, "TRUE"
+		}
+		if c.HttpOnly {
+			d = "#HttpOnly_" + d
+		}
+		secure := "FALSE"
+		if c.Secure {
+			secure = "TRUE"
+		}
+		var exp int64
+		if !c.Expires.IsZero() {
+			exp = c.Expires.Unix()
+		}
+		if _, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", d, sub, c.Path, secure, exp, c.Name, c.Value); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
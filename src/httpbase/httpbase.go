@@ -1,216 +1,322 @@
-package httpbase
-
-import (
-	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
-	"encoding/pem"
-	"errors"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"net/url"
-	"os"
-	"strings"
-	"time"
-
-	"github.com/himananiito/livedl/buildno"
-	"github.com/himananiito/livedl/defines"
-)
-
-func GetUserAgent() string {
-	return fmt.Sprintf(
-		"livedl/%s (contact: twitter=%s, email=%s)",
-		buildno.GetBuildNo(),
-		defines.Twitter,
-		defines.Email,
-	)
-}
-
-var Client = &http.Client{
-	Timeout: time.Duration(5) * time.Second,
-	CheckRedirect: func(req *http.Request, via []*http.Request) (err error) {
-		if req != nil && via != nil && len(via) > 0 {
-			if len(via) >= 10 {
-				return errors.New("stopped after 10 redirects")
-			}
-			req.Header = via[0].Header
-		}
-		return nil
-	},
-}
-
-func checkTransport() bool {
-	if Client.Transport == nil {
-		Client.Transport = &http.Transport{}
-	}
-	switch Client.Transport.(type) {
-	case *http.Transport:
-		return true
-	}
-	return false
-}
-func checkTLSClientConfig() bool {
-	if !checkTransport() {
-		return false
-	}
-
-	if Client.Transport.(*http.Transport).TLSClientConfig == nil {
-		Client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{}
-	}
-
-	return true
-}
-func SetRootCA(file string) (err error) {
-	if !checkTLSClientConfig() {
-		err = fmt.Errorf("SetRootCA: check failed")
-		return
-	}
-
-	dat, err := ioutil.ReadFile(file)
-	if err != nil {
-		return
-	}
-
-	// try decode pem
-	var nDecode int
-	for len(dat) > 0 {
-		block, d := pem.Decode(dat)
-		if block == nil {
-			break
-		}
-		dat = d
-		nDecode++
-		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
-			continue
-		}
-		addCert(block.Bytes)
-	}
-	if nDecode < 1 {
-		addCert(dat)
-	}
-
-	return
-}
-func addCert(dat []byte) (err error) {
-	certs, err := x509.ParseCertificates(dat)
-	if err != nil {
-		return
-	}
-	if certs == nil {
-		err = fmt.Errorf("ParseCertificates failed")
-		return
-	}
-
-	if len(certs) > 0 {
-		if Client.Transport.(*http.Transport).TLSClientConfig.RootCAs == nil {
-			Client.Transport.(*http.Transport).TLSClientConfig.RootCAs = x509.NewCertPool()
-		}
-	}
-
-	for _, cert := range certs {
-		Client.Transport.(*http.Transport).TLSClientConfig.RootCAs.AddCert(cert)
-	}
-	return
-}
-
-func SetSkipVerify(skip bool) (err error) {
-	if checkTLSClientConfig() {
-		Client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = skip
-	} else {
-		err = fmt.Errorf("SetSkipVerify(%#v): check failed", skip)
-	}
-	return
-}
-func SetProxy(rawurl string) (err error) {
-	if !checkTransport() {
-		return fmt.Errorf("SetProxy(%#v): check failed", rawurl)
-	}
-
-	u, err := url.Parse(rawurl)
-	if err != nil {
-		return
-	}
-	Client.Transport.(*http.Transport).Proxy = http.ProxyURL(u)
-	return
-}
-
-func httpBase(method, uri string, header map[string]string, body io.Reader) (resp *http.Response, err, neterr error) {
-	req, err := http.NewRequest(method, uri, body)
-	if err != nil {
-		return
-	}
-
-	req.Header.Set("User-Agent", GetUserAgent())
-
-	for k, v := range header {
-		req.Header.Set(k, v)
-	}
-
-	resp, neterr = Client.Do(req)
-	if neterr != nil {
-		if strings.Contains(neterr.Error(), "x509: certificate signed by unknown") {
-			fmt.Println(neterr)
-			os.Exit(10)
-		}
-		return
-	}
-	return
-}
-func Get(uri string, header map[string]string) (*http.Response, error, error) {
-	return httpBase("GET", uri, header, nil)
-}
-func PostForm(uri string, header map[string]string, val url.Values) (*http.Response, error, error) {
-	if header == nil {
-		header = make(map[string]string)
-	}
-	header["Content-Type"] = "application/x-www-form-urlencoded; charset=utf-8"
-	return httpBase("POST", uri, header, strings.NewReader(val.Encode()))
-}
-func reqJson(method, uri string, header map[string]string, data interface{}) (
-	*http.Response, error, error) {
-	encoded, err := json.Marshal(data)
-	if err != nil {
-		return nil, err, nil
-	}
-
-	if header == nil {
-		header = make(map[string]string)
-	}
-	header["Content-Type"] = "application/json"
-
-	return httpBase(method, uri, header, bytes.NewReader(encoded))
-}
-func PostJson(uri string, header map[string]string, data interface{}) (*http.Response, error, error) {
-	return reqJson("POST", uri, header, data)
-}
-func PutJson(uri string, header map[string]string, data interface{}) (*http.Response, error, error) {
-	return reqJson("PUT", uri, header, data)
-}
-func PostData(uri string, header map[string]string, data io.Reader) (*http.Response, error, error) {
-	if header == nil {
-		header = make(map[string]string)
-	}
-	return httpBase("POST", uri, header, data)
-}
-func GetBytes(uri string, header map[string]string) (code int, buff []byte, err, neterr error) {
-	resp, err, neterr := Get(uri, header)
-	if err != nil {
-		return
-	}
-	if neterr != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	buff, neterr = ioutil.ReadAll(resp.Body)
-	if neterr != nil {
-		return
-	}
-
-	code = resp.StatusCode
-
-	return
-}
+package httpbase
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/himananiito/livedl/buildno"
+	"github.com/himananiito/livedl/defines"
+)
+
+func GetUserAgent() string {
+	return fmt.Sprintf(
+		"livedl/%s (contact: twitter=%s, email=%s)",
+		buildno.GetBuildNo(),
+		defines.Twitter,
+		defines.Email,
+	)
+}
+
+var Client = &http.Client{
+	Timeout: time.Duration(5) * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) (err error) {
+		if req != nil && via != nil && len(via) > 0 {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			req.Header = via[0].Header
+		}
+		return nil
+	},
+}
+
+// Clientと同じ設定(proxy、ルート証明書など)でタイムアウトだけ違うClient
+// 大きいファイルのダウンロード用。timeoutが0なら無制限
+func NewClient(timeout time.Duration) *http.Client {
+	checkTransport()
+	return &http.Client{
+		Transport:     Client.Transport,
+		CheckRedirect: Client.CheckRedirect,
+		Jar:           Client.Jar,
+		Timeout:       timeout,
+	}
+}
+
+func checkTransport() bool {
+	if Client.Transport == nil {
+		Client.Transport = &http.Transport{}
+	}
+	return transport() != nil
+}
+
+// -capture, -replayで包んだもの
+type wrappedTransport interface {
+	unwrap() http.RoundTripper
+}
+
+// Client.Transportの中の*http.Transport
+func transport() *http.Transport {
+	rt := Client.Transport
+	for {
+		switch t := rt.(type) {
+		case *http.Transport:
+			return t
+		case wrappedTransport:
+			rt = t.unwrap()
+		default:
+			return nil
+		}
+	}
+}
+func checkTLSClientConfig() bool {
+	if !checkTransport() {
+		return false
+	}
+
+	if transport().TLSClientConfig == nil {
+		transport().TLSClientConfig = &tls.Config{}
+	}
+
+	return true
+}
+func SetRootCA(file string) (err error) {
+	if !checkTLSClientConfig() {
+		err = fmt.Errorf("SetRootCA: check failed")
+		return
+	}
+
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	// try decode pem
+	var nDecode int
+	for len(dat) > 0 {
+		block, d := pem.Decode(dat)
+		if block == nil {
+			break
+		}
+		dat = d
+		nDecode++
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+		addCert(block.Bytes)
+	}
+	if nDecode < 1 {
+		addCert(dat)
+	}
+
+	return
+}
+func addCert(dat []byte) (err error) {
+	certs, err := x509.ParseCertificates(dat)
+	if err != nil {
+		return
+	}
+	if certs == nil {
+		err = fmt.Errorf("ParseCertificates failed")
+		return
+	}
+
+	if len(certs) > 0 {
+		if transport().TLSClientConfig.RootCAs == nil {
+			transport().TLSClientConfig.RootCAs = x509.NewCertPool()
+		}
+	}
+
+	for _, cert := range certs {
+		transport().TLSClientConfig.RootCAs.AddCert(cert)
+	}
+	return
+}
+
+func SetSkipVerify(skip bool) (err error) {
+	if checkTLSClientConfig() {
+		transport().TLSClientConfig.InsecureSkipVerify = skip
+	} else {
+		err = fmt.Errorf("SetSkipVerify(%#v): check failed", skip)
+	}
+	return
+}
+
+// http以外のTLS接続(rtmpsなど)用の設定
+func GetTLSConfig() *tls.Config {
+	if checkTLSClientConfig() {
+		return transport().TLSClientConfig.Clone()
+	}
+	return &tls.Config{}
+}
+func httpBase(method, uri string, header map[string]string, body io.Reader) (resp *http.Response, err, neterr error) {
+	return httpRetry(nil, method, uri, header, body, false)
+}
+
+// pに従ってリトライする。pがnilならDefaultRetry
+// readAllならボディも読み、読めなければネットワークエラーとしてリトライする
+func httpRetry(p *RetryPolicy, method, uri string, header map[string]string, body io.Reader, readAll bool) (resp *http.Response, err, neterr error) {
+	// リトライ時に送り直すので読んでおく
+	var data []byte
+	if body != nil {
+		if data, err = ioutil.ReadAll(body); err != nil {
+			return
+		}
+	}
+	policy := getRetry(p).forMethod(method)
+	start := time.Now()
+
+	for n := 1; ; n++ {
+		var rdr io.Reader
+		if body != nil {
+			rdr = bytes.NewReader(data)
+		}
+		resp, err, neterr = httpOnce(method, uri, header, rdr)
+		if err != nil {
+			return
+		}
+		if neterr == nil && readAll {
+			buff, e := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if e != nil {
+				neterr = e
+			} else {
+				resp.Body = ioutil.NopCloser(bytes.NewReader(buff))
+			}
+		}
+
+		wait, retry := policy.next(n, start, resp, neterr)
+		if !retry {
+			if neterr != nil {
+				resp = nil
+			}
+			return
+		}
+		if neterr == nil {
+			resp.Body.Close()
+		}
+		time.Sleep(wait)
+	}
+}
+
+func httpOnce(method, uri string, header map[string]string, body io.Reader) (resp *http.Response, err, neterr error) {
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("User-Agent", GetUserAgent())
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, neterr = Client.Do(req)
+	if neterr != nil {
+		if strings.Contains(neterr.Error(), "x509: certificate signed by unknown") {
+			fmt.Println(neterr)
+			os.Exit(10)
+		}
+		return
+	}
+	return
+}
+func Get(uri string, header map[string]string) (*http.Response, error, error) {
+	return httpBase("GET", uri, header, nil)
+}
+func PostForm(uri string, header map[string]string, val url.Values) (*http.Response, error, error) {
+	return PostFormRetry(nil, uri, header, val)
+}
+
+// リトライの設定を指定する。pがnilならDefaultRetry
+func PostFormRetry(p *RetryPolicy, uri string, header map[string]string, val url.Values) (*http.Response, error, error) {
+	if header == nil {
+		header = make(map[string]string)
+	}
+	header["Content-Type"] = "application/x-www-form-urlencoded; charset=utf-8"
+	return httpRetry(p, "POST", uri, header, strings.NewReader(val.Encode()), false)
+}
+func reqJson(method, uri string, header map[string]string, data interface{}) (
+	*http.Response, error, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	if header == nil {
+		header = make(map[string]string)
+	}
+	header["Content-Type"] = "application/json"
+
+	return httpBase(method, uri, header, bytes.NewReader(encoded))
+}
+func PostJson(uri string, header map[string]string, data interface{}) (*http.Response, error, error) {
+	return reqJson("POST", uri, header, data)
+}
+func PutJson(uri string, header map[string]string, data interface{}) (*http.Response, error, error) {
+	return reqJson("PUT", uri, header, data)
+}
+func PostData(uri string, header map[string]string, data io.Reader) (*http.Response, error, error) {
+	if header == nil {
+		header = make(map[string]string)
+	}
+	return httpBase("POST", uri, header, data)
+}
+func GetBytes(uri string, header map[string]string) (code int, buff []byte, err, neterr error) {
+	return GetBytesRetry(nil, uri, header)
+}
+
+// リトライの設定を指定する。pがnilならDefaultRetry
+func GetBytesRetry(p *RetryPolicy, uri string, header map[string]string) (code int, buff []byte, err, neterr error) {
+	resp, err, neterr := httpRetry(p, "GET", uri, header, nil, true)
+	if err != nil {
+		return
+	}
+	if neterr != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	buff, neterr = ioutil.ReadAll(resp.Body)
+	if neterr != nil {
+		return
+	}
+
+	code = resp.StatusCode
+
+	return
+}
+func PostFormBytes(uri string, header map[string]string, val url.Values) (code int, buff []byte, err, neterr error) {
+	if header == nil {
+		header = make(map[string]string)
+	}
+	header["Content-Type"] = "application/x-www-form-urlencoded; charset=utf-8"
+	resp, err, neterr := httpRetry(nil, "POST", uri, header, strings.NewReader(val.Encode()), true)
+	if err != nil {
+		return
+	}
+	if neterr != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	buff, neterr = ioutil.ReadAll(resp.Body)
+	if neterr != nil {
+		return
+	}
+
+	code = resp.StatusCode
+
+	return
+}
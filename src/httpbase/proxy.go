@@ -0,0 +1,319 @@
+package httpbase
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyの設定。http, https, socks5(socks5h)で、ユーザー名とパスワードはURLに書く
+// サービスごとの設定はホスト名で選ぶ。HTTPのClientもwebsocketもRTMPもここを見る
+
+var proxyServices = []struct {
+	name    string
+	domains []string
+}{
+	{"nico", []string{"nicovideo.jp", "nimg.jp", "nicolive.jp", "nico", "smilevideo.jp", "dmc.nico"}},
+	{"tcas", []string{"twitcasting.tv", "twitcasting.net"}},
+	{"yt", []string{"youtube.com", "youtu.be", "googlevideo.com", "ytimg.com", "ggpht.com"}},
+}
+
+var proxyMtx sync.RWMutex
+var defaultProxy *url.URL
+var serviceProxy = map[string]*url.URL{} // nilなら直接接続
+
+func parseProxy(rawurl string) (u *url.URL, err error) {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "http://" + rawurl
+	}
+	if u, err = url.Parse(rawurl); err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		err = fmt.Errorf("proxy: unsupported scheme: %s", u.Scheme)
+		return
+	}
+	if u.Hostname() == "" {
+		err = fmt.Errorf("proxy: host not specified: %s", rawurl)
+	}
+	return
+}
+
+func setProxyFunc() error {
+	if !checkTransport() {
+		return fmt.Errorf("proxy: check failed")
+	}
+	transport().Proxy = func(req *http.Request) (*url.URL, error) {
+		return ProxyURL(req.URL.Hostname()), nil
+	}
+	return nil
+}
+
+func SetProxy(rawurl string) (err error) {
+	u, err := parseProxy(rawurl)
+	if err != nil {
+		return
+	}
+	proxyMtx.Lock()
+	defaultProxy = u
+	proxyMtx.Unlock()
+	return setProxyFunc()
+}
+
+// サービス(nico, tcas, yt)ごとのproxy。"direct"なら-http-proxyを使わない
+func SetServiceProxy(service, rawurl string) (err error) {
+	var found bool
+	for _, s := range proxyServices {
+		if s.name == service {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("proxy: unknown service: %s", service)
+	}
+	var u *url.URL
+	if !strings.EqualFold(rawurl, "direct") {
+		if u, err = parseProxy(rawurl); err != nil {
+			return
+		}
+	}
+	proxyMtx.Lock()
+	serviceProxy[service] = u
+	proxyMtx.Unlock()
+	return setProxyFunc()
+}
+
+// hostへの接続に使うproxy。nilなら直接接続
+func ProxyURL(host string) *url.URL {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	proxyMtx.RLock()
+	defer proxyMtx.RUnlock()
+	for _, s := range proxyServices {
+		for _, d := range s.domains {
+			if host == d || strings.HasSuffix(host, "."+d) {
+				if u, ok := serviceProxy[s.name]; ok {
+					return u
+				}
+			}
+		}
+	}
+	return defaultProxy
+}
+
+// TCPで接続する。proxyが設定されていればそれを通す(websocket, RTMP用)
+func Dial(network, addr string) (conn net.Conn, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	p := ProxyURL(host)
+	if p == nil {
+		return d.Dial(network, addr)
+	}
+	switch p.Scheme {
+	case "socks5", "socks5h":
+		return dialSocks5(d, p, addr)
+	default:
+		return dialConnect(d, p, addr)
+	}
+}
+
+func proxyAddr(p *url.URL) string {
+	if p.Port() != "" {
+		return p.Host
+	}
+	switch p.Scheme {
+	case "https":
+		return net.JoinHostPort(p.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(p.Hostname(), "1080")
+	}
+	return net.JoinHostPort(p.Hostname(), "80")
+}
+
+// 読み過ぎた分を先に返す
+type bufConn struct {
+	net.Conn
+	rdr *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.rdr.Read(b)
+}
+
+// HTTPのCONNECT
+func dialConnect(d *net.Dialer, p *url.URL, addr string) (conn net.Conn, err error) {
+	if conn, err = d.Dial("tcp", proxyAddr(p)); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}()
+	if p.Scheme == "https" {
+		conf := GetTLSConfig()
+		conf.ServerName = p.Hostname()
+		tc := tls.Client(conn, conf)
+		if err = tc.Handshake(); err != nil {
+			return
+		}
+		conn = tc
+	}
+
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		pass, _ := p.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("proxy: CONNECT %s: %s", addr, resp.Status)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		conn = &bufConn{Conn: conn, rdr: br}
+	}
+	return
+}
+
+// SOCKS5(RFC1928)、ユーザー名とパスワード(RFC1929)
+func dialSocks5(d *net.Dialer, p *url.URL, addr string) (conn net.Conn, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return
+	}
+	if conn, err = d.Dial("tcp", proxyAddr(p)); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+
+	methods := []byte{0x00}
+	if p.User != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err = conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return
+	}
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		return
+	}
+	if b[0] != 5 {
+		return nil, fmt.Errorf("socks5: unexpected version: %d", b[0])
+	}
+	switch b[1] {
+	case 0x00:
+	case 0x02:
+		if p.User == nil {
+			return nil, fmt.Errorf("socks5: authentication required")
+		}
+		user := p.User.Username()
+		pass, _ := p.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return nil, fmt.Errorf("socks5: username or password too long")
+		}
+		req := []byte{1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err = conn.Write(req); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return
+		}
+		if b[1] != 0 {
+			return nil, fmt.Errorf("socks5: authentication failed")
+		}
+	default:
+		return nil, fmt.Errorf("socks5: no acceptable authentication method")
+	}
+
+	// 名前解決はproxyで行う
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, 1), ip4...)
+		} else {
+			req = append(append(req, 4), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: host too long")
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return
+	}
+	if head[1] != 0 {
+		return nil, fmt.Errorf("socks5: connect %s: reply %d", addr, head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 1:
+		skip = 4
+	case 4:
+		skip = 16
+	case 3:
+		if _, err = io.ReadFull(conn, b[:1]); err != nil {
+			return
+		}
+		skip = int(b[0])
+	default:
+		return nil, fmt.Errorf("socks5: unknown address type: %d", head[3])
+	}
+	if _, err = io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
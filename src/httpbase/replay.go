@@ -0,0 +1,284 @@
+package httpbase
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// -replay: -captureで書き出したHARをローカルのサーバーから返す
+// HTTPとwebsocketのみ。RTMPと外部コマンド(ffmpeg, streamlink, youtube-dl)は対象外
+//
+// 同じURLは記録された順に返し、使い切ったら最後のものを返す
+// URLが一致しなければクエリを除いて比べる(タイムシフトのstartなど)
+
+type replayer struct {
+	mu       sync.Mutex
+	entries  []*harEntry
+	used     []bool
+	listener net.Listener
+}
+
+var replay *replayer
+
+func loadHar(file string) (entries []*harEntry, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	var har struct {
+		Log struct {
+			Entries []*harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err = json.Unmarshal(data, &har); err != nil {
+		// StopCaptureされずに終わったもの。1行に1つなので途中の行は捨てる
+		s := strings.TrimRight(string(data), " \t\r\n,")
+		if e := json.Unmarshal([]byte(s+"\n]}}"), &har); e != nil {
+			i := strings.LastIndex(s, ",\n")
+			if i < 0 {
+				return
+			}
+			if e := json.Unmarshal([]byte(s[:i]+"\n]}}"), &har); e != nil {
+				return
+			}
+		}
+		err = nil
+	}
+	entries = har.Log.Entries
+	for _, e := range entries {
+		e.started, _ = time.Parse(time.RFC3339Nano, e.StartedDateTime)
+	}
+	// 書き出しは終わった順なので始まった順に並べ直す
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].started.Before(entries[j].started) })
+	return
+}
+
+// -replay。以降のHTTPとwebsocketは全てfileの記録から返す
+func StartReplay(file string) (err error) {
+	if replay != nil {
+		return fmt.Errorf("replay: already started")
+	}
+	if !checkTransport() {
+		return fmt.Errorf("replay: check failed")
+	}
+	entries, err := loadHar(file)
+	if err != nil {
+		return
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	r := &replayer{
+		entries:  entries,
+		used:     make([]bool, len(entries)),
+		listener: l,
+	}
+	go http.Serve(l, r)
+
+	replay = r
+	Client.Transport = &replayTransport{
+		base: Client.Transport,
+		stub: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", l.Addr().String())
+			},
+			DisableCompression: true,
+		},
+	}
+	fmt.Printf("replay: %d entries from %s\n", len(entries), file)
+	return
+}
+
+// 全てのリクエストをローカルのサーバーに送る。元のschemeはX-Forwarded-Protoで伝える
+type replayTransport struct {
+	base http.RoundTripper
+	stub *http.Transport
+}
+
+func (t *replayTransport) unwrap() http.RoundTripper {
+	return t.base
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.Header.Set("X-Forwarded-Proto", req.URL.Scheme)
+	r.URL.Scheme = "http"
+	return t.stub.RoundTrip(r)
+}
+
+func stripQuery(u string) string {
+	if i := strings.Index(u, "?"); i >= 0 {
+		return u[:i]
+	}
+	return u
+}
+
+func (r *replayer) find(method, u string) *harEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	match := []func(e *harEntry) bool{
+		func(e *harEntry) bool { return e.Request.URL == u },
+		func(e *harEntry) bool { return stripQuery(e.Request.URL) == stripQuery(u) },
+	}
+	for _, f := range match {
+		for i, e := range r.entries {
+			if !r.used[i] && e.Request.Method == method && f(e) {
+				r.used[i] = true
+				return e
+			}
+		}
+	}
+	for _, f := range match {
+		for i := len(r.entries) - 1; i >= 0; i-- {
+			if e := r.entries[i]; e.Request.Method == method && f(e) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (r *replayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	proto := req.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+	}
+	u := redact(proto + "://" + req.Host + req.URL.RequestURI())
+	e := r.find(req.Method, u)
+	if e == nil {
+		fmt.Printf("replay: not captured: %s %s\n", req.Method, u)
+		http.Error(w, "replay: not captured", 404)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(req) {
+		r.serveWebsocket(w, req, e)
+		return
+	}
+
+	if e.Error != "" {
+		// ネットワークエラーは接続を切る
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		http.Error(w, e.Error, 502)
+		return
+	}
+
+	for _, h := range e.Response.Headers {
+		switch strings.ToLower(h.Name) {
+		case "content-length", "transfer-encoding", "connection":
+		default:
+			w.Header().Add(h.Name, h.Value)
+		}
+	}
+	body := []byte(e.Response.Content.Text)
+	if e.Response.Content.Encoding == "base64" {
+		body, _ = base64.StdEncoding.DecodeString(e.Response.Content.Text)
+	}
+	w.WriteHeader(e.Response.Status)
+	w.Write(body)
+}
+
+// 受信したメッセージは記録と同じ間隔で送る
+// 送信したメッセージの位置ではクライアントから同じ数を受け取るまで待つ
+func (r *replayer) serveWebsocket(w http.ResponseWriter, req *http.Request, e *harEntry) {
+	up := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	for _, h := range e.Response.Headers {
+		if strings.EqualFold(h.Name, "Sec-WebSocket-Protocol") {
+			up.Subprotocols = append(up.Subprotocols, h.Value)
+		}
+	}
+	conn, err := up.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var mtx sync.Mutex
+	var received int
+	chRecv := make(chan struct{}, 1)
+	chClosed := make(chan struct{})
+	go func() {
+		defer close(chClosed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			mtx.Lock()
+			received++
+			mtx.Unlock()
+			select {
+			case chRecv <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	waitRecv := func(n int) bool {
+		timeout := time.After(10 * time.Second)
+		for {
+			mtx.Lock()
+			ok := received >= n
+			mtx.Unlock()
+			if ok {
+				return true
+			}
+			select {
+			case <-chRecv:
+			case <-timeout:
+				return true
+			case <-chClosed:
+				return false
+			}
+		}
+	}
+
+	start := time.Now()
+	t0 := float64(e.started.UnixNano())/1e9 + e.Timings.Wait/1000
+	var sent int
+	for _, m := range e.WsMessages {
+		if m.Type == "send" {
+			sent++
+			if !waitRecv(sent) {
+				return
+			}
+			continue
+		}
+		if d := start.Add(time.Duration((m.Time - t0) * float64(time.Second))).Sub(time.Now()); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-chClosed:
+				return
+			}
+		}
+		data := []byte(m.Data)
+		if m.Opcode != websocket.TextMessage {
+			data, _ = base64.StdEncoding.DecodeString(m.Data)
+		}
+		if err := conn.WriteMessage(m.Opcode, data); err != nil {
+			return
+		}
+	}
+	if e.Closed == "server" {
+		return
+	}
+	<-chClosed
+}
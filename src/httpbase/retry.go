@@ -0,0 +1,178 @@
+package httpbase
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// リトライの設定
+type RetryPolicy struct {
+	MaxRetry       int           // 0ならリトライしない
+	MinWait        time.Duration // 初回の待ち時間。以降は倍にする
+	MaxWait        time.Duration // 待ち時間の上限
+	Jitter         float64       // 待ち時間を±Jitterの割合でずらす(0〜1)
+	Deadline       time.Duration // 最初のリクエストからの期限。0なら無制限
+	RetryNetErr    bool          // ネットワークエラー(GETなど冪等なメソッドのみ)
+	RetryNetErrAll bool          // POSTなどでもネットワークエラーをリトライする(送り直しても問題ない場合)
+	Retry5xx       bool          // 500〜599
+	RetryCodes     []int         // その他にリトライするステータスコード(408, 429など)
+}
+
+var retryMtx sync.RWMutex
+
+// Get, PostForm, GetBytesなどで使う
+var DefaultRetry = RetryPolicy{
+	MaxRetry:    3,
+	MinWait:     time.Second,
+	MaxWait:     30 * time.Second,
+	Jitter:      0.2,
+	Deadline:    2 * time.Minute,
+	RetryNetErr: true,
+	Retry5xx:    true,
+	RetryCodes:  []int{408, 429},
+}
+
+// ライブのプレイリストやセグメント用
+// 遅れると追いつけなくなるので、ネットワークエラーのみ短い期限で繰り返す
+// 403や5xxは呼び出し元で判断する(再接続、画質を下げるなど)
+var LiveRetry = RetryPolicy{
+	MaxRetry:    3,
+	MinWait:     500 * time.Millisecond,
+	MaxWait:     2 * time.Second,
+	Jitter:      0.2,
+	Deadline:    10 * time.Second,
+	RetryNetErr: true,
+}
+
+var NoRetry = RetryPolicy{}
+
+// オプションからDefaultRetryとLiveRetryを設定する
+// maxRetry, deadlineが負、minWait, maxWaitが0以下なら変えない。deadlineが0なら無制限
+func SetRetry(maxRetry int, minWait, maxWait, deadline time.Duration) {
+	retryMtx.Lock()
+	defer retryMtx.Unlock()
+
+	if maxRetry >= 0 {
+		DefaultRetry.MaxRetry = maxRetry
+		LiveRetry.MaxRetry = maxRetry
+	}
+	if minWait > 0 {
+		DefaultRetry.MinWait = minWait
+	}
+	if maxWait > 0 {
+		DefaultRetry.MaxWait = maxWait
+	}
+	if deadline >= 0 {
+		DefaultRetry.Deadline = deadline
+		if deadline > 0 && deadline < LiveRetry.Deadline {
+			LiveRetry.Deadline = deadline
+		}
+	}
+}
+
+// DefaultRetryのコピー。変えてhttpRetryなどに渡す
+func GetDefaultRetry() RetryPolicy {
+	return getRetry(nil)
+}
+
+func getRetry(p *RetryPolicy) RetryPolicy {
+	retryMtx.RLock()
+	defer retryMtx.RUnlock()
+	if p == nil {
+		return DefaultRetry
+	}
+	return *p
+}
+
+// POSTは処理されたかもしれないので、5xxは503(処理されていない)のみにする
+// ネットワークエラーもRetryNetErrAllでなければリトライしない
+func (p RetryPolicy) forMethod(method string) RetryPolicy {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return p
+	}
+	if !p.RetryNetErrAll {
+		p.RetryNetErr = false
+	}
+	if p.Retry5xx {
+		p.Retry5xx = false
+		p.RetryCodes = append(append([]int{}, p.RetryCodes...), 503)
+	}
+	return p
+}
+
+func (p RetryPolicy) retryStatus(code int) bool {
+	if p.Retry5xx && 500 <= code && code <= 599 {
+		return true
+	}
+	for _, c := range p.RetryCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// n回目(1〜)のリトライまでの待ち時間
+func (p RetryPolicy) backoff(n int) time.Duration {
+	wait := float64(p.MinWait) * math.Pow(2, float64(n-1))
+	if p.MaxWait > 0 && wait > float64(p.MaxWait) {
+		wait = float64(p.MaxWait)
+	}
+	if p.Jitter > 0 {
+		wait *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(wait)
+}
+
+// Retry-After(秒数またはHTTP-date)
+func retryAfter(resp *http.Response) (d time.Duration, ok bool) {
+	s := resp.Header.Get("Retry-After")
+	if s == "" {
+		return
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d = time.Until(t); d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return
+}
+
+// 次を試すならその待ち時間を返す
+func (p RetryPolicy) next(n int, start time.Time, resp *http.Response, neterr error) (wait time.Duration, retry bool) {
+	if n > p.MaxRetry {
+		return
+	}
+	if neterr != nil {
+		if !p.RetryNetErr {
+			return
+		}
+	} else if resp == nil || !p.retryStatus(resp.StatusCode) {
+		return
+	}
+
+	wait = p.backoff(n)
+	if resp != nil {
+		if d, ok := retryAfter(resp); ok {
+			wait = d
+			// 期限が無い場合は長すぎるRetry-Afterで止まらないようにする
+			if p.Deadline == 0 && p.MaxWait > 0 && wait > p.MaxWait {
+				wait = p.MaxWait
+			}
+		}
+	}
+	if p.Deadline > 0 && time.Since(start)+wait > p.Deadline {
+		return
+	}
+	retry = true
+	return
+}
@@ -0,0 +1,52 @@
+package httpbase
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryNetErrMethod(t *testing.T) {
+	neterr := errors.New("connection reset")
+	p := RetryPolicy{MaxRetry: 3, MinWait: time.Millisecond, RetryNetErr: true}
+
+	for _, tc := range []struct {
+		method string
+		all    bool
+		retry  bool
+	}{
+		{"GET", false, true},
+		{"PUT", false, true},
+		{"POST", false, false},
+		{"PATCH", false, false},
+		{"POST", true, true},
+	} {
+		p.RetryNetErrAll = tc.all
+		if _, retry := p.forMethod(tc.method).next(1, time.Now(), nil, neterr); retry != tc.retry {
+			t.Errorf("%s all=%v: retry %v", tc.method, tc.all, retry)
+		}
+	}
+}
+
+func TestRetryAfterCap(t *testing.T) {
+	resp := &http.Response{StatusCode: 503, Header: http.Header{"Retry-After": {"3600"}}}
+	p := RetryPolicy{MaxRetry: 3, MinWait: time.Second, MaxWait: 30 * time.Second, Retry5xx: true}
+
+	// 期限が無ければMaxWaitまで
+	if wait, retry := p.next(1, time.Now(), resp, nil); !retry || wait != p.MaxWait {
+		t.Errorf("no deadline: %v %v", wait, retry)
+	}
+
+	// 期限があって間に合わなければリトライしない
+	p.Deadline = time.Minute
+	if _, retry := p.next(1, time.Now(), resp, nil); retry {
+		t.Errorf("deadline: retry")
+	}
+
+	// 期限内ならRetry-Afterに従う
+	resp.Header.Set("Retry-After", "5")
+	if wait, retry := p.next(1, time.Now(), resp, nil); !retry || wait != 5*time.Second {
+		t.Errorf("within deadline: %v %v", wait, retry)
+	}
+}
@@ -0,0 +1,103 @@
+package httpbase
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocket用。Cookie(Jar)、TLS、proxyの設定をhttpと共有する
+func NewDialer() *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDial:          Dial,
+		HandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:  GetTLSConfig(),
+		Jar:              Jar,
+	}
+}
+
+// websocketで接続する。-capture, -replayの時はここで記録、再生する
+func DialWebsocket(rawurl string, header http.Header) (conn *websocket.Conn, resp *http.Response, err error) {
+	if capt == nil && replay == nil {
+		return NewDialer().Dial(rawurl, header)
+	}
+
+	// フレームを見るためにTLSはこちらで行い、gorillaにはws://で渡す
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+	secure := u.Scheme == "wss" || u.Scheme == "https"
+	port := u.Port()
+	if port == "" {
+		if secure {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	h := http.Header{}
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Set("Host", u.Host)
+	// Jarは元のURL(wss)で選ぶ
+	var cookies []string
+	for _, c := range Jar.Cookies(u) {
+		cookies = append(cookies, c.Name+"="+c.Value)
+	}
+	if len(cookies) > 0 {
+		h.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	pu := *u
+	pu.Scheme = "ws"
+	pu.Host = net.JoinHostPort(u.Hostname(), port)
+
+	d := &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	var e *harEntry
+	if replay != nil {
+		h.Set("X-Forwarded-Proto", u.Scheme)
+		d.NetDial = func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, replay.listener.Addr().String())
+		}
+	}
+	if capt != nil {
+		e = capt.newWsEntry(rawurl, h)
+		next := d.NetDial
+		if next == nil {
+			next = func(network, addr string) (c net.Conn, err error) {
+				if c, err = Dial(network, addr); err != nil || !secure {
+					return
+				}
+				conf := GetTLSConfig()
+				if conf.ServerName == "" {
+					conf.ServerName = u.Hostname()
+				}
+				tc := tls.Client(c, conf)
+				if err = tc.Handshake(); err != nil {
+					c.Close()
+					return nil, err
+				}
+				return tc, nil
+			}
+		}
+		d.NetDial = func(network, addr string) (net.Conn, error) {
+			c, err := next(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return capt.wrapWs(c, e), nil
+		}
+	}
+
+	conn, resp, err = d.Dial(pu.String(), h)
+	if e != nil {
+		capt.wsDialed(e, resp, err)
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package httpsub
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/himananiito/livedl/files"
+	"github.com/himananiito/livedl/httpbase"
+	"github.com/himananiito/livedl/outname"
+)
+
+// -http-getでURLのファイルをダウンロードする
+
+type DownloadOpt struct {
+	Url       string
+	Output    string   // 空ならURLのファイル名
+	Conns     int      // 同時接続数
+	Header    []string // "Name: value"
+	Cookie    string   // "name=value; name2=value2"
+	Interrupt <-chan struct{}
+	Stdout    io.Writer // nilなら標準出力
+}
+
+func outputName(opt DownloadOpt) (fileName string, err error) {
+	fileName = opt.Output
+	if fileName == "" {
+		if u, e := url.Parse(opt.Url); e == nil {
+			fileName, _ = url.PathUnescape(path.Base(u.Path))
+		}
+		fileName = files.ReplaceForbidden(fileName)
+		if fileName == "" || fileName == "." || fileName == "_" {
+			fileName = "download"
+		}
+	}
+	if !filepath.IsAbs(fileName) && outname.GetRootDir() != "" {
+		fileName = filepath.Join(outname.GetRootDir(), fileName)
+	}
+
+	// 途中のものがあれば続きから、無ければ既存のファイルは上書きしない
+	if _, e := os.Stat(fileName + ".part.json"); e == nil {
+		return
+	}
+	if _, e := os.Stat(fileName); e == nil {
+		return files.GetFileNameNext(fileName)
+	}
+	return
+}
+
+func Download(opt DownloadOpt) (fileName string, err error) {
+	if fileName, err = outputName(opt); err != nil {
+		return
+	}
+	if err = files.MkdirByFileName(fileName); err != nil {
+		return
+	}
+
+	sub := Get(opt.Url, fileName)
+	sub.Concurrent(opt.Conns)
+	sub.Client = httpbase.NewClient(0)
+	sub.Header = map[string]string{
+		"User-Agent": httpbase.GetUserAgent(),
+	}
+	for _, h := range opt.Header {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("invalid header: %s", h)
+			return
+		}
+		sub.Header[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if opt.Cookie != "" {
+		sub.Header["Cookie"] = opt.Cookie
+	}
+
+	stdout := opt.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	var last time.Time
+	sub.Progress = func(done, total int64) {
+		if now := time.Now(); now.Sub(last) >= time.Second || done == total {
+			last = now
+			if total > 0 {
+				fmt.Fprintf(stdout, "Downloading %s: %d/%d (%.1f%%)\n", fileName, done, total, float64(done)*100/float64(total))
+			} else {
+				fmt.Fprintf(stdout, "Downloading %s: %d\n", fileName, done)
+			}
+		}
+	}
+
+	fin := make(chan struct{})
+	defer close(fin)
+	go func() {
+		select {
+		case <-opt.Interrupt:
+			sub.Cancel()
+		case <-fin:
+		}
+	}()
+
+	fmt.Fprintf(stdout, "HTTP: %s -> %s\n", opt.Url, fileName)
+	if err = sub.Wait(); err == ErrCancelled {
+		fmt.Fprintf(stdout, "interrupted: %s (rerun to resume)\n", fileName)
+	}
+	return
+}
@@ -1,136 +1,516 @@
-
-package httpsub
-
-import (
-	"net/http"
-	"os"
-	"sync"
-	"log"
-	"io"
-	"fmt"
-	"bytes"
-)
-
-type SubDownloader struct {
-	method string
-	uri string
-	data []byte
-	Header map[string]string
-	RangeSize int64
-	BuffSize int64
-	fileName string
-	file *os.File
-	numConcurrent int
-	chRunning chan bool
-	mtx sync.Mutex
-	wg sync.WaitGroup
-	chLength chan int64
-}
-func (sub *SubDownloader) Concurrent(c int) {
-	sub.numConcurrent = c
-}
-func Get(uri, fileName string) (sub *SubDownloader) {
-	sub = &SubDownloader{
-		method: "GET",
-		uri: uri,
-		fileName: fileName,
-	}
-	return
-}
-func (sub *SubDownloader) Close() {
-	sub.mtx.Lock()
-	defer sub.mtx.Unlock()
-	if sub.file != nil {
-		sub.file.Close()
-		sub.file = nil
-	}
-}
-func (sub *SubDownloader) open() {
-	f, err := os.Create(sub.fileName)
-	if err != nil {
-		log.Fatal(err)
-	}
-	sub.file = f
-}
-func (sub *SubDownloader) write(pos int64, rdr io.Reader) (err error) {
-	sub.mtx.Lock()
-	defer sub.mtx.Unlock()
-	//fmt.Printf("write %d\n", pos)
-	if sub.file == nil {
-		sub.open()
-	}
-	if _, err = sub.file.Seek(pos, 0); err != nil {
-		log.Fatalln(err)
-	}
-	if _, err = io.Copy(sub.file, rdr); err != nil {
-		log.Fatalln(err)
-	}
-	return
-}
-func (sub *SubDownloader) subrange(pos int64) {
-	//fmt.Printf("start subrange pos(%d), size(%d) \n", pos, sub.RangeSize)
-	sub.wg.Add(1)
-	sub.chRunning <- true
-	go func() {
-		defer func() {
-			<-sub.chRunning
-			sub.wg.Done()
-		}()
-		data := bytes.NewBuffer(sub.data)
-		req, _ := http.NewRequest(sub.method, sub.uri, data)
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", pos, pos + sub.RangeSize - 1))
-
-		client := new(http.Client)
-		resp, err := client.Do(req)
-		if err != nil {
-			return
-		}
-		defer resp.Body.Close()
-
-		switch resp.StatusCode {
-		case 206:
-		default:
-			log.Fatalf("StatusCode is %v\n", resp.StatusCode)
-		}
-		sub.chLength <- resp.ContentLength
-
-		buff := new(bytes.Buffer)
-		wbytes := int64(0)
-		for {
-			n, _ := io.CopyN(buff, resp.Body, sub.BuffSize)
-			//fmt.Printf("buff size is %d\n", buff.Len())
-			if n > 0 {
-				sub.write(pos + wbytes, buff)
-				wbytes += n
-			} else {
-				return
-			}
-		}
-	}()
-}
-func (sub *SubDownloader) Wait() {
-	sub.chRunning = make(chan bool, sub.numConcurrent)
-	sub.chLength = make(chan int64, 10)
-
-	if sub.RangeSize <= 0 {
-		sub.RangeSize = 10*1000*1000
-	}
-
-	if sub.BuffSize <= 0 {
-		sub.BuffSize = 3*1000*1000
-	}
-
-	pos := int64(0)
-	for {
-		sub.subrange(pos)
-		length := <-sub.chLength
-		fmt.Printf("Downloading %v: %v-%v\n", sub.fileName, pos, pos + length - 1)
-		if length == sub.RangeSize {
-			pos += length
-		} else {
-			break
-		}
-	}
-	sub.wg.Wait()
-	sub.Close()
-}
+package httpsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type SubDownloader struct {
+	method        string
+	uri           string
+	data          []byte
+	Header        map[string]string
+	RangeSize     int64
+	BuffSize      int64
+	fileName      string
+	file          *os.File
+	numConcurrent int
+	mtx           sync.Mutex
+
+	// nilならhttp.Client{}
+	Client *http.Client
+	// 失敗した範囲のリトライ回数と初回の待ち時間(以降は倍にする)
+	MaxRetry  int
+	RetryWait time.Duration
+	// 進捗。totalが分からない場合は-1
+	Progress func(done, total int64)
+
+	state     partState
+	done      int64
+	total     int64
+	chCancel  chan struct{}
+	cancelled bool
+}
+
+// 再開用に.part.jsonに保存する内容
+type partState struct {
+	Uri          string
+	Size         int64
+	RangeSize    int64
+	ETag         string  `json:",omitempty"`
+	LastModified string  `json:",omitempty"`
+	Done         []int64 // 完了した範囲の番号
+}
+
+func (sub *SubDownloader) Concurrent(c int) {
+	sub.numConcurrent = c
+}
+func Get(uri, fileName string) (sub *SubDownloader) {
+	sub = &SubDownloader{
+		method:   "GET",
+		uri:      uri,
+		fileName: fileName,
+		chCancel: make(chan struct{}),
+	}
+	return
+}
+func (sub *SubDownloader) Close() {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+	if sub.file != nil {
+		sub.file.Close()
+		sub.file = nil
+	}
+}
+
+// 中断する。完了した範囲は.part.jsonに残るので再開できる
+func (sub *SubDownloader) Cancel() {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+	if !sub.cancelled {
+		sub.cancelled = true
+		close(sub.chCancel)
+	}
+}
+
+func (sub *SubDownloader) stateName() string {
+	return sub.fileName + ".part.json"
+}
+func (sub *SubDownloader) loadState() (st partState, ok bool) {
+	dat, err := ioutil.ReadFile(sub.stateName())
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(dat, &st); err != nil {
+		return
+	}
+	if _, err = os.Stat(sub.fileName); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// mtxを取ってから呼ぶ
+func (sub *SubDownloader) saveState() (err error) {
+	sort.Slice(sub.state.Done, func(i, j int) bool { return sub.state.Done[i] < sub.state.Done[j] })
+	dat, err := json.Marshal(sub.state)
+	if err != nil {
+		return
+	}
+	tmp := sub.stateName() + ".tmp"
+	if err = ioutil.WriteFile(tmp, dat, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, sub.stateName())
+}
+
+func (sub *SubDownloader) progress(n int64) {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+	sub.done += n
+	if sub.Progress != nil {
+		sub.Progress(sub.done, sub.total)
+	}
+}
+
+func (sub *SubDownloader) request(header map[string]string) (resp *http.Response, err error) {
+	req, err := http.NewRequest(sub.method, sub.uri, bytes.NewReader(sub.data))
+	if err != nil {
+		return
+	}
+	for k, v := range sub.Header {
+		req.Header.Set(k, v)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	client := sub.Client
+	if client == nil {
+		client = new(http.Client)
+	}
+	return client.Do(req)
+}
+
+// Cancelされたらtrue
+func (sub *SubDownloader) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return false
+	case <-sub.chCancel:
+		return true
+	}
+}
+
+var ErrCancelled = fmt.Errorf("httpsub: cancelled")
+
+// bodyをposから書く。書いたバイト数を返す
+func (sub *SubDownloader) copyAt(pos int64, body io.Reader) (wbytes int64, err error) {
+	buff := make([]byte, sub.BuffSize)
+	for {
+		select {
+		case <-sub.chCancel:
+			err = ErrCancelled
+			return
+		default:
+		}
+		n, e := io.ReadFull(body, buff)
+		if n > 0 {
+			if _, err = sub.file.WriteAt(buff[:n], pos+wbytes); err != nil {
+				return
+			}
+			wbytes += int64(n)
+			sub.progress(int64(n))
+		}
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			return
+		}
+		if e != nil {
+			err = e
+			return
+		}
+	}
+}
+
+var reContentRange = regexp.MustCompile(`^bytes\s+(\d+)-(\d+)/(\d+|\*)`)
+
+// 1つの範囲を取る。途中で切れたら続きから取り直す
+func (sub *SubDownloader) subrange(index int64) (err error) {
+	start := index * sub.RangeSize
+	end := start + sub.RangeSize - 1
+	if end >= sub.state.Size {
+		end = sub.state.Size - 1
+	}
+	pos := start
+	wait := sub.RetryWait
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			if retry > sub.MaxRetry {
+				return fmt.Errorf("httpsub: range %d-%d: %v", start, end, err)
+			}
+			if sub.sleep(wait) {
+				return ErrCancelled
+			}
+			wait *= 2
+		}
+
+		var resp *http.Response
+		resp, err = sub.request(map[string]string{
+			"Range": fmt.Sprintf("bytes=%d-%d", pos, end),
+		})
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != 206 {
+			resp.Body.Close()
+			err = fmt.Errorf("StatusCode is %v", resp.StatusCode)
+			if !retryStatus(resp.StatusCode) {
+				// リトライしても同じ
+				return fmt.Errorf("httpsub: range %d-%d: %v", start, end, err)
+			}
+			continue
+		}
+		if ma := reContentRange.FindStringSubmatch(resp.Header.Get("Content-Range")); ma == nil || ma[1] != strconv.FormatInt(pos, 10) {
+			resp.Body.Close()
+			err = fmt.Errorf("unexpected Content-Range: %q", resp.Header.Get("Content-Range"))
+			continue
+		}
+
+		var n int64
+		n, err = sub.copyAt(pos, io.LimitReader(resp.Body, end-pos+1))
+		resp.Body.Close()
+		pos += n
+		if err == ErrCancelled {
+			return
+		}
+		if pos > end {
+			break
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			// 進んでいるならリトライ回数を戻す
+			retry = 0
+			wait = sub.RetryWait
+		}
+	}
+
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+	sub.state.Done = append(sub.state.Done, index)
+	return sub.saveState()
+}
+
+// リトライすれば成功するかもしれないステータス
+func retryStatus(code int) bool {
+	return code >= 500 || code == 408 || code == 429
+}
+
+// Rangeに対応していないサーバー用。再開はできないので最初から取り直す
+// respがnilならリクエストから
+func (sub *SubDownloader) single(resp *http.Response) (err error) {
+	wait := sub.RetryWait
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			if retry > sub.MaxRetry {
+				return
+			}
+			if sub.sleep(wait) {
+				return ErrCancelled
+			}
+			wait *= 2
+			resp = nil
+		}
+		if resp == nil {
+			if resp, err = sub.request(nil); err != nil {
+				continue
+			}
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			err = fmt.Errorf("httpsub: StatusCode is %v", resp.StatusCode)
+			if !retryStatus(resp.StatusCode) {
+				return
+			}
+			continue
+		}
+		sub.mtx.Lock()
+		sub.done = 0
+		sub.total = resp.ContentLength
+		sub.mtx.Unlock()
+		if err = sub.file.Truncate(0); err != nil {
+			resp.Body.Close()
+			return
+		}
+
+		var n int64
+		n, err = sub.copyAt(0, resp.Body)
+		resp.Body.Close()
+		if err == ErrCancelled {
+			return
+		}
+		if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+			err = fmt.Errorf("httpsub: size mismatch: %d != %d", n, resp.ContentLength)
+		}
+		if err == nil {
+			return
+		}
+	}
+}
+
+func (sub *SubDownloader) openFile(truncate bool) (err error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if truncate {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(sub.fileName, flag, 0644)
+	if err != nil {
+		return
+	}
+	sub.mtx.Lock()
+	sub.file = f
+	sub.mtx.Unlock()
+	return
+}
+
+// サイズとRangeに対応しているかを調べる
+func (sub *SubDownloader) probe() (resp *http.Response, err error) {
+	wait := sub.RetryWait
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			if retry > sub.MaxRetry {
+				return
+			}
+			if sub.sleep(wait) {
+				return nil, ErrCancelled
+			}
+			wait *= 2
+		}
+		resp, err = sub.request(map[string]string{"Range": "bytes=0-0"})
+		if err != nil {
+			continue
+		}
+		switch {
+		case resp.StatusCode == 200 || resp.StatusCode == 206:
+			return
+		case retryStatus(resp.StatusCode):
+			resp.Body.Close()
+			err = fmt.Errorf("httpsub: StatusCode is %v", resp.StatusCode)
+		default:
+			resp.Body.Close()
+			err = fmt.Errorf("httpsub: StatusCode is %v", resp.StatusCode)
+			return nil, err
+		}
+	}
+}
+
+// ダウンロードが終わるまで待つ
+func (sub *SubDownloader) Wait() (err error) {
+	if sub.numConcurrent <= 0 {
+		sub.numConcurrent = 1
+	}
+	if sub.RangeSize <= 0 {
+		sub.RangeSize = 10 * 1000 * 1000
+	}
+	if sub.BuffSize <= 0 {
+		sub.BuffSize = 3 * 1000 * 1000
+	}
+	if sub.BuffSize > sub.RangeSize {
+		sub.BuffSize = sub.RangeSize
+	}
+	if sub.RetryWait <= 0 {
+		sub.RetryWait = time.Second
+	}
+	if sub.MaxRetry <= 0 {
+		sub.MaxRetry = 5
+	}
+	defer sub.Close()
+
+	resp, err := sub.probe()
+	if err != nil {
+		return
+	}
+
+	var size int64 = -1
+	if resp.StatusCode == 206 {
+		if ma := reContentRange.FindStringSubmatch(resp.Header.Get("Content-Range")); ma != nil && ma[3] != "*" {
+			size, _ = strconv.ParseInt(ma[3], 10, 64)
+		}
+	}
+	if size < 0 {
+		// Rangeが使えない。206なら全体を取り直す
+		if resp.StatusCode == 206 {
+			resp.Body.Close()
+			resp = nil
+		}
+		os.Remove(sub.stateName())
+		if err = sub.openFile(true); err != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return
+		}
+		return sub.single(resp)
+	}
+	resp.Body.Close()
+
+	st := partState{
+		Uri:          sub.uri,
+		Size:         size,
+		RangeSize:    sub.RangeSize,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	done := make(map[int64]bool)
+	if old, ok := sub.loadState(); ok && old.Size == st.Size && old.RangeSize > 0 &&
+		old.ETag == st.ETag && old.LastModified == st.LastModified {
+		// 再開する。URLはトークンなどで変わることがあるので見ない
+		sub.RangeSize = old.RangeSize
+		st.RangeSize = old.RangeSize
+		st.Done = old.Done
+		for _, i := range old.Done {
+			done[i] = true
+		}
+	}
+	sub.state = st
+	if err = sub.openFile(len(done) == 0); err != nil {
+		return
+	}
+	if err = sub.file.Truncate(size); err != nil {
+		return
+	}
+	sub.mtx.Lock()
+	err = sub.saveState()
+	sub.mtx.Unlock()
+	if err != nil {
+		return
+	}
+
+	count := (size + sub.RangeSize - 1) / sub.RangeSize
+	sub.total = size
+	for i := int64(0); i < count; i++ {
+		if done[i] {
+			sub.done += sub.rangeBytes(i)
+		}
+	}
+	sub.progress(0)
+
+	chIndex := make(chan int64)
+	chErr := make(chan error, count+1)
+	var wg sync.WaitGroup
+	for w := 0; w < sub.numConcurrent; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range chIndex {
+				if e := sub.subrange(i); e != nil {
+					chErr <- e
+				}
+			}
+		}()
+	}
+	func() {
+		defer close(chIndex)
+		for i := int64(0); i < count; i++ {
+			if done[i] {
+				continue
+			}
+			select {
+			case chIndex <- i:
+			case <-sub.chCancel:
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	select {
+	case err = <-chErr:
+		return
+	default:
+	}
+	select {
+	case <-sub.chCancel:
+		return ErrCancelled
+	default:
+	}
+
+	// 書き込めた範囲(.part.json)の合計がサイズと一致すること
+	st, ok := sub.loadState()
+	if !ok {
+		return fmt.Errorf("httpsub: %s not saved", sub.stateName())
+	}
+	var written int64
+	seen := make(map[int64]bool)
+	for _, i := range st.Done {
+		if i >= 0 && i < count && !seen[i] {
+			seen[i] = true
+			written += sub.rangeBytes(i)
+		}
+	}
+	if written != size {
+		return fmt.Errorf("httpsub: size mismatch: %d != %d", written, size)
+	}
+	os.Remove(sub.stateName())
+	return
+}
+
+// i番目の範囲のバイト数
+func (sub *SubDownloader) rangeBytes(i int64) int64 {
+	end := (i + 1) * sub.RangeSize
+	if end > sub.state.Size {
+		end = sub.state.Size
+	}
+	return end - i*sub.RangeSize
+}
@@ -0,0 +1,209 @@
+package httpsub
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testData = func() []byte {
+	b := make([]byte, 1000)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}()
+
+var reRange = regexp.MustCompile(`^bytes=(\d+)-(\d+)$`)
+
+// Rangeの開始位置。Rangeが無ければ-1
+func rangeStart(r *http.Request) int64 {
+	ma := reRange.FindStringSubmatch(r.Header.Get("Range"))
+	if ma == nil {
+		return -1
+	}
+	n, _ := strconv.ParseInt(ma[1], 10, 64)
+	return n
+}
+
+func serveData(w http.ResponseWriter, r *http.Request) {
+	http.ServeContent(w, r, "data", time.Unix(1500000000, 0), bytes.NewReader(testData))
+}
+
+func download(t *testing.T, uri, name string) error {
+	t.Helper()
+	sub := Get(uri, name)
+	sub.Concurrent(1)
+	sub.RangeSize = 100
+	sub.RetryWait = time.Millisecond
+	return sub.Wait()
+}
+
+func checkFile(t *testing.T, name string) {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, testData) {
+		t.Errorf("content mismatch: %d bytes", len(b))
+	}
+	if _, err := os.Stat(name + ".part.json"); err == nil {
+		t.Errorf(".part.json not removed")
+	}
+}
+
+// 途中で切れた範囲は続きから、5xxはリトライして取る
+func TestSubrangeRetry(t *testing.T) {
+	var mtx sync.Mutex
+	var n int
+	var starts []int64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pos := rangeStart(r)
+		mtx.Lock()
+		n++
+		cnt := n
+		starts = append(starts, pos)
+		mtx.Unlock()
+
+		switch cnt {
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			// 半分だけ返して切る
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", pos, pos+99, len(testData)))
+			w.Header().Set("Content-Length", "100")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(testData[pos : pos+50])
+		default:
+			serveData(w, r)
+		}
+	}))
+	defer s.Close()
+
+	name := filepath.Join(t.TempDir(), "out")
+	if err := download(t, s.URL, name); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name)
+
+	// probe, 503, 途中まで, 続きから
+	if len(starts) < 4 || starts[1] != 0 || starts[2] != 0 || starts[3] != 50 {
+		t.Errorf("range requests: %v", starts)
+	}
+}
+
+// .part.jsonがあれば完了した範囲は取らない
+func TestResume(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rangeStart(r) >= 500 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		serveData(w, r)
+	}))
+	if err := download(t, s.URL, name); err == nil {
+		t.Fatal("no error")
+	}
+	s.Close()
+	if _, err := os.Stat(name + ".part.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mtx sync.Mutex
+	var starts []int64
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		starts = append(starts, rangeStart(r))
+		mtx.Unlock()
+		serveData(w, r)
+	}))
+	defer s.Close()
+	if err := download(t, s.URL, name); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, name)
+
+	// probe以外は500から
+	for _, pos := range starts[1:] {
+		if pos < 500 {
+			t.Errorf("range requests: %v", starts)
+			break
+		}
+	}
+	if len(starts) != 6 {
+		t.Errorf("range requests: %v", starts)
+	}
+}
+
+// Rangeに対応していなければ全体を取る
+func TestFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler func(n int, w http.ResponseWriter, r *http.Request)
+		err     bool
+	}{
+		{"ignore range", func(n int, w http.ResponseWriter, r *http.Request) {
+			w.Write(testData)
+		}, false},
+		{"unknown size", func(n int, w http.ResponseWriter, r *http.Request) {
+			switch {
+			case rangeStart(r) >= 0:
+				w.Header().Set("Content-Range", "bytes 0-0/*")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(testData[:1])
+			case n == 2:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				w.Write(testData)
+			}
+		}, false},
+		{"not found", func(n int, w http.ResponseWriter, r *http.Request) {
+			if rangeStart(r) >= 0 {
+				w.Header().Set("Content-Range", "bytes 0-0/*")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(testData[:1])
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("not found"))
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mtx sync.Mutex
+			var n int
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mtx.Lock()
+				n++
+				cnt := n
+				mtx.Unlock()
+				tc.handler(cnt, w, r)
+			}))
+			defer s.Close()
+
+			name := filepath.Join(t.TempDir(), "out")
+			err := download(t, s.URL, name)
+			if tc.err {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, name)
+		})
+	}
+}
@@ -1,192 +1,412 @@
-package main
-
-import (
-	"fmt"
-	"os"
-	"path/filepath"
-	"regexp"
-	"strings"
-	"time"
-
-	"github.com/himananiito/livedl/httpbase"
-	"github.com/himananiito/livedl/niconico"
-	"github.com/himananiito/livedl/options"
-	"github.com/himananiito/livedl/twitcas"
-	"github.com/himananiito/livedl/youtube"
-	"github.com/himananiito/livedl/zip2mp4"
-)
-
-func main() {
-	var baseDir string
-	if regexp.MustCompile(`\AC:\\.*\\Temp\\go-build[^\\]*\\[^\\]+\\exe\\[^\\]*\.exe\z`).MatchString(os.Args[0]) {
-		// go runで起動時
-		pwd, e := os.Getwd()
-		if e != nil {
-			fmt.Println(e)
-			return
-		}
-		baseDir = pwd
-	} else {
-		//pa, e := filepath.Abs(os.Args[0])
-		pa, e := os.Executable()
-		if e != nil {
-			fmt.Println(e)
-			return
-		}
-
-		// symlinkを追跡する
-		for {
-			sl, e := os.Readlink(pa)
-			if e != nil {
-				break
-			}
-			pa = sl
-		}
-		baseDir = filepath.Dir(pa)
-	}
-
-	opt := options.ParseArgs()
-
-	// chdir if not disabled
-	if !opt.NoChdir {
-		fmt.Printf("chdir: %s\n", baseDir)
-		if e := os.Chdir(baseDir); e != nil {
-			fmt.Println(e)
-			return
-		}
-	}
-
-	// http
-	if opt.HttpRootCA != "" {
-		if err := httpbase.SetRootCA(opt.HttpRootCA); err != nil {
-			fmt.Println(err)
-			return
-		}
-	}
-	if opt.HttpSkipVerify {
-		if err := httpbase.SetSkipVerify(true); err != nil {
-			fmt.Println(err)
-			return
-		}
-	}
-	if opt.HttpProxy != "" {
-		if err := httpbase.SetProxy(opt.HttpProxy); err != nil {
-			fmt.Println(err)
-			return
-		}
-	}
-
-	switch opt.Command {
-	default:
-		fmt.Printf("Unknown command: %v\n", opt.Command)
-		os.Exit(1)
-
-	case "TWITCAS":
-		var doneTime int64
-		for {
-			done, dbLocked := twitcas.TwitcasRecord(opt.TcasId, "")
-			if dbLocked {
-				break
-			}
-			if !opt.TcasRetry {
-				break
-			}
-
-			if opt.TcasRetryTimeoutMinute < 0 {
-
-			} else if done {
-				doneTime = time.Now().Unix()
-
-			} else {
-				if doneTime == 0 {
-					doneTime = time.Now().Unix()
-				} else {
-					delta := time.Now().Unix() - doneTime
-					var minutes int
-					if opt.TcasRetryTimeoutMinute == 0 {
-						minutes = options.DefaultTcasRetryTimeoutMinute
-					} else {
-						minutes = opt.TcasRetryTimeoutMinute
-					}
-
-					if minutes > 0 {
-						if delta > int64(minutes*60) {
-							break
-						}
-					}
-				}
-			}
-
-			var interval int
-			if opt.TcasRetryInterval <= 0 {
-				interval = options.DefaultTcasRetryInterval
-			} else {
-				interval = opt.TcasRetryInterval
-			}
-			select {
-			case <-time.After(time.Duration(interval) * time.Second):
-			}
-		}
-
-	case "YOUTUBE":
-		err := youtube.Record(opt.YoutubeId, opt.YtNoStreamlink, opt.YtNoYoutubeDl)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-	case "NICOLIVE":
-		hlsPlaylistEnd, dbname, err := niconico.Record(opt)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		if hlsPlaylistEnd && opt.NicoAutoConvert {
-			done, nMp4s, err := zip2mp4.ConvertDB(dbname, opt.ConvExt, opt.NicoSkipHb)
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-			if done {
-				if nMp4s == 1 {
-					if 1 <= opt.NicoAutoDeleteDBMode {
-						os.Remove(dbname)
-					}
-				} else if 1 < nMp4s {
-					if 2 <= opt.NicoAutoDeleteDBMode {
-						os.Remove(dbname)
-					}
-				}
-			}
-		}
-	case "NICOLIVE_TEST":
-		if err := niconico.TestRun(opt); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-	case "ZIP2MP4":
-		if err := zip2mp4.Convert(opt.ZipFile); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-	case "DB2MP4":
-		if strings.HasSuffix(opt.DBFile, ".yt.sqlite3") {
-			zip2mp4.YtComment(opt.DBFile)
-
-		} else if opt.ExtractChunks {
-			if _, err := zip2mp4.ExtractChunks(opt.DBFile, opt.NicoSkipHb); err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-
-		} else {
-			if _, _, err := zip2mp4.ConvertDB(opt.DBFile, opt.ConvExt, opt.NicoSkipHb); err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-		}
-	}
-
-	return
-}
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/himananiito/livedl/daemon"
+	"github.com/himananiito/livedl/diskguard"
+	"github.com/himananiito/livedl/flvs"
+	"github.com/himananiito/livedl/gorman"
+	"github.com/himananiito/livedl/httpbase"
+	"github.com/himananiito/livedl/httpsub"
+	"github.com/himananiito/livedl/niconico"
+	"github.com/himananiito/livedl/options"
+	"github.com/himananiito/livedl/outname"
+	"github.com/himananiito/livedl/rtmps"
+	"github.com/himananiito/livedl/twitcas"
+	"github.com/himananiito/livedl/youtube"
+	"github.com/himananiito/livedl/zip2mp4"
+)
+
+func main() {
+	var baseDir string
+	if regexp.MustCompile(`\AC:\\.*\\Temp\\go-build[^\\]*\\[^\\]+\\exe\\[^\\]*\.exe\z`).MatchString(os.Args[0]) {
+		// go runで起動時
+		pwd, e := os.Getwd()
+		if e != nil {
+			fmt.Println(e)
+			return
+		}
+		baseDir = pwd
+	} else {
+		//pa, e := filepath.Abs(os.Args[0])
+		pa, e := os.Executable()
+		if e != nil {
+			fmt.Println(e)
+			return
+		}
+
+		// symlinkを追跡する
+		for {
+			sl, e := os.Readlink(pa)
+			if e != nil {
+				break
+			}
+			pa = sl
+		}
+		baseDir = filepath.Dir(pa)
+	}
+
+	gorman.NotifyDump()
+
+	opt := options.ParseArgs()
+
+	// chdir if not disabled
+	if !opt.NoChdir {
+		fmt.Printf("chdir: %s\n", baseDir)
+		if e := os.Chdir(baseDir); e != nil {
+			fmt.Println(e)
+			return
+		}
+	}
+
+	// http
+	if opt.HttpRootCA != "" {
+		if err := httpbase.SetRootCA(opt.HttpRootCA); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if opt.HttpSkipVerify {
+		if err := httpbase.SetSkipVerify(true); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if opt.HttpProxy != "" {
+		if err := httpbase.SetProxy(opt.HttpProxy); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	for service, proxy := range map[string]string{
+		"nico": opt.HttpProxyNico,
+		"tcas": opt.HttpProxyTcas,
+		"yt":   opt.HttpProxyYt,
+	} {
+		if proxy != "" {
+			if err := httpbase.SetServiceProxy(service, proxy); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+	}
+	httpbase.SetRetry(opt.HttpRetry, opt.HttpRetryWait, opt.HttpRetryMaxWait, opt.HttpRetryDeadline)
+	if opt.ReplayFile != "" {
+		if err := httpbase.StartReplay(opt.ReplayFile); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	// cookie
+	if err := loadCookies(opt); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer finish(opt)
+
+	// capture(cookieを読み込んだ後)
+	if opt.CaptureFile != "" {
+		if err := httpbase.StartCapture(opt.CaptureFile); err != nil {
+			fmt.Println(err)
+			return
+		}
+		httpbase.AddSecret(opt.NicoSession)
+	}
+
+	// output
+	if opt.OutputDir != "" {
+		outname.SetRootDir(opt.OutputDir)
+	}
+
+	// disk space
+	if opt.MinFreeSpace > 0 {
+		diskguard.SetMinFree(opt.MinFreeSpace)
+		if opt.AltOutputDir != "" {
+			if err := diskguard.SetAltDir(opt.AltOutputDir); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+	}
+
+	if opt.Command == "DAEMON" {
+		if err := daemon.New(opt, run).Serve(opt.ApiAddr); err != nil {
+			fmt.Println(err)
+			finish(opt)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opt.Command == "BATCH" {
+		if err := runBatch(opt); err != nil {
+			fmt.Println(err)
+			finish(opt)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if _, err := run(opt); err != nil {
+		fmt.Println(err)
+		finish(opt)
+		os.Exit(1)
+	}
+
+	return
+}
+
+// 保存したCookieと-cookiesのcookies.txtを読み込む
+func loadCookies(opt options.Option) (err error) {
+	if opt.CookieClear {
+		if err = options.ClearCookies(opt.NicoLoginAlias); err != nil {
+			return
+		}
+		fmt.Println("cookies cleared")
+	} else {
+		data, e := options.LoadCookies(opt.NicoLoginAlias)
+		if e != nil {
+			return e
+		}
+		if data != nil {
+			if err = httpbase.Jar.Load(data); err != nil {
+				return
+			}
+		}
+	}
+
+	if opt.CookieFile != "" {
+		f, e := os.Open(opt.CookieFile)
+		if e != nil {
+			return e
+		}
+		n, e := httpbase.Jar.ImportNetscape(f)
+		f.Close()
+		if e != nil {
+			return e
+		}
+		fmt.Printf("cookies: %d imported from %s\n", n, opt.CookieFile)
+
+		data, e := httpbase.Jar.Save()
+		if e != nil {
+			return e
+		}
+		if e := options.SaveCookies(opt.NicoLoginAlias, data, true); e != nil {
+			// 保存できなくても今回は使える
+			fmt.Printf("cookies: not saved: %v\n", e)
+		}
+	}
+	return
+}
+
+// 終了時、os.Exitの前に呼ぶ
+func finish(opt options.Option) {
+	saveCookies(opt)
+	if err := httpbase.StopCapture(); err != nil {
+		fmt.Printf("capture: %v\n", err)
+	}
+}
+
+// 変わったCookieを保存する
+// ログインしたアカウントならそのアカウントに、それ以外は-cookiesで読み込んだことがある場合のみ
+func saveCookies(opt options.Option) {
+	if !httpbase.Jar.Changed() {
+		return
+	}
+	data, err := httpbase.Jar.Save()
+	if err == nil {
+		err = options.SaveCookies(opt.NicoLoginAlias, data, opt.NicoLoginAlias != "")
+	}
+	if err != nil {
+		fmt.Printf("cookies: not saved: %v\n", err)
+	}
+}
+
+// コマンドを実行する。outFilesは書き出したファイル
+func run(opt options.Option) (outFiles []string, err error) {
+	split := zip2mp4.Split{Duration: opt.SplitDuration, Size: opt.SplitSize}
+	rng := zip2mp4.Range{From: opt.ConvFrom, To: opt.ConvTo, FromSeqNo: opt.ConvFromSeqNo, ToSeqNo: opt.ConvToSeqNo}
+
+	switch opt.Command {
+	default:
+		err = fmt.Errorf("Unknown command: %v", opt.Command)
+
+	case "TWITCAS":
+		var doneTime int64
+		for {
+			done, dbLocked, fileNames := twitcas.TwitcasRecord(opt.TcasId, opt.TcasFormat, split.Duration, split.Size, opt.Out(), opt.Interrupt)
+			outFiles = append(outFiles, fileNames...)
+			if dbLocked {
+				break
+			}
+			select {
+			case <-opt.Interrupt:
+				return
+			default:
+			}
+			if !opt.TcasRetry {
+				break
+			}
+
+			if opt.TcasRetryTimeoutMinute < 0 {
+
+			} else if done {
+				doneTime = time.Now().Unix()
+
+			} else {
+				if doneTime == 0 {
+					doneTime = time.Now().Unix()
+				} else {
+					delta := time.Now().Unix() - doneTime
+					var minutes int
+					if opt.TcasRetryTimeoutMinute == 0 {
+						minutes = options.DefaultTcasRetryTimeoutMinute
+					} else {
+						minutes = opt.TcasRetryTimeoutMinute
+					}
+
+					if minutes > 0 {
+						if delta > int64(minutes*60) {
+							break
+						}
+					}
+				}
+			}
+
+			var interval int
+			if opt.TcasRetryInterval <= 0 {
+				interval = options.DefaultTcasRetryInterval
+			} else {
+				interval = opt.TcasRetryInterval
+			}
+			select {
+			case <-time.After(time.Duration(interval) * time.Second):
+			case <-opt.Interrupt:
+				return
+			}
+		}
+
+	case "YOUTUBE":
+		err = youtube.Record(opt.YoutubeId, opt.YtFormat, opt.YtNoStreamlink, opt.YtNoYoutubeDl, opt.Out(), opt.Interrupt)
+
+	case "NICOLIVE":
+		hlsPlaylistEnd, dbname, e := niconico.Record(opt)
+		if e != nil {
+			err = e
+			return
+		}
+		if dbname != "" {
+			outFiles = append(outFiles, dbname)
+		}
+		if hlsPlaylistEnd && opt.NicoAutoConvert {
+			done, broken, mp4s, e := zip2mp4.ConvertDB(dbname, opt.ConvExt, opt.ConvFormat, opt.NicoSkipHb, split, zip2mp4.Range{}, opt.Out())
+			if e != nil {
+				err = e
+				return
+			}
+			outFiles = append(outFiles, mp4s...)
+			if done {
+				var removed bool
+				// -split-*で分けたものは分割されていないとみなす
+				if !broken {
+					if 1 <= opt.NicoAutoDeleteDBMode {
+						removed = os.Remove(dbname) == nil
+					}
+				} else {
+					if 2 <= opt.NicoAutoDeleteDBMode {
+						removed = os.Remove(dbname) == nil
+					}
+				}
+				if removed {
+					outFiles = outFiles[1:]
+				}
+			}
+		}
+	case "NICOLIVE_TEST":
+		err = niconico.TestRun(opt)
+
+	case "ZIP2MP4":
+		err = zip2mp4.Convert(opt.ZipFile, opt.Out())
+
+	case "DB2HLS":
+		_, err = zip2mp4.ConvertDBToHls(opt.DBFile, opt.HlsDir, opt.NicoSkipHb)
+
+	case "DB_INFO":
+		err = zip2mp4.PrintDBInfo(opt.DBFile, opt.Json)
+
+	case "RTMP":
+		args, e := rtmps.ParseConnArgs(opt.RtmpConn)
+		if e != nil {
+			err = e
+			return
+		}
+		fileName, done, e := rtmps.Record(rtmps.RecordOpt{
+			Url:       opt.RtmpUrl,
+			TcUrl:     opt.RtmpTcUrl,
+			SwfUrl:    opt.RtmpSwfUrl,
+			PageUrl:   opt.RtmpPageUrl,
+			ConnArgs:  args,
+			Start:     opt.RtmpStart,
+			Format:    opt.RtmpFormat,
+			Interrupt: opt.Interrupt,
+			Stdout:    opt.Out(),
+		})
+		if fileName != "" {
+			outFiles = append(outFiles, fileName)
+		}
+		if e != nil {
+			err = e
+			return
+		}
+		if done && opt.RtmpAutoConvert {
+			mp4s, e := zip2mp4.ConvertFlv(fileName, opt.ConvExt, opt.Out())
+			if e != nil {
+				err = e
+				return
+			}
+			outFiles = append(outFiles, mp4s...)
+		}
+
+	case "FLV_INDEX":
+		err = flvs.AddKeyframes(opt.FlvFile)
+
+	case "HTTP_GET":
+		fileName, e := httpsub.Download(httpsub.DownloadOpt{
+			Url:       opt.HttpGetUrl,
+			Output:    opt.HttpGetOutput,
+			Conns:     opt.HttpConns,
+			Header:    opt.HttpHeader,
+			Cookie:    opt.HttpCookie,
+			Interrupt: opt.Interrupt,
+			Stdout:    opt.Out(),
+		})
+		if e != nil {
+			err = e
+			return
+		}
+		outFiles = append(outFiles, fileName)
+
+	case "DB2MP4":
+		if opt.FlvFile != "" {
+			outFiles, err = zip2mp4.ConvertFlv(opt.FlvFile, opt.ConvExt, opt.Out())
+
+		} else if strings.HasSuffix(opt.DBFile, ".yt.sqlite3") {
+			zip2mp4.YtComment(opt.DBFile)
+
+		} else if opt.ExtractChunks {
+			_, err = zip2mp4.ExtractChunks(opt.DBFile, opt.NicoSkipHb, opt.Out())
+
+		} else {
+			_, _, outFiles, err = zip2mp4.ConvertDB(opt.DBFile, opt.ConvExt, opt.ConvFormat, opt.NicoSkipHb, split, rng, opt.Out())
+		}
+	}
+
+	return
+}
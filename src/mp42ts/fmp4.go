@@ -0,0 +1,587 @@
+package mp42ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MPEG-TSのチャンク(ニコ生のHLS)をブラウザのMediaSourceで再生できるfragmented MP4にする
+// H.264/AACのみ。タイムスタンプはPTSのまま(映像は90kHz、音声はサンプリング周波数)なので
+// 続きのチャンクのFragmentを順に追加すれば続けて再生できる
+
+// 1チャンク分の映像と音声
+type TsChunk struct {
+	video []tsSample
+	audio []tsSample
+
+	sps, pps []byte
+	asc      []byte // AudioSpecificConfig
+	rate     int
+	chans    int
+}
+
+type tsSample struct {
+	dts  int64
+	cto  int64
+	key  bool
+	data []byte // 映像はNALの前に4バイトの長さを付けたもの、音声はADTSヘッダを除いたもの
+}
+
+var ErrUnsupportedCodec = errors.New("ts: unsupported codec (H.264/AAC only)")
+
+const (
+	tsVideoId = 1
+	tsAudioId = 2
+)
+
+var adtsRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+func tsTimestamp(b []byte) int64 {
+	return int64(b[0]&0x0e)<<29 | int64(b[1])<<22 | int64(b[2]&0xfe)<<14 | int64(b[3])<<7 | int64(b[4])>>1
+}
+
+// PESをまとめながらPAT/PMTで映像と音声のPIDを調べる
+func ParseTs(data []byte) (c *TsChunk, err error) {
+	pesByPid := map[int][][]byte{}
+	streamType := map[int]byte{}
+	var pmtPid = -1
+	var order []int
+
+	for i := 0; i+188 <= len(data); i += 188 {
+		pkt := data[i : i+188]
+		if pkt[0] != 0x47 {
+			err = fmt.Errorf("ts: sync byte not found at %d", i)
+			return
+		}
+		pusi := pkt[1]&0x40 != 0
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		p := 4
+		switch pkt[3] & 0x30 {
+		case 0x10:
+		case 0x30:
+			p += 1 + int(pkt[4])
+		default:
+			continue
+		}
+		if p >= len(pkt) {
+			continue
+		}
+		payload := pkt[p:]
+
+		switch {
+		case pid == 0 || pid == pmtPid:
+			if !pusi || int(payload[0])+1 >= len(payload) {
+				continue
+			}
+			section := payload[1+int(payload[0]):]
+			if len(section) < 12 {
+				continue
+			}
+			end := 3 + int(binary.BigEndian.Uint16(section[1:])&0x0fff) - 4 // CRCを除く
+			if end > len(section) {
+				end = len(section)
+			}
+			if pid == 0 && section[0] == 0 {
+				for j := 8; j+4 <= end; j += 4 {
+					if binary.BigEndian.Uint16(section[j:]) != 0 {
+						pmtPid = int(binary.BigEndian.Uint16(section[j+2:]) & 0x1fff)
+						break
+					}
+				}
+			} else if section[0] == 2 {
+				j := 12 + int(binary.BigEndian.Uint16(section[10:])&0x0fff)
+				for ; j+5 <= end; j += 5 + int(binary.BigEndian.Uint16(section[j+3:])&0x0fff) {
+					streamType[int(binary.BigEndian.Uint16(section[j+1:])&0x1fff)] = section[j]
+				}
+			}
+		default:
+			list, ok := pesByPid[pid]
+			if pusi {
+				if !ok {
+					order = append(order, pid)
+				}
+				pesByPid[pid] = append(list, append([]byte(nil), payload...))
+			} else if n := len(list); n > 0 {
+				list[n-1] = append(list[n-1], payload...)
+			}
+		}
+	}
+
+	c = &TsChunk{}
+	for _, pid := range order {
+		// PMTが無ければstream_idで判断する
+		typ, ok := streamType[pid]
+		for _, pes := range pesByPid[pid] {
+			if len(pes) < 14 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 ||
+				len(pes) < 9+int(pes[8]) || pes[7]&0x80 == 0 {
+				continue
+			}
+			pts := tsTimestamp(pes[9:])
+			dts := pts
+			if pes[7]&0xc0 == 0xc0 && len(pes) >= 19 {
+				dts = tsTimestamp(pes[14:])
+			}
+			es := pes[9+int(pes[8]):]
+			switch {
+			case typ == 0x1b || (!ok && 0xe0 <= pes[3] && pes[3] <= 0xef):
+				c.addVideo(es, pts, dts)
+			case typ == 0x0f || (!ok && 0xc0 <= pes[3] && pes[3] <= 0xdf):
+				c.addAudio(es, pts)
+			case ok:
+				err = ErrUnsupportedCodec
+				return
+			}
+		}
+	}
+	if len(c.video) == 0 && len(c.audio) == 0 {
+		err = fmt.Errorf("ts: no audio/video")
+		return
+	}
+	if len(c.video) > 0 && (c.sps == nil || c.pps == nil) {
+		err = fmt.Errorf("ts: SPS/PPS not found")
+		return
+	}
+	return
+}
+
+// Annex BのNALを長さ付きにする。SPS, PPSはinitに入れる
+func (c *TsChunk) addVideo(es []byte, pts, dts int64) {
+	s := tsSample{dts: dts, cto: (pts - dts) & (1<<33 - 1)}
+	for _, nal := range bytes.Split(es, []byte{0, 0, 1}) {
+		nal = bytes.TrimRight(nal, "\x00")
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case 5:
+			s.key = true
+		case 7:
+			c.sps = append([]byte(nil), nal...)
+			continue
+		case 8:
+			c.pps = append([]byte(nil), nal...)
+			continue
+		case 9: // AUD
+			continue
+		}
+		s.data = append(s.data, b32(len(nal))...)
+		s.data = append(s.data, nal...)
+	}
+	if len(s.data) > 0 {
+		c.video = append(c.video, s)
+	}
+}
+
+// ADTSのフレームに分ける。PTSは先頭のフレームのもの
+func (c *TsChunk) addAudio(es []byte, pts int64) {
+	var n int64
+	for len(es) >= 7 && es[0] == 0xff && es[1]&0xf0 == 0xf0 {
+		size := int(es[3]&0x03)<<11 | int(es[4])<<3 | int(es[5])>>5
+		hdr := 7
+		if es[1]&0x01 == 0 {
+			hdr = 9
+		}
+		if size < hdr || size > len(es) {
+			break
+		}
+		if c.asc == nil {
+			profile := es[2] >> 6
+			freq := (es[2] >> 2) & 0x0f
+			chans := (es[2]&0x01)<<2 | es[3]>>6
+			if int(freq) >= len(adtsRates) {
+				break
+			}
+			c.rate = adtsRates[freq]
+			c.chans = int(chans)
+			c.asc = []byte{(profile+1)<<3 | freq>>1, freq<<7 | chans<<3}
+		}
+		c.audio = append(c.audio, tsSample{
+			dts:  pts + n*1024*90000/int64(c.rate),
+			key:  true,
+			data: es[hdr:size],
+		})
+		n++
+		es = es[size:]
+	}
+}
+
+// MediaSource.addSourceBufferに渡すcodecs
+func (c *TsChunk) Codecs() string {
+	var codecs []string
+	if len(c.video) > 0 && len(c.sps) >= 4 {
+		codecs = append(codecs, fmt.Sprintf("avc1.%02x%02x%02x", c.sps[1], c.sps[2], c.sps[3]))
+	}
+	if len(c.audio) > 0 {
+		codecs = append(codecs, fmt.Sprintf("mp4a.40.%d", c.asc[0]>>3))
+	}
+	return fmt.Sprintf(`video/mp4; codecs="%s"`, strings.Join(codecs, ", "))
+}
+
+// 初期化セグメントが変わったか調べるためのID(画質の切り替えなど)
+func (c *TsChunk) ConfigId() string {
+	return fmt.Sprintf("%x", crc32(bytes.Join([][]byte{c.sps, c.pps, c.asc}, nil)))
+}
+
+func (c *TsChunk) avcC() []byte {
+	return bytes.Join([][]byte{
+		{1, c.sps[1], c.sps[2], c.sps[3], 0xff, 0xe1},
+		b16(len(c.sps)), c.sps,
+		{1}, b16(len(c.pps)), c.pps,
+	}, nil)
+}
+
+// ftypとmoov
+func (c *TsChunk) Init() []byte {
+	ftyp := box("ftyp", []byte("isom"), b32(0x200), []byte("isomiso6avc1mp41"))
+
+	var traks, trexs [][]byte
+	trak := func(id, timescale int, tkhdSize []byte, hdlr, xmhd, entry []byte) {
+		var volume int
+		if id == tsAudioId {
+			volume = 0x100
+		}
+		tkhd := fullBox("tkhd", 0, 3,
+			b32(0), b32(0),
+			b32(id), b32(0),
+			b32(0),
+			make([]byte, 8),
+			b16(0), b16(0),
+			b16(volume), b16(0),
+			bytes.Join(matrix, nil),
+			tkhdSize,
+		)
+		mdhd := fullBox("mdhd", 0, 0,
+			b32(0), b32(0),
+			b32(timescale), b32(0),
+			b16(0x55c4), b16(0),
+		)
+		dinf := box("dinf", fullBox("dref", 0, 0, b32(1), fullBox("url ", 0, 1)))
+		stbl := box("stbl",
+			fullBox("stsd", 0, 0, b32(1), entry),
+			fullBox("stts", 0, 0, b32(0)),
+			fullBox("stsc", 0, 0, b32(0)),
+			fullBox("stsz", 0, 0, b32(0), b32(0)),
+			fullBox("stco", 0, 0, b32(0)),
+		)
+		traks = append(traks, box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", xmhd, dinf, stbl))))
+		trexs = append(trexs, fullBox("trex", 0, 0, b32(id), b32(1), b32(0), b32(0), b32(0)))
+	}
+
+	if len(c.video) > 0 {
+		avcC := c.avcC()
+		width, height := AvcSize(avcC)
+		trak(tsVideoId, 90000, append(b32(width<<16), b32(height<<16)...),
+			fullBox("hdlr", 0, 0, b32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00")),
+			fullBox("vmhd", 0, 1, make([]byte, 8)),
+			box("avc1",
+				make([]byte, 6), b16(1),
+				make([]byte, 16),
+				b16(width), b16(height),
+				b32(0x480000), b32(0x480000),
+				b32(0), b16(1),
+				make([]byte, 32),
+				b16(0x18), b16(0xffff),
+				box("avcC", avcC),
+			),
+		)
+	}
+	if len(c.audio) > 0 {
+		trak(tsAudioId, c.rate, make([]byte, 8),
+			fullBox("hdlr", 0, 0, b32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00")),
+			fullBox("smhd", 0, 0, make([]byte, 4)),
+			box("mp4a",
+				make([]byte, 6), b16(1),
+				make([]byte, 8),
+				b16(c.chans), b16(16),
+				b16(0), b16(0),
+				b32(c.rate<<16),
+				esds(tsAudioId, c.asc),
+			),
+		)
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		b32(0), b32(0),
+		b32(1000), b32(0),
+		b32(0x10000),
+		b16(0x100), b16(0),
+		b32(0), b32(0),
+		bytes.Join(matrix, nil),
+		make([]byte, 24),
+		b32(tsAudioId+1),
+	)
+	moov := box("moov", append(append([][]byte{mvhd}, traks...), box("mvex", trexs...))...)
+	return append(ftyp, moov...)
+}
+
+// moofとmdat。seqはmfhdのsequence_number(チャンクのseqno)
+func (c *TsChunk) Fragment(seq uint32) []byte {
+	type track struct {
+		id      int
+		base    int64
+		samples []tsSample
+		durs    []int64
+	}
+	var tracks []track
+	if len(c.video) > 0 {
+		t := track{id: tsVideoId, base: c.video[0].dts, samples: c.video}
+		for i, s := range c.video {
+			var d int64 = 3000
+			if i+1 < len(c.video) {
+				d = (c.video[i+1].dts - s.dts) & (1<<33 - 1)
+			} else if i > 0 {
+				d = t.durs[i-1]
+			}
+			t.durs = append(t.durs, d)
+		}
+		tracks = append(tracks, t)
+	}
+	if len(c.audio) > 0 {
+		t := track{id: tsAudioId, base: c.audio[0].dts * int64(c.rate) / 90000, samples: c.audio}
+		for range c.audio {
+			t.durs = append(t.durs, 1024)
+		}
+		tracks = append(tracks, t)
+	}
+
+	// data_offsetはmoofの先頭から。moofの大きさはoffsetによらないので一度作ってから決める
+	moof := func(dataOffset int) []byte {
+		trafs := [][]byte{fullBox("mfhd", 0, 0, b32(int(seq)))}
+		offset := dataOffset
+		for _, t := range tracks {
+			entries := [][]byte{b32(len(t.samples)), b32(offset)}
+			for i, s := range t.samples {
+				flags := 0x01010000 // non-sync
+				if s.key {
+					flags = 0x02000000
+				}
+				entries = append(entries, b32(int(t.durs[i])), b32(len(s.data)), b32(flags), b32(int(s.cto)))
+				offset += len(s.data)
+			}
+			trafs = append(trafs, box("traf",
+				fullBox("tfhd", 0, 0x020000, b32(t.id)), // default-base-is-moof
+				fullBox("tfdt", 1, 0, b64(uint64(t.base))),
+				fullBox("trun", 0, 0x000f01, entries...),
+			))
+		}
+		return box("moof", trafs...)
+	}
+	size := len(moof(0))
+
+	mdat := [][]byte{}
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			mdat = append(mdat, s.data)
+		}
+	}
+	return append(moof(size+8), box("mdat", mdat...)...)
+}
+
+func b16(n int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(n))
+	return b
+}
+func b32(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+func b64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+func box(typ string, payload ...[]byte) []byte {
+	var size int
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, 8+size)
+	b = append(b, b32(8+size)...)
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+func fullBox(typ string, version byte, flags int, payload ...[]byte) []byte {
+	head := b32(flags)
+	head[0] = version
+	return box(typ, append([][]byte{head}, payload...)...)
+}
+
+var matrix = [][]byte{
+	b32(0x10000), b32(0), b32(0),
+	b32(0), b32(0x10000), b32(0),
+	b32(0), b32(0), b32(0x40000000),
+}
+
+func descriptor(tag byte, payload ...[]byte) []byte {
+	var size int
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := []byte{tag, 0x80 | byte(size>>21), 0x80 | byte(size>>14), 0x80 | byte(size>>7), byte(size & 0x7f)}
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func esds(id int, asc []byte) []byte {
+	return fullBox("esds", 0, 0,
+		descriptor(3, b16(id), []byte{0},
+			descriptor(4,
+				[]byte{0x40, 0x15, 0, 0, 0}, // AAC, AudioStream, bufferSizeDB
+				b32(0), b32(0),              // maxBitrate, avgBitrate
+				descriptor(5, asc),
+			),
+			descriptor(6, []byte{2}),
+		),
+	)
+}
+
+// 読み終えた後はshortになり、0を返し続ける
+type bitReader struct {
+	b     []byte
+	pos   int
+	short bool
+}
+
+func (r *bitReader) bit() int {
+	if r.pos >= len(r.b)*8 {
+		r.short = true
+		return 0
+	}
+	v := int(r.b[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return v
+}
+func (r *bitReader) bits(n int) (v int) {
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return
+}
+func (r *bitReader) ue() int {
+	var zeros int
+	for r.bit() == 0 && zeros < 32 {
+		if r.short {
+			return 0
+		}
+		zeros++
+	}
+	v := (1 << uint(zeros)) - 1 + r.bits(zeros)
+	if r.short {
+		return 0
+	}
+	return v
+}
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 != 0 {
+		return (v + 1) / 2
+	}
+	return -v / 2
+}
+
+// avcCの最初のSPSから映像のサイズを得る。読めなければ0
+func AvcSize(avcC []byte) (width, height int) {
+	if len(avcC) < 8 || avcC[5]&0x1f == 0 {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(avcC[6:8]))
+	if len(avcC) < 8+size || size < 4 {
+		return
+	}
+	// emulation prevention byteを取り除く
+	var sps []byte
+	for i, b := range avcC[8 : 8+size] {
+		if b == 3 && i >= 2 && avcC[8+i-1] == 0 && avcC[8+i-2] == 0 {
+			continue
+		}
+		sps = append(sps, b)
+	}
+
+	r := &bitReader{b: sps[1:]}
+	profile := r.bits(8)
+	r.bits(16) // constraint_set_flags, level_idc
+	r.ue()     // seq_parameter_set_id
+	chroma := 1
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = r.ue()
+		if chroma == 3 {
+			r.bit()
+		}
+		r.ue() // bit_depth_luma
+		r.ue() // bit_depth_chroma
+		r.bit()
+		if r.bit() == 1 {
+			n := 8
+			if chroma == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				count := 16
+				if i >= 6 {
+					count = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < count && !r.short; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num
+	switch r.ue() {
+	case 0:
+		r.ue()
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && !r.short; n-- {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	w := r.ue() + 1
+	h := r.ue() + 1
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit()
+	}
+	r.bit() // direct_8x8_inference_flag
+	var cl, cr, ct, cb int
+	if r.bit() == 1 {
+		cl, cr, ct, cb = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	cropX, cropY := 1, 2-frameMbsOnly
+	if chroma == 1 || chroma == 2 {
+		cropX = 2
+	}
+	if chroma == 1 {
+		cropY *= 2
+	}
+	if r.short {
+		return
+	}
+	width = w*16 - (cl+cr)*cropX
+	height = h*16*(2-frameMbsOnly) - (ct+cb)*cropY
+	return
+}
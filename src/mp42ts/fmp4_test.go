@@ -0,0 +1,137 @@
+package mp42ts
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 1280x720 Baseline
+var testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe4}
+var testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+
+func nals(ns ...[]byte) (b []byte) {
+	for _, n := range ns {
+		b = append(b, b32(len(n))...)
+		b = append(b, n...)
+	}
+	return
+}
+
+func testChunk() *TsChunk {
+	return &TsChunk{
+		video: []tsSample{
+			{dts: 900000, cto: 3000, key: true, data: nals([]byte{0x65, 0x88, 0x84, 0x00, 0x10})},
+			{dts: 903000, cto: 6000, data: nals([]byte{0x41, 0x9a, 0x02})},
+			{dts: 906000, cto: 0, data: nals([]byte{0x01, 0x9e, 0x03}, []byte{0x01, 0x9e, 0x04})},
+		},
+		audio: []tsSample{
+			{dts: 900000, key: true, data: []byte{0x21, 0x10, 0x04}},
+			{dts: 901920, key: true, data: []byte{0x21, 0x10, 0x05, 0x06}},
+			{dts: 903840, key: true, data: []byte{0x21, 0x10, 0x07}},
+		},
+		sps:   testSPS,
+		pps:   testPPS,
+		asc:   []byte{0x11, 0x90}, // AAC LC, 48kHz, 2ch
+		rate:  48000,
+		chans: 2,
+	}
+}
+
+// Init + FragmentをParseで読めること
+func TestTsChunkFragment(t *testing.T) {
+	c := testChunk()
+	if got, want := c.Codecs(), `video/mp4; codecs="avc1.42c01f, mp4a.40.2"`; got != want {
+		t.Errorf("codecs %q, want %q", got, want)
+	}
+	if w, h := AvcSize(c.avcC()); w != 1280 || h != 720 {
+		t.Errorf("size %dx%d", w, h)
+	}
+
+	tracks, err := Parse(append(c.Init(), c.Fragment(7)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("%d tracks", len(tracks))
+	}
+	for _, tr := range tracks {
+		var src []tsSample
+		switch tr.Codec {
+		case "avc1":
+			src = c.video
+			if len(tr.SPS) != 1 || !bytes.Equal(tr.SPS[0], testSPS) || len(tr.PPS) != 1 || !bytes.Equal(tr.PPS[0], testPPS) {
+				t.Errorf("avc1: SPS/PPS %x %x", tr.SPS, tr.PPS)
+			}
+		case "mp4a":
+			src = c.audio
+			if !bytes.Equal(tr.ASC, c.asc) {
+				t.Errorf("mp4a: ASC %x", tr.ASC)
+			}
+		default:
+			t.Fatalf("codec %q", tr.Codec)
+		}
+		if len(tr.Samples) != len(src) {
+			t.Fatalf("%s: %d samples, want %d", tr.Codec, len(tr.Samples), len(src))
+		}
+		for i, s := range tr.Samples {
+			want := src[i]
+			dts := s.DTS * 90000 / int64(tr.Timescale)
+			if dts != want.dts || s.CTO*90000/int64(tr.Timescale) != want.cto || s.Key != want.key || !bytes.Equal(s.Data, want.data) {
+				t.Errorf("%s[%d]: dts %d cto %d key %v data %x, want %+v", tr.Codec, i, dts, s.CTO, s.Key, s.Data, want)
+			}
+		}
+	}
+}
+
+// MuxerでMPEG-TSにしたものを読み直す
+func TestParseTs(t *testing.T) {
+	c := testChunk()
+	var ts bytes.Buffer
+	if err := NewMuxer(&ts).WriteMP4(append(c.Init(), c.Fragment(0)...)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseTs(ts.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.sps, testSPS) || !bytes.Equal(got.pps, testPPS) || !bytes.Equal(got.asc, c.asc) {
+		t.Errorf("config %x %x %x", got.sps, got.pps, got.asc)
+	}
+	if got.ConfigId() != c.ConfigId() {
+		t.Errorf("config id %s, want %s", got.ConfigId(), c.ConfigId())
+	}
+	// Muxerは先頭に1秒足す
+	for _, tc := range []struct {
+		name      string
+		got, want []tsSample
+	}{
+		{"video", got.video, c.video},
+		{"audio", got.audio, c.audio},
+	} {
+		if len(tc.got) != len(tc.want) {
+			t.Fatalf("%s: %d samples, want %d", tc.name, len(tc.got), len(tc.want))
+		}
+		for i, s := range tc.got {
+			want := tc.want[i]
+			if s.dts != want.dts+90000 || s.cto != want.cto || s.key != want.key || !bytes.Equal(s.data, want.data) {
+				t.Errorf("%s[%d]: %+v, want %+v", tc.name, i, s, want)
+			}
+		}
+	}
+
+	if _, err := ParseTs([]byte{0x47, 0, 0}); err == nil {
+		t.Error("no error for a short chunk")
+	}
+}
+
+// 途中で切れたSPSで止まらない
+func TestAvcSizeTruncated(t *testing.T) {
+	// pic_order_cnt_type 1でnum_ref_frames_in_pic_order_cnt_cycleが2^32-2
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xd3, 0x00, 0x00, 0x00, 0x01, 0xff, 0xff, 0xff, 0xfe}
+	for i := 4; i <= len(sps); i++ {
+		c := &TsChunk{sps: sps[:i], pps: testPPS}
+		if w, h := AvcSize(c.avcC()); w != 0 || h != 0 {
+			t.Errorf("%x: size %dx%d", sps[:i], w, h)
+		}
+	}
+}
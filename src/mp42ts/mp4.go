@@ -0,0 +1,591 @@
+package mp42ts
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MP4(fMP4)の1トラック
+type Track struct {
+	Handler   string // vide, soun
+	Codec     string // avc1, mp4a
+	Timescale uint32
+
+	// H.264
+	NALLengthSize int
+	SPS           [][]byte
+	PPS           [][]byte
+
+	// AAC
+	ASC []byte // AudioSpecificConfig
+
+	Samples []Sample
+	// tfdtがあればSamplesのDTSはファイルをまたいで連続している
+	HasBaseTime bool
+}
+
+type Sample struct {
+	DTS      int64 // Timescale単位
+	CTO      int64 // PTS - DTS
+	Duration int64
+	Key      bool
+	Data     []byte
+}
+
+// boxを順に処理する。offsetはbの先頭からのboxの位置
+func eachBox(b []byte, fn func(typ string, payload []byte, offset int)) {
+	offset := 0
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		typ := string(b[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(b[8:])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return
+		}
+		fn(typ, b[hdr:size], offset)
+		b = b[size:]
+		offset += int(size)
+	}
+}
+
+// 子のboxを探す
+func findBox(b []byte, path ...string) (payload []byte, ok bool) {
+	if len(path) == 0 {
+		return b, true
+	}
+	eachBox(b, func(typ string, p []byte, _ int) {
+		if !ok && typ == path[0] {
+			payload, ok = findBox(p, path[1:]...)
+		}
+	})
+	return
+}
+
+func u16(b []byte, i int) uint32 {
+	if i+2 > len(b) {
+		return 0
+	}
+	return uint32(binary.BigEndian.Uint16(b[i:]))
+}
+
+func u32(b []byte, i int) uint32 {
+	if i+4 > len(b) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b[i:])
+}
+
+func u64(b []byte, i int) uint64 {
+	if i+8 > len(b) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b[i:])
+}
+
+// boxにentry_countの分のエントリがあるか。hdrはエントリの前の大きさ
+func entries(box []byte, name string, hdr, size int) (n int, err error) {
+	n = int(u32(box, hdr-4))
+	if len(box) < hdr || n > (len(box)-hdr)/size {
+		err = fmt.Errorf("mp4: %s: %d entries out of range", name, n)
+	}
+	return
+}
+
+// trexのデフォルト値
+type trackDefaults struct {
+	duration uint32
+	size     uint32
+	flags    uint32
+}
+
+// MP4を読んで各トラックのサンプルを取り出す
+func Parse(b []byte) (tracks []*Track, err error) {
+	moov, ok := findBox(b, "moov")
+	if !ok {
+		err = fmt.Errorf("mp4: moov not found")
+		return
+	}
+
+	byId := map[uint32]*Track{}
+	defaults := map[uint32]trackDefaults{}
+
+	eachBox(moov, func(typ string, p []byte, _ int) {
+		if err != nil {
+			return
+		}
+		switch typ {
+		case "trak":
+			var id uint32
+			var t *Track
+			id, t, err = parseTrak(p, b)
+			if t != nil {
+				byId[id] = t
+				tracks = append(tracks, t)
+			}
+		case "mvex":
+			eachBox(p, func(typ string, p []byte, _ int) {
+				if typ == "trex" {
+					defaults[u32(p, 4)] = trackDefaults{
+						duration: u32(p, 12),
+						size:     u32(p, 16),
+						flags:    u32(p, 20),
+					}
+				}
+			})
+		}
+	})
+	if err != nil {
+		return
+	}
+	if len(tracks) == 0 {
+		err = fmt.Errorf("mp4: no supported track")
+		return
+	}
+
+	// fragments
+	eachBox(b, func(typ string, moof []byte, offset int) {
+		if typ == "moof" && err == nil {
+			err = parseMoof(b, moof, offset, byId, defaults)
+		}
+	})
+	return
+}
+
+func parseTrak(trak, file []byte) (id uint32, t *Track, err error) {
+	tkhd, ok := findBox(trak, "tkhd")
+	if !ok {
+		return
+	}
+	if len(tkhd) < 4 {
+		err = fmt.Errorf("mp4: tkhd too short")
+		return
+	}
+	if tkhd[0] == 1 {
+		id = u32(tkhd, 20)
+	} else {
+		id = u32(tkhd, 12)
+	}
+
+	t = &Track{}
+	if hdlr, ok := findBox(trak, "mdia", "hdlr"); ok && len(hdlr) >= 12 {
+		t.Handler = string(hdlr[8:12])
+	}
+	if mdhd, ok := findBox(trak, "mdia", "mdhd"); ok {
+		if len(mdhd) < 4 {
+			err = fmt.Errorf("mp4: mdhd too short")
+			return 0, nil, err
+		}
+		if mdhd[0] == 1 {
+			t.Timescale = u32(mdhd, 20)
+		} else {
+			t.Timescale = u32(mdhd, 12)
+		}
+	}
+	if t.Timescale == 0 {
+		return 0, nil, nil
+	}
+
+	stbl, ok := findBox(trak, "mdia", "minf", "stbl")
+	if !ok {
+		return 0, nil, nil
+	}
+	stsd, ok := findBox(stbl, "stsd")
+	if !ok || len(stsd) < 8 {
+		return 0, nil, nil
+	}
+	eachBox(stsd[8:], func(typ string, p []byte, _ int) {
+		if t.Codec != "" {
+			return
+		}
+		switch typ {
+		case "avc1", "avc3":
+			// VisualSampleEntry
+			if len(p) < 78 {
+				return
+			}
+			if avcC, ok := findBox(p[78:], "avcC"); ok {
+				t.Codec = "avc1"
+				parseAvcC(t, avcC)
+			}
+		case "mp4a":
+			// AudioSampleEntry
+			if len(p) < 28 {
+				return
+			}
+			if esds, ok := findBox(p[28:], "esds"); ok {
+				t.Codec = "mp4a"
+				t.ASC = parseEsds(esds)
+			}
+		}
+	})
+	if t.Codec == "" {
+		return 0, nil, nil
+	}
+
+	if err = parseStbl(t, stbl, file); err != nil {
+		return 0, nil, err
+	}
+	return
+}
+
+func parseAvcC(t *Track, b []byte) {
+	if len(b) < 6 {
+		return
+	}
+	t.NALLengthSize = int(b[4]&3) + 1
+	n := int(b[5] & 0x1f)
+	i := 6
+	for ; n > 0 && i+2 <= len(b); n-- {
+		l := int(u16(b, i))
+		if i+2+l > len(b) {
+			return
+		}
+		t.SPS = append(t.SPS, b[i+2:i+2+l])
+		i += 2 + l
+	}
+	if i >= len(b) {
+		return
+	}
+	n = int(b[i])
+	i++
+	for ; n > 0 && i+2 <= len(b); n-- {
+		l := int(u16(b, i))
+		if i+2+l > len(b) {
+			return
+		}
+		t.PPS = append(t.PPS, b[i+2:i+2+l])
+		i += 2 + l
+	}
+}
+
+// 記述子の長さ
+func descLen(b []byte, i int) (n, next int) {
+	for k := 0; k < 4 && i < len(b); k++ {
+		n = n<<7 | int(b[i]&0x7f)
+		i++
+		if b[i-1]&0x80 == 0 {
+			break
+		}
+	}
+	return n, i
+}
+
+// esdsからAudioSpecificConfigを取り出す
+func parseEsds(b []byte) (asc []byte) {
+	i := 4
+	for i+2 <= len(b) {
+		tag := b[i]
+		n, next := descLen(b, i+1)
+		i = next
+		switch tag {
+		case 0x03: // ES_Descriptor
+			if i+3 > len(b) {
+				return
+			}
+			flags := b[i+2]
+			i += 3
+			if flags&0x80 != 0 {
+				i += 2
+			}
+			if flags&0x40 != 0 && i < len(b) {
+				i += 1 + int(b[i])
+			}
+			if flags&0x20 != 0 {
+				i += 2
+			}
+		case 0x04: // DecoderConfigDescriptor
+			i += 13
+		case 0x05: // DecoderSpecificInfo
+			if i+n <= len(b) {
+				asc = b[i : i+n]
+			}
+			return
+		default:
+			i += n
+		}
+	}
+	return
+}
+
+// 断片化されていないMP4のサンプル
+func parseStbl(t *Track, stbl, file []byte) (err error) {
+	stsz, ok := findBox(stbl, "stsz")
+	if !ok {
+		return
+	}
+	count := int(u32(stsz, 8))
+	if count == 0 {
+		return
+	}
+	fixed := u32(stsz, 4)
+	// 1サンプルは1バイト以上なのでファイルより多くは無い
+	if fixed == 0 {
+		count, err = entries(stsz, "stsz", 12, 4)
+	} else if count > len(file) {
+		err = fmt.Errorf("mp4: stsz: %d entries out of range", count)
+	}
+	if err != nil {
+		return
+	}
+	sizes := make([]uint32, count)
+	if fixed != 0 {
+		for i := range sizes {
+			sizes[i] = fixed
+		}
+	} else {
+		for i := range sizes {
+			sizes[i] = u32(stsz, 12+4*i)
+		}
+	}
+
+	var offsets []uint64
+	if stco, ok := findBox(stbl, "stco"); ok {
+		n, err := entries(stco, "stco", 8, 4)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			offsets = append(offsets, uint64(u32(stco, 8+4*i)))
+		}
+	} else if co64, ok := findBox(stbl, "co64"); ok {
+		n, err := entries(co64, "co64", 8, 8)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			offsets = append(offsets, u64(co64, 8+8*i))
+		}
+	}
+
+	// チャンクごとのサンプル数
+	var nstsc int
+	stsc, ok := findBox(stbl, "stsc")
+	if ok {
+		if nstsc, err = entries(stsc, "stsc", 8, 12); err != nil {
+			return
+		}
+	}
+	perChunk := func(chunk int) int {
+		n := 0
+		for i := 0; i < nstsc; i++ {
+			if int(u32(stsc, 8+12*i)) <= chunk+1 {
+				n = int(u32(stsc, 8+12*i+4))
+			}
+		}
+		return n
+	}
+
+	var durations []int64
+	if stts, ok := findBox(stbl, "stts"); ok {
+		n, err := entries(stts, "stts", 8, 8)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			c := int(u32(stts, 8+8*i))
+			d := int64(u32(stts, 8+8*i+4))
+			for ; c > 0 && len(durations) < count; c-- {
+				durations = append(durations, d)
+			}
+		}
+	}
+	var ctos []int64
+	if ctts, ok := findBox(stbl, "ctts"); ok {
+		n, err := entries(ctts, "ctts", 8, 8)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			c := int(u32(ctts, 8+8*i))
+			o := int64(int32(u32(ctts, 8+8*i+4)))
+			for ; c > 0 && len(ctos) < count; c-- {
+				ctos = append(ctos, o)
+			}
+		}
+	}
+	var sync map[int]bool
+	if stss, ok := findBox(stbl, "stss"); ok {
+		n, err := entries(stss, "stss", 8, 4)
+		if err != nil {
+			return err
+		}
+		sync = map[int]bool{}
+		for i := 0; i < n; i++ {
+			sync[int(u32(stss, 8+4*i))-1] = true
+		}
+	}
+
+	var dts int64
+	s := 0
+	for chunk, off := range offsets {
+		for k := perChunk(chunk); k > 0 && s < count; k-- {
+			end := off + uint64(sizes[s])
+			if off > uint64(len(file)) {
+				return fmt.Errorf("mp4: chunk %d out of range", chunk)
+			}
+			if end > uint64(len(file)) {
+				return // 途中で切れたファイル
+			}
+			smp := Sample{
+				DTS:  dts,
+				Key:  sync == nil || sync[s],
+				Data: file[off:end],
+			}
+			if s < len(durations) {
+				smp.Duration = durations[s]
+			}
+			if s < len(ctos) {
+				smp.CTO = ctos[s]
+			}
+			t.Samples = append(t.Samples, smp)
+			dts += smp.Duration
+			off = end
+			s++
+		}
+	}
+	return
+}
+
+func parseMoof(file, moof []byte, moofOffset int, byId map[uint32]*Track, defaults map[uint32]trackDefaults) (err error) {
+	eachBox(moof, func(typ string, traf []byte, _ int) {
+		if typ != "traf" || err != nil {
+			return
+		}
+		tfhd, ok := findBox(traf, "tfhd")
+		if !ok {
+			return
+		}
+		id := u32(tfhd, 4)
+		t, ok := byId[id]
+		if !ok {
+			return
+		}
+		def := defaults[id]
+
+		tf := u32(tfhd, 0) & 0xffffff
+		base := uint64(moofOffset)
+		i := 8
+		if tf&0x01 != 0 {
+			base = u64(tfhd, i)
+			i += 8
+		}
+		if tf&0x02 != 0 {
+			i += 4
+		}
+		if tf&0x08 != 0 {
+			def.duration = u32(tfhd, i)
+			i += 4
+		}
+		if tf&0x10 != 0 {
+			def.size = u32(tfhd, i)
+			i += 4
+		}
+		if tf&0x20 != 0 {
+			def.flags = u32(tfhd, i)
+		}
+
+		var dts int64
+		if n := len(t.Samples); n > 0 {
+			dts = t.Samples[n-1].DTS + t.Samples[n-1].Duration
+		}
+		if tfdt, ok := findBox(traf, "tfdt"); ok {
+			if len(tfdt) < 4 {
+				err = fmt.Errorf("mp4: tfdt too short")
+				return
+			}
+			if tfdt[0] == 1 {
+				dts = int64(u64(tfdt, 4))
+			} else {
+				dts = int64(u32(tfdt, 4))
+			}
+			t.HasBaseTime = true
+		}
+
+		pos := base
+		eachBox(traf, func(typ string, trun []byte, _ int) {
+			if typ != "trun" || len(trun) < 8 || err != nil {
+				return
+			}
+			version := trun[0]
+			rf := u32(trun, 0) & 0xffffff
+			count := int(u32(trun, 4))
+			j := 8
+			if rf&0x01 != 0 {
+				pos = base + uint64(int64(int32(u32(trun, j))))
+				j += 4
+			}
+			firstFlags, hasFirst := uint32(0), false
+			if rf&0x04 != 0 {
+				firstFlags, hasFirst = u32(trun, j), true
+				j += 4
+			}
+			// サンプルごとのフィールドが無ければ、大きさ0のサンプルでもファイルより多くは無いとする
+			per := 0
+			for _, f := range []uint32{0x100, 0x200, 0x400, 0x800} {
+				if rf&f != 0 {
+					per += 4
+				}
+			}
+			if (per > 0 && count > (len(trun)-j)/per) || (per == 0 && count > len(file)) {
+				err = fmt.Errorf("mp4: trun: %d entries out of range", count)
+				return
+			}
+			for k := 0; k < count; k++ {
+				dur, size, flags := def.duration, def.size, def.flags
+				var cto int64
+				if rf&0x100 != 0 {
+					dur = u32(trun, j)
+					j += 4
+				}
+				if rf&0x200 != 0 {
+					size = u32(trun, j)
+					j += 4
+				}
+				if rf&0x400 != 0 {
+					flags = u32(trun, j)
+					j += 4
+				}
+				if rf&0x800 != 0 {
+					if version == 0 {
+						cto = int64(u32(trun, j))
+					} else {
+						cto = int64(int32(u32(trun, j)))
+					}
+					j += 4
+				}
+				if k == 0 && hasFirst {
+					flags = firstFlags
+				}
+				if pos > uint64(len(file)) {
+					err = fmt.Errorf("mp4: trun: data offset out of range")
+					return
+				}
+				end := pos + uint64(size)
+				if end > uint64(len(file)) {
+					return
+				}
+				t.Samples = append(t.Samples, Sample{
+					DTS:      dts,
+					CTO:      cto,
+					Duration: int64(dur),
+					// sample_is_non_sync_sample
+					Key:  t.Handler != "vide" || flags&0x10000 == 0,
+					Data: file[pos:end],
+				})
+				dts += int64(dur)
+				pos = end
+			}
+		})
+	})
+	return
+}
@@ -0,0 +1,93 @@
+package mp42ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// 音声のみのtrak。stblの中身を入れ替える
+func testTrak(tkhd, mdhd []byte, stbl ...[]byte) []byte {
+	stsd := box("stsd", be32(0), be32(1), box("mp4a", make([]byte, 28), box("esds", be32(0))))
+	return box("trak",
+		box("tkhd", tkhd),
+		box("mdia",
+			box("mdhd", mdhd),
+			box("hdlr", be32(0), be32(0), []byte("soun")),
+			box("minf", box("stbl", append([][]byte{stsd}, stbl...)...)),
+		),
+	)
+}
+
+var (
+	testTkhd = append(make([]byte, 12), be32(1)...)
+	testMdhd = append(make([]byte, 12), be32(48000)...)
+)
+
+// trunのdata_offsetはmoofの先頭から
+func testMoof(tfdt []byte, trunFlags, count uint32, entries ...[]byte) []byte {
+	traf := [][]byte{box("tfhd", be32(0), be32(1))}
+	if tfdt != nil {
+		traf = append(traf, box("tfdt", tfdt))
+	}
+	trun := append([][]byte{be32(trunFlags), be32(count)}, entries...)
+	traf = append(traf, box("trun", trun...))
+	return box("moof", box("traf", traf...))
+}
+
+func join(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+// 壊れたMP4でpanicせずにエラーを返す
+func TestParseBounds(t *testing.T) {
+	moov := box("moov", testTrak(testTkhd, testMdhd))
+	// moofの大きさはdata_offsetによらない
+	size := len(testMoof(be32(0), 0x201, 1, be32(0), be32(2)))
+	valid := join(moov, testMoof(be32(0), 0x201, 1, be32(uint32(size+8)), be32(2)), box("mdat", []byte{1, 2}))
+	for _, tc := range []struct {
+		name    string
+		file    []byte
+		samples int // -1はエラー
+	}{
+		{"ok", valid, 1},
+		{"empty tkhd", box("moov", testTrak(nil, testMdhd)), -1},
+		{"empty mdhd", box("moov", testTrak(testTkhd, nil)), -1},
+		{"stsz count", box("moov", testTrak(testTkhd, testMdhd, box("stsz", be32(0), be32(0), be32(0x40000000)))), -1},
+		{"stsz fixed count", box("moov", testTrak(testTkhd, testMdhd, box("stsz", be32(0), be32(1), be32(0x40000000)))), -1},
+		{"stts count", box("moov", testTrak(testTkhd, testMdhd,
+			box("stsz", be32(0), be32(1), be32(1)), box("stts", be32(0), be32(0xffffffff)))), -1},
+		{"stco offset", box("moov", testTrak(testTkhd, testMdhd,
+			box("stsz", be32(0), be32(1), be32(1)), box("stsc", be32(0), be32(1), be32(1), be32(1), be32(1)),
+			box("stco", be32(0), be32(1), be32(0xffffff00)))), -1},
+		{"empty tfdt", join(moov, testMoof([]byte{}, 0x200, 1, be32(0))), -1},
+		{"trun count", join(moov, testMoof(be32(0), 0x200, 0x40000000)), -1},
+		{"trun count without entries", join(moov, testMoof(be32(0), 0, 0x40000000)), -1},
+		{"trun data offset", join(moov, testMoof(be32(0), 0x201, 1, be32(0x80000000), be32(1))), -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tracks, err := Parse(tc.file)
+			if tc.samples < 0 {
+				if err == nil {
+					t.Errorf("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tracks) != 1 || len(tracks[0].Samples) != tc.samples {
+				t.Fatalf("tracks %+v", tracks)
+			}
+			if got := tracks[0].Samples[0].Data; !bytes.Equal(got, []byte{1, 2}) {
+				t.Errorf("data %x", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,425 @@
+package mp42ts
+
+import (
+	"io"
+	"sort"
+)
+
+// 映像と音声が別々になったMP4をMPEG-TSにする(Bento4のmp42tsの代わり)
+
+const (
+	pidPMT   = 0x1000
+	pidVideo = 0x100
+	pidAudio = 0x101
+
+	// 先頭のタイムスタンプ(90kHz)。PCRをDTSより前にするため
+	baseTime = 90000
+	pcrDelay = 9000
+)
+
+type Muxer struct {
+	w  io.Writer
+	cc map[uint16]byte
+	// トラックごとの次のDTS(90kHz)。tfdtが無い場合に続きにする
+	next map[string]int64
+	// PMTに書いたストリーム
+	hasVideo bool
+	hasAudio bool
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w:    w,
+		cc:   map[uint16]byte{},
+		next: map[string]int64{},
+	}
+}
+
+type esFrame struct {
+	pid  uint16
+	pts  int64
+	dts  int64
+	key  bool
+	data []byte
+}
+
+// 映像、音声のMP4(それぞれ初期化セグメントを含む)をまとめてMPEG-TSにして書き出す
+func (m *Muxer) WriteMP4(files ...[]byte) (err error) {
+	var frames []esFrame
+	for _, b := range files {
+		tracks, e := Parse(b)
+		if e != nil {
+			return e
+		}
+		for _, t := range tracks {
+			frames = append(frames, m.frames(t)...)
+		}
+	}
+	if len(frames) == 0 {
+		return
+	}
+	// DTS順に並べる
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].dts < frames[j].dts })
+
+	for _, f := range frames {
+		if f.pid == pidVideo {
+			m.hasVideo = true
+		} else {
+			m.hasAudio = true
+		}
+	}
+	if err = m.writePAT(); err != nil {
+		return
+	}
+	if err = m.writePMT(); err != nil {
+		return
+	}
+
+	pcrPid := uint16(pidAudio)
+	if m.hasVideo {
+		pcrPid = pidVideo
+	}
+	for _, f := range frames {
+		streamId := byte(0xe0)
+		if f.pid == pidAudio {
+			streamId = 0xc0
+		}
+		if err = m.writePES(f.pid, streamId, f, f.pid == pcrPid); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *Muxer) frames(t *Track) (frames []esFrame) {
+	if len(t.Samples) == 0 {
+		return
+	}
+	to90k := func(v int64) int64 {
+		return v * 90000 / int64(t.Timescale)
+	}
+
+	var offset int64
+	if t.HasBaseTime {
+		offset = baseTime
+	} else {
+		offset = baseTime + m.next[t.Handler]
+	}
+
+	for _, s := range t.Samples {
+		f := esFrame{
+			pts: to90k(s.DTS+s.CTO) + offset,
+			dts: to90k(s.DTS) + offset,
+			key: s.Key,
+		}
+		switch t.Codec {
+		case "avc1":
+			f.pid = pidVideo
+			f.data = annexB(t, s)
+		case "mp4a":
+			f.pid = pidAudio
+			f.data = adts(t.ASC, s.Data)
+		default:
+			continue
+		}
+		frames = append(frames, f)
+	}
+	last := t.Samples[len(t.Samples)-1]
+	m.next[t.Handler] = to90k(last.DTS+last.Duration) + offset - baseTime
+	return
+}
+
+// 長さ付きのNALをスタートコード区切りにする。キーフレームにはSPS, PPSを付ける
+func annexB(t *Track, s Sample) []byte {
+	start := []byte{0, 0, 0, 1}
+	out := append([]byte{}, start...)
+	out = append(out, 0x09, 0xf0) // AUD
+
+	var nals [][]byte
+	hasSPS := false
+	b := s.Data
+	for len(b) >= t.NALLengthSize && t.NALLengthSize > 0 {
+		var n int
+		for i := 0; i < t.NALLengthSize; i++ {
+			n = n<<8 | int(b[i])
+		}
+		b = b[t.NALLengthSize:]
+		if n > len(b) {
+			break
+		}
+		nal := b[:n]
+		b = b[n:]
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case 9: // AUD
+			continue
+		case 7:
+			hasSPS = true
+		}
+		nals = append(nals, nal)
+	}
+	if s.Key && !hasSPS {
+		for _, sps := range t.SPS {
+			out = append(out, start...)
+			out = append(out, sps...)
+		}
+		for _, pps := range t.PPS {
+			out = append(out, start...)
+			out = append(out, pps...)
+		}
+	}
+	for _, nal := range nals {
+		out = append(out, start...)
+		out = append(out, nal...)
+	}
+	return out
+}
+
+// AACにADTSヘッダを付ける
+func adts(asc, data []byte) []byte {
+	profile := byte(2) // AAC LC
+	var freq, ch byte
+	if len(asc) >= 2 {
+		if ot := asc[0] >> 3; 1 <= ot && ot <= 4 {
+			profile = ot
+		}
+		freq = (asc[0]&7)<<1 | asc[1]>>7
+		ch = (asc[1] >> 3) & 0xf
+	}
+	n := len(data) + 7
+	h := []byte{
+		0xff,
+		0xf1,
+		(profile-1)<<6 | freq<<2 | ch>>2,
+		(ch&3)<<6 | byte(n>>11),
+		byte(n >> 3),
+		byte(n&7)<<5 | 0x1f,
+		0xfc,
+	}
+	return append(h, data...)
+}
+
+func putTimestamp(b []byte, prefix byte, t int64) {
+	b[0] = prefix<<4 | byte(t>>29)&0x0e | 1
+	b[1] = byte(t >> 22)
+	b[2] = byte(t>>14) | 1
+	b[3] = byte(t >> 7)
+	b[4] = byte(t<<1) | 1
+}
+
+func (m *Muxer) writePES(pid uint16, streamId byte, f esFrame, withPcr bool) error {
+	var hdr []byte
+	if f.pts != f.dts {
+		hdr = make([]byte, 19)
+		hdr[7] = 0xc0
+		hdr[8] = 10
+		putTimestamp(hdr[9:], 3, f.pts)
+		putTimestamp(hdr[14:], 1, f.dts)
+	} else {
+		hdr = make([]byte, 14)
+		hdr[7] = 0x80
+		hdr[8] = 5
+		putTimestamp(hdr[9:], 2, f.pts)
+	}
+	hdr[2] = 1
+	hdr[3] = streamId
+	hdr[6] = 0x80
+	if l := len(hdr) - 6 + len(f.data); l <= 0xffff {
+		hdr[4] = byte(l >> 8)
+		hdr[5] = byte(l)
+	}
+
+	pcr := int64(-1)
+	if withPcr {
+		pcr = f.dts - pcrDelay
+	}
+	return m.writePackets(pid, append(hdr, f.data...), pcr, f.key)
+}
+
+func (m *Muxer) writePackets(pid uint16, payload []byte, pcr int64, key bool) error {
+	first := true
+	for len(payload) > 0 {
+		var pkt [188]byte
+		pkt[0] = 0x47
+		pkt[1] = byte(pid>>8) & 0x1f
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+		cc := m.cc[pid]
+		m.cc[pid] = (cc + 1) & 0x0f
+
+		// adaptation_fieldの長さの後ろ
+		var af []byte
+		if first && (pcr >= 0 || key) {
+			var flags byte
+			if key {
+				flags |= 0x40
+			}
+			if pcr >= 0 {
+				flags |= 0x10
+			}
+			af = append(af, flags)
+			if pcr >= 0 {
+				af = append(af,
+					byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1),
+					byte(pcr&1)<<7|0x7e, 0,
+				)
+			}
+		}
+		afLen := 0
+		if af != nil {
+			afLen = 1 + len(af)
+		}
+		if stuff := 184 - afLen - len(payload); stuff > 0 {
+			if af == nil {
+				af = []byte{}
+				if stuff >= 2 {
+					af = append(af, 0)
+					stuff--
+				}
+				stuff--
+			}
+			for ; stuff > 0; stuff-- {
+				af = append(af, 0xff)
+			}
+			afLen = 1 + len(af)
+		}
+
+		if af != nil {
+			pkt[3] = 0x30 | cc
+			pkt[4] = byte(len(af))
+			copy(pkt[5:], af)
+		} else {
+			pkt[3] = 0x10 | cc
+		}
+		n := copy(pkt[4+afLen:], payload)
+		payload = payload[n:]
+		if _, err := m.w.Write(pkt[:]); err != nil {
+			return err
+		}
+		first = false
+	}
+	return nil
+}
+
+func (m *Muxer) writeSection(pid uint16, section []byte) error {
+	var pkt [188]byte
+	pkt[0] = 0x47
+	pkt[1] = 0x40 | byte(pid>>8)&0x1f
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.cc[pid]
+	m.cc[pid] = (m.cc[pid] + 1) & 0x0f
+	pkt[4] = 0 // pointer_field
+	n := copy(pkt[5:], section)
+	n = copy(pkt[5+n:], crc32(section))
+	for i := 5 + len(section) + n; i < 188; i++ {
+		pkt[i] = 0xff
+	}
+	_, err := m.w.Write(pkt[:])
+	return err
+}
+
+func (m *Muxer) writePAT() error {
+	return m.writeSection(0, []byte{
+		0x00,     // table_id
+		0xb0, 13, // section_length
+		0x00, 0x01, // transport_stream_id
+		0xc1, 0x00, 0x00,
+		0x00, 0x01, // program_number
+		0xe0 | pidPMT>>8, pidPMT & 0xff,
+	})
+}
+
+func (m *Muxer) writePMT() error {
+	pcrPid := uint16(pidAudio)
+	if m.hasVideo {
+		pcrPid = pidVideo
+	}
+	var es []byte
+	if m.hasVideo {
+		es = append(es, 0x1b, 0xe0|pidVideo>>8, pidVideo&0xff, 0xf0, 0x00)
+	}
+	if m.hasAudio {
+		es = append(es, 0x0f, 0xe0|pidAudio>>8, pidAudio&0xff, 0xf0, 0x00)
+	}
+	l := 9 + len(es) + 4
+	section := []byte{
+		0x02, // table_id
+		0xb0 | byte(l>>8), byte(l),
+		0x00, 0x01, // program_number
+		0xc1, 0x00, 0x00,
+		0xe0 | byte(pcrPid>>8), byte(pcrPid),
+		0xf0, 0x00, // program_info_length
+	}
+	return m.writeSection(pidPMT, append(section, es...))
+}
+
+// MPEG-2のCRC32
+func crc32(b []byte) []byte {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}
+}
+
+// MPEG-TSの先頭のPTS(90kHz)。映像があれば映像のPTS
+func FirstPts(data []byte) (pts int64, ok bool) {
+	var audioPts int64
+	var audioOk bool
+	for i := 0; i+188 <= len(data); i += 188 {
+		pkt := data[i : i+188]
+		if pkt[0] != 0x47 {
+			break
+		}
+		// payload_unit_start_indicator
+		if pkt[1]&0x40 == 0 {
+			continue
+		}
+		p := 4
+		switch pkt[3] & 0x30 {
+		case 0x10:
+		case 0x30:
+			p += 1 + int(pkt[4])
+		default:
+			continue
+		}
+		if p+14 > len(pkt) {
+			continue
+		}
+		pes := pkt[p:]
+		if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+			continue
+		}
+		// PTS_DTS_flags
+		if pes[7]&0x80 == 0 {
+			continue
+		}
+		t := int64(pes[9]&0x0e)<<29 |
+			int64(pes[10])<<22 |
+			int64(pes[11]&0xfe)<<14 |
+			int64(pes[12])<<7 |
+			int64(pes[13])>>1
+
+		switch {
+		case 0xe0 <= pes[3] && pes[3] <= 0xef:
+			return t, true
+		case 0xc0 <= pes[3] && pes[3] <= 0xdf:
+			if !audioOk {
+				audioPts = t
+				audioOk = true
+			}
+		}
+	}
+	return audioPts, audioOk
+}
@@ -0,0 +1,274 @@
+package mp42ts
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testSample struct {
+	dur, cto uint32
+	key      bool
+	data     []byte
+}
+
+// 1トラックのfMP4(初期化セグメントと1つのmoof)
+func testFmp4(handler string, timescale uint32, entry []byte, samples []testSample) []byte {
+	moov := box("moov", box("trak",
+		box("tkhd", testTkhd),
+		box("mdia",
+			box("mdhd", append(make([]byte, 12), be32(timescale)...)),
+			box("hdlr", be32(0), be32(0), []byte(handler)),
+			box("minf", box("stbl", box("stsd", be32(0), be32(1), entry))),
+		),
+	))
+
+	var entries [][]byte
+	var mdat []byte
+	for _, s := range samples {
+		flags := uint32(0x10000)
+		if s.key {
+			flags = 0
+		}
+		entries = append(entries, be32(s.dur), be32(uint32(len(s.data))), be32(flags), be32(s.cto))
+		mdat = append(mdat, s.data...)
+	}
+	// data_offset, duration, size, flags, composition_time_offset
+	moof := func(offset int) []byte {
+		return testMoof(join(be32(0), be32(0)), 0xf01, uint32(len(samples)), append([][]byte{be32(uint32(offset))}, entries...)...)
+	}
+	return join(moov, moof(len(moof(0))+8), box("mdat", mdat))
+}
+
+// AAC LC, 48kHz, 2ch
+var testASC = []byte{0x11, 0x90}
+
+func testVideo() ([]byte, []testSample) {
+	avcC := join([]byte{1, 0x42, 0xc0, 0x1f, 0xff, 0xe1, 0, byte(len(testSPS))}, testSPS, []byte{1, 0, byte(len(testPPS))}, testPPS)
+	entry := box("avc1", make([]byte, 78), box("avcC", avcC))
+
+	nal := func(typ byte, n int) []byte {
+		b := append(be32(uint32(n)), typ)
+		for i := 1; i < n; i++ {
+			b = append(b, byte(i))
+		}
+		return b
+	}
+	samples := []testSample{
+		// 複数のパケットに分かれる
+		{3000, 3000, true, nal(0x65, 500)},
+		{3000, 0, false, nal(0x41, 20)},
+		{3000, 6000, false, nal(0x41, 170)},
+	}
+	return testFmp4("vide", 90000, entry, samples), samples
+}
+
+func testAudio() ([]byte, []testSample) {
+	esds := join(be32(0),
+		[]byte{0x03, 21, 0, 1, 0},
+		[]byte{0x04, 15, 0x40, 0x15}, make([]byte, 11),
+		[]byte{0x05, 2}, testASC,
+	)
+	entry := box("mp4a", make([]byte, 28), box("esds", esds))
+	var samples []testSample
+	for i := 0; i < 4; i++ {
+		samples = append(samples, testSample{1024, 0, true, bytes.Repeat([]byte{byte(i)}, 10)})
+	}
+	return testFmp4("soun", 48000, entry, samples), samples
+}
+
+type testPES struct {
+	pid      uint16
+	streamId byte
+	pts, dts int64
+	pcr      int64 // -1は無し
+	random   bool
+	length   int // PES_packet_lengthから分かるデータの長さ
+	data     []byte
+}
+
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]&0x0e)<<29 | int64(b[1])<<22 | int64(b[2]&0xfe)<<14 | int64(b[3])<<7 | int64(b[4])>>1
+}
+
+// MPEG-2のCRC32(チェック値)
+func TestCrc32(t *testing.T) {
+	if got := crc32([]byte("123456789")); !bytes.Equal(got, []byte{0x03, 0x76, 0xe6, 0xe7}) {
+		t.Errorf("crc32: %x", got)
+	}
+}
+
+// 映像と音声をまとめたMPEG-TSのPAT, PMT, PES, PCR, continuity_counter
+func TestMuxer(t *testing.T) {
+	video, vs := testVideo()
+	audio, as := testAudio()
+
+	var buf bytes.Buffer
+	if err := NewMuxer(&buf).WriteMP4(video, audio); err != nil {
+		t.Fatal(err)
+	}
+	ts := buf.Bytes()
+	if len(ts) == 0 || len(ts)%188 != 0 {
+		t.Fatalf("size %d", len(ts))
+	}
+
+	cc := map[uint16]int{}
+	sections := map[uint16][]byte{}
+	var pes []*testPES
+	cur := map[uint16]*testPES{}
+
+	for i := 0; i < len(ts); i += 188 {
+		pkt := ts[i : i+188]
+		if pkt[0] != 0x47 {
+			t.Fatalf("packet %d: sync byte %x", i/188, pkt[0])
+		}
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		pusi := pkt[1]&0x40 != 0
+
+		// PIDごとに0から1ずつ増える
+		if want := cc[pid] & 0x0f; int(pkt[3]&0x0f) != want {
+			t.Errorf("packet %d: pid %x: continuity_counter %d, want %d", i/188, pid, pkt[3]&0x0f, want)
+		}
+		cc[pid]++
+
+		p := 4
+		pcr := int64(-1)
+		random := false
+		switch pkt[3] & 0x30 {
+		case 0x10:
+		case 0x30:
+			afLen := int(pkt[4])
+			if afLen > 0 {
+				flags := pkt[5]
+				random = flags&0x40 != 0
+				if flags&0x10 != 0 {
+					b := pkt[6:]
+					pcr = int64(b[0])<<25 | int64(b[1])<<17 | int64(b[2])<<9 | int64(b[3])<<1 | int64(b[4])>>7
+				}
+			}
+			p += 1 + afLen
+		default:
+			t.Fatalf("packet %d: adaptation_field_control %x", i/188, pkt[3])
+		}
+		payload := pkt[p:]
+
+		if pid == 0 || pid == pidPMT {
+			if !pusi || payload[0] != 0 {
+				t.Fatalf("pid %x: pointer_field", pid)
+			}
+			l := int(payload[2]&0x0f)<<8 | int(payload[3])
+			sec := payload[1 : 4+l]
+			// CRCを含めて計算すると0になる
+			if got := crc32(sec); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+				t.Errorf("pid %x: CRC mismatch: %x", pid, sec[len(sec)-4:])
+			}
+			sections[pid] = sec
+			continue
+		}
+
+		if pusi {
+			if !bytes.HasPrefix(payload, []byte{0, 0, 1}) {
+				t.Fatalf("packet %d: PES start code %x", i/188, payload[:4])
+			}
+			e := &testPES{pid: pid, streamId: payload[3], pcr: pcr, random: random}
+			n := int(payload[4])<<8 | int(payload[5])
+			switch payload[7] & 0xc0 {
+			case 0xc0:
+				if payload[8] != 10 || payload[9]>>4 != 3 || payload[14]>>4 != 1 {
+					t.Errorf("packet %d: PES header %x", i/188, payload[:19])
+				}
+				e.pts = readTimestamp(payload[9:])
+				e.dts = readTimestamp(payload[14:])
+			case 0x80:
+				if payload[8] != 5 || payload[9]>>4 != 2 {
+					t.Errorf("packet %d: PES header %x", i/188, payload[:14])
+				}
+				e.pts = readTimestamp(payload[9:])
+				e.dts = e.pts
+			default:
+				t.Fatalf("packet %d: PTS_DTS_flags %x", i/188, payload[7])
+			}
+			e.length = n - 3 - int(payload[8])
+			e.data = append(e.data, payload[9+int(payload[8]):]...)
+			cur[pid] = e
+			pes = append(pes, e)
+		} else {
+			e := cur[pid]
+			if e == nil {
+				t.Fatalf("packet %d: no PES start", i/188)
+			}
+			e.data = append(e.data, payload...)
+		}
+	}
+
+	// PATはプログラム1のPMT
+	if pat := sections[0]; len(pat) != 16 || pat[0] != 0 ||
+		(uint16(pat[8])<<8|uint16(pat[9])) != 1 ||
+		(uint16(pat[10]&0x1f)<<8|uint16(pat[11])) != pidPMT {
+		t.Errorf("PAT %x", pat)
+	}
+	// PMTはPCRが映像、H.264とAAC
+	want := join([]byte{0x02, 0xb0, 23, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0},
+		[]byte{0x1b, 0xe1, 0x00, 0xf0, 0}, []byte{0x0f, 0xe1, 0x01, 0xf0, 0})
+	if pmt := sections[pidPMT]; len(pmt) != len(want)+4 || !bytes.Equal(pmt[:len(want)], want) {
+		t.Errorf("PMT %x", pmt)
+	}
+
+	if len(pes) != len(vs)+len(as) {
+		t.Fatalf("%d PES", len(pes))
+	}
+	var vi, ai int
+	var lastDts int64
+	for k, e := range pes {
+		if len(e.data) != e.length {
+			t.Errorf("PES %d: PES_packet_length %d, data %d", k, e.length, len(e.data))
+		}
+		// DTS順
+		if e.dts < lastDts {
+			t.Errorf("PES %d: dts %d < %d", k, e.dts, lastDts)
+		}
+		lastDts = e.dts
+
+		switch e.pid {
+		case pidVideo:
+			s := vs[vi]
+			dts := int64(baseTime + 3000*vi)
+			if e.streamId != 0xe0 || e.dts != dts || e.pts != dts+int64(s.cto) {
+				t.Errorf("video %d: stream %x pts %d dts %d", vi, e.streamId, e.pts, e.dts)
+			}
+			if e.pcr != dts-pcrDelay {
+				t.Errorf("video %d: pcr %d", vi, e.pcr)
+			}
+			if e.random != s.key {
+				t.Errorf("video %d: random_access_indicator %v", vi, e.random)
+			}
+			// AUD、キーフレームにはSPS, PPS
+			sc := []byte{0, 0, 0, 1}
+			data := join(sc, []byte{0x09, 0xf0})
+			if s.key {
+				data = join(data, sc, testSPS, sc, testPPS)
+			}
+			data = join(data, sc, s.data[4:])
+			if !bytes.Equal(e.data, data) {
+				t.Errorf("video %d: data %x", vi, e.data)
+			}
+			vi++
+		case pidAudio:
+			s := as[ai]
+			pts := int64(baseTime + 1920*ai)
+			if e.streamId != 0xc0 || e.pts != pts || e.dts != pts {
+				t.Errorf("audio %d: stream %x pts %d dts %d", ai, e.streamId, e.pts, e.dts)
+			}
+			if e.pcr >= 0 {
+				t.Errorf("audio %d: pcr %d", ai, e.pcr)
+			}
+			// ADTS(AAC LC, 48kHz, 2ch)
+			h := []byte{0xff, 0xf1, 0x4c, 0x80, byte((7 + len(s.data)) >> 3), byte((7+len(s.data))&7)<<5 | 0x1f, 0xfc}
+			if !bytes.Equal(e.data, join(h, s.data)) {
+				t.Errorf("audio %d: data %x", ai, e.data)
+			}
+			ai++
+		default:
+			t.Errorf("PES %d: pid %x", k, e.pid)
+		}
+	}
+}
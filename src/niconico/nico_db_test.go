@@ -0,0 +1,61 @@
+package niconico
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// 切り替えた後のdbにも放送情報があり、前後のdbが分かること
+func TestDBSwitch(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "lv1.sqlite3")
+	second := filepath.Join(dir, "alt", "lv1.sqlite3")
+
+	hls := &NicoHls{dbName: first, stdout: ioutil.Discard}
+	if err := hls.dbOpen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hls.db.Exec(`INSERT INTO kvs (k,v) VALUES ("title", "test"), ("livePts", 90000)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := hls.dbSwitch(second); err != nil {
+		t.Fatal(err)
+	}
+	defer hls.db.Close()
+	if hls.dbName != second {
+		t.Errorf("dbName: %s", hls.dbName)
+	}
+
+	kvs := func(name string) map[string]string {
+		db, err := sql.Open("sqlite3", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		rows, err := db.Query(`SELECT k, v FROM kvs`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		m := map[string]string{}
+		for rows.Next() {
+			var k, v string
+			if err := rows.Scan(&k, &v); err != nil {
+				t.Fatal(err)
+			}
+			m[k] = v
+		}
+		return m
+	}
+
+	m := kvs(first)
+	if m["nextDB"] != second || m["prevDB"] != "" {
+		t.Errorf("first: %v", m)
+	}
+	m = kvs(second)
+	if m["title"] != "test" || m["livePts"] != "90000" || m["prevDB"] != first || m["nextDB"] != "" {
+		t.Errorf("second: %v", m)
+	}
+}
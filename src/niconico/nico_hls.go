@@ -4,8 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -23,12 +25,14 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
+	"github.com/himananiito/livedl/diskguard"
 	"github.com/himananiito/livedl/files"
 	"github.com/himananiito/livedl/gorman"
 	"github.com/himananiito/livedl/httpbase"
+	"github.com/himananiito/livedl/mp42ts"
 	"github.com/himananiito/livedl/objs"
 	"github.com/himananiito/livedl/options"
+	"github.com/himananiito/livedl/outname"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/sha3"
 )
@@ -45,6 +49,7 @@ type playlist struct {
 	withoutFormat      bool
 	seqNo              int
 	position           float64
+	durations          []float64 // 生放送のチャンクの長さ
 }
 type NicoHls struct {
 	wsapi int
@@ -62,6 +67,10 @@ type NicoHls struct {
 	chInterrupt  chan os.Signal
 	nInterrupt   int
 	mtxInterrupt sync.Mutex
+	interrupt    <-chan struct{} // 外部からの停止要求(-daemon)
+
+	stdout io.Writer // 出力先(-daemonではジョブごと)
+	logger *log.Logger
 
 	mtxRestart  sync.Mutex
 	restartMain bool
@@ -77,6 +86,8 @@ type NicoHls struct {
 
 	isTimeshift        bool
 	timeshiftStart     float64
+	openTime           float64 // vposの基準。生放送のチャンクの位置を求める
+	liveAnchored       bool    // 生放送の位置の基準(livePosition, livePts)を記録した
 	fastTimeshift      bool
 	ultrafastTimeshift bool
 
@@ -85,6 +96,7 @@ type NicoHls struct {
 
 	finish      bool
 	commentDone bool
+	diskFull    bool
 
 	NicoSession string
 	limitBw     int
@@ -101,6 +113,9 @@ type NicoHls struct {
 
 	mtxWg sync.Mutex
 
+	stats    Stats
+	statsMtx sync.Mutex
+
 	gmPlst *gorman.GoroutineManager
 	gmCmnt *gorman.GoroutineManager
 	gmDB   *gorman.GoroutineManager
@@ -127,7 +142,7 @@ func NewHls(opt options.Option, prop map[string]interface{}) (hls *NicoHls, err
 	wsapi := 2
 	if m := regexp.MustCompile(`/wsapi/v1/`).FindStringSubmatch(webSocketUrl); len(m) > 0 {
 		wsapi = 1
-		log.Println("wsapi: 1")
+		fmt.Fprintln(opt.Out(), "wsapi: 1")
 	}
 
 	myUserId, _ := prop["//myId"].(string)
@@ -146,7 +161,7 @@ func NewHls(opt options.Option, prop map[string]interface{}) (hls *NicoHls, err
 		}
 		webSocketUrl = strings.Replace(webSocketUrl, "/wsapi/v2/", "/wsapi/v1/", 1)
 		wsapi = 1
-		log.Println("wsapi: 1")
+		fmt.Fprintln(opt.Out(), "wsapi: 1")
 	}
 
 	var pid string
@@ -154,98 +169,15 @@ func NewHls(opt options.Option, prop map[string]interface{}) (hls *NicoHls, err
 		pid, _ = nicoliveProgramId.(string)
 	}
 
-	var uname string // ユーザ名
-	var uid string   // ユーザID
-	var cname string // コミュ名 or チャンネル名
-	var cid string   // コミュID or チャンネルID
-
-	var pt string
-	if providerType, ok := prop["providerType"]; ok {
-		if pt, ok = providerType.(string); ok {
-			if pt == "official" {
-				uname = "official"
-				uid = "official"
-				cname = "official"
-				cid = "official"
-			}
-		}
-	}
-
-	// ユーザ名
-	if userName, ok := prop["userName"]; ok {
-		uname, _ = userName.(string)
-	}
-
 	// ユーザID
-	if userPageUrl, ok := prop["userPageUrl"]; ok {
-		if u, ok := userPageUrl.(string); ok {
-			if m := regexp.MustCompile(`/user/(\d+)`).FindStringSubmatch(u); len(m) > 0 {
-				uid = m[1]
-				prop["userId"] = uid
-			}
+	if userPageUrl, ok := prop["userPageUrl"].(string); ok {
+		if m := regexp.MustCompile(`/user/(\d+)`).FindStringSubmatch(userPageUrl); len(m) > 0 {
+			prop["userId"] = m[1]
 		}
 	}
-	if uid == "" && pt == "channel" {
-		uid = "channel"
-	}
-
-	// コミュ名
-	if socName, ok := prop["socName"]; ok {
-		cname, _ = socName.(string)
-	}
-
-	// コミュID
-	if comId, ok := prop["comId"]; ok {
-		cid, _ = comId.(string)
-	}
-	if cid == "" {
-		if socId, ok := prop["socId"]; ok {
-			cid, _ = socId.(string)
-		}
-	}
-
-	var title string
-	if t, ok := prop["title"]; ok {
-		title, _ = t.(string)
-	}
-
-	var beginTime int64
-	if t, ok := prop["beginTime"]; ok {
-		if bt, ok := t.(float64); ok {
-			beginTime = int64(bt)
-		}
-	}
-	tBegin := time.Unix(beginTime, 0)
-	sYear := fmt.Sprintf("%04d", tBegin.Year())
-	sMonth := fmt.Sprintf("%02d", tBegin.Month())
-	sDay := fmt.Sprintf("%02d", tBegin.Day())
-	sDay8 := fmt.Sprintf("%04d%02d%02d", tBegin.Year(), tBegin.Month(), tBegin.Day())
-	sDay6 := fmt.Sprintf("%02d%02d%02d", tBegin.Year()%100, tBegin.Month(), tBegin.Day())
-	sHour := fmt.Sprintf("%02d", tBegin.Hour())
-	sMinute := fmt.Sprintf("%02d", tBegin.Minute())
-	sSecond := fmt.Sprintf("%02d", tBegin.Second())
-	sTime6 := fmt.Sprintf("%02d%02d%02d", tBegin.Hour(), tBegin.Minute(), tBegin.Second())
-	sTime4 := fmt.Sprintf("%02d%02d", tBegin.Hour(), tBegin.Minute())
 
 	// "${PID}-${UNAME}-${TITLE}"
-	dbName := opt.NicoFormat
-	dbName = strings.Replace(dbName, "?PID?", files.ReplaceForbidden(pid), -1)
-	dbName = strings.Replace(dbName, "?UNAME?", files.ReplaceForbidden(uname), -1)
-	dbName = strings.Replace(dbName, "?UID?", files.ReplaceForbidden(uid), -1)
-	dbName = strings.Replace(dbName, "?CNAME?", files.ReplaceForbidden(cname), -1)
-	dbName = strings.Replace(dbName, "?CID?", files.ReplaceForbidden(cid), -1)
-	dbName = strings.Replace(dbName, "?TITLE?", files.ReplaceForbidden(title), -1)
-	// date,time
-	dbName = strings.Replace(dbName, "?YEAR?", sYear, -1)
-	dbName = strings.Replace(dbName, "?MONTH?", sMonth, -1)
-	dbName = strings.Replace(dbName, "?DAY?", sDay, -1)
-	dbName = strings.Replace(dbName, "?DAY8?", sDay8, -1)
-	dbName = strings.Replace(dbName, "?DAY6?", sDay6, -1)
-	dbName = strings.Replace(dbName, "?HOUR?", sHour, -1)
-	dbName = strings.Replace(dbName, "?MINUTE?", sMinute, -1)
-	dbName = strings.Replace(dbName, "?SECOND?", sSecond, -1)
-	dbName = strings.Replace(dbName, "?TIME6?", sTime6, -1)
-	dbName = strings.Replace(dbName, "?TIME4?", sTime4, -1)
+	dbName := outname.Path(opt.NicoFormat, nameVars(prop))
 
 	if timeshift {
 		dbName = dbName + "(TS)"
@@ -268,18 +200,27 @@ func NewHls(opt options.Option, prop map[string]interface{}) (hls *NicoHls, err
 		fastTimeshift:      opt.NicoFastTs || opt.NicoUltraFastTs,
 		ultrafastTimeshift: opt.NicoUltraFastTs,
 
+		interrupt: opt.Interrupt,
+		stdout:    opt.Out(),
+		logger:    log.New(opt.Out(), "", log.LstdFlags),
+
 		NicoSession: opt.NicoSession,
 		limitBw:     opt.NicoLimitBw,
 		limitBwOrig: opt.NicoLimitBw,
 		nicoDebug:   opt.NicoDebug,
 
-		gmPlst: gorman.WithChecker(func(c int) { hls.checkReturnCode(c) }),
-		gmCmnt: gorman.WithChecker(func(c int) { hls.checkReturnCode(c) }),
-		gmDB:   gorman.WithChecker(func(c int) { hls.checkReturnCode(c) }),
-		gmMain: gorman.WithChecker(func(c int) { hls.checkReturnCode(c) }),
-
 		timeshiftStart: opt.NicoTsStart,
 	}
+	if t, ok := prop["openTime"].(float64); ok {
+		hls.openTime = t
+	}
+
+	// mainを止めるとplaylist, comment, DBも止まる
+	// DBの書き込みはctxを見ないので、止めても最後まで書く
+	hls.gmMain = gorman.WithChecker(nicoliveProgramId, hls.checkError)
+	hls.gmPlst = hls.gmMain.Child("playlist", hls.checkError)
+	hls.gmCmnt = hls.gmMain.Child("comment", hls.checkError)
+	hls.gmDB = hls.gmMain.Child("db", hls.checkError)
 
 	hls.fastTimeshiftOrig = hls.fastTimeshift
 	hls.ultrafastTimeshiftOrig = hls.ultrafastTimeshift
@@ -294,12 +235,12 @@ func NewHls(opt options.Option, prop map[string]interface{}) (hls *NicoHls, err
 			break
 		}
 
-		fmt.Printf("can't open: %s\n", hls.dbName)
+		fmt.Fprintf(opt.Out(), "can't open: %s\n", hls.dbName)
 		hls.dbName = fmt.Sprintf("%s.sqlite3", pid)
 	}
 
 	if err := hls.memdbOpen(); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(opt.Out(), err)
 		os.Exit(1)
 	}
 
@@ -313,6 +254,84 @@ func NewHls(opt options.Option, prop map[string]interface{}) (hls *NicoHls, err
 
 	return
 }
+
+// ファイル名の置換変数
+func nameVars(prop map[string]interface{}) (vars outname.Vars) {
+	var pid string
+	if nicoliveProgramId, ok := prop["nicoliveProgramId"]; ok {
+		pid, _ = nicoliveProgramId.(string)
+	}
+
+	var uname string // ユーザ名
+	var uid string   // ユーザID
+	var cname string // コミュ名 or チャンネル名
+	var cid string   // コミュID or チャンネルID
+
+	var pt string
+	if providerType, ok := prop["providerType"]; ok {
+		if pt, ok = providerType.(string); ok {
+			if pt == "official" {
+				uname = "official"
+				uid = "official"
+				cname = "official"
+				cid = "official"
+			}
+		}
+	}
+
+	// ユーザ名
+	if userName, ok := prop["userName"]; ok {
+		uname, _ = userName.(string)
+	}
+
+	// ユーザID
+	if userId, ok := prop["userId"].(string); ok {
+		uid = userId
+	}
+	if uid == "" && pt == "channel" {
+		uid = "channel"
+	}
+
+	// コミュ名
+	if socName, ok := prop["socName"]; ok {
+		cname, _ = socName.(string)
+	}
+
+	// コミュID
+	if comId, ok := prop["comId"]; ok {
+		cid, _ = comId.(string)
+	}
+	if cid == "" {
+		if socId, ok := prop["socId"]; ok {
+			cid, _ = socId.(string)
+		}
+	}
+
+	var title string
+	if t, ok := prop["title"]; ok {
+		title, _ = t.(string)
+	}
+
+	var beginTime int64
+	if t, ok := prop["beginTime"]; ok {
+		if bt, ok := t.(float64); ok {
+			beginTime = int64(bt)
+		}
+	}
+
+	vars = outname.Vars{
+		"SERVICE": "nico",
+		"PID":     pid,
+		"UNAME":   uname,
+		"UID":     uid,
+		"CNAME":   cname,
+		"CID":     cid,
+		"TITLE":   title,
+	}
+	vars.SetTime(time.Unix(beginTime, 0))
+	return
+}
+
 func (hls *NicoHls) Close() {
 	hls.dbCommit()
 	if hls.db != nil {
@@ -378,6 +397,7 @@ func (hls *NicoHls) commentHandler(tag string, attr interface{}) (err error) {
 			"locale":    attrMap["locale"],
 			"hash":      hash,
 		})
+		hls.statsComment()
 	} else {
 		if d, ok := attrMap["thread"].(float64); ok {
 			hls.dbKVSet("comment/thread", fmt.Sprintf("%.f", d))
@@ -408,25 +428,27 @@ const (
 	GOT_SIGNAL
 	ERROR_SHUTDOWN
 	NETWORK_ERROR
+	DISK_FULL
 )
 
-func (hls *NicoHls) stopPCGoroutines() {
-	hls.stopPGoroutines()
-	hls.stopCGoroutines()
+// causeは止めた原因(gorman.Causeで取れる)
+func (hls *NicoHls) stopPCGoroutines(cause error) {
+	hls.stopPGoroutines(cause)
+	hls.stopCGoroutines(cause)
 }
-func (hls *NicoHls) stopAllGoroutines() {
-	hls.stopPGoroutines()
-	hls.stopCGoroutines()
-	hls.stopMGoroutines()
+func (hls *NicoHls) stopAllGoroutines(cause error) {
+	hls.stopPGoroutines(cause)
+	hls.stopCGoroutines(cause)
+	hls.stopMGoroutines(cause)
 }
-func (hls *NicoHls) stopPGoroutines() {
-	hls.gmPlst.Cancel()
+func (hls *NicoHls) stopPGoroutines(cause error) {
+	hls.gmPlst.Cancel(cause)
 }
-func (hls *NicoHls) stopCGoroutines() {
-	hls.gmCmnt.Cancel()
+func (hls *NicoHls) stopCGoroutines(cause error) {
+	hls.gmCmnt.Cancel(cause)
 }
-func (hls *NicoHls) stopMGoroutines() {
-	hls.gmMain.Cancel()
+func (hls *NicoHls) stopMGoroutines(cause error) {
+	hls.gmMain.Cancel(cause)
 }
 func (hls *NicoHls) working() bool {
 	return hls.gmPlst.Count() > 0 || hls.gmCmnt.Count() > 0 || hls.gmDB.Count() > 0
@@ -440,23 +462,26 @@ func (hls *NicoHls) stopInterrupt() {
 func (hls *NicoHls) startInterrupt() {
 	if hls.chInterrupt == nil {
 		hls.chInterrupt = make(chan os.Signal, 10)
-		signal.Notify(hls.chInterrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+		// -daemonではシグナルはデーモン側で受けてinterruptを閉じる
+		if hls.interrupt == nil {
+			signal.Notify(hls.chInterrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+		}
 	}
 
-	hls.startMGoroutine(func(sig <-chan struct{}) int {
+	hls.startMGoroutine("interrupt", func(ctx context.Context) error {
 		select {
 		case <-hls.chInterrupt:
 			hls.IncrInterrupt()
-			fmt.Printf("Interrupt count: %d\n", hls.nInterrupt)
+			fmt.Fprintf(hls.stdout, "Interrupt count: %d\n", hls.nInterrupt)
 			go func() {
 				hls.dbCommit()
 			}()
-			if hls.nInterrupt >= 2 {
+			if hls.nInterrupt >= 2 && hls.interrupt == nil {
 				os.Exit(0)
 			}
-			return INTERRUPT
-		case <-sig:
-			return GOT_SIGNAL
+			return gorman.Fail(INTERRUPT, nil)
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	})
 }
@@ -481,13 +506,17 @@ func (hls *NicoHls) markRestartMain(delay int) {
 	hls.mtxRestart.Lock()
 	defer hls.mtxRestart.Unlock()
 
-	if (!hls.restartMain) && (!hls.finish) {
+	if (!hls.restartMain) && (!hls.finish) && (!hls.diskFull) {
 		hls.startDelay = delay
 		hls.restartMain = true
 	}
 }
-func (hls *NicoHls) checkReturnCode(code int) {
+func (hls *NicoHls) checkError(err error) {
 	// NEVER restart goroutines here except interrupt handler
+	code := gorman.Code(err)
+	if hls.nicoDebug && err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", debug_Now(), err)
+	}
 	switch code {
 	case NETWORK_ERROR, MAIN_TEMPORARILY_ERROR:
 		delay := hls.getStartDelay()
@@ -501,7 +530,7 @@ func (hls *NicoHls) checkReturnCode(code int) {
 		} else {
 			hls.markRestartMain(60)
 		}
-		hls.stopPCGoroutines()
+		hls.stopPCGoroutines(err)
 
 	case DELAY:
 		//log.Println("delay")
@@ -512,59 +541,65 @@ func (hls *NicoHls) checkReturnCode(code int) {
 		if !hls.interrupted() {
 			hls.markRestartMain(0)
 		}
-		hls.stopPGoroutines()
+		hls.stopPGoroutines(err)
 
 	case PLAYLIST_END:
-		fmt.Println("playlist end.")
+		fmt.Fprintln(hls.stdout, "playlist end.")
 		hls.finish = true
 		if hls.isTimeshift {
 			if hls.commentDone {
-				hls.stopPCGoroutines()
+				hls.stopPCGoroutines(err)
 			} else if !hls.getCommentStarted() {
-				hls.stopPCGoroutines()
+				hls.stopPCGoroutines(err)
 			} else {
-				fmt.Println("waiting comment")
+				fmt.Fprintln(hls.stdout, "waiting comment")
 			}
 		} else {
-			hls.stopPCGoroutines()
+			hls.stopPCGoroutines(err)
 		}
 
 	case MAIN_WS_ERROR:
-		hls.stopPGoroutines()
+		hls.stopPGoroutines(err)
 
 	case MAIN_DISCONNECT:
-		hls.stopPCGoroutines()
+		hls.stopPCGoroutines(err)
 
 	case MAIN_END_PROGRAM:
 		hls.finish = true
-		hls.stopPCGoroutines()
+		hls.stopPCGoroutines(err)
 
 	case MAIN_INVALID_STREAM_QUALITY:
 		hls.markRestartMain(0)
-		hls.stopPGoroutines()
+		hls.stopPGoroutines(err)
 
 	case PLAYLIST_ERROR:
-		hls.stopPCGoroutines()
+		hls.stopPCGoroutines(err)
 
 	case COMMENT_WS_ERROR:
 		//log.Println("comment websocket error")
-		hls.stopCGoroutines()
+		hls.stopCGoroutines(err)
 
 	case COMMENT_SAVE_ERROR:
 		//log.Println("comment save error")
-		hls.stopCGoroutines()
+		hls.stopCGoroutines(err)
 
 	case INTERRUPT:
 		hls.startInterrupt()
-		hls.stopPCGoroutines()
+		hls.stopPCGoroutines(err)
 
 	case ERROR_SHUTDOWN:
-		hls.stopPCGoroutines()
+		hls.stopPCGoroutines(err)
+
+	case DISK_FULL:
+		// 書き込み済みのデータを確定させて録画を止める
+		hls.diskFull = true
+		hls.dbCommit()
+		hls.stopPCGoroutines(err)
 
 	case COMMENT_DONE:
 		hls.commentDone = true
 		if hls.finish {
-			hls.stopPCGoroutines()
+			hls.stopPCGoroutines(err)
 		}
 
 	case OK:
@@ -572,29 +607,29 @@ func (hls *NicoHls) checkReturnCode(code int) {
 }
 
 // Of playlist
-func (hls *NicoHls) startPGoroutine(f func(<-chan struct{}) int) {
+func (hls *NicoHls) startPGoroutine(name string, f func(context.Context) error) {
 	if !hls.interrupted() {
-		hls.gmPlst.Go(f)
+		hls.gmPlst.Go(name, f)
 	}
 }
 
 // Of comment
-func (hls *NicoHls) startCGoroutine(f func(<-chan struct{}) int) {
+func (hls *NicoHls) startCGoroutine(name string, f func(context.Context) error) {
 	if !hls.interrupted() {
-		hls.gmCmnt.Go(f)
+		hls.gmCmnt.Go(name, f)
 	}
 }
 
 // Of DB
-func (hls *NicoHls) startDBGoroutine(f func(<-chan struct{}) int) {
+func (hls *NicoHls) startDBGoroutine(name string, f func(context.Context) error) {
 	if !hls.interrupted() {
-		hls.gmDB.Go(f)
+		hls.gmDB.Go(name, f)
 	}
 }
 
 // Of main
-func (hls *NicoHls) startMGoroutine(f func(<-chan struct{}) int) {
-	hls.gmMain.Go(f)
+func (hls *NicoHls) startMGoroutine(name string, f func(context.Context) error) {
+	hls.gmMain.Go(name, f)
 }
 
 func (hls *NicoHls) waitRestartMain() bool {
@@ -602,7 +637,7 @@ func (hls *NicoHls) waitRestartMain() bool {
 	if ok {
 		fn := runtime.FuncForPC(pc)
 		if !strings.HasSuffix(fn.Name(), ".Wait") {
-			log.Printf("[FIXME] Don't call waitRestartMain from %s\n", fn.Name())
+			hls.logger.Printf("[FIXME] Don't call waitRestartMain from %s\n", fn.Name())
 		}
 	}
 
@@ -641,7 +676,7 @@ func (hls *NicoHls) waitAllGoroutines() {
 func (hls *NicoHls) getwaybackkey(threadId string) (waybackkey string, neterr, err error) {
 
 	uri := fmt.Sprintf("https://live.nicovideo.jp/api/getwaybackkey?thread=%s", url.QueryEscape(threadId))
-	resp, err, neterr := httpbase.Get(uri, map[string]string{"Cookie": "user_session=" + hls.NicoSession})
+	resp, err, neterr := httpbase.Get(uri, nil)
 	if err != nil {
 		return
 	}
@@ -676,7 +711,7 @@ func (hls *NicoHls) startComment(messageServerUri, threadId, waybackkey string)
 	if (!hls.getCommentStarted()) && (!hls.commentDone) {
 		hls.setCommentStarted(true)
 
-		hls.startCGoroutine(func(sig <-chan struct{}) int {
+		hls.startCGoroutine("message", func(ctx context.Context) error {
 			defer func() {
 				hls.setCommentStarted(false)
 			}()
@@ -684,7 +719,7 @@ func (hls *NicoHls) startComment(messageServerUri, threadId, waybackkey string)
 			var err error
 
 			// here blocks several seconds
-			conn, _, err := websocket.DefaultDialer.Dial(
+			conn, _, err := httpbase.DialWebsocket(
 				messageServerUri,
 				map[string][]string{
 					"Origin":                 []string{"https://live2.nicovideo.jp"},
@@ -694,9 +729,9 @@ func (hls *NicoHls) startComment(messageServerUri, threadId, waybackkey string)
 			)
 			if err != nil {
 				if !hls.interrupted() {
-					log.Println("comment connect:", err)
+					hls.logger.Println("comment connect:", err)
 				}
-				return COMMENT_WS_ERROR
+				return gorman.Fail(COMMENT_WS_ERROR, err)
 			}
 			var wsMtx sync.Mutex
 			writeJson := func(d interface{}) error {
@@ -705,33 +740,33 @@ func (hls *NicoHls) startComment(messageServerUri, threadId, waybackkey string)
 				return conn.WriteJSON(d)
 			}
 
-			hls.startCGoroutine(func(sig <-chan struct{}) int {
-				<-sig
+			hls.startCGoroutine("close", func(ctx context.Context) error {
+				<-ctx.Done()
 				if conn != nil {
 					conn.Close()
 				}
-				return OK
+				return nil
 			})
 
-			hls.startCGoroutine(func(sig <-chan struct{}) int {
+			hls.startCGoroutine("keepalive", func(ctx context.Context) error {
 				for !hls.interrupted() {
 					select {
 					case <-time.After(60 * time.Second):
 						if conn != nil {
 							if err := writeJson(""); err != nil {
 								if !hls.interrupted() {
-									log.Println("comment send null:", err)
+									hls.logger.Println("comment send null:", err)
 								}
-								return COMMENT_WS_ERROR
+								return gorman.Fail(COMMENT_WS_ERROR, err)
 							}
 						} else {
-							return OK
+							return nil
 						}
-					case <-sig:
-						return GOT_SIGNAL
+					case <-ctx.Done():
+						return ctx.Err()
 					}
 				}
-				return OK
+				return nil
 			})
 
 			var mtxChatTime sync.Mutex
@@ -749,9 +784,9 @@ func (hls *NicoHls) startComment(messageServerUri, threadId, waybackkey string)
 
 			if hls.isTimeshift {
 
-				hls.startCGoroutine(func(sig <-chan struct{}) int {
+				hls.startCGoroutine("timeshift", func(ctx context.Context) error {
 					defer func() {
-						fmt.Println("Comment done.")
+						fmt.Fprintln(hls.stdout, "Comment done.")
 					}()
 
 					var pre int64
@@ -785,14 +820,14 @@ func (hls *NicoHls) startComment(messageServerUri, threadId, waybackkey string)
 									OBJ{"ping": OBJ{"content": "rf:1"}},
 								})
 								if err != nil {
-									return NETWORK_ERROR
+									return gorman.Fail(NETWORK_ERROR, err)
 								}
 
 							} else if c < pre+100 {
 								// 通常,1000カウント弱増えるが、少ししか増えない場合
 								finishHint++
 								if finishHint > 2 {
-									return COMMENT_DONE
+									return gorman.Fail(COMMENT_DONE, nil)
 								}
 
 							} else {
@@ -800,11 +835,11 @@ func (hls *NicoHls) startComment(messageServerUri, threadId, waybackkey string)
 							}
 							pre = c
 
-						case <-sig:
-							return GOT_SIGNAL
+						case <-ctx.Done():
+							return ctx.Err()
 						}
 					}
-					return COMMENT_DONE
+					return gorman.Fail(COMMENT_DONE, nil)
 				})
 
 			} else {
@@ -826,44 +861,44 @@ func (hls *NicoHls) startComment(messageServerUri, threadId, waybackkey string)
 				})
 				if err != nil {
 					if !hls.interrupted() {
-						log.Println("comment send first:", err)
+						hls.logger.Println("comment send first:", err)
 					}
-					return COMMENT_WS_ERROR
+					return gorman.Fail(COMMENT_WS_ERROR, err)
 				}
 			}
 
 			for !hls.interrupted() {
 				select {
-				case <-sig:
-					return GOT_SIGNAL
+				case <-ctx.Done():
+					return ctx.Err()
 				default:
 					var res interface{}
 					// Blocks here
 					if err = conn.ReadJSON(&res); err != nil {
-						return COMMENT_WS_ERROR
+						return gorman.Fail(COMMENT_WS_ERROR, err)
 					}
 
 					//fmt.Printf("debug %#v\n", res)
 
 					if data, ok := objs.Find(res, "chat"); ok {
 						if err := hls.commentHandler("chat", data); err != nil {
-							return COMMENT_SAVE_ERROR
+							return gorman.Fail(COMMENT_SAVE_ERROR, err)
 						}
 						incChatCount()
 
 					} else if data, ok := objs.Find(res, "thread"); ok {
 						if err := hls.commentHandler("thread", data); err != nil {
-							return COMMENT_SAVE_ERROR
+							return gorman.Fail(COMMENT_SAVE_ERROR, err)
 						}
 
 					} else if _, ok := objs.Find(res, "ping"); ok {
 						// nop
 					} else {
-						fmt.Printf("[FIXME] Unknown Message: %#v\n", res)
+						fmt.Fprintf(hls.stdout, "[FIXME] Unknown Message: %#v\n", res)
 					}
 				}
 			}
-			return OK
+			return nil
 		})
 	}
 }
@@ -878,37 +913,23 @@ func urlJoin(base *url.URL, uri string) (res *url.URL, err error) {
 	return
 }
 
-func getStringBase(uri string, header map[string]string) (s string, code int, t int64, err, neterr error) {
+func getStringBase(p *httpbase.RetryPolicy, uri string, header map[string]string) (s string, code int, t int64, err, neterr error) {
 	start := time.Now().UnixNano()
 	defer func() {
 		t = (time.Now().UnixNano() - start) / (1000 * 1000)
 	}()
 
-	resp, err, neterr := httpbase.Get(uri, header)
-	if err != nil {
-		return
-	}
-	if neterr != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	bs, neterr := ioutil.ReadAll(resp.Body)
-	if neterr != nil {
-		return
-	}
-
+	code, bs, err, neterr := httpbase.GetBytesRetry(p, uri, header)
 	s = string(bs)
-
-	code = resp.StatusCode
-
 	return
 }
+
+// プレイリスト用
 func getString(uri string) (s string, code int, t int64, err, neterr error) {
-	return getStringBase(uri, nil)
+	return getStringBase(&httpbase.LiveRetry, uri, nil)
 }
 func getStringHeader(uri string, header map[string]string) (s string, code int, t int64, err, neterr error) {
-	return getStringBase(uri, header)
+	return getStringBase(nil, uri, header)
 }
 func postStringHeader(uri string, header map[string]string, val url.Values) (s string, code int, t int64, err, neterr error) {
 	start := time.Now().UnixNano()
@@ -916,49 +937,19 @@ func postStringHeader(uri string, header map[string]string, val url.Values) (s s
 		t = (time.Now().UnixNano() - start) / (1000 * 1000)
 	}()
 
-	resp, err, neterr := httpbase.PostForm(uri, header, val)
-	if err != nil {
-		return
-	}
-	if neterr != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	bs, neterr := ioutil.ReadAll(resp.Body)
-	if neterr != nil {
-		return
-	}
-
+	code, bs, err, neterr := httpbase.PostFormBytes(uri, header, val)
 	s = string(bs)
-
-	code = resp.StatusCode
-
 	return
 }
 
+// セグメント用
 func getBytes(uri string) (code int, buff []byte, t int64, err, neterr error) {
 	start := time.Now().UnixNano()
 	defer func() {
 		t = (time.Now().UnixNano() - start) / (1000 * 1000)
 	}()
 
-	resp, err, neterr := httpbase.Get(uri, nil)
-	if err != nil {
-		return
-	}
-	if neterr != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	buff, neterr = ioutil.ReadAll(resp.Body)
-	if neterr != nil {
-		return
-	}
-
-	code = resp.StatusCode
-
+	code, buff, err, neterr = httpbase.GetBytesRetry(&httpbase.LiveRetry, uri, nil)
 	return
 }
 
@@ -982,9 +973,16 @@ func (hls *NicoHls) saveMedia(seqno int, uri string) (is403, is404, is500 bool,
 		fmt.Fprintf(os.Stderr, "%s:getBytes@saveMedia: seqno=%d, code=%v, err=%v, neterr=%v, %v(ms), len=%v\n",
 			debug_Now(), seqno, code, err, neterr, millisec, len(buff))
 	}
+	if neterr != nil {
+		hls.statsError(code, neterr)
+	}
 	if err != nil || neterr != nil {
 		return
 	}
+	switch code {
+	case 403, 404, 500:
+		hls.statsError(code, nil)
+	}
 
 	switch code {
 	case 403:
@@ -1021,10 +1019,16 @@ func (hls *NicoHls) saveMedia(seqno int, uri string) (is403, is404, is500 bool,
 		"data":      buff,
 	}
 
-	if seqno == hls.playlist.seqNo {
-		if hls.isTimeshift {
+	if hls.isTimeshift {
+		if seqno == hls.playlist.seqNo {
 			data["position"] = hls.playlist.position
 		}
+	} else {
+		hls.anchorLive(seqno, buff)
+	}
+
+	if err = hls.checkFreeSpace(); err != nil {
+		return
 	}
 
 	if hls.nicoDebug {
@@ -1035,10 +1039,54 @@ func (hls *NicoHls) saveMedia(seqno int, uri string) (is403, is404, is500 bool,
 		timePassed = append(timePassed, time.Now().UnixNano())
 	}
 	hls.memdbSet200(seqno)
+	hls.statsMedia(seqno, hls.playlist.bandwidth, len(buff))
 
 	return
 }
 
+// 生放送は最初に取得したプレイリストのチャンクの推定位置とPTSを記録する
+// -d2mはこれとチャンクのPTSから位置を求めるので、途中で止まっても時計はずれない
+func (hls *NicoHls) anchorLive(seqno int, buff []byte) {
+	if hls.liveAnchored || hls.openTime <= 0 {
+		return
+	}
+	i := seqno - hls.playlist.seqNo
+	if i < 0 || i >= len(hls.playlist.durations) {
+		return
+	}
+	pts, ok := mp42ts.FirstPts(buff)
+	if !ok {
+		return
+	}
+	pos := hls.playlist.position
+	for _, d := range hls.playlist.durations[:i] {
+		pos += d
+	}
+	hls.dbKVSet("livePosition", pos)
+	hls.dbKVSet("livePts", pts)
+	hls.liveAnchored = true
+}
+
+// 空き容量が足りなければ予備の出力先に切り替える
+// 切り替えられなければdiskguard.ErrLowSpaceを返す
+func (hls *NicoHls) checkFreeSpace() (err error) {
+	ok, free, _ := diskguard.Check(hls.dbName)
+	if ok {
+		return
+	}
+	diskguard.Warn(hls.dbName, free)
+
+	if name, ok := diskguard.Alternative(hls.dbName); ok {
+		if e := hls.dbSwitch(name); e == nil {
+			return
+		} else {
+			fmt.Fprintln(hls.stdout, e)
+		}
+	}
+	err = diskguard.ErrLowSpace
+	return
+}
+
 func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, neterr, err error) {
 	u := argUri.String()
 	m3u8, code, millisec, err, neterr := getString(u)
@@ -1068,7 +1116,7 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 							return
 						} else {
 							hls.bw500 = hls.playlist.bandwidth
-							fmt.Printf("Changing limitBw: %v -> %v\n", hls.limitBw, hls.playlist.bandwidth-1)
+							fmt.Fprintf(hls.stdout, "Changing limitBw: %v -> %v\n", hls.limitBw, hls.playlist.bandwidth-1)
 							hls.limitBw = hls.playlist.bandwidth - 1
 						}
 					}
@@ -1087,7 +1135,7 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 			is500 = true
 			return
 		}
-		fmt.Printf("#### playlist code: %d: %s\n", code, argUri.String())
+		fmt.Fprintf(hls.stdout, "#### playlist code: %d: %s\n", code, argUri.String())
 		err = fmt.Errorf("playlist code: %d: %s", code, argUri.String())
 		return
 	}
@@ -1149,7 +1197,7 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 		ma := re.FindAllStringSubmatch(m3u8, -1)
 
 		if len(ma) == 0 {
-			log.Println("No medias in playlist")
+			hls.logger.Println("No medias in playlist")
 			hls.playlist.nextTime = time.Now().Add(time.Second)
 			return
 		}
@@ -1164,33 +1212,29 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 		var seqMax int
 		var totalDuration float64
 		for i, a := range ma {
-			var duration float64
 			seqno := i + hls.playlist.seqNo
 			if seqno > seqMax {
 				seqMax = seqno
 			}
 
-			if hls.isTimeshift || i == 0 {
-				d, e := strconv.ParseFloat(a[1], 64)
-				if e != nil {
-					err = e
-					return
-				}
-
-				if hls.isTimeshift {
-					duration = d
-					totalDuration += d
-				} else {
-					if i == 0 {
-						if d > 3 {
-							fmt.Printf("debug: found EXTINF=%v\n", d)
-							d = 2.0
-						} else {
-							d = d + 0.5
-						}
-						t := time.Duration(float64(time.Second) * d)
-						hls.playlist.nextTime = time.Now().Add(t)
+			d, e := strconv.ParseFloat(a[1], 64)
+			if e != nil {
+				err = e
+				return
+			}
+			duration := d
+			totalDuration += d
+
+			if !hls.isTimeshift {
+				if i == 0 {
+					if d > 3 {
+						fmt.Fprintf(hls.stdout, "debug: found EXTINF=%v\n", d)
+						d = 2.0
+					} else {
+						d = d + 0.5
 					}
+					t := time.Duration(float64(time.Second) * d)
+					hls.playlist.nextTime = time.Now().Add(t)
 				}
 			}
 
@@ -1219,13 +1263,23 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 					hls.playlist.format = f
 
 				} else if hls.playlist.format != f {
-					fmt.Println(m3u8)
-					fmt.Println("[FIXME] media format changed")
+					fmt.Fprintln(hls.stdout, m3u8)
+					fmt.Fprintln(hls.stdout, "[FIXME] media format changed")
 					hls.playlist.withoutFormat = true
 				}
 			}
 		}
 
+		// 生放送は最後のチャンクの終わりを今として、先頭のチャンクの位置を推定する
+		if !hls.isTimeshift && !hls.liveAnchored && hls.openTime > 0 {
+			now := float64(time.Now().UnixNano()) / float64(time.Second)
+			hls.playlist.position = now - hls.openTime - totalDuration
+			hls.playlist.durations = hls.playlist.durations[:0]
+			for _, seq := range seqlist {
+				hls.playlist.durations = append(hls.playlist.durations, seq.duration)
+			}
+		}
+
 		if hls.isTimeshift {
 			if !hls.ultrafastTimeshift {
 				td := seqlist[0].duration * float64(time.Second)
@@ -1242,10 +1296,10 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 			} else {
 				pos += fmt.Sprintf("%02d:%02d", sec/60, sec%60)
 			}
-			fmt.Printf("Current SeqNo: %d, Pos: %s\n", hls.playlist.seqNo, pos)
+			fmt.Fprintf(hls.stdout, "Current SeqNo: %d, Pos: %s\n", hls.playlist.seqNo, pos)
 
 		} else {
-			fmt.Printf("Current SeqNo: %d\n", hls.playlist.seqNo)
+			fmt.Fprintf(hls.stdout, "Current SeqNo: %d\n", hls.playlist.seqNo)
 		}
 
 		minSeq := math.MaxInt32
@@ -1319,7 +1373,7 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 				return
 			}
 			if is404 {
-				fmt.Printf("sequence 404: %d\n", seq.seqno)
+				fmt.Fprintf(hls.stdout, "sequence 404: %d\n", seq.seqno)
 				found404 = true
 			}
 			if is403 {
@@ -1329,7 +1383,7 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 			// TS時、先頭(SeqNo=0)で500となる時があるが
 			// Seekしなければ次回に取得可能なので一時的に倍速モードを切る
 			if is500 && hls.fastTimeshift && (seq.seqno == 0) {
-				fmt.Println("[WARN] disabled fastTimeshift")
+				fmt.Fprintln(hls.stdout, "[WARN] disabled fastTimeshift")
 
 				hls.fastTimeshift = false
 				hls.ultrafastTimeshift = false
@@ -1381,7 +1435,7 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 					maxBw = bw
 					uri, err = urlJoin(argUri, a[2])
 					if err != nil {
-						log.Println(err)
+						hls.logger.Println(err)
 					}
 				}
 
@@ -1411,7 +1465,7 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 				return
 			}
 
-			fmt.Printf("BANDWIDTH: %d\n", maxBw)
+			fmt.Fprintf(hls.stdout, "BANDWIDTH: %d\n", maxBw)
 			hls.playlist.bandwidth = maxBw
 			if hls.isTimeshift && hls.fastTimeshift {
 
@@ -1422,19 +1476,19 @@ func (hls *NicoHls) getPlaylist(argUri *url.URL) (is403, isEnd, is500 bool, nete
 			return hls.getPlaylist(uri)
 
 		} else {
-			log.Println("playlist error")
+			hls.logger.Println("playlist error")
 		}
 	}
 	return
 }
 
 func (hls *NicoHls) startPlaylist(uri string) {
-	hls.startPGoroutine(func(sig <-chan struct{}) int {
+	hls.startPGoroutine("playlist", func(ctx context.Context) error {
 		hls.playlist = playlist{}
 		//hls.playlist.uri = uri
 		u, e := url.Parse(uri)
 		if e != nil {
-			return PLAYLIST_ERROR
+			return gorman.Fail(PLAYLIST_ERROR, e)
 		}
 
 		hls.playlist.uri = u
@@ -1488,34 +1542,37 @@ func (hls *NicoHls) startPlaylist(uri string) {
 				is403, isEnd, is500, neterr, err := hls.getPlaylist(uri)
 				if neterr != nil {
 					if !hls.interrupted() {
-						log.Println("playlist:", e)
+						hls.logger.Println("playlist:", e)
 					}
-					return NETWORK_ERROR
+					return gorman.Fail(NETWORK_ERROR, neterr)
 				}
 				if is500 {
 					if !hls.interrupted() {
-						log.Println("playlist(500):", e)
+						hls.logger.Println("playlist(500):", e)
 					}
-					return NETWORK_ERROR
+					return gorman.Fail(NETWORK_ERROR, fmt.Errorf("playlist: status 500"))
+				}
+				if err == diskguard.ErrLowSpace {
+					return gorman.Fail(DISK_FULL, err)
 				}
 				if err != nil {
 					if !hls.interrupted() {
-						log.Println("playlist:", e)
+						hls.logger.Println("playlist:", e)
 					}
-					return PLAYLIST_ERROR
+					return gorman.Fail(PLAYLIST_ERROR, err)
 				}
 				if is403 {
-					return PLAYLIST_403
+					return gorman.Fail(PLAYLIST_403, nil)
 				}
 				if isEnd {
-					return PLAYLIST_END
+					return gorman.Fail(PLAYLIST_END, nil)
 				}
 
-			case <-sig:
-				return GOT_SIGNAL
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
-		return OK
+		return nil
 	})
 }
 func (hls *NicoHls) startMain() {
@@ -1525,28 +1582,28 @@ func (hls *NicoHls) startMain() {
 	}
 
 	// エラー時はMAIN_*を返すこと
-	hls.startPGoroutine(func(sig <-chan struct{}) int {
+	hls.startPGoroutine("watch", func(ctx context.Context) error {
 		if hls.nicoDebug {
 			fmt.Fprintf(os.Stderr, "%s:startMain: delay = %d(sec)\n", debug_Now(), hls.startDelay)
 		}
 
 		select {
 		case <-time.After(time.Duration(hls.startDelay) * time.Second):
-		case <-sig:
-			return GOT_SIGNAL
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
 		if hls.nicoDebug {
 			fmt.Fprintf(os.Stderr, "%s:start dial main(%s)\n", debug_Now(), hls.webSocketUrl)
 		}
-		conn, _, err := websocket.DefaultDialer.Dial(
+		conn, _, err := httpbase.DialWebsocket(
 			hls.webSocketUrl,
 			map[string][]string{
 				"User-Agent": []string{httpbase.GetUserAgent()},
 			},
 		)
 		if err != nil {
-			return NETWORK_ERROR
+			return gorman.Fail(NETWORK_ERROR, err)
 		}
 		var wsMtx sync.Mutex
 		writeJson := func(d interface{}) error {
@@ -1557,24 +1614,24 @@ func (hls *NicoHls) startMain() {
 
 		// debug
 		if false {
-			log.Printf("start ws error tsst")
-			hls.startPGoroutine(func(sig <-chan struct{}) int {
+			hls.logger.Printf("start ws error tsst")
+			hls.startPGoroutine("debug", func(ctx context.Context) error {
 				select {
 				case <-time.After(10 * time.Second):
 					conn.Close()
-					return OK
-				case <-sig:
-					return GOT_SIGNAL
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
 				}
 			})
 		}
 
-		hls.startPGoroutine(func(sig <-chan struct{}) int {
-			<-sig
+		hls.startPGoroutine("close", func(ctx context.Context) error {
+			<-ctx.Done()
 			if conn != nil {
 				conn.Close()
 			}
-			return OK
+			return nil
 		})
 
 		err = writeJson(OBJ{
@@ -1594,9 +1651,9 @@ func (hls *NicoHls) startMain() {
 		})
 		if err != nil {
 			if !hls.interrupted() {
-				log.Println("websocket getpermit write:", err)
+				hls.logger.Println("websocket getpermit write:", err)
 			}
-			return NETWORK_ERROR
+			return gorman.Fail(NETWORK_ERROR, err)
 		}
 
 		var playlistStarted bool
@@ -1604,17 +1661,17 @@ func (hls *NicoHls) startMain() {
 		var watchinginterval int
 		for !hls.interrupted() {
 			select {
-			case <-sig:
-				return GOT_SIGNAL
+			case <-ctx.Done():
+				return ctx.Err()
 			default:
 			}
 			var res interface{}
 			err = conn.ReadJSON(&res)
 			if err != nil {
 				if (!hls.interrupted()) && (!hls.finish) {
-					log.Println("websocket read:", err)
+					hls.logger.Println("websocket read:", err)
 				}
-				return NETWORK_ERROR
+				return gorman.Fail(NETWORK_ERROR, err)
 			}
 			if hls.nicoDebug {
 				fmt.Fprintf(os.Stderr, "%s:ReadJSON => %v\n", debug_Now(), res)
@@ -1622,7 +1679,7 @@ func (hls *NicoHls) startMain() {
 
 			_type, ok := objs.FindString(res, "type")
 			if !ok {
-				fmt.Printf("type not found\n")
+				fmt.Fprintf(hls.stdout, "type not found\n")
 				continue
 			}
 			switch _type {
@@ -1646,7 +1703,7 @@ func (hls *NicoHls) startMain() {
 
 				if (!watchingStarted) && watchinginterval > 0 {
 					watchingStarted = true
-					hls.startPGoroutine(func(sig <-chan struct{}) int {
+					hls.startPGoroutine("keepSeat", func(ctx context.Context) error {
 						for {
 							select {
 							case <-time.After(time.Duration(watchinginterval) * time.Second):
@@ -1655,12 +1712,12 @@ func (hls *NicoHls) startMain() {
 								})
 								if err != nil {
 									if !hls.interrupted() {
-										log.Println("websocket watching:", err)
+										hls.logger.Println("websocket watching:", err)
 									}
-									return NETWORK_ERROR
+									return gorman.Fail(NETWORK_ERROR, err)
 								}
-							case <-sig:
-								return GOT_SIGNAL
+							case <-ctx.Done():
+								return ctx.Err()
 							}
 						}
 					})
@@ -1678,23 +1735,23 @@ func (hls *NicoHls) startMain() {
 				// print params
 				if _arr, ok := objs.FindString(res, "data", "reason"); ok {
 					arr := []interface{}{0, _arr}
-					fmt.Printf("%v\n", arr)
+					fmt.Fprintf(hls.stdout, "%v\n", arr)
 					if len(arr) >= 2 {
 						if s, ok := arr[1].(string); ok {
 							switch s {
 							case "END_PROGRAM":
-								return MAIN_END_PROGRAM
+								return gorman.Fail(MAIN_END_PROGRAM, fmt.Errorf("disconnect: %s", s))
 							case "SERVICE_TEMPORARILY_UNAVAILABLE", "INTERNAL_SERVERERROR":
-								return MAIN_TEMPORARILY_ERROR
+								return gorman.Fail(MAIN_TEMPORARILY_ERROR, fmt.Errorf("disconnect: %s", s))
 							case "TOO_MANY_CONNECTIONS":
-								return MAIN_DISCONNECT
+								return gorman.Fail(MAIN_DISCONNECT, fmt.Errorf("disconnect: %s", s))
 							case "TEMPORARILY_CROWDED":
-								return MAIN_END_PROGRAM
+								return gorman.Fail(MAIN_END_PROGRAM, fmt.Errorf("disconnect: %s", s))
 							}
 						}
 					}
 				}
-				return MAIN_DISCONNECT
+				return gorman.Fail(MAIN_DISCONNECT, nil)
 
 			case "room":
 				// comment
@@ -1727,15 +1784,15 @@ func (hls *NicoHls) startMain() {
 				})
 				if err != nil {
 					if !hls.interrupted() {
-						log.Println("websocket watching:", err)
+						hls.logger.Println("websocket watching:", err)
 					}
-					return NETWORK_ERROR
+					return gorman.Fail(NETWORK_ERROR, err)
 				}
 			case "error":
 				code, ok := objs.FindString(res, "data", "code")
 				if !ok {
-					log.Printf("Unknown error: %#v\n", res)
-					return ERROR_SHUTDOWN
+					hls.logger.Printf("Unknown error: %#v\n", res)
+					return gorman.Fail(ERROR_SHUTDOWN, fmt.Errorf("unknown error: %v", res))
 				}
 
 				// https://nicolive.cdn.nimg.jp/relive/front_assets/scripts/nicolib.4bb8b62b35.js
@@ -1745,9 +1802,9 @@ func (hls *NicoHls) startMain() {
 					switch hls.quality {
 					case "abr":
 						hls.quality = "high"
-						return MAIN_INVALID_STREAM_QUALITY
+						return gorman.Fail(MAIN_INVALID_STREAM_QUALITY, fmt.Errorf("error: %s", code))
 					default:
-						return ERROR_SHUTDOWN
+						return gorman.Fail(ERROR_SHUTDOWN, fmt.Errorf("error: %s", code))
 					}
 				//case
 				//	"INTERNAL_SERVERERROR",
@@ -1766,7 +1823,7 @@ func (hls *NicoHls) startMain() {
 				default:
 					//	log.Printf("Unknown error: %s\n%#v\n", code, res)
 					//	return ERROR_SHUTDOWN
-					fmt.Printf("error code: %v\n", code)
+					fmt.Fprintf(hls.stdout, "error code: %v\n", code)
 					if hls.msgErrorSeqNo == hls.playlist.seqNo {
 						hls.msgErrorCount++
 					} else {
@@ -1774,17 +1831,17 @@ func (hls *NicoHls) startMain() {
 						hls.msgErrorCount = 1
 					}
 					if hls.msgErrorCount >= 3 {
-						return ERROR_SHUTDOWN
+						return gorman.Fail(ERROR_SHUTDOWN, fmt.Errorf("error: %s", code))
 					} else {
-						return NETWORK_ERROR
+						return gorman.Fail(NETWORK_ERROR, fmt.Errorf("error: %s", code))
 					}
 				}
 
 			default:
-				log.Printf("Unknown type: %s\n%#v\n", _type, res)
+				hls.logger.Printf("Unknown type: %s\n%#v\n", _type, res)
 			} // end switch "type"
 		} // for ReadJSON
-		return OK
+		return nil
 	})
 }
 
@@ -1793,30 +1850,14 @@ func (hls *NicoHls) startMainV1() {
 }
 
 func (hls *NicoHls) serve(hlsPort int) {
-	hls.startMGoroutine(func(sig <-chan struct{}) int {
+	hls.startMGoroutine("serve", func(ctx context.Context) error {
 		gin.SetMode(gin.ReleaseMode)
 		gin.DefaultErrorWriter = ioutil.Discard
 		gin.DefaultWriter = ioutil.Discard
 		router := gin.Default()
 
 		router.GET("", func(c *gin.Context) {
-			seqno := hls.dbGetLastSeqNo()
-			body := fmt.Sprintf(
-				`#EXTM3U
-#EXT-X-VERSION:3
-#EXT-X-TARGETDURATION:1
-#EXT-X-MEDIA-SEQUENCE:%d
-
-#EXTINF:1.0,
-/ts/%d/test.ts
-
-#EXTINF:1.0,
-/ts/%d/test.ts
-
-#EXTINF:1.0,
-/ts/%d/test.ts
-
-`, seqno-2, seqno-2, seqno-1, seqno)
+			body := hls.previewPlaylist("/ts/%d/test.ts")
 			c.Data(http.StatusOK, "application/x-mpegURL", []byte(body))
 			return
 		})
@@ -1844,10 +1885,10 @@ func (hls *NicoHls) serve(hlsPort int) {
 		go func() {
 			select {
 			case <-chLocal:
-			case <-sig:
+			case <-ctx.Done():
 			}
 			if err := srv.Shutdown(context.Background()); err != nil {
-				log.Printf("srv.Shutdown: %v\n", err)
+				hls.logger.Printf("srv.Shutdown: %v\n", err)
 			}
 			close(idleConnsClosed)
 		}()
@@ -1855,11 +1896,11 @@ func (hls *NicoHls) serve(hlsPort int) {
 		// クライアントはlocalhostでなく127.0.0.1で接続すること
 		// localhostは遅いため
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Printf("srv.ListenAndServe: %v\n", err)
+			hls.logger.Printf("srv.ListenAndServe: %v\n", err)
 		}
 
 		<-idleConnsClosed
-		return OK
+		return nil
 	})
 }
 
@@ -1868,14 +1909,29 @@ func (hls *NicoHls) Wait(testTimeout, hlsPort int) {
 	hls.startInterrupt()
 	defer hls.stopInterrupt()
 
+	hls.statsRegister()
+	defer hls.statsUnregister()
+
 	if testTimeout > 0 {
-		hls.startMGoroutine(func(sig <-chan struct{}) int {
+		hls.startMGoroutine("testTimeout", func(ctx context.Context) error {
 			select {
-			case <-sig:
-				return GOT_SIGNAL
+			case <-ctx.Done():
+				return ctx.Err()
 			case <-time.After(time.Duration(testTimeout) * time.Second):
 				hls.chInterrupt <- syscall.Signal(1000)
-				return OK
+				return nil
+			}
+		})
+	}
+
+	if hls.interrupt != nil {
+		hls.startMGoroutine("interrupt", func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-hls.interrupt:
+				hls.chInterrupt <- syscall.Signal(1000)
+				return nil
 			}
 		})
 	}
@@ -1889,11 +1945,11 @@ func (hls *NicoHls) Wait(testTimeout, hlsPort int) {
 		if hls.waitRestartMain() {
 			continue
 		}
-		hls.stopPCGoroutines()
+		hls.stopPCGoroutines(fmt.Errorf("playlist stopped"))
 		hls.waitCGoroutines()
 	}
 
-	hls.stopAllGoroutines()
+	hls.stopAllGoroutines(fmt.Errorf("recording finished"))
 	hls.waitAllGoroutines()
 
 	return
@@ -1901,20 +1957,20 @@ func (hls *NicoHls) Wait(testTimeout, hlsPort int) {
 
 func postTsRsv0(opt options.Option) (err error) {
 	if ma := regexp.MustCompile(`lv(\d+)`).FindStringSubmatch(opt.NicoLiveId); len(ma) > 0 {
-		if err = postTsRsvBase(0, ma[1], opt.NicoSession); err != nil {
+		if err = postTsRsvBase(0, ma[1], opt.NicoSession, opt.Out()); err != nil {
 			return
 		}
-		err = postTsRsvBase(1, ma[1], opt.NicoSession)
+		err = postTsRsvBase(1, ma[1], opt.NicoSession, opt.Out())
 	}
 	return
 }
 func postTsRsv1(opt options.Option) (err error) {
 	if ma := regexp.MustCompile(`lv(\d+)`).FindStringSubmatch(opt.NicoLiveId); len(ma) > 0 {
-		err = postTsRsvBase(1, ma[1], opt.NicoSession)
+		err = postTsRsvBase(1, ma[1], opt.NicoSession, opt.Out())
 	}
 	return
 }
-func postTsRsvBase(num int, vid, session string) (err error) {
+func postTsRsvBase(num int, vid, session string, stdout io.Writer) (err error) {
 	var uri string
 	if num == 0 {
 		uri = fmt.Sprintf("https://live.nicovideo.jp/api/watchingreservation?mode=watch_num&vid=%s", vid)
@@ -1922,9 +1978,8 @@ func postTsRsvBase(num int, vid, session string) (err error) {
 		uri = fmt.Sprintf("https://live.nicovideo.jp/api/watchingreservation?mode=confirm_watch_my&vid=%s", vid)
 	}
 
-	header := map[string]string{
-		"Cookie": "user_session=" + session,
-	}
+	setSession(session)
+	header := map[string]string{}
 	dat0, _, _, err, neterr := getStringHeader(uri, header)
 	if err != nil || neterr != nil {
 		if err == nil {
@@ -1944,7 +1999,7 @@ func postTsRsvBase(num int, vid, session string) (err error) {
 		err = fmt.Errorf("postTsRsv: already watched")
 		return
 	} else {
-		fmt.Printf("postTsRsv: token not found: >>>%s<<<\n", dat0)
+		fmt.Fprintf(stdout, "postTsRsv: token not found: >>>%s<<<\n", dat0)
 		err = fmt.Errorf("postTsRsv: token not found")
 		return
 	}
@@ -1983,7 +2038,7 @@ func postTsRsvBase(num int, vid, session string) (err error) {
 		return
 	}
 	if (!strings.Contains(dat1, "status=\"ok\"")) && (!strings.Contains(dat1, "\"regist_finished\"")) {
-		fmt.Printf("postTsRsv: status not ok: >>>%s<<<\n", dat1)
+		fmt.Fprintf(stdout, "postTsRsv: status not ok: >>>%s<<<\n", dat1)
 		err = fmt.Errorf("postTsRsv: status not ok")
 		return
 	}
@@ -1993,13 +2048,10 @@ func postTsRsvBase(num int, vid, session string) (err error) {
 
 func getProps(opt options.Option) (props interface{}, isFlash, notLogin, tsRsv0, tsRsv1 bool, err error) {
 
-	header := map[string]string{}
-	if opt.NicoSession != "" {
-		header["Cookie"] = "user_session=" + opt.NicoSession
-	}
+	setSession(opt.NicoSession)
 
 	uri := fmt.Sprintf("https://live2.nicovideo.jp/watch/%s", opt.NicoLiveId)
-	dat, _, _, err, neterr := getStringHeader(uri, header)
+	dat, _, _, err, neterr := getStringHeader(uri, nil)
 	if err != nil || neterr != nil {
 		if err == nil {
 			err = neterr
@@ -2017,7 +2069,7 @@ func getProps(opt options.Option) (props interface{}, isFlash, notLogin, tsRsv0,
 		case "login":
 			notLogin = false
 		default:
-			fmt.Printf("[FIXME] login_status = %s\n", ma[1])
+			fmt.Fprintf(opt.Out(), "[FIXME] login_status = %s\n", ma[1])
 		}
 	} else {
 		notLogin = true
@@ -2036,12 +2088,12 @@ func getProps(opt options.Option) (props interface{}, isFlash, notLogin, tsRsv0,
 	} else if regexp.MustCompile(`この番組は.{1,50}に終了`).MatchString(dat) {
 		// タイムシフト予約ボタン
 		if ma := regexp.MustCompile(`Nicolive\.WatchingReservation\.register`).FindStringSubmatch(dat); len(ma) > 0 {
-			fmt.Printf("timeshift reservation required\n")
+			fmt.Fprintf(opt.Out(), "timeshift reservation required\n")
 			tsRsv0 = true
 			return
 		}
 		if ma := regexp.MustCompile(`Nicolive\.WatchingReservation\.confirm`).FindStringSubmatch(dat); len(ma) > 0 {
-			fmt.Printf("timeshift reservation required\n")
+			fmt.Fprintf(opt.Out(), "timeshift reservation required\n")
 			tsRsv1 = true
 			return
 		}
@@ -2087,7 +2139,7 @@ func NicoRecHls(opt options.Option) (done, playlistEnd, notLogin, reserved bool,
 	}
 
 	if isFlash {
-		fmt.Println("Flash page detected.")
+		fmt.Fprintln(opt.Out(), "Flash page detected.")
 		return
 	}
 
@@ -2141,8 +2193,8 @@ func NicoRecHls(opt options.Option) (done, playlistEnd, notLogin, reserved bool,
 			kv[k] = v
 
 			if opt.NicoDebug {
-				fmt.Println(k, v)
-				fmt.Println("----------")
+				fmt.Fprintln(opt.Out(), k, v)
+				fmt.Fprintln(opt.Out(), "----------")
 			}
 		}
 	}
@@ -2153,7 +2205,7 @@ func NicoRecHls(opt options.Option) (done, playlistEnd, notLogin, reserved bool,
 	}
 
 	if nicocas {
-		fmt.Println("nicocas not supported.")
+		fmt.Fprintln(opt.Out(), "nicocas not supported.")
 		return
 
 	} else {
@@ -2163,7 +2215,7 @@ func NicoRecHls(opt options.Option) (done, playlistEnd, notLogin, reserved bool,
 			//"//myId",
 		} {
 			if _, ok := kv[k]; !ok {
-				fmt.Printf("%v not found\n", k)
+				fmt.Fprintf(opt.Out(), "%v not found\n", k)
 				return
 			}
 		}
@@ -2175,7 +2227,7 @@ func NicoRecHls(opt options.Option) (done, playlistEnd, notLogin, reserved bool,
 		hls, e := NewHls(opt, kv)
 		if e != nil {
 			err = e
-			fmt.Println(err)
+			fmt.Fprintln(opt.Out(), err)
 			return
 		}
 		defer hls.Close()
@@ -2185,6 +2237,9 @@ func NicoRecHls(opt options.Option) (done, playlistEnd, notLogin, reserved bool,
 		dbName = hls.dbName
 		playlistEnd = hls.finish
 		done = true
+		if hls.diskFull {
+			err = diskguard.ErrLowSpace
+		}
 	}
 
 	/*
@@ -2194,12 +2249,12 @@ func NicoRecHls(opt options.Option) (done, playlistEnd, notLogin, reserved bool,
 			// 実験放送
 			userId, ok := objs.FindString(props, "broadcaster", "id")
 			if ! ok {
-				fmt.Printf("userId not found")
+				fmt.Fprintf(opt.Out(), "userId not found")
 			}
 
 			nickname, ok := objs.FindString(props, "broadcaster", "nickname")
 			if ! ok {
-				fmt.Printf("nickname not found")
+				fmt.Fprintf(opt.Out(), "nickname not found")
 			}
 
 			var isArchive bool
@@ -0,0 +1,318 @@
+package niconico
+
+import (
+	"database/sql"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/himananiito/livedl/niconico/nicotest"
+	"github.com/himananiito/livedl/options"
+)
+
+// nicotestに向けてNicoRecHlsを実行し、作られたDBを開く
+func recHls(t *testing.T, s *nicotest.Server, opt options.Option) *sql.DB {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if err := s.Install(); err != nil {
+		t.Fatal(err)
+	}
+	opt.NicoLiveId = s.LiveId
+	opt.NicoSession = "nicotest_session"
+	opt.NicoTestTimeout = 60
+	opt.NicoFormat = "?PID?"
+
+	done, _, _, _, dbName, err := NicoRecHls(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		t.Fatal("NicoRecHls: not done")
+	}
+	if dbName == "" {
+		t.Fatal("NicoRecHls: no db")
+	}
+
+	// 作業ディレクトリを戻す前に絶対パスにする
+	if dbName, err = filepath.Abs(dbName); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbName+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func queryInt(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// 全てのチャンクが揃っていて、中身がnicotestのものと一致すること
+func checkMedia(t *testing.T, db *sql.DB, s *nicotest.Server, from int) {
+	t.Helper()
+	rows, err := db.Query(`SELECT seqno, bandwidth, size, data FROM media
+		WHERE IFNULL(notfound, 0) == 0 ORDER BY seqno`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	next := from
+	for rows.Next() {
+		var seqno, bandwidth, size int
+		var data []byte
+		if err := rows.Scan(&seqno, &bandwidth, &size, &data); err != nil {
+			t.Fatal(err)
+		}
+		if seqno != next {
+			t.Errorf("media: seqno %d, want %d", seqno, next)
+		}
+		next = seqno + 1
+		if size != len(data) {
+			t.Errorf("media %d: size %d, len(data) %d", seqno, size, len(data))
+		}
+		variant := 1
+		if bandwidth == 1000000 {
+			variant = 2
+		}
+		if string(data) != string(s.Chunk(variant, seqno)) {
+			t.Errorf("media %d: data mismatch", seqno)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if next != s.Chunks {
+		t.Errorf("media: last seqno %d, want %d", next-1, s.Chunks-1)
+	}
+}
+
+func checkKVS(t *testing.T, db *sql.DB, s *nicotest.Server) {
+	t.Helper()
+	var id, title string
+	if err := db.QueryRow(`SELECT v FROM kvs WHERE k = "nicoliveProgramId"`).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT v FROM kvs WHERE k = "title"`).Scan(&title); err != nil {
+		t.Fatal(err)
+	}
+	if id != s.LiveId || title != s.Title {
+		t.Errorf("kvs: %s %q, want %s %q", id, title, s.LiveId, s.Title)
+	}
+	// 自分のユーザ情報(//で始まるもの)は入れない
+	if n := queryInt(t, db, `SELECT COUNT(*) FROM kvs WHERE k LIKE "//%"`); n != 0 {
+		t.Errorf("kvs: %d private keys", n)
+	}
+	if n := queryInt(t, db, `SELECT COUNT(*) FROM kvs WHERE k = "comment/thread"`); n != 1 {
+		t.Errorf("kvs: comment/thread not saved")
+	}
+}
+
+func newLiveServer() *nicotest.Server {
+	s := nicotest.NewServer()
+	s.Chunks = 6
+	s.Backlog = 2
+	s.Comments = 10
+	return s
+}
+
+func TestRecHlsLive(t *testing.T) {
+	s := newLiveServer()
+	defer s.Close()
+	db := recHls(t, s, options.Option{})
+
+	checkMedia(t, db, s, 0)
+	checkLiveAnchor(t, db, s)
+	checkKVS(t, db, s)
+	if n := queryInt(t, db, `SELECT COUNT(DISTINCT no) FROM comment`); n != s.Comments {
+		t.Errorf("comment: %d, want %d", n, s.Comments)
+	}
+	if n := queryInt(t, db, `SELECT COUNT(*) FROM comment WHERE thread = "1000000001"`); n == 0 {
+		t.Errorf("comment: thread not saved")
+	}
+	if s.Watching() != 1 {
+		t.Errorf("startWatching: %d, want 1", s.Watching())
+	}
+}
+
+// エラーの後は視聴用websocketから接続し直して続きを録る
+func TestRecHlsRestart(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		match string
+		code  int
+	}{
+		{"playlist403", "/ts/playlist.m3u8", 403},
+		{"master500", "master.m3u8", 500},
+		{"chunk500", "/ts/3.ts", 500},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newLiveServer()
+			defer s.Close()
+			s.Inject(tc.match, tc.code, 1)
+			db := recHls(t, s, options.Option{})
+
+			checkMedia(t, db, s, 0)
+			if s.Watching() < 2 {
+				t.Errorf("startWatching: %d, want restart", s.Watching())
+			}
+		})
+	}
+}
+
+// 視聴用websocketが切れたら再接続する
+func TestRecHlsDropWatch(t *testing.T) {
+	s := newLiveServer()
+	defer s.Close()
+	go func() {
+		time.Sleep(2 * time.Second)
+		s.DropWatch()
+	}()
+	db := recHls(t, s, options.Option{})
+
+	checkMedia(t, db, s, 0)
+	if s.Watching() < 2 {
+		t.Errorf("startWatching: %d, want restart", s.Watching())
+	}
+}
+
+// 404のチャンクは取得できなかったものとして記録し、録画は続ける
+func TestRecHlsChunk404(t *testing.T) {
+	s := newLiveServer()
+	defer s.Close()
+	s.Inject("/ts/3.ts", 404, 10)
+	db := recHls(t, s, options.Option{})
+
+	if n := queryInt(t, db, `SELECT COUNT(*) FROM media WHERE seqno = 3 AND notfound = 1 AND data IS NULL`); n != 1 {
+		t.Errorf("media 3: notfound not recorded")
+	}
+	if n := queryInt(t, db, `SELECT COUNT(*) FROM media WHERE seqno > 3 AND size > 0`); n != s.Chunks-4 {
+		t.Errorf("media after 404: %d, want %d", n, s.Chunks-4)
+	}
+	if s.Watching() != 1 {
+		t.Errorf("startWatching: %d, want 1", s.Watching())
+	}
+}
+
+func newTimeshiftServer() *nicotest.Server {
+	s := nicotest.NewServer()
+	s.Timeshift = true
+	s.Chunks = 12
+	s.Comments = 30
+	return s
+}
+
+// タイムシフトでは#DMC-CURRENT-POSITIONを各チャンクの位置として記録する
+func checkPosition(t *testing.T, db *sql.DB, s *nicotest.Server, from int) {
+	t.Helper()
+	rows, err := db.Query(`SELECT seqno, position FROM media WHERE position IS NOT NULL ORDER BY seqno`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var n int
+	for rows.Next() {
+		var seqno int
+		var pos float64
+		if err := rows.Scan(&seqno, &pos); err != nil {
+			t.Fatal(err)
+		}
+		if seqno < from {
+			t.Errorf("media %d: before start %d", seqno, from)
+		}
+		if want := float64(seqno) * s.Duration; math.Abs(pos-want) > 0.001 {
+			t.Errorf("media %d: position %f, want %f", seqno, pos, want)
+		}
+		n++
+	}
+	if n == 0 {
+		t.Error("media: no position")
+	}
+}
+
+// 生放送ではチャンクの位置を記録せず、最初のチャンクの推定位置とPTSを記録する
+// 推定は、openTimeが秒単位なのとチャンクの途中で取得する分ずれる
+func checkLiveAnchor(t *testing.T, db *sql.DB, s *nicotest.Server) {
+	t.Helper()
+	if n := queryInt(t, db, `SELECT COUNT(*) FROM media WHERE position IS NOT NULL`); n != 0 {
+		t.Errorf("media: %d positions", n)
+	}
+	var pos float64
+	var pts int64
+	if err := db.QueryRow(`SELECT
+		(SELECT v FROM kvs WHERE k = "livePosition"),
+		(SELECT v FROM kvs WHERE k = "livePts")`).Scan(&pos, &pts); err != nil {
+		t.Fatal(err)
+	}
+	// nicotestのPTSはチャンクの位置に1秒足したもの
+	if want := float64(pts)/90000 - 1; math.Abs(pos-want) > 1+s.Duration {
+		t.Errorf("livePosition %f, want %f", pos, want)
+	}
+}
+
+func TestRecHlsTimeshift(t *testing.T) {
+	s := newTimeshiftServer()
+	defer s.Close()
+	db := recHls(t, s, options.Option{NicoUltraFastTs: true})
+
+	checkMedia(t, db, s, 0)
+	checkPosition(t, db, s, 0)
+	checkKVS(t, db, s)
+	if n := queryInt(t, db, `SELECT COUNT(DISTINCT no) FROM comment`); n != s.Comments {
+		t.Errorf("comment: %d, want %d", n, s.Comments)
+	}
+	if n := queryInt(t, db, `SELECT COUNT(*) FROM kvs WHERE k = "status" AND v = "ENDED"`); n != 1 {
+		t.Errorf("kvs: status not ENDED")
+	}
+}
+
+// -nico-ts-startの位置から録る
+func TestRecHlsTimeshiftStart(t *testing.T) {
+	s := newTimeshiftServer()
+	defer s.Close()
+	db := recHls(t, s, options.Option{NicoUltraFastTs: true, NicoTsStart: 6})
+
+	checkMedia(t, db, s, 6)
+	checkPosition(t, db, s, 6)
+}
+
+// タイムシフトの途中でプレイリストが403になったら接続し直して続きから録る
+func TestRecHlsTimeshiftRestart(t *testing.T) {
+	s := newTimeshiftServer()
+	defer s.Close()
+	go func() {
+		for i := 0; i < 500; i++ {
+			for _, r := range s.Requests() {
+				if strings.HasSuffix(r, "/ts/5.ts") {
+					s.Inject("/ts/playlist.m3u8", 403, 1)
+					return
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	db := recHls(t, s, options.Option{NicoUltraFastTs: true})
+
+	checkMedia(t, db, s, 0)
+	checkPosition(t, db, s, 0)
+	if s.Watching() < 2 {
+		t.Errorf("startWatching: %d, want restart", s.Watching())
+	}
+}
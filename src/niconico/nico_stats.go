@@ -0,0 +1,153 @@
+package niconico
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 録画中の状態(-daemonのダッシュボード用)
+type Stats struct {
+	ProgramId     string    `json:"programId"`
+	DBName        string    `json:"dbName"`
+	Started       time.Time `json:"started"`
+	Timeshift     bool      `json:"timeshift"`
+	SeqNo         int       `json:"seqno"`
+	Bandwidth     int       `json:"bandwidth"`
+	Chunks        int       `json:"chunks"`
+	Bytes         int64     `json:"bytes"`
+	Errors403     int       `json:"errors403"`
+	Errors404     int       `json:"errors404"`
+	Errors500     int       `json:"errors500"`
+	NetworkErrors int       `json:"networkErrors"`
+	Comments      int       `json:"comments"`
+	CommentRate   int       `json:"commentRate"` // 直近1分間のコメント数
+
+	commentTimes []time.Time
+}
+
+var activeMtx sync.Mutex
+var activeHls = map[string]*NicoHls{}
+
+func (hls *NicoHls) statsRegister() {
+	hls.statsMtx.Lock()
+	hls.stats.ProgramId = hls.nicoliveProgramId
+	hls.stats.Started = time.Now()
+	hls.stats.Timeshift = hls.isTimeshift
+	hls.statsMtx.Unlock()
+
+	activeMtx.Lock()
+	defer activeMtx.Unlock()
+	activeHls[hls.nicoliveProgramId] = hls
+}
+
+func (hls *NicoHls) statsUnregister() {
+	activeMtx.Lock()
+	defer activeMtx.Unlock()
+	if activeHls[hls.nicoliveProgramId] == hls {
+		delete(activeHls, hls.nicoliveProgramId)
+	}
+}
+
+func (hls *NicoHls) statsMedia(seqno, bandwidth, size int) {
+	hls.statsMtx.Lock()
+	defer hls.statsMtx.Unlock()
+	hls.stats.SeqNo = seqno
+	hls.stats.Bandwidth = bandwidth
+	hls.stats.Chunks++
+	hls.stats.Bytes += int64(size)
+}
+
+func (hls *NicoHls) statsError(code int, neterr error) {
+	hls.statsMtx.Lock()
+	defer hls.statsMtx.Unlock()
+	switch {
+	case neterr != nil:
+		hls.stats.NetworkErrors++
+	case code == 403:
+		hls.stats.Errors403++
+	case code == 404:
+		hls.stats.Errors404++
+	case code == 500:
+		hls.stats.Errors500++
+	}
+}
+
+func (hls *NicoHls) statsComment() {
+	hls.statsMtx.Lock()
+	defer hls.statsMtx.Unlock()
+	now := time.Now()
+	hls.stats.Comments++
+	hls.stats.commentTimes = append(hls.stats.commentTimes, now)
+
+	i := 0
+	for i < len(hls.stats.commentTimes) && now.Sub(hls.stats.commentTimes[i]) > time.Minute {
+		i++
+	}
+	hls.stats.commentTimes = hls.stats.commentTimes[i:]
+}
+
+func getActiveHls(programId string) (hls *NicoHls, ok bool) {
+	activeMtx.Lock()
+	defer activeMtx.Unlock()
+	hls, ok = activeHls[programId]
+	return
+}
+
+// 録画中の番組の状態
+func GetStats(programId string) (s Stats, ok bool) {
+	hls, ok := getActiveHls(programId)
+	if !ok {
+		return
+	}
+
+	hls.statsMtx.Lock()
+	s = hls.stats
+	now := time.Now()
+	for _, t := range hls.stats.commentTimes {
+		if now.Sub(t) <= time.Minute {
+			s.CommentRate++
+		}
+	}
+	s.commentTimes = nil
+	hls.statsMtx.Unlock()
+
+	hls.dbMtx.Lock()
+	s.DBName = hls.dbName
+	hls.dbMtx.Unlock()
+	return
+}
+
+// 直近のチャンクを並べたプレイリスト。tsFormatはチャンクのURL(%dにseqno)
+func (hls *NicoHls) previewPlaylist(tsFormat string) string {
+	seqno := hls.dbGetLastSeqNo()
+	body := fmt.Sprintf(`#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:%d
+
+`, seqno-2)
+	for i := seqno - 2; i <= seqno; i++ {
+		body += fmt.Sprintf("#EXTINF:1.0,\n"+tsFormat+"\n\n", i)
+	}
+	return body
+}
+
+// 録画中の番組のプレビュー用プレイリスト
+func PreviewPlaylist(programId, tsFormat string) (body string, ok bool) {
+	hls, ok := getActiveHls(programId)
+	if !ok {
+		return
+	}
+	body = hls.previewPlaylist(tsFormat)
+	return
+}
+
+func PreviewMedia(programId string, seqno int) (data []byte, ok bool) {
+	hls, ok := getActiveHls(programId)
+	if !ok {
+		return
+	}
+	data = hls.dbGetLastMedia(seqno)
+	return
+}
@@ -0,0 +1,166 @@
+package nicotest
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 画質ごとの帯域。パスの/1/, /2/に対応する
+var bandwidths = []int{192000, 1000000}
+
+const hlsToken = "nicotest_hls_token"
+
+// startWatchingに返すmaster.m3u8
+func (s *Server) streamUri() string {
+	return fmt.Sprintf("https://liveedge.dmc.nico/hlslive/ht2_nicolive/nicolive-production-pg%s/master.m3u8?ht2_nicolive=%s",
+		s.digits(), hlsToken)
+}
+
+// チャンクの中身。TSのパケットに画質とシーケンス番号を書いたもの。先頭のパケットはPTSを持つ
+func (s *Server) Chunk(variant, seq int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < 16; i++ {
+		pkt := make([]byte, 188)
+		pkt[0] = 0x47
+		pkt[1] = 0x01
+		pkt[2] = 0x00
+		pkt[3] = 0x10 | byte(i&0x0f)
+		p := 4
+		if i == 0 {
+			// 映像のPESの先頭。PTSはチャンクの位置に1秒足したもの
+			pkt[1] |= 0x40
+			pts := int64((1 + float64(seq)*s.Duration) * 90000)
+			p += copy(pkt[p:], []byte{
+				0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x80, 0x05,
+				0x21 | byte(pts>>29)&0x0e,
+				byte(pts >> 22),
+				byte(pts>>14) | 0x01,
+				byte(pts >> 7),
+				byte(pts<<1) | 0x01,
+			})
+		}
+		n := copy(pkt[p:], fmt.Sprintf("nicotest variant=%d seq=%d", variant, seq))
+		for j := p + n; j < len(pkt); j++ {
+			pkt[j] = 0xff
+		}
+		buf.Write(pkt)
+	}
+	return buf.Bytes()
+}
+
+var reMedia = regexp.MustCompile(`/(\d+)/ts/(playlist\.m3u8|(\d+)\.ts)\z`)
+
+func (s *Server) serveHls(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("ht2_nicolive") != hlsToken {
+		http.Error(w, "invalid token", 403)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/master.m3u8") {
+		s.serveMaster(w, r)
+		return
+	}
+	ma := reMedia.FindStringSubmatch(r.URL.Path)
+	if len(ma) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	variant, _ := strconv.Atoi(ma[1])
+	if variant < 1 || variant > len(bandwidths) {
+		http.NotFound(w, r)
+		return
+	}
+	if ma[3] == "" {
+		s.serveMedia(w, r)
+		return
+	}
+
+	seq, _ := strconv.Atoi(ma[3])
+	var ok bool
+	if s.Timeshift {
+		ok = seq < s.Chunks
+	} else {
+		head, _ := s.liveHead()
+		ok = seq <= head
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(s.Chunk(variant, seq))
+}
+
+// タイムシフトではstartの位置から始める
+func (s *Server) serveMaster(w http.ResponseWriter, r *http.Request) {
+	query := "?ht2_nicolive=" + hlsToken
+	if s.Timeshift {
+		if start := r.URL.Query().Get("start"); start != "" {
+			f, err := strconv.ParseFloat(start, 64)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			pos := int(math.Floor(f/s.Duration + 0.5))
+			if pos < 0 {
+				pos = 0
+			}
+			if pos > s.Chunks-1 {
+				pos = s.Chunks - 1
+			}
+			s.mu.Lock()
+			s.tsPos = pos
+			s.mu.Unlock()
+			query += "&start=" + start
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	fmt.Fprint(w, "#EXTM3U\n")
+	for i, bw := range bandwidths {
+		fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n%d/ts/playlist.m3u8%s\n", bw, i+1, query)
+	}
+}
+
+func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request) {
+	var first, last int
+	var end bool
+	if s.Timeshift {
+		// 取得するたびに1つ進む
+		s.mu.Lock()
+		first = s.tsPos
+		if s.tsPos < s.Chunks-1 {
+			s.tsPos++
+		}
+		s.mu.Unlock()
+		last = first + 2
+		if last >= s.Chunks-1 {
+			last = s.Chunks - 1
+			end = true
+		}
+	} else {
+		last, end = s.liveHead()
+		first = last - 2
+		if first < 0 {
+			first = 0
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n",
+		int(math.Ceil(s.Duration)), first)
+	if s.Timeshift {
+		fmt.Fprintf(w, "#DMC-CURRENT-POSITION:%.3f\n#DMC-STREAM-DURATION:%.3f\n",
+			float64(first)*s.Duration, float64(s.Chunks)*s.Duration)
+	}
+	for i := first; i <= last; i++ {
+		fmt.Fprintf(w, "#EXTINF:%.3f,\n%d.ts?ht2_nicolive=%s\n", s.Duration, i, hlsToken)
+	}
+	if end {
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	}
+}
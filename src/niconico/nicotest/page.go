@@ -0,0 +1,144 @@
+package nicotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+const threadId = "1000000001"
+const audienceToken = "nicotest_audience_token"
+const reserveToken = "ulck_nicotest"
+
+func (s *Server) digits() string {
+	return strings.TrimPrefix(s.LiveId, "lv")
+}
+
+func (s *Server) loggedIn(r *http.Request) bool {
+	c, err := r.Cookie("user_session")
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return s.Session == "" || c.Value == s.Session
+}
+
+// live2.nicovideo.jp/watch/lv*
+func (s *Server) serveWatchPage(w http.ResponseWriter, r *http.Request) {
+	begin, _ := s.clock()
+	end := s.endTime()
+	login := s.loggedIn(r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if s.Timeshift && s.Reserve && !s.Reserved() {
+		fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="ja"><head><meta charset="UTF-8"><title>%s - ニコニコ生放送</title></head>
+<body>
+<p>この番組は%sに終了いたしました。</p>
+<script>var login_status = '%s'; Nicolive.WatchingReservation.register('%s');</script>
+</body></html>
+`, html.EscapeString(s.Title), end.Format("2006/01/02 15:04"), loginStatus(login), s.digits())
+		return
+	}
+
+	status := "ON_AIR"
+	if s.Timeshift {
+		status = "ENDED"
+	}
+	props := map[string]interface{}{
+		"program": map[string]interface{}{
+			"nicoliveProgramId": s.LiveId,
+			"title":             s.Title,
+			"description":       "nicotestの番組",
+			"status":            status,
+			"beginTime":         begin.Unix(),
+			"openTime":          begin.Unix(),
+			"endTime":           end.Unix(),
+			"providerType":      "community",
+			"mediaServerType":   "DMC",
+			"isFollowerOnly":    false,
+			"isPrivate":         false,
+			"supplier": map[string]interface{}{
+				"name":    "nicotest-user",
+				"pageUrl": "https://www.nicovideo.jp/user/1",
+			},
+		},
+		"site": map[string]interface{}{
+			"serverTime": begin.Unix() * 1000,
+			"relive": map[string]interface{}{
+				"webSocketUrl": fmt.Sprintf("wss://a.live2.nicovideo.jp/wsapi/v2/watch/%s?audience_token=%s", s.digits(), audienceToken),
+			},
+		},
+		"community": map[string]interface{}{
+			"id": "co1",
+		},
+		"socialGroup": map[string]interface{}{
+			"id":          "co1",
+			"name":        "nicotest-community",
+			"type":        "community",
+			"level":       1,
+			"description": "nicotestのコミュニティ",
+		},
+		"user": map[string]interface{}{
+			"isLoggedIn": login,
+		},
+	}
+	if login {
+		u := props["user"].(map[string]interface{})
+		u["id"] = "2"
+		u["nickname"] = "nicotest-viewer"
+		u["accountType"] = "premium"
+	}
+	data, err := json.Marshal(props)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="ja"><head><meta charset="UTF-8"><title>%s - ニコニコ生放送</title></head>
+<body>
+<script id="embedded-data" data-props="%s"></script>
+<script>var login_status = '%s';</script>
+</body></html>
+`, html.EscapeString(s.Title), html.EscapeString(string(data)), loginStatus(login))
+}
+
+func loginStatus(login bool) string {
+	if login {
+		return "login"
+	}
+	return "not_login"
+}
+
+// live.nicovideo.jp/api/watchingreservation
+// GETでトークン入りのページ、POSTで予約する
+func (s *Server) serveReservation(w http.ResponseWriter, r *http.Request) {
+	if !s.loggedIn(r) {
+		http.Error(w, "login required", 403)
+		return
+	}
+	if r.Method != "POST" {
+		action := "doRegister"
+		if r.URL.Query().Get("mode") == "confirm_watch_my" {
+			action = "confirmToWatch"
+		}
+		fmt.Fprintf(w, `<a href="#" onclick="TimeshiftActions.%s('%s', '%s'); return false;">予約</a>`,
+			action, r.URL.Query().Get("vid"), reserveToken)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if r.PostForm.Get("token") != reserveToken || r.PostForm.Get("vid") != s.digits() {
+		fmt.Fprint(w, `<nicolive_video_response status="fail"></nicolive_video_response>`)
+		return
+	}
+	if r.PostForm.Get("mode") == "use" {
+		s.mu.Lock()
+		s.reserved = true
+		s.mu.Unlock()
+	}
+	fmt.Fprint(w, `<nicolive_video_response status="ok"></nicolive_video_response>`)
+}
@@ -0,0 +1,376 @@
+// niconicoパッケージ(NicoRecHls)を試すためのローカルの偽ニコ生サーバー
+// 視聴ページ(data-props)、視聴用websocket、HLS(m3u8, TS)、コメントサーバーに応答する
+//
+// httpbaseの-http-proxy-nicoとしてCONNECTを受け、自分の証明書でTLSを終端するので
+// live2.nicovideo.jpなどのURLはそのままで良い。Installで設定する
+package nicotest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/himananiito/livedl/httpbase"
+)
+
+type Server struct {
+	URL      string // proxyとしてのURL(http://127.0.0.1:port)
+	Listener net.Listener
+
+	// 番組の設定。録画を始める前に変える
+	LiveId    string
+	Title     string
+	Session   string  // 空でなければuser_sessionがこれと一致する時だけログイン扱い
+	Timeshift bool    // 終了した番組(status=ENDED)
+	Reserve   bool    // タイムシフトの予約が必要なページを返す
+	Chunks    int     // チャンクの数
+	Backlog   int     // 生放送で視聴開始時に既にあるチャンクの数
+	Duration  float64 // チャンクの長さ(秒)
+	Comments  int     // コメントの数
+
+	cert    *x509.Certificate
+	tlsConf *tls.Config
+	hs      *http.Server
+	hsTLS   *http.Server
+	tlsLn   *connListener
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex
+	begin     time.Time // 番組開始
+	start     time.Time // 最初のアクセス。生放送の進み具合の基準
+	requests  []string
+	injects   []inject
+	conns     map[net.Conn]bool
+	watchWs   map[*wsConn]bool
+	watching  int
+	pongs     int
+	keepSeats int
+	reserved  bool
+	tsPos     int // タイムシフトの現在のチャンク
+}
+
+type inject struct {
+	match string
+	code  int
+	count int
+}
+
+func NewServer() *Server {
+	cert, x, err := selfSigned()
+	if err != nil {
+		panic(fmt.Sprintf("nicotest: failed to create certificate: %v", err))
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("nicotest: failed to listen: %v", err))
+	}
+	s := &Server{
+		URL:      "http://" + l.Addr().String(),
+		Listener: l,
+		LiveId:   "lv1",
+		Title:    "nicotest",
+		Chunks:   10,
+		Backlog:  3,
+		Duration: 1.0,
+		Comments: 20,
+		cert:     x,
+		tlsConf:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		tlsLn:    newConnListener(l.Addr()),
+		conns:    map[net.Conn]bool{},
+		watchWs:  map[*wsConn]bool{},
+	}
+	s.hs = &http.Server{Handler: s}
+	s.hsTLS = &http.Server{Handler: s}
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.hs.Serve(l)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.hsTLS.Serve(s.tlsLn)
+	}()
+	return s
+}
+
+func selfSigned() (cert tls.Certificate, x *x509.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nicotest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames: []string{
+			"nicovideo.jp", "*.nicovideo.jp", "*.live2.nicovideo.jp", "*.dmc.nico", "localhost",
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	if x, err = x509.ParseCertificate(der); err != nil {
+		return
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+// サーバーの証明書(PEM)
+func (s *Server) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw})
+}
+
+// ニコニコへの接続がこのサーバーに向かうようにhttpbaseを設定する
+// (-http-proxy-nicoと-http-root-caを指定したのと同じ)
+func (s *Server) Install() (err error) {
+	f, err := ioutil.TempFile("", "nicotest-*.pem")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(s.CertPEM())
+	f.Close()
+	if err != nil {
+		return
+	}
+	if err = httpbase.SetRootCA(f.Name()); err != nil {
+		return
+	}
+	return httpbase.SetServiceProxy("nico", s.URL)
+}
+
+func (s *Server) Close() {
+	s.hs.Close()
+	s.hsTLS.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// 次のcount回、URL(ホスト名+パス)にmatchを含むリクエストをcodeで失敗させる
+// 例: Inject("master.m3u8", 403, 1), Inject("/ts/5.ts", 404, 3)
+func (s *Server) Inject(match string, code, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.injects = append(s.injects, inject{match: match, code: code, count: count})
+}
+
+func (s *Server) injected(u string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, in := range s.injects {
+		if in.count > 0 && strings.Contains(u, in.match) {
+			s.injects[i].count--
+			return in.code
+		}
+	}
+	return 0
+}
+
+// これまでのリクエスト("GET live2.nicovideo.jp/watch/lv1"など)
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// startWatchingを受けた回数。再接続の確認用
+func (s *Server) Watching() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watching
+}
+
+// pongを受けた回数
+func (s *Server) Pongs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pongs
+}
+
+// keepSeatを受けた回数
+func (s *Server) KeepSeats() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keepSeats
+}
+
+// タイムシフトの予約が済んだか
+func (s *Server) Reserved() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reserved
+}
+
+// 番組開始と、生放送の最初のアクセスからの経過
+func (s *Server) clock() (begin time.Time, elapsed float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.start.IsZero() {
+		s.start = time.Now()
+		if s.Timeshift {
+			s.begin = s.start.Add(-time.Hour)
+		} else {
+			s.begin = s.start.Add(-time.Duration(float64(s.Backlog) * s.Duration * float64(time.Second)))
+		}
+	}
+	return s.begin, time.Since(s.start).Seconds()
+}
+
+// 生放送で今あるチャンクの最後と、放送が終わったか
+func (s *Server) liveHead() (head int, ended bool) {
+	_, e := s.clock()
+	pos := float64(s.Backlog) + e/s.Duration
+	head = int(pos)
+	if head >= s.Chunks {
+		head = s.Chunks - 1
+	}
+	ended = pos >= float64(s.Chunks)
+	return
+}
+
+func (s *Server) endTime() time.Time {
+	begin, _ := s.clock()
+	return begin.Add(time.Duration(float64(s.Chunks) * s.Duration * float64(time.Second)))
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" {
+		s.connect(w, r)
+		return
+	}
+	u := hostname(r.Host) + r.URL.Path
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+u)
+	s.mu.Unlock()
+	if code := s.injected(u); code != 0 {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/watch/"):
+		s.serveWatchPage(w, r)
+	case p == "/api/getwaybackkey":
+		fmt.Fprint(w, "waybackkey=nicotest.waybackkey")
+	case p == "/api/watchingreservation":
+		s.serveReservation(w, r)
+	case strings.HasPrefix(p, "/wsapi/v2/watch/"):
+		s.serveWatch(w, r)
+	case p == "/websocket":
+		s.serveMessage(w, r)
+	case strings.HasPrefix(p, "/hlslive/"):
+		s.serveHls(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// CONNECTを受けたら、そのまま自分がTLSサーバーになる
+func (s *Server) connect(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack not supported", 500)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.mu.Unlock()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	s.tlsLn.push(tls.Server(conn, s.tlsConf))
+}
+
+// CONNECTで受けた接続をhttp.Serverに渡す
+type connListener struct {
+	addr net.Addr
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr: addr,
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(c net.Conn) {
+	select {
+	case l.ch <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// 書き込みを排他するwebsocket
+type wsConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *wsConn) writeJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.WriteJSON(v)
+}
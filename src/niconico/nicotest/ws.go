@@ -0,0 +1,271 @@
+package nicotest
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const pingInterval = 5 * time.Second
+
+type obj = map[string]interface{}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+var msgUpgrader = websocket.Upgrader{
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{"msg.nicovideo.jp#json"},
+}
+
+// 視聴中のwebsocketにdisconnectを送る(END_PROGRAM, TOO_MANY_CONNECTIONSなど)
+func (s *Server) Disconnect(reason string) {
+	for _, c := range s.watchConns() {
+		c.writeJSON(obj{"type": "disconnect", "data": obj{"reason": reason}})
+	}
+}
+
+// 視聴中のwebsocketにerrorを送る(INVALID_STREAM_QUALITYなど)
+func (s *Server) SendError(code string) {
+	for _, c := range s.watchConns() {
+		c.writeJSON(obj{"type": "error", "data": obj{"code": code}})
+	}
+}
+
+// 視聴中のwebsocketを切断する。再接続の確認用
+func (s *Server) DropWatch() {
+	for _, c := range s.watchConns() {
+		c.Close()
+	}
+}
+
+func (s *Server) watchConns() (list []*wsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.watchWs {
+		list = append(list, c)
+	}
+	return
+}
+
+// a.live2.nicovideo.jp/wsapi/v2/watch/*
+func (s *Server) serveWatch(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("audience_token") != audienceToken {
+		http.Error(w, "invalid token", 403)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &wsConn{Conn: ws}
+	s.mu.Lock()
+	s.watchWs[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchWs, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// ping。生放送は終わったらEND_PROGRAM
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if time.Since(last) >= pingInterval {
+				last = time.Now()
+				if c.writeJSON(obj{"type": "ping"}) != nil {
+					return
+				}
+			}
+			if !s.Timeshift {
+				_, e := s.clock()
+				if float64(s.Backlog)+e/s.Duration >= float64(s.Chunks+1) {
+					c.writeJSON(obj{"type": "disconnect", "data": obj{"reason": "END_PROGRAM"}})
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var msg obj
+		if err := c.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg["type"] {
+		case "startWatching":
+			s.mu.Lock()
+			s.watching++
+			s.mu.Unlock()
+			begin, _ := s.clock()
+			for _, m := range []obj{
+				{"type": "seat", "data": obj{"keepIntervalSec": 30}},
+				{"type": "schedule", "data": obj{
+					"begin": begin.Format(time.RFC3339),
+					"end":   s.endTime().Format(time.RFC3339),
+				}},
+				{"type": "stream", "data": obj{
+					"uri":                s.streamUri(),
+					"quality":            "abr",
+					"availableQualities": []string{"abr", "super_high", "high"},
+					"protocol":           "hls",
+				}},
+				{"type": "room", "data": obj{
+					"name":       "アリーナ",
+					"threadId":   threadId,
+					"waybackkey": "nicotest.waybackkey",
+					"messageServer": obj{
+						"uri":  "wss://msgd.live2.nicovideo.jp/websocket",
+						"type": "niwavided",
+					},
+					"isFirst": true,
+				}},
+			} {
+				if c.writeJSON(m) != nil {
+					return
+				}
+			}
+		case "keepSeat":
+			s.mu.Lock()
+			s.keepSeats++
+			s.mu.Unlock()
+		case "pong":
+			s.mu.Lock()
+			s.pongs++
+			s.mu.Unlock()
+		}
+	}
+}
+
+// i番目(0から)のコメント。番組の長さに均等に並べる
+func (s *Server) comment(i int) obj {
+	begin, _ := s.clock()
+	t := s.commentTime(i)
+	return obj{
+		"thread":    threadId,
+		"no":        i + 1,
+		"vpos":      int(t.Sub(begin) / (10 * time.Millisecond)),
+		"date":      t.Unix(),
+		"date_usec": t.Nanosecond() / 1000,
+		"user_id":   fmt.Sprintf("nicotest-%d", i%5),
+		"premium":   i % 2,
+		"anonymity": 1,
+		"mail":      "184",
+		"content":   fmt.Sprintf("コメント%d", i+1),
+	}
+}
+
+func (s *Server) commentTime(i int) time.Time {
+	begin, _ := s.clock()
+	total := float64(s.Chunks) * s.Duration
+	sec := total * float64(i) / float64(s.Comments)
+	return begin.Add(time.Duration(sec * float64(time.Second)))
+}
+
+// msgd.live2.nicovideo.jp/websocket
+// 生放送は過去のコメントを返してから新しいものを流す
+// タイムシフトはwhenより前のものを最大1000件返す
+func (s *Server) serveMessage(w http.ResponseWriter, r *http.Request) {
+	ws, err := msgUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &wsConn{Conn: ws}
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	var pushing bool
+
+	for {
+		var msg interface{}
+		if err := c.ReadJSON(&msg); err != nil {
+			return
+		}
+		list, ok := msg.([]interface{})
+		if !ok {
+			// 60秒ごとの""
+			continue
+		}
+		for _, m := range list {
+			m, ok := m.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if ping, ok := m["ping"]; ok {
+				if c.writeJSON(obj{"ping": ping}) != nil {
+					return
+				}
+				continue
+			}
+			th, ok := m["thread"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if th["thread"] != threadId {
+				c.writeJSON(obj{"thread": obj{"resultcode": 1, "thread": th["thread"]}})
+				continue
+			}
+
+			limit := time.Now()
+			if when, ok := th["when"].(float64); ok {
+				limit = time.Unix(0, int64(when*1e9))
+			}
+			next := 0
+			for next < s.Comments && s.commentTime(next).Before(limit) {
+				next++
+			}
+			from := next - 1000
+			if from < 0 {
+				from = 0
+			}
+			if c.writeJSON(obj{"thread": obj{
+				"resultcode":  0,
+				"thread":      threadId,
+				"last_res":    next,
+				"ticket":      "0x12345678",
+				"revision":    1,
+				"server_time": time.Now().Unix(),
+			}}) != nil {
+				return
+			}
+			for i := from; i < next; i++ {
+				if c.writeJSON(obj{"chat": s.comment(i)}) != nil {
+					return
+				}
+			}
+
+			if !s.Timeshift && !pushing {
+				pushing = true
+				go s.pushComments(c, next, done)
+			}
+		}
+	}
+}
+
+func (s *Server) pushComments(c *wsConn, next int, done <-chan struct{}) {
+	for ; next < s.Comments; next++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Until(s.commentTime(next))):
+		}
+		if c.writeJSON(obj{"chat": s.comment(next)}) != nil {
+			return
+		}
+	}
+}
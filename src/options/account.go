@@ -0,0 +1,391 @@
+package options
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/himananiito/livedl/cryptoconf"
+	"golang.org/x/term"
+)
+
+// account.dbの user, pass, session はマスターパスフレーズから作った鍵で暗号化する
+// パスフレーズは 環境変数 LIVEDL_MASTER_PASS, -master-pass-fd <fd>, 端末からの入力 の順で取得する
+
+const secretPrefix = "enc1:"
+
+var masterKey []byte
+var masterPassFd = -1
+
+func readMasterPass(create bool) (pass string, err error) {
+	if s := os.Getenv("LIVEDL_MASTER_PASS"); s != "" {
+		pass = s
+		return
+	}
+
+	if masterPassFd >= 0 {
+		f := os.NewFile(uintptr(masterPassFd), "master-pass")
+		if f == nil {
+			err = fmt.Errorf("-master-pass-fd %d: invalid fd", masterPassFd)
+			return
+		}
+		pass, err = bufio.NewReader(f).ReadString('\n')
+		f.Close()
+		pass = strings.TrimRight(pass, "\r\n")
+		if pass != "" {
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("-master-pass-fd %d: %v", masterPassFd, err)
+		}
+		return
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		err = fmt.Errorf("master passphrase required: set LIVEDL_MASTER_PASS or use -master-pass-fd")
+		return
+	}
+	prompt := func(msg string) (s string, err error) {
+		fmt.Fprint(os.Stderr, msg)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		s = string(b)
+		return
+	}
+	if create {
+		fmt.Fprintln(os.Stderr, "account.dbを暗号化するためのマスターパスフレーズを設定してください")
+	}
+	if pass, err = prompt("Master passphrase: "); err != nil {
+		return
+	}
+	if pass == "" {
+		err = fmt.Errorf("master passphrase: empty")
+		return
+	}
+	if create {
+		var again string
+		if again, err = prompt("Master passphrase (again): "); err != nil {
+			return
+		}
+		if again != pass {
+			err = fmt.Errorf("master passphrase: mismatch")
+			return
+		}
+	}
+	return
+}
+
+// マスターパスフレーズを確認して鍵を用意する。平文で保存されていたものは暗号化する
+func accountUnlock(db *sql.DB) (err error) {
+	if masterKey != nil {
+		return
+	}
+
+	var salt, check []byte
+	db.QueryRow(`SELECT v FROM meta WHERE k = "salt"`).Scan(&salt)
+	db.QueryRow(`SELECT v FROM meta WHERE k = "check"`).Scan(&check)
+
+	create := len(salt) == 0 || len(check) == 0
+	pass, err := readMasterPass(create)
+	if err != nil {
+		return
+	}
+
+	if create {
+		if salt, err = cryptoconf.NewSalt(); err != nil {
+			return
+		}
+	}
+	key, err := cryptoconf.DeriveKey(pass, salt)
+	if err != nil {
+		return
+	}
+
+	if create {
+		if check, err = cryptoconf.Seal(key, []byte("livedl")); err != nil {
+			return
+		}
+		_, err = db.Exec(`
+			INSERT OR REPLACE INTO meta (k, v) VALUES ("salt", ?);
+			INSERT OR REPLACE INTO meta (k, v) VALUES ("check", ?);
+		`, salt, check)
+		if err != nil {
+			return
+		}
+	} else if _, e := cryptoconf.Open(key, check); e != nil {
+		err = fmt.Errorf("master passphrase: wrong passphrase")
+		return
+	}
+
+	masterKey = key
+	err = accountMigrate(db)
+	return
+}
+
+func encryptSecret(s string) (res string, err error) {
+	if s == "" {
+		return
+	}
+	b, err := cryptoconf.Seal(masterKey, []byte(s))
+	if err != nil {
+		return
+	}
+	res = secretPrefix + base64.StdEncoding.EncodeToString(b)
+	return
+}
+
+// 暗号化されていない(移行前の)値はそのまま返す
+func decryptSecret(s string) (res string, err error) {
+	if !strings.HasPrefix(s, secretPrefix) {
+		res = s
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, secretPrefix))
+	if err != nil {
+		return
+	}
+	b, err = cryptoconf.Open(masterKey, b)
+	if err != nil {
+		return
+	}
+	res = string(b)
+	return
+}
+
+// 平文で保存されている行を暗号化する
+func accountMigrate(db *sql.DB) (err error) {
+	rows, err := db.Query(`SELECT alias, user, pass, IFNULL(session, "") FROM niconico`)
+	if err != nil {
+		return
+	}
+	type account struct {
+		alias, user, pass, session string
+	}
+	var list []account
+	for rows.Next() {
+		var a account
+		if err = rows.Scan(&a.alias, &a.user, &a.pass, &a.session); err != nil {
+			rows.Close()
+			return
+		}
+		list = append(list, a)
+	}
+	rows.Close()
+
+	for _, a := range list {
+		var changed bool
+		for _, p := range []*string{&a.user, &a.pass, &a.session} {
+			if *p == "" || strings.HasPrefix(*p, secretPrefix) {
+				continue
+			}
+			if *p, err = encryptSecret(*p); err != nil {
+				return
+			}
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		_, err = db.Exec(`UPDATE niconico SET user = ?, pass = ?, session = ? WHERE alias = ?`,
+			a.user, a.pass, a.session, a.alias)
+		if err != nil {
+			return
+		}
+		fmt.Printf("account encrypted: %s\n", a.alias)
+	}
+	return
+}
+
+func dbAccountExists(db *sql.DB, alias string) bool {
+	var n int64
+	db.QueryRow(`SELECT COUNT(*) FROM niconico WHERE alias = ?`, alias).Scan(&n)
+	return n > 0
+}
+
+// -account list
+func accountList(current string) (err error) {
+	db, err := dbAccountOpen()
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return
+	}
+	defer db.Close()
+
+	var n int64
+	db.QueryRow(`SELECT COUNT(*) FROM niconico`).Scan(&n)
+	if n == 0 {
+		fmt.Println("no account")
+		return
+	}
+	if err = accountUnlock(db); err != nil {
+		return
+	}
+
+	rows, err := db.Query(`SELECT alias, user, IFNULL(session, "") FROM niconico ORDER BY alias`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var alias, user, session string
+		if err = rows.Scan(&alias, &user, &session); err != nil {
+			return
+		}
+		if user, err = decryptSecret(user); err != nil {
+			return
+		}
+		mark := " "
+		if alias == current {
+			mark = "*"
+		}
+		sess := ""
+		if session != "" {
+			sess = " (session)"
+		}
+		fmt.Printf("%s %s\t%s%s\n", mark, alias, user, sess)
+	}
+	return
+}
+
+// -account remove
+func accountRemove(alias string) (err error) {
+	db, err := dbAccountOpen()
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return
+	}
+	defer db.Close()
+
+	if !dbAccountExists(db, alias) {
+		err = fmt.Errorf("account not found: %s", alias)
+		return
+	}
+	_, err = db.Exec(`
+		DELETE FROM niconico WHERE alias = ?;
+		DELETE FROM cookies WHERE alias = ?
+	`, alias, alias)
+	return
+}
+
+// -account rename
+func accountRename(from, to string) (err error) {
+	db, err := dbAccountOpen()
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return
+	}
+	defer db.Close()
+
+	if !dbAccountExists(db, from) {
+		err = fmt.Errorf("account not found: %s", from)
+		return
+	}
+	if dbAccountExists(db, to) {
+		err = fmt.Errorf("account already exists: %s", to)
+		return
+	}
+	_, err = db.Exec(`
+		UPDATE niconico SET alias = ? WHERE alias = ?;
+		UPDATE cookies SET alias = ? WHERE alias = ?
+	`, to, from, to, from)
+	return
+}
+
+// -account use
+func accountCheck(alias string) (err error) {
+	db, err := dbAccountOpen()
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return
+	}
+	defer db.Close()
+
+	if !dbAccountExists(db, alias) {
+		err = fmt.Errorf("account not found: %s", alias)
+	}
+	return
+}
+
+// Cookieはアカウント(NicoLoginAlias)ごとにaccount.dbに暗号化して保存する
+
+// 保存されていなければnil
+func LoadCookies(alias string) (data []byte, err error) {
+	db, err := dbAccountOpen()
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return
+	}
+	defer db.Close()
+
+	var enc string
+	if db.QueryRow(`SELECT IFNULL(data, "") FROM cookies WHERE alias = ?`, alias).Scan(&enc) != nil || enc == "" {
+		return
+	}
+	if err = accountUnlock(db); err != nil {
+		return
+	}
+	s, err := decryptSecret(enc)
+	if err != nil {
+		return
+	}
+	data = []byte(s)
+	return
+}
+
+// createがfalseなら、既に保存されている場合のみ更新する
+func SaveCookies(alias string, data []byte, create bool) (err error) {
+	db, err := dbAccountOpen()
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return
+	}
+	defer db.Close()
+
+	if !create {
+		var n int64
+		db.QueryRow(`SELECT COUNT(*) FROM cookies WHERE alias = ?`, alias).Scan(&n)
+		if n == 0 {
+			return
+		}
+	}
+	if err = accountUnlock(db); err != nil {
+		return
+	}
+	enc, err := encryptSecret(string(data))
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT OR REPLACE INTO cookies (alias, data) VALUES (?, ?)`, alias, enc)
+	return
+}
+
+// -cookies-clear
+func ClearCookies(alias string) (err error) {
+	db, err := dbAccountOpen()
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`DELETE FROM cookies WHERE alias = ?`, alias)
+	return
+}
@@ -0,0 +1,210 @@
+package options
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// 全体に適用される設定なので行ごとには変えられない
+var batchGlobal = map[string]bool{
+	"OutputDir":      true,
+	"AltOutputDir":   true,
+	"MinFreeSpace":   true,
+	"HttpRootCA":     true,
+	"HttpSkipVerify": true,
+	"HttpProxy":      true,
+	"HttpProxyNico":  true,
+	"HttpProxyTcas":  true,
+	"HttpProxyYt":    true,
+	"NoChdir":        true,
+	"BatchJobs":      true,
+	"BatchReport":    true,
+	// Cookieは全てのジョブで共有するので、アカウントも1つにする
+	"NicoSession":    true,
+	"NicoLoginAlias": true,
+	"CookieFile":     true,
+}
+
+// -batchのリストの1行を解析する
+//
+//	lv123456789 -nico-format=?PID? -nico-auto-convert
+//	https://twitcasting.tv/XXXXX
+//	-tcas XXXXX
+//	-yt XXXXXXXXXXX
+//	rec.sqlite3 -conv-ext=ts
+//
+// 空行と#で始まる行は無視する(ok == false)
+func ParseBatchLine(base Option, line string) (opt Option, ok bool, err error) {
+	args, err := splitBatchLine(line)
+	if err != nil {
+		return
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+		return
+	}
+
+	if opt, err = ParseJobArgs(base, args); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// 対象(lvXXXやxxx.sqlite3など)とオプションからOptionを作る。設定は保存されない
+func ParseJobArgs(base Option, args []string) (opt Option, err error) {
+	opt = base
+	opt.Command = ""
+	opt.NicoLiveId = ""
+	opt.TcasId = ""
+	opt.YoutubeId = ""
+	opt.ZipFile = ""
+	opt.DBFile = ""
+
+	setTarget := func(cmd, arg string) error {
+		if opt.Command != "" {
+			return fmt.Errorf("too many targets: %s", arg)
+		}
+		switch cmd {
+		case "NICOLIVE":
+			ma := regexp.MustCompile(`(lv\d+)`).FindStringSubmatch(arg)
+			if len(ma) == 0 {
+				return fmt.Errorf("Not nicolive id: %s", arg)
+			}
+			opt.NicoLiveId = ma[1]
+		case "TWITCAS":
+			ma := regexp.MustCompile(`\A(?:https?://twitcasting\.tv/)?([^/]+)`).FindStringSubmatch(arg)
+			if len(ma) == 0 {
+				return fmt.Errorf("Not twitcasting user: %s", arg)
+			}
+			opt.TcasId = ma[1]
+		case "YOUTUBE":
+			if ma := regexp.MustCompile(`v=([\w-]+)`).FindStringSubmatch(arg); len(ma) > 0 {
+				opt.YoutubeId = ma[1]
+			} else if ma := regexp.MustCompile(`\A([\w-]+)\z`).FindStringSubmatch(arg); len(ma) > 0 {
+				opt.YoutubeId = ma[1]
+			} else {
+				return fmt.Errorf("Not YouTube id: %s", arg)
+			}
+		case "ZIP2MP4":
+			opt.ZipFile = arg
+		case "DB2MP4":
+			opt.DBFile = arg
+		}
+		opt.Command = cmd
+		return nil
+	}
+
+	keywords := map[string]string{
+		"nico":       "NICOLIVE",
+		"tcas":       "TWITCAS",
+		"yt":         "YOUTUBE",
+		"d2m":        "DB2MP4",
+		"z2m":        "ZIP2MP4",
+		"nicolive":   "NICOLIVE",
+		"twitcas":    "TWITCAS",
+		"youtube":    "YOUTUBE",
+		"db-to-mp4":  "DB2MP4",
+		"zip-to-mp4": "ZIP2MP4",
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if ma := regexp.MustCompile(`\A--?([^=]+)(?:=(.*))?\z`).FindStringSubmatch(arg); len(ma) > 0 {
+			name := strings.ToLower(ma[1])
+			if cmd, isTarget := keywords[name]; isTarget {
+				if i+1 >= len(args) {
+					err = fmt.Errorf("%s: value required", arg)
+					return
+				}
+				i++
+				if err = setTarget(cmd, args[i]); err != nil {
+					return
+				}
+				continue
+			}
+
+			field, found := confFieldName(name)
+			if !found {
+				err = fmt.Errorf("Unknown option: %s", arg)
+				return
+			}
+			if batchGlobal[field] {
+				err = fmt.Errorf("%s: cannot be set per line", arg)
+				return
+			}
+			var val interface{}
+			if strings.Contains(arg, "=") {
+				val = ma[2]
+			} else if reflect.ValueOf(opt).FieldByName(field).Kind() == reflect.Bool {
+				val = true
+			} else if i+1 < len(args) {
+				i++
+				val = args[i]
+			} else {
+				err = fmt.Errorf("%s: value required", arg)
+				return
+			}
+			if _, err = setConf(&opt, field, val); err != nil {
+				return
+			}
+			continue
+		}
+
+		switch {
+		case regexp.MustCompile(`\A(https?://(?:[^/]*@)?(?:[^/]*\.)*nicovideo\.jp(?::[^/]*)?/(?:[^/]*?/)*)?(lv\d+)(?:\?.*)?\z`).MatchString(arg):
+			err = setTarget("NICOLIVE", arg)
+		case regexp.MustCompile(`\Ahttps?://twitcasting\.tv/([^/]+)(?:/.*)?\z`).MatchString(arg):
+			err = setTarget("TWITCAS", arg)
+		case regexp.MustCompile(`\Ahttps?://(?:[^/]*\.)*youtube\.com/(?:.*\W)?v=([\w-]+)(?:[^\w-].*)?\z`).MatchString(arg):
+			err = setTarget("YOUTUBE", arg)
+		case regexp.MustCompile(`(?i)\.sqlite3\z`).MatchString(arg):
+			err = setTarget("DB2MP4", arg)
+		case regexp.MustCompile(`(?i)\.zip\z`).MatchString(arg):
+			err = setTarget("ZIP2MP4", arg)
+		default:
+			err = fmt.Errorf("Unknown target: %s", arg)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if opt.Command == "" {
+		err = fmt.Errorf("target not specified")
+		return
+	}
+	return
+}
+
+// 空白で区切る。"..."で空白を含められる
+func splitBatchLine(line string) (args []string, err error) {
+	var cur []rune
+	var quoted, inArg bool
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (c == ' ' || c == '\t' || c == '\r' || c == '\n'):
+			if inArg {
+				args = append(args, string(cur))
+				cur = cur[:0]
+				inArg = false
+			}
+		default:
+			cur = append(cur, c)
+			inArg = true
+		}
+	}
+	if quoted {
+		err = fmt.Errorf("unterminated quote: %s", line)
+		return
+	}
+	if inArg {
+		args = append(args, string(cur))
+	}
+	return
+}
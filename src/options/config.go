@@ -0,0 +1,440 @@
+package options
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 設定ファイル(YAML)の例
+//
+//	nico-format: "?PID?-?UNAME?-?TITLE?"
+//	nico-auto-convert: on
+//	profiles:
+//	  archive:
+//	    output-dir: D:/archive
+//	    conv-ext: ts
+//
+// キーはオプション名(nico-format)でもconf.dbのキー(NicoFormat)でもよい
+// 優先順位: コマンドライン > 環境変数(LIVEDL_*) > プロファイル > 設定ファイル > conf.db
+
+// 設定ファイルや環境変数からは設定させない項目
+var confExcluded = map[string]bool{
+	"Command":       true,
+	"NicoLiveId":    true,
+	"TcasId":        true,
+	"YoutubeId":     true,
+	"ZipFile":       true,
+	"DBFile":        true,
+	"FlvFile":       true,
+	"ConfFile":      true,
+	"ConfPass":      true,
+	"ConfigFile":    true,
+	"ConfigProfile": true,
+	"NicoRtmpIndex": true,
+	"BatchFile":     true,
+	"Interrupt":     true,
+	"Stdout":        true,
+	"Json":          true,
+	"HlsDir":        true,
+	"RtmpUrl":       true,
+	"RtmpConn":      true,
+	"HttpGetUrl":    true,
+	"HttpGetOutput": true,
+	"HttpHeader":    true,
+	"CookieClear":   true,
+	"CaptureFile":   true,
+	"ReplayFile":    true,
+}
+
+// -conf-showで値を伏せ、-conf-exportで書き出さない項目
+var confSecret = map[string]bool{
+	"NicoSession": true,
+	"HttpCookie":  true,
+}
+
+// オプション名とフィールド名が一致しないもの
+var confAliases = map[string]string{
+	"nicoautodeletemode":   "NicoAutoDeleteDBMode",
+	"nicoforcereservation": "NicoForceResv",
+	"tcasretrytimeout":     "TcasRetryTimeoutMinute",
+	"extract":              "ExtractChunks",
+	"from":                 "ConvFrom",
+	"to":                   "ConvTo",
+	"fromseqno":            "ConvFromSeqNo",
+	"toseqno":              "ConvToSeqNo",
+}
+
+func confKey(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "-", "", -1)
+	s = strings.Replace(s, "_", "", -1)
+	return s
+}
+
+// キーに対応するOptionのフィールド名
+func confFieldName(key string) (name string, ok bool) {
+	k := confKey(key)
+	if name, ok = confAliases[k]; ok {
+		return
+	}
+	t := reflect.TypeOf(Option{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if confExcluded[f.Name] {
+			continue
+		}
+		if confKey(f.Name) == k {
+			name = f.Name
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+func setConfValue(v reflect.Value, val interface{}) (err error) {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		// 数値は秒
+		var d time.Duration
+		if d, err = parseDuration(fmt.Sprint(val)); err == nil {
+			v.SetInt(int64(d))
+		}
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if val == nil {
+			v.SetString("")
+		} else {
+			v.SetString(fmt.Sprint(val))
+		}
+
+	case reflect.Bool:
+		switch x := val.(type) {
+		case bool:
+			v.SetBool(x)
+		case int:
+			v.SetBool(x != 0)
+		case int64:
+			v.SetBool(x != 0)
+		case string:
+			switch strings.ToLower(x) {
+			case "on", "true", "yes", "1":
+				v.SetBool(true)
+			case "off", "false", "no", "0":
+				v.SetBool(false)
+			default:
+				err = fmt.Errorf("not a boolean: %v", x)
+			}
+		default:
+			err = fmt.Errorf("not a boolean: %v", val)
+		}
+
+	case reflect.Int, reflect.Int64:
+		switch x := val.(type) {
+		case int:
+			v.SetInt(int64(x))
+		case int64:
+			v.SetInt(x)
+		case float64:
+			v.SetInt(int64(x))
+		case bool:
+			if x {
+				v.SetInt(1)
+			} else {
+				v.SetInt(0)
+			}
+		case string:
+			var n int64
+			if v.Kind() == reflect.Int64 {
+				// サイズ指定(5Gなど)
+				n, err = parseSize(x)
+			} else {
+				var i int
+				i, err = strconv.Atoi(x)
+				n = int64(i)
+			}
+			if err != nil {
+				return
+			}
+			v.SetInt(n)
+		default:
+			err = fmt.Errorf("not a number: %v", val)
+		}
+
+	case reflect.Float64:
+		switch x := val.(type) {
+		case int:
+			v.SetFloat(float64(x))
+		case float64:
+			v.SetFloat(x)
+		case string:
+			var f float64
+			if f, err = strconv.ParseFloat(x, 64); err != nil {
+				return
+			}
+			v.SetFloat(f)
+		default:
+			err = fmt.Errorf("not a number: %v", val)
+		}
+
+	default:
+		err = fmt.Errorf("[FIXME] unsupported type: %v", v.Kind())
+	}
+	return
+}
+
+func setConf(opt *Option, key string, val interface{}) (name string, err error) {
+	name, ok := confFieldName(key)
+	if !ok {
+		err = fmt.Errorf("unknown option: %s", key)
+		return
+	}
+	if err = setConfValue(reflect.ValueOf(opt).Elem().FieldByName(name), val); err != nil {
+		err = fmt.Errorf("%s: %v", key, err)
+	}
+	return
+}
+
+func confMap(intf interface{}) (res map[string]interface{}, ok bool) {
+	switch m := intf.(type) {
+	case map[interface{}]interface{}:
+		res = map[string]interface{}{}
+		for k, v := range m {
+			res[fmt.Sprint(k)] = v
+		}
+		ok = true
+	case map[string]interface{}:
+		res = m
+		ok = true
+	}
+	return
+}
+
+func applyConfMap(opt *Option, src map[string]string, data map[string]interface{}, source string) (err error) {
+	// 同じ順番で適用されるようにする
+	var keys []string
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name, e := setConf(opt, k, data[k])
+		if e != nil {
+			err = fmt.Errorf("%s: %v", source, e)
+			return
+		}
+		src[name] = source
+	}
+	return
+}
+
+// 設定ファイルを読み込み、共通の設定の後にプロファイルの設定を適用する
+func applyConfigFile(opt *Option, src map[string]string, fileName, profile string) (err error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+
+	var intf interface{}
+	if err = yaml.Unmarshal(b, &intf); err != nil {
+		err = fmt.Errorf("%s: %v", fileName, err)
+		return
+	}
+	data, ok := confMap(intf)
+	if !ok {
+		if intf == nil {
+			data = map[string]interface{}{}
+		} else {
+			err = fmt.Errorf("%s: not a map", fileName)
+			return
+		}
+	}
+
+	var profiles map[string]interface{}
+	if p, ok := data["profiles"]; ok {
+		if profiles, ok = confMap(p); !ok {
+			err = fmt.Errorf("%s: profiles: not a map", fileName)
+			return
+		}
+		delete(data, "profiles")
+	}
+
+	if err = applyConfMap(opt, src, data, "config"); err != nil {
+		return
+	}
+
+	if profile != "" {
+		p, ok := profiles[profile]
+		if !ok {
+			err = fmt.Errorf("%s: profile not found: %s", fileName, profile)
+			return
+		}
+		pdata, ok := confMap(p)
+		if !ok {
+			if p != nil {
+				err = fmt.Errorf("%s: profile %s: not a map", fileName, profile)
+				return
+			}
+			pdata = map[string]interface{}{}
+		}
+		if err = applyConfMap(opt, src, pdata, "profile:"+profile); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// LIVEDL_NICO_FORMAT のような環境変数を適用する
+func applyEnv(opt *Option, src map[string]string) (err error) {
+	envs := os.Environ()
+	sort.Strings(envs)
+	for _, env := range envs {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "LIVEDL_") {
+			continue
+		}
+		switch kv[0] {
+		case "LIVEDL_DIR", "LIVEDL_CONFIG", "LIVEDL_PROFILE":
+			continue
+		}
+		key := strings.TrimPrefix(kv[0], "LIVEDL_")
+		if _, ok := confFieldName(key); !ok {
+			continue
+		}
+		name, e := setConf(opt, key, kv[1])
+		if e != nil {
+			err = fmt.Errorf("%s: %v", kv[0], e)
+			return
+		}
+		src[name] = "env"
+	}
+	return
+}
+
+// コマンドラインで変更された項目を記録する
+func markChanged(src map[string]string, before, after Option) {
+	a := reflect.ValueOf(before)
+	b := reflect.ValueOf(after)
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			src[t.Field(i).Name] = "cli"
+		}
+	}
+}
+
+func printConf(opt Option, src map[string]string) {
+	v := reflect.ValueOf(opt)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if confExcluded[name] {
+			continue
+		}
+		source, ok := src[name]
+		if !ok {
+			source = "default"
+		}
+		val := fmt.Sprintf("%#v", v.Field(i).Interface())
+		if d, ok := v.Field(i).Interface().(time.Duration); ok {
+			val = d.String()
+		}
+		if s, ok := v.Field(i).Interface().(string); ok && s != "" {
+			if confSecret[name] {
+				val = `"REDACTED"`
+			} else if r, ok := redactPassword(s); ok {
+				val = fmt.Sprintf("%#v", r)
+			}
+		}
+		fmt.Printf("%-24s %-32s %s\n", name, val, source)
+	}
+}
+
+// proxyなどのURLのuser:pass@のパスワードを伏せる
+func redactPassword(s string) (res string, ok bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return
+	}
+	if _, ok = u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		res = u.String()
+	}
+	return
+}
+
+func dbConfDelete(db *sql.DB, k string) (err error) {
+	if strings.EqualFold(k, "all") {
+		_, err = db.Exec(`DELETE FROM conf`)
+		return
+	}
+	name, ok := confFieldName(k)
+	if !ok {
+		err = fmt.Errorf("unknown option: %s", k)
+		return
+	}
+	_, err = db.Exec(`DELETE FROM conf WHERE k = ?`, name)
+	return
+}
+
+// conf.dbに保存された設定を設定ファイルの形式で書き出す
+func exportConf(db *sql.DB, fileName string) (err error) {
+	rows, err := db.Query(`SELECT k, v FROM conf ORDER BY k`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	t := reflect.TypeOf(Option{})
+	data := map[string]interface{}{}
+	for rows.Next() {
+		var k string
+		var v interface{}
+		if err = rows.Scan(&k, &v); err != nil {
+			return
+		}
+		f, ok := t.FieldByName(k)
+		if !ok || confSecret[k] {
+			continue
+		}
+		// 型を揃える
+		val := reflect.New(f.Type).Elem()
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		if n, ok := v.(int64); ok && f.Type == reflect.TypeOf(time.Duration(0)) {
+			// conf.dbにはナノ秒で保存されている
+			v = time.Duration(n).String()
+		}
+		if e := setConfValue(val, v); e != nil {
+			continue
+		}
+		data[k] = val.Interface()
+		if s, ok := data[k].(string); ok {
+			if r, ok := redactPassword(s); ok {
+				data[k] = r
+				fmt.Printf("%s: password is not exported (REDACTED)\n", k)
+			}
+		}
+	}
+
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(fileName, b, 0644)
+	return
+}
@@ -0,0 +1,156 @@
+package outname
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/himananiito/livedl/files"
+)
+
+// 置換変数。値はファイル名に使えない文字を置き換えてから埋め込まれる
+type Vars map[string]string
+
+// どのサービスでも使える置換変数。値が無い場合は空文字列になる
+var commonKeys = []string{
+	"SERVICE", // nico, tcas, youtube
+	"PID",     // 番組ID、ムービーID、動画ID
+	"UNAME",   // ユーザ名
+	"UID",     // ユーザID
+	"TITLE",   // タイトル
+	"CNAME",   // コミュ名 or チャンネル名
+	"CID",     // コミュID or チャンネルID
+	"YEAR", "MONTH", "DAY", "DAY8", "DAY6",
+	"HOUR", "MINUTE", "SECOND", "TIME6", "TIME4",
+}
+
+// 1つのディレクトリ名/ファイル名の長さの上限(バイト)
+// 拡張子や"(TS)"、"-2"などを後から付けるため、255より少し小さくしておく
+var maxComponentBytes = 230
+
+var rootDir string
+
+func SetRootDir(dir string) {
+	rootDir = dir
+}
+func GetRootDir() string {
+	return rootDir
+}
+
+func (v Vars) SetTime(t time.Time) {
+	v["YEAR"] = fmt.Sprintf("%04d", t.Year())
+	v["MONTH"] = fmt.Sprintf("%02d", t.Month())
+	v["DAY"] = fmt.Sprintf("%02d", t.Day())
+	v["DAY8"] = fmt.Sprintf("%04d%02d%02d", t.Year(), t.Month(), t.Day())
+	v["DAY6"] = fmt.Sprintf("%02d%02d%02d", t.Year()%100, t.Month(), t.Day())
+	v["HOUR"] = fmt.Sprintf("%02d", t.Hour())
+	v["MINUTE"] = fmt.Sprintf("%02d", t.Minute())
+	v["SECOND"] = fmt.Sprintf("%02d", t.Second())
+	v["TIME6"] = fmt.Sprintf("%02d%02d%02d", t.Hour(), t.Minute(), t.Second())
+	v["TIME4"] = fmt.Sprintf("%02d%02d", t.Hour(), t.Minute())
+}
+
+func (v Vars) lookup(key string) (val string, ok bool) {
+	if val, ok = v[key]; ok {
+		return
+	}
+	for _, k := range commonKeys {
+		if k == key {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+var rePlaceholder = regexp.MustCompile(`\?([A-Z][A-Z0-9]*)(?::(\d+))?\?`)
+
+// ?KEY?を置き換える。?KEY:N?はN文字までに切り詰める
+// 知らない置換変数はそのまま残す
+func formatComponent(format string, vars Vars) string {
+	s := rePlaceholder.ReplaceAllStringFunc(format, func(m string) string {
+		ma := rePlaceholder.FindStringSubmatch(m)
+		val, ok := vars.lookup(ma[1])
+		if !ok {
+			return m
+		}
+		val = files.ReplaceForbidden(val)
+		if ma[2] != "" {
+			if n, err := strconv.Atoi(ma[2]); err == nil {
+				val = truncateRunes(val, n)
+			}
+		}
+		return val
+	})
+	return truncateBytes(s, maxComponentBytes)
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// formatからファイル名(拡張子なし)を作る
+// formatの"/"と"\"はディレクトリの区切りとして扱う
+// Windowsのドライブ名(C:)とUNCパス(\\server\share)はそのまま残す
+func Format(format string, vars Vars) string {
+	vol := filepath.VolumeName(format)
+	format = strings.Replace(format[len(vol):], `\`, "/", -1)
+	list := []string{vol}
+	if strings.HasPrefix(format, "/") {
+		list[0] += string(filepath.Separator)
+	}
+	for _, c := range strings.Split(format, "/") {
+		list = append(list, formatComponent(c, vars))
+	}
+	return filepath.Join(list...)
+}
+
+// Formatの結果を出力先のディレクトリの下に置く
+func Path(format string, vars Vars) string {
+	name := Format(format, vars)
+	if rootDir != "" && !filepath.IsAbs(name) {
+		name = filepath.Join(rootDir, name)
+	}
+	return name
+}
+
+// 既存のファイル名を出力先のディレクトリの下に移す
+// 既に出力先の下にあるもの(サブディレクトリも含む)はそのまま
+func Rebase(fileName string) string {
+	if rootDir == "" || under(rootDir, fileName) {
+		return fileName
+	}
+	return filepath.Join(rootDir, filepath.Base(fileName))
+}
+
+func under(dir, fileName string) bool {
+	d, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	f, err := filepath.Abs(fileName)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(d, f)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,61 @@
+package outname
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	vars := Vars{"PID": "lv1", "TITLE": `a\b/c`}
+	sep := string(filepath.Separator)
+	tests := []struct {
+		format, want string
+	}{
+		{"?PID?", "lv1"},
+		{"?PID? ?TITLE?", "lv1 a￥b∕c"},
+		{`rec/?PID?\?TITLE:1?`, filepath.Join("rec", "lv1", "a")},
+		{"/rec/?PID?", sep + filepath.Join("rec", "lv1")},
+		{"rec//?PID?/", filepath.Join("rec", "lv1")},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests, []struct {
+			format, want string
+		}{
+			{`C:\rec\?PID?`, `C:\rec\lv1`},
+			{`C:/rec/?PID?`, `C:\rec\lv1`},
+			// ドライブの今のディレクトリから
+			{`C:?PID?`, `C:lv1`},
+			{`\\server\share\rec\?PID?`, `\\server\share\rec\lv1`},
+			{`//server/share/?PID?`, `\\server\share\lv1`},
+			{`\rec\?PID?`, `\rec\lv1`},
+		}...)
+	}
+	for _, tc := range tests {
+		if got := Format(tc.format, vars); got != tc.want {
+			t.Errorf("Format(%q) = %q, want %q", tc.format, got, tc.want)
+		}
+	}
+}
+
+func TestRebase(t *testing.T) {
+	root := filepath.Join("out", "rec")
+	SetRootDir(root)
+	defer SetRootDir("")
+
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"a.sqlite3", filepath.Join(root, "a.sqlite3")},
+		{filepath.Join("other", "a.sqlite3"), filepath.Join(root, "a.sqlite3")},
+		{filepath.Join(root, "a.sqlite3"), filepath.Join(root, "a.sqlite3")},
+		// 出力先の下のディレクトリはそのまま
+		{filepath.Join(root, "user", "2020", "a.sqlite3"), filepath.Join(root, "user", "2020", "a.sqlite3")},
+		{filepath.Join("out", "rec2", "a.sqlite3"), filepath.Join(root, "a.sqlite3")},
+		{filepath.Join(root, "..", "a.sqlite3"), filepath.Join(root, "a.sqlite3")},
+	} {
+		if got := Rebase(tc.in); got != tc.want {
+			t.Errorf("Rebase(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package rtmps
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// FP9以降のハンドシェイク(digest)とRTMPE
+// http://repo.or.cz/w/rtmpdump.git/blob/HEAD:/librtmp/handshake.h
+
+const (
+	sigSize    = 1536
+	digestSize = 32
+	dhKeySize  = 128
+)
+
+var genuineFMSKey = []byte{
+	'G', 'e', 'n', 'u', 'i', 'n', 'e', ' ', 'A', 'd', 'o', 'b', 'e', ' ',
+	'F', 'l', 'a', 's', 'h', ' ', 'M', 'e', 'd', 'i', 'a', ' ',
+	'S', 'e', 'r', 'v', 'e', 'r', ' ', '0', '0', '1', // 36
+	0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8, 0x2e, 0x00, 0xd0, 0xd1,
+	0x02, 0x9e, 0x7e, 0x57, 0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab,
+	0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae, // 68
+}
+
+var genuineFPKey = []byte{
+	'G', 'e', 'n', 'u', 'i', 'n', 'e', ' ', 'A', 'd', 'o', 'b', 'e', ' ',
+	'F', 'l', 'a', 's', 'h', ' ', 'P', 'l', 'a', 'y', 'e', 'r', ' ',
+	'0', '0', '1', // 30
+	0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8, 0x2e, 0x00, 0xd0, 0xd1,
+	0x02, 0x9e, 0x7e, 0x57, 0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab,
+	0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae, // 62
+}
+
+// RFC2409 Oakley Group 2
+var dhPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+var dhGenerator = big.NewInt(2)
+
+func sum4(b []byte) int {
+	return int(b[0]) + int(b[1]) + int(b[2]) + int(b[3])
+}
+
+// digestとDH公開鍵の位置。schemeは0か1
+func digestOffset(sig []byte, scheme int) int {
+	if scheme == 0 {
+		return sum4(sig[772:])%728 + 776
+	}
+	return sum4(sig[8:])%728 + 12
+}
+func dhOffset(sig []byte, scheme int) int {
+	if scheme == 0 {
+		return sum4(sig[768:])%632 + 8
+	}
+	return sum4(sig[1532:])%632 + 772
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// digestの部分を除いたsigのHMAC
+func sigDigest(sig []byte, pos int, key []byte) []byte {
+	return hmacSha256(key, sig[:pos], sig[pos+digestSize:])
+}
+
+func verifyDigest(sig []byte, scheme int, key []byte) bool {
+	pos := digestOffset(sig, scheme)
+	return hmac.Equal(sig[pos:pos+digestSize], sigDigest(sig, pos, key))
+}
+
+// C2, S2の末尾の署名。peerDigestは相手のC1, S1のdigest
+func responseSignature(sig, peerDigest, key []byte) []byte {
+	return hmacSha256(hmacSha256(key, peerDigest), sig[:sigSize-digestSize])
+}
+
+type dhKey struct {
+	priv *big.Int
+	pub  []byte
+}
+
+func newDHKey() (key dhKey, err error) {
+	b := make([]byte, dhKeySize)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	key.priv = new(big.Int).SetBytes(b)
+	key.pub = padKey(new(big.Int).Exp(dhGenerator, key.priv, dhPrime))
+	return
+}
+
+func padKey(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) >= dhKeySize {
+		return b[len(b)-dhKeySize:]
+	}
+	return append(make([]byte, dhKeySize-len(b)), b...)
+}
+
+func (key dhKey) secret(peer []byte) (secret []byte, err error) {
+	y := new(big.Int).SetBytes(peer)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(dhPrime) >= 0 {
+		err = fmt.Errorf("RTMPE: invalid public key")
+		return
+	}
+	secret = padKey(new(big.Int).Exp(y, key.priv, dhPrime))
+	return
+}
+
+// in: 相手から受信する方, out: 送信する方
+func rc4Keys(secret, pubIn, pubOut []byte) (in, out *rc4.Cipher, err error) {
+	if out, err = rc4.NewCipher(hmacSha256(secret, pubIn)[:16]); err != nil {
+		return
+	}
+	if in, err = rc4.NewCipher(hmacSha256(secret, pubOut)[:16]); err != nil {
+		return
+	}
+	// ハンドシェイクの分だけ鍵ストリームを進める
+	skip := make([]byte, sigSize)
+	in.XORKeyStream(skip, skip)
+	out.XORKeyStream(skip, skip)
+	return
+}
+
+// RTMPEの暗号化された接続
+type rc4Conn struct {
+	net.Conn
+	in  *rc4.Cipher
+	out *rc4.Cipher
+}
+
+func (c *rc4Conn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.in.XORKeyStream(b[:n], b[:n])
+	return
+}
+func (c *rc4Conn) Write(b []byte) (n int, err error) {
+	buf := make([]byte, len(b))
+	c.out.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+func randomSig() (sig []byte, err error) {
+	sig = make([]byte, sigSize)
+	_, err = rand.Read(sig)
+	return
+}
+
+func readSig(conn net.Conn) (sig []byte, err error) {
+	sig = make([]byte, sigSize)
+	_, err = io.ReadFull(conn, sig)
+	return
+}
+
+// digestを使うハンドシェイク。encryptedならRTMPE
+// 戻り値のconnを以後の通信に使う
+func complexHandshake(conn net.Conn, encrypted bool) (res net.Conn, err error) {
+	c1, err := randomSig()
+	if err != nil {
+		return
+	}
+	binary.BigEndian.PutUint32(c1, 0)
+	c0 := byte(3)
+	if encrypted {
+		c0 = 6
+		copy(c1[4:], []byte{128, 0, 3, 2})
+	} else {
+		copy(c1[4:], []byte{10, 0, 45, 2})
+	}
+
+	var key dhKey
+	if encrypted {
+		if key, err = newDHKey(); err != nil {
+			return
+		}
+		pos := dhOffset(c1, 0)
+		copy(c1[pos:], key.pub)
+	}
+	c1pos := digestOffset(c1, 0)
+	copy(c1[c1pos:], sigDigest(c1, c1pos, genuineFPKey[:30]))
+	c1digest := c1[c1pos : c1pos+digestSize]
+
+	// Send C0+C1
+	if _, err = conn.Write(append([]byte{c0}, c1...)); err != nil {
+		return
+	}
+
+	// Recv S0
+	s0 := make([]byte, 1)
+	if _, err = io.ReadFull(conn, s0); err != nil {
+		return
+	}
+	if s0[0] != c0 {
+		if encrypted {
+			err = fmt.Errorf("RTMPE: server does not support encryption: type=%d", s0[0])
+			return
+		}
+		fmt.Printf("[WARN] RTMP handshake type mismatch: %d\n", s0[0])
+	}
+
+	// Recv S1
+	s1, err := readSig(conn)
+	if err != nil {
+		return
+	}
+
+	// digestに対応していないサーバー
+	if bytes.Equal(s1[4:8], []byte{0, 0, 0, 0}) {
+		if encrypted {
+			err = fmt.Errorf("RTMPE: server does not support FP9 handshake")
+			return
+		}
+		// Send C2(=S1)
+		if _, err = conn.Write(s1); err != nil {
+			return
+		}
+		// Recv S2
+		if _, err = io.CopyN(ioutil.Discard, conn, sigSize); err != nil {
+			return
+		}
+		res = conn
+		return
+	}
+
+	scheme := 0
+	if !verifyDigest(s1, scheme, genuineFMSKey[:36]) {
+		scheme = 1
+		if !verifyDigest(s1, scheme, genuineFMSKey[:36]) {
+			err = fmt.Errorf("RTMP handshake: could not verify the server digest")
+			return
+		}
+	}
+	s1pos := digestOffset(s1, scheme)
+	s1digest := s1[s1pos : s1pos+digestSize]
+
+	var in, out *rc4.Cipher
+	if encrypted {
+		pos := dhOffset(s1, scheme)
+		serverPub := s1[pos : pos+dhKeySize]
+		secret, e := key.secret(serverPub)
+		if e != nil {
+			err = e
+			return
+		}
+		if in, out, err = rc4Keys(secret, serverPub, key.pub); err != nil {
+			return
+		}
+	}
+
+	// Send C2
+	c2, err := randomSig()
+	if err != nil {
+		return
+	}
+	copy(c2[sigSize-digestSize:], responseSignature(c2, s1digest, genuineFPKey))
+	if _, err = conn.Write(c2); err != nil {
+		return
+	}
+
+	// Recv S2
+	s2, err := readSig(conn)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(s2[sigSize-digestSize:], responseSignature(s2, c1digest, genuineFMSKey)) {
+		err = fmt.Errorf("RTMP handshake: server signature mismatch")
+		return
+	}
+
+	if encrypted {
+		res = &rc4Conn{Conn: conn, in: in, out: out}
+	} else {
+		res = conn
+	}
+	return
+}
+
+// サーバー側のハンドシェイク(テスト用のサーバーで使う)
+// kindはsimple, digest, encryptedのいずれか
+func ServerHandshake(conn net.Conn) (res net.Conn, kind string, err error) {
+	c0 := make([]byte, 1)
+	if _, err = io.ReadFull(conn, c0); err != nil {
+		return
+	}
+	encrypted := c0[0] == 6
+	if c0[0] != 3 && !encrypted {
+		err = fmt.Errorf("RTMP handshake: unsupported type: %d", c0[0])
+		return
+	}
+	c1, err := readSig(conn)
+	if err != nil {
+		return
+	}
+
+	s1, err := randomSig()
+	if err != nil {
+		return
+	}
+	binary.BigEndian.PutUint32(s1, uint32(time.Now().Unix()))
+
+	scheme := 0
+	if !verifyDigest(c1, scheme, genuineFPKey[:30]) {
+		scheme = 1
+		if !verifyDigest(c1, scheme, genuineFPKey[:30]) {
+			scheme = -1
+		}
+	}
+
+	// 単純なハンドシェイク
+	if scheme < 0 {
+		if encrypted {
+			err = fmt.Errorf("RTMP handshake: could not verify the client digest")
+			return
+		}
+		copy(s1[4:], []byte{0, 0, 0, 0})
+		wbuff := bytes.NewBuffer(nil)
+		wbuff.WriteByte(3)
+		wbuff.Write(s1)
+		wbuff.Write(c1)
+		if _, err = wbuff.WriteTo(conn); err != nil {
+			return
+		}
+		if _, err = io.CopyN(ioutil.Discard, conn, sigSize); err != nil {
+			return
+		}
+		res, kind = conn, "simple"
+		return
+	}
+
+	c1pos := digestOffset(c1, scheme)
+	c1digest := c1[c1pos : c1pos+digestSize]
+
+	copy(s1[4:], []byte{3, 5, 1, 1})
+	var in, out *rc4.Cipher
+	if encrypted {
+		key, e := newDHKey()
+		if e != nil {
+			err = e
+			return
+		}
+		pos := dhOffset(s1, scheme)
+		copy(s1[pos:], key.pub)
+
+		pos = dhOffset(c1, scheme)
+		clientPub := c1[pos : pos+dhKeySize]
+		secret, e := key.secret(clientPub)
+		if e != nil {
+			err = e
+			return
+		}
+		if in, out, err = rc4Keys(secret, clientPub, key.pub); err != nil {
+			return
+		}
+	}
+	s1pos := digestOffset(s1, scheme)
+	copy(s1[s1pos:], sigDigest(s1, s1pos, genuineFMSKey[:36]))
+	s1digest := s1[s1pos : s1pos+digestSize]
+
+	s2, err := randomSig()
+	if err != nil {
+		return
+	}
+	copy(s2[sigSize-digestSize:], responseSignature(s2, c1digest, genuineFMSKey))
+
+	wbuff := bytes.NewBuffer(nil)
+	wbuff.WriteByte(c0[0])
+	wbuff.Write(s1)
+	wbuff.Write(s2)
+	if _, err = wbuff.WriteTo(conn); err != nil {
+		return
+	}
+
+	c2, err := readSig(conn)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(c2[sigSize-digestSize:], responseSignature(c2, s1digest, genuineFPKey)) {
+		err = fmt.Errorf("RTMP handshake: client signature mismatch")
+		return
+	}
+
+	if encrypted {
+		res, kind = &rc4Conn{Conn: conn, in: in, out: out}, "encrypted"
+	} else {
+		res, kind = conn, "digest"
+	}
+	return
+}
@@ -0,0 +1,317 @@
+package rtmps
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/himananiito/livedl/amf"
+	"github.com/himananiito/livedl/files"
+	"github.com/himananiito/livedl/flvs"
+	"github.com/himananiito/livedl/objs"
+	"github.com/himananiito/livedl/outname"
+)
+
+// -rtmpで任意のRTMPのストリームを録画する
+
+type RecordOpt struct {
+	Url       string        // rtmp://host/app/stream (TcUrlがあればストリーム名だけでもよい)
+	TcUrl     string        // 空ならUrlの最初のパスまで
+	SwfUrl    string        //
+	PageUrl   string        //
+	ConnArgs  []interface{} // connectに追加する引数(ParseConnArgs)
+	Start     time.Duration // 録画済みのストリームをこの位置から録画する
+	Format    string        // 保存時のファイル名
+	Interrupt <-chan struct{}
+	Stdout    io.Writer // nilなら標準出力
+}
+
+// 再接続の回数
+const recordRetry = 10
+
+// tcUrlとストリーム名に分ける
+func splitUrl(rawurl, tcUrl string) (tc, stream string, err error) {
+	if tcUrl != "" {
+		tc = tcUrl
+		prefix := strings.TrimSuffix(tcUrl, "/") + "/"
+		if strings.HasPrefix(rawurl, prefix) {
+			stream = rawurl[len(prefix):]
+		} else if !strings.Contains(rawurl, "://") {
+			stream = rawurl
+		}
+	} else if ma := regexp.MustCompile(`\A(\w+://[^/\s]+/[^/\s?]+)/(\S+)\z`).FindStringSubmatch(rawurl); len(ma) > 0 {
+		tc = ma[1]
+		stream = ma[2]
+	}
+	if stream == "" {
+		err = fmt.Errorf("RTMP: stream name not found: %s", rawurl)
+		return
+	}
+
+	// .flvは付けない。.mp4, .f4vにはmp4:を付ける
+	if !regexp.MustCompile(`\A\w+:`).MatchString(stream) {
+		if regexp.MustCompile(`(?i)\.(?:f4v|mp4)(?:\?|\z)`).MatchString(stream) {
+			stream = "mp4:" + stream
+		} else {
+			stream = regexp.MustCompile(`(?i)\.flv(\?|\z)`).ReplaceAllString(stream, "$1")
+		}
+	}
+	return
+}
+
+// rtmpdumpの-C(--conn)と同じ書式。B:1(真偽値) N:1.5(数値) S:str(文字列) Z:(null)
+// O:1, O:0はオブジェクトの開始と終了。オブジェクトの中ではNS:name:strのように名前を付ける
+func ParseConnArgs(list []string) (args []interface{}, err error) {
+	type object struct {
+		m    map[string]interface{}
+		name string
+	}
+	var stack []object
+
+	for _, s := range list {
+		var name string
+		named := strings.HasPrefix(s, "N") && len(stack) > 0
+		if named {
+			s = s[1:]
+		}
+		if len(s) < 2 || s[1] != ':' {
+			err = fmt.Errorf("-rtmp-conn: invalid: %s", s)
+			return
+		}
+		typ, val := s[0], s[2:]
+		if named {
+			i := strings.Index(val, ":")
+			if i < 0 {
+				err = fmt.Errorf("-rtmp-conn: name required: %s", s)
+				return
+			}
+			name, val = val[:i], val[i+1:]
+		}
+
+		var v interface{}
+		switch typ {
+		case 'B':
+			v = val != "0" && !strings.EqualFold(val, "false")
+		case 'N':
+			f, e := strconv.ParseFloat(val, 64)
+			if e != nil {
+				err = fmt.Errorf("-rtmp-conn: not a number: %s", s)
+				return
+			}
+			v = f
+		case 'S':
+			v = val
+		case 'Z':
+			v = nil
+		case 'O':
+			if val == "1" {
+				stack = append(stack, object{m: map[string]interface{}{}, name: name})
+				continue
+			}
+			if len(stack) == 0 {
+				err = fmt.Errorf("-rtmp-conn: unexpected end of object")
+				return
+			}
+			obj := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			v, name = obj.m, obj.name
+		default:
+			err = fmt.Errorf("-rtmp-conn: unknown type: %s", s)
+			return
+		}
+
+		if len(stack) > 0 {
+			stack[len(stack)-1].m[name] = v
+		} else {
+			args = append(args, v)
+		}
+	}
+	if len(stack) > 0 {
+		err = fmt.Errorf("-rtmp-conn: object not closed")
+	}
+	return
+}
+
+// 録画済みのflvの続きの位置。recordedは録画済みのストリーム(onMetaDataにdurationがある)だった場合
+func resumePoint(fileName string) (ts int, recorded, ok bool) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	rdr, err := flvs.NewReader(f)
+	if err == nil {
+		if tag, e := rdr.Next(); e == nil && tag.Type == flvs.TagScript {
+			if data, _ := amf.DecodeAmf0(tag.Data); len(data) > 1 {
+				if d, _ := objs.FindFloat64(data[1], "duration"); d > 0 {
+					recorded = true
+				}
+			}
+		}
+	}
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	flv, err := flvs.Open(fileName)
+	if err != nil {
+		return
+	}
+	ts = flv.GetLastTimestamp()
+	flv.Close()
+	ok = ts > 0
+	return
+}
+
+// 録画する。doneは最後まで録画できた(配信が終わった)場合
+// 同じ名前のflvがあれば、その最後のタイムスタンプから続けて録画する
+func Record(opt RecordOpt) (fileName string, done bool, err error) {
+	tc, stream, err := splitUrl(opt.Url, opt.TcUrl)
+	if err != nil {
+		return
+	}
+
+	rtmp, err := NewRtmp(tc, opt.SwfUrl, opt.PageUrl, opt.ConnArgs...)
+	if err != nil {
+		return
+	}
+	defer rtmp.Close()
+	rtmp.SetFixAggrTimestamp(true)
+	stdout := opt.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	rtmp.SetOutput(stdout)
+
+	format := opt.Format
+	if format == "" {
+		format = "?PID?"
+	}
+	pid := strings.SplitN(stream, "?", 2)[0]
+	pid = strings.TrimSuffix(path.Base(pid[strings.Index(pid, ":")+1:]), path.Ext(pid))
+	host := tc
+	if u, e := url.Parse(tc); e == nil {
+		host = u.Hostname()
+	}
+	vars := outname.Vars{
+		"SERVICE": "rtmp",
+		"PID":     pid,
+		"UNAME":   host,
+	}
+	vars.SetTime(time.Now())
+	fileName = outname.Path(format, vars) + ".flv"
+	resumeTs, recorded, resume := resumePoint(fileName)
+	if !resume {
+		if fileName, err = files.GetFileNameNext(fileName); err != nil {
+			return
+		}
+	}
+	if err = files.MkdirByFileName(fileName); err != nil {
+		return
+	}
+	rtmp.SetFlvName(fileName)
+	fmt.Fprintf(stdout, "RTMP: %s %s -> %s\n", tc, stream, fileName)
+	if resume {
+		rtmp.SetTimestamp(resumeTs)
+		fmt.Fprintf(stdout, "RTMP: resume: last timestamp: %d\n", resumeTs)
+	}
+
+	// 中断されたら接続を閉じる
+	fin := make(chan struct{})
+	defer close(fin)
+	go func() {
+		select {
+		case <-opt.Interrupt:
+			rtmp.Abort()
+		case <-fin:
+		}
+	}()
+
+	start := int(opt.Start / time.Millisecond)
+	tryRecord := func() (incomplete bool, err error) {
+		if err = rtmp.Connect(); err != nil {
+			return
+		}
+		if err = rtmp.CreateStream(); err != nil {
+			return
+		}
+		if err = rtmp.SetBufferLength(1, 3600*1000); err != nil {
+			return
+		}
+
+		// 続きから録画する。ファイルのタイムスタンプは0から
+		ts := rtmp.GetTimestamp()
+		switch {
+		case ts > 0 && (rtmp.IsRecorded() || recorded):
+			// 重複した部分はflvに書かれない
+			pos := ts - 1000
+			if pos < 0 {
+				pos = 0
+			}
+			err = rtmp.PlayTime(stream, start+pos)
+			rtmp.RebaseTimestamp(pos)
+		case ts > 0:
+			err = rtmp.PlayTime(stream, -2)
+			rtmp.RebaseTimestamp(ts + 1)
+		case start > 0:
+			err = rtmp.PlayTime(stream, start)
+			rtmp.RebaseTimestamp(0)
+		default:
+			err = rtmp.PlayTime(stream, -2)
+			rtmp.RebaseTimestamp(0)
+		}
+		if err != nil {
+			return
+		}
+
+		_, incomplete, err = rtmp.Wait()
+		return
+	}
+
+	for i := 0; i < recordRetry; i++ {
+		if i > 0 {
+			fmt.Fprintf(stdout, "RTMP: reconnecting(%d/%d): last timestamp: %d\n", i, recordRetry-1, rtmp.GetTimestamp())
+			select {
+			case <-time.After(3 * time.Second):
+			case <-opt.Interrupt:
+				err = nil
+				rtmp.Finish()
+				return
+			}
+		}
+
+		before := rtmp.GetTimestamp()
+		incomplete, e := tryRecord()
+		if rtmp.IsAborted() {
+			err = nil
+			rtmp.Finish()
+			return
+		}
+		if e != nil {
+			fmt.Fprintf(stdout, "RTMP: %v\n", e)
+			err = e
+			continue
+		}
+		err = nil
+		// 続きが無い
+		if !incomplete {
+			done = true
+			break
+		}
+		if rtmp.GetTimestamp() > before {
+			// 進んでいるなら再接続の回数を戻す
+			i = 0
+		} else {
+			err = fmt.Errorf("RTMP: no data after reconnecting: last timestamp: %d", before)
+		}
+	}
+	rtmp.Finish()
+	fmt.Fprintf(stdout, "done\n")
+	return
+}
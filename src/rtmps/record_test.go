@@ -0,0 +1,131 @@
+package rtmps
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/himananiito/livedl/amf"
+	"github.com/himananiito/livedl/flvs"
+)
+
+func TestSplitUrl(t *testing.T) {
+	for _, tc := range []struct {
+		url, tcUrl string
+		tc, stream string
+		err        bool
+	}{
+		{"rtmp://host/app/live", "", "rtmp://host/app", "live", false},
+		{"rtmp://host:1935/app/dir/live?token=x", "", "rtmp://host:1935/app", "dir/live?token=x", false},
+		{"rtmp://host/app/video.flv", "", "rtmp://host/app", "video", false},
+		{"rtmp://host/app/video.FLV?t=1", "", "rtmp://host/app", "video?t=1", false},
+		{"rtmp://host/app/video.mp4", "", "rtmp://host/app", "mp4:video.mp4", false},
+		{"rtmp://host/app/video.f4v?t=1", "", "rtmp://host/app", "mp4:video.f4v?t=1", false},
+		{"rtmp://host/app/mp4:video.mp4", "", "rtmp://host/app", "mp4:video.mp4", false},
+		{"rtmp://host/app/inst/live", "rtmp://host/app/inst", "rtmp://host/app/inst", "live", false},
+		{"rtmp://host/app/inst/live", "rtmp://host/app/inst/", "rtmp://host/app/inst/", "live", false},
+		{"live", "rtmp://host/app", "rtmp://host/app", "live", false},
+		{"rtmp://other/app/live", "rtmp://host/app", "", "", true},
+		{"rtmp://host/app", "", "", "", true},
+		{"host/app/live", "", "", "", true},
+	} {
+		tc_, stream, err := splitUrl(tc.url, tc.tcUrl)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s %s: no error", tc.url, tc.tcUrl)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", tc.url, tc.tcUrl, err)
+			continue
+		}
+		if tc_ != tc.tc || stream != tc.stream {
+			t.Errorf("%s %s: %q %q, want %q %q", tc.url, tc.tcUrl, tc_, stream, tc.tc, tc.stream)
+		}
+	}
+}
+
+func TestParseConnArgs(t *testing.T) {
+	for _, tc := range []struct {
+		list []string
+		args []interface{}
+		err  bool
+	}{
+		{nil, nil, false},
+		{[]string{"B:1", "B:0", "B:false", "N:1.5", "S:a:b", "S:", "Z:"},
+			[]interface{}{true, false, false, 1.5, "a:b", "", nil}, false},
+		{[]string{"S:x", "O:1", "NS:name:a:b", "NN:n:2", "NO:sub:1", "NB:ok:1", "NO:sub:0", "O:0", "N:3"},
+			[]interface{}{"x", map[string]interface{}{
+				"name": "a:b",
+				"n":    2.0,
+				"sub":  map[string]interface{}{"ok": true},
+			}, 3.0}, false},
+		// オブジェクトの外のNは数値
+		{[]string{"N:1"}, []interface{}{1.0}, false},
+		{[]string{"N:x"}, nil, true},
+		{[]string{"X:1"}, nil, true},
+		{[]string{"S"}, nil, true},
+		{[]string{"O:1", "NS:a"}, nil, true},
+		{[]string{"O:1", "NS:a:b"}, nil, true},
+		{[]string{"O:0"}, nil, true},
+	} {
+		args, err := ParseConnArgs(tc.list)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: no error", tc.list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("%v: %#v, want %#v", tc.list, args, tc.args)
+		}
+	}
+}
+
+// 録画済みのflvの最後のタイムスタンプから続ける
+func TestResumePoint(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, duration float64, frames int) string {
+		name = filepath.Join(dir, name)
+		flv, err := flvs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer flv.Close()
+		meta, err := amf.EncodeAmf0([]interface{}{"onMetaData", map[string]interface{}{"duration": duration}}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = flv.WriteMetaData(bytes.NewBuffer(meta), 0); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < frames; i++ {
+			if err = flv.WriteVideo(bytes.NewBuffer([]byte{0x27, 1, 0, 0, 0, byte(i)}), i*40); err != nil {
+				t.Fatal(err)
+			}
+			if err = flv.WriteAudio(bytes.NewBuffer([]byte{0xaf, 1, byte(i)}), i*40+10); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return name
+	}
+
+	if ts, recorded, ok := resumePoint(write("recorded.flv", 10, 5)); !ok || ts != 160 || !recorded {
+		t.Errorf("recorded: %d %v %v", ts, recorded, ok)
+	}
+	if ts, recorded, ok := resumePoint(write("live.flv", 0, 5)); !ok || ts != 160 || recorded {
+		t.Errorf("live: %d %v %v", ts, recorded, ok)
+	}
+	if _, _, ok := resumePoint(write("empty.flv", 0, 0)); ok {
+		t.Errorf("empty: ok")
+	}
+	if _, _, ok := resumePoint(filepath.Join(dir, "none.flv")); ok {
+		t.Errorf("none: ok")
+	}
+}
@@ -0,0 +1,144 @@
+package rtmps_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/himananiito/livedl/flvs"
+	"github.com/himananiito/livedl/httpbase"
+	"github.com/himananiito/livedl/rtmps"
+	"github.com/himananiito/livedl/rtmps/rtmptest"
+)
+
+// 接続して最後まで録画したFLVの名前
+func record(t *testing.T, tc string, complexHandshake bool) string {
+	t.Helper()
+	rtmp, err := rtmps.NewRtmp(tc, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtmp.Close()
+	rtmp.SetComplexHandshake(complexHandshake)
+	name := filepath.Join(t.TempDir(), "test.flv")
+	rtmp.SetFlvName(name)
+
+	if err = rtmp.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rtmp.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rtmp.PlayTime("live", -2); err != nil {
+		t.Fatal(err)
+	}
+	done, incomplete, err := rtmp.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done || incomplete {
+		t.Errorf("done %v, incomplete %v", done, incomplete)
+	}
+	if err = rtmp.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// 送られたフレームが全てFLVに書かれていること
+func checkFlv(t *testing.T, name string, frames, interval int) {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := flvs.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := map[byte]int{}
+	for {
+		tag, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.Type == flvs.TagVideo {
+			if want := count[flvs.TagVideo] * interval; tag.Timestamp != want {
+				t.Errorf("video %d: timestamp %d, want %d", count[flvs.TagVideo], tag.Timestamp, want)
+			}
+			if key := count[flvs.TagVideo] == 0; tag.IsKeyFrame() != key {
+				t.Errorf("video %d: keyframe %v", count[flvs.TagVideo], !key)
+			}
+		}
+		count[tag.Type]++
+	}
+	if count[flvs.TagVideo] != frames || count[flvs.TagAudio] != frames || count[flvs.TagScript] == 0 {
+		t.Errorf("tags %v, want %d frames", count, frames)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		tls       bool
+		scheme    string
+		complex   bool
+		handshake string
+	}{
+		{"simple", false, "rtmp", false, "simple"},
+		{"digest", false, "rtmp", true, "digest"},
+		{"rtmpe", false, "rtmpe", false, "encrypted"},
+		{"rtmps", true, "rtmps", false, "simple"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var s *rtmptest.Server
+			if tc.tls {
+				s = rtmptest.NewTLSServer()
+				ca := filepath.Join(t.TempDir(), "ca.pem")
+				if err := ioutil.WriteFile(ca, s.CertPEM(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := httpbase.SetRootCA(ca); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				s = rtmptest.NewServer()
+			}
+			defer s.Close()
+			s.Frames = 10
+			s.Interval = 20
+
+			tcUrl := tc.scheme + strings.TrimPrefix(s.URL, strings.SplitN(s.URL, ":", 2)[0])
+			name := record(t, tcUrl, tc.complex)
+			checkFlv(t, name, s.Frames, s.Interval)
+
+			if got := s.Handshakes(); len(got) != 1 || got[0] != tc.handshake {
+				t.Errorf("handshakes %v, want %s", got, tc.handshake)
+			}
+			if got := s.Streams(); len(got) != 1 || got[0] != "live" {
+				t.Errorf("streams %v", got)
+			}
+		})
+	}
+}
+
+// 自己署名の証明書を信頼していなければ接続できない
+func TestRecordUntrusted(t *testing.T) {
+	s := rtmptest.NewTLSServer()
+	defer s.Close()
+	rtmp, err := rtmps.NewRtmp(s.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtmp.Close()
+	if err = rtmp.Connect(); err == nil {
+		t.Error("connected to an untrusted server")
+	}
+}
@@ -0,0 +1,423 @@
+// rtmpsパッケージを試すためのローカルのRTMPサーバー
+// connect, createStream, playに応答して短いストリームを送る
+package rtmptest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/himananiito/livedl/amf"
+	"github.com/himananiito/livedl/rtmps"
+)
+
+const chunkSize = 4096
+
+type Server struct {
+	URL      string // rtmp://127.0.0.1:port/app (TLSならrtmps://)
+	Listener net.Listener
+
+	// 送るフレームの数と間隔(ミリ秒)
+	Frames   int
+	Interval int
+
+	cert *x509.Certificate
+
+	mu         sync.Mutex
+	handshakes []string
+	streams    []string
+	wg         sync.WaitGroup
+}
+
+func newServer(l net.Listener, scheme string) *Server {
+	s := &Server{
+		URL:      fmt.Sprintf("%s://%s/app", scheme, l.Addr().String()),
+		Listener: l,
+		Frames:   50,
+		Interval: 40,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// rtmp://(rtmpe://でも接続できる)
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("rtmptest: failed to listen: %v", err))
+	}
+	return newServer(l, "rtmp")
+}
+
+// rtmps://。証明書は自己署名なのでCertPEMをルート証明書にする
+func NewTLSServer() *Server {
+	cert, x, err := selfSigned()
+	if err != nil {
+		panic(fmt.Sprintf("rtmptest: failed to create certificate: %v", err))
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		panic(fmt.Sprintf("rtmptest: failed to listen: %v", err))
+	}
+	s := newServer(l, "rtmps")
+	s.cert = x
+	return s
+}
+
+func selfSigned() (cert tls.Certificate, x *x509.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rtmptest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	if x, err = x509.ParseCertificate(der); err != nil {
+		return
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+// TLSサーバーの証明書(PEM)。httpbase.SetRootCAに渡すファイルに書く
+func (s *Server) CertPEM() []byte {
+	if s.cert == nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw})
+}
+
+// これまでの接続のハンドシェイクの種類(simple, digest, encrypted)
+func (s *Server) Handshakes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.handshakes...)
+}
+
+// playされたストリーム名
+func (s *Server) Streams() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.streams...)
+}
+
+func (s *Server) Close() {
+	s.Listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			if err := s.handle(conn); err != nil && err != io.EOF {
+				fmt.Printf("rtmptest: %v\n", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) (err error) {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	c, kind, err := rtmps.ServerHandshake(conn)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.handshakes = append(s.handshakes, kind)
+	s.mu.Unlock()
+
+	w := &writer{w: c}
+	r := &reader{r: c, chunkSize: 128, streams: map[int]*chunkStream{}}
+	for {
+		typeId, body, e := r.readMessage()
+		if e != nil {
+			return e
+		}
+		if typeId == rtmps.TID_SETCHUNKSIZE && len(body) >= 4 {
+			r.chunkSize = int(binary.BigEndian.Uint32(body) & 0x7fffffff)
+			continue
+		}
+		if typeId != rtmps.TID_AMF0COMMAND {
+			continue
+		}
+		cmd, e := amf.DecodeAmf0(body)
+		if e != nil {
+			return e
+		}
+		if len(cmd) < 2 {
+			continue
+		}
+		name, _ := cmd[0].(string)
+		trId, _ := cmd[1].(float64)
+
+		switch name {
+		case "connect":
+			if err = w.control(rtmps.TID_WINDOW_ACK_SIZE, be32(2500000)); err != nil {
+				return
+			}
+			if err = w.control(rtmps.TID_SETPEERBANDWIDTH, append(be32(2500000), 2)); err != nil {
+				return
+			}
+			if err = w.control(rtmps.TID_SETCHUNKSIZE, be32(chunkSize)); err != nil {
+				return
+			}
+			w.chunkSize = chunkSize
+			err = w.command(0, 0, "_result", trId,
+				map[string]interface{}{"fmsVer": "FMS/3,5,7,7009", "capabilities": 31},
+				map[string]interface{}{
+					"level":          "status",
+					"code":           "NetConnection.Connect.Success",
+					"description":    "Connection succeeded.",
+					"objectEncoding": 0,
+				},
+			)
+		case "createStream":
+			err = w.command(0, 0, "_result", trId, nil, 1)
+		case "play":
+			if len(cmd) >= 4 {
+				stream, _ := cmd[3].(string)
+				s.mu.Lock()
+				s.streams = append(s.streams, stream)
+				s.mu.Unlock()
+			}
+			err = s.play(w)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Play.Startから始めてフレームを送り、Play.Completeで終わる
+func (s *Server) play(w *writer) (err error) {
+	duration := s.Frames * s.Interval
+	if err = w.control(rtmps.TID_USERCONTROL, append([]byte{0, rtmps.UC_STREAMBEGIN}, be32(1)...)); err != nil {
+		return
+	}
+	if err = w.command(1, 0, "onStatus", 0, nil, map[string]interface{}{
+		"level": "status",
+		"code":  "NetStream.Play.Start",
+	}); err != nil {
+		return
+	}
+	meta, err := amf.EncodeAmf0([]interface{}{"onMetaData", map[string]interface{}{
+		"duration":        float64(duration) / 1000,
+		"videocodecid":    7,
+		"audiocodecid":    10,
+		"videoframerate":  1000 / s.Interval,
+		"audiosamplerate": 44100,
+	}}, true)
+	if err != nil {
+		return
+	}
+	if err = w.message(5, rtmps.TID_AMF0DATA, 1, 0, meta); err != nil {
+		return
+	}
+
+	for i := 0; i < s.Frames; i++ {
+		ts := i * s.Interval
+		// AVC NALU(先頭はキーフレーム)
+		video := []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 2, 0x41, byte(i)}
+		if i == 0 {
+			video[0] = 0x17
+		}
+		if err = w.message(6, rtmps.TID_VIDEO, 1, ts, video); err != nil {
+			return
+		}
+		// AAC raw
+		if err = w.message(4, rtmps.TID_AUDIO, 1, ts, []byte{0xaf, 1, 0x21, byte(i)}); err != nil {
+			return
+		}
+	}
+	last := (s.Frames - 1) * s.Interval
+	return w.message(5, rtmps.TID_AMF0DATA, 1, last, mustEncode("onPlayStatus", map[string]interface{}{
+		"level": "status",
+		"code":  "NetStream.Play.Complete",
+	}))
+}
+
+func mustEncode(data ...interface{}) []byte {
+	b, err := amf.EncodeAmf0(data, false)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func be32(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+type writer struct {
+	w         io.Writer
+	chunkSize int
+}
+
+func (w *writer) control(typeId int, body []byte) error {
+	return w.message(2, typeId, 0, 0, body)
+}
+
+func (w *writer) command(streamId, ts int, name string, args ...interface{}) error {
+	return w.message(3, rtmps.TID_AMF0COMMAND, streamId, ts, mustEncode(append([]interface{}{name}, args...)...))
+}
+
+// 1つのメッセージを書く。先頭はtype0、続きはtype3
+func (w *writer) message(csId, typeId, streamId, ts int, body []byte) (err error) {
+	csz := w.chunkSize
+	if csz <= 0 {
+		csz = 128
+	}
+	buff := bytes.NewBuffer(nil)
+	buff.WriteByte(byte(csId))
+	buff.Write(be32(ts)[1:])
+	buff.Write(be32(len(body))[1:])
+	buff.WriteByte(byte(typeId))
+	sid := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sid, uint32(streamId))
+	buff.Write(sid)
+	for first := true; first || len(body) > 0; first = false {
+		if !first {
+			buff.WriteByte(0xc0 | byte(csId))
+		}
+		n := len(body)
+		if n > csz {
+			n = csz
+		}
+		buff.Write(body[:n])
+		body = body[n:]
+	}
+	_, err = buff.WriteTo(w.w)
+	return
+}
+
+type chunkStream struct {
+	length   int
+	typeId   int
+	streamId int
+	body     []byte
+}
+
+type reader struct {
+	r         io.Reader
+	chunkSize int
+	streams   map[int]*chunkStream
+}
+
+func (r *reader) read(n int) (b []byte, err error) {
+	b = make([]byte, n)
+	_, err = io.ReadFull(r.r, b)
+	return
+}
+
+func be24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// クライアントからのメッセージを1つ読む
+func (r *reader) readMessage() (typeId int, body []byte, err error) {
+	for {
+		b, e := r.read(1)
+		if e != nil {
+			err = e
+			return
+		}
+		format := int(b[0] >> 6)
+		csId := int(b[0] & 0x3f)
+		switch csId {
+		case 0:
+			if b, err = r.read(1); err != nil {
+				return
+			}
+			csId = 64 + int(b[0])
+		case 1:
+			if b, err = r.read(2); err != nil {
+				return
+			}
+			csId = 64 + int(b[0]) + int(b[1])*256
+		}
+
+		cs, ok := r.streams[csId]
+		if !ok {
+			cs = &chunkStream{}
+			r.streams[csId] = cs
+		}
+		var tsField int
+		switch format {
+		case 0:
+			if b, err = r.read(11); err != nil {
+				return
+			}
+			tsField = be24(b)
+			cs.length = be24(b[3:])
+			cs.typeId = int(b[6])
+			cs.streamId = int(binary.LittleEndian.Uint32(b[7:]))
+		case 1:
+			if b, err = r.read(7); err != nil {
+				return
+			}
+			tsField = be24(b)
+			cs.length = be24(b[3:])
+			cs.typeId = int(b[6])
+		case 2:
+			if b, err = r.read(3); err != nil {
+				return
+			}
+			tsField = be24(b)
+		}
+		if tsField == 0xffffff {
+			if _, err = r.read(4); err != nil {
+				return
+			}
+		}
+
+		n := cs.length - len(cs.body)
+		if n > r.chunkSize {
+			n = r.chunkSize
+		}
+		if b, err = r.read(n); err != nil {
+			return
+		}
+		cs.body = append(cs.body, b...)
+		if len(cs.body) >= cs.length {
+			typeId, body = cs.typeId, cs.body
+			cs.body = nil
+			return
+		}
+	}
+}
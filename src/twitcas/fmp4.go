@@ -0,0 +1,147 @@
+package twitcas
+
+import (
+	"encoding/binary"
+)
+
+// fMP4のboxを順に処理する
+func eachBox(b []byte, fn func(typ string, payload []byte)) {
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		typ := string(b[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(b[8:])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return
+		}
+		fn(typ, b[hdr:size])
+		b = b[size:]
+	}
+}
+
+// 初期化セグメントから映像のtrack_idを探す
+func videoTrackId(init []byte) (id uint32, ok bool) {
+	eachBox(init, func(typ string, moov []byte) {
+		if typ != "moov" {
+			return
+		}
+		eachBox(moov, func(typ string, trak []byte) {
+			if typ != "trak" {
+				return
+			}
+			var tid uint32
+			var isVideo bool
+			eachBox(trak, func(typ string, p []byte) {
+				switch typ {
+				case "tkhd":
+					if len(p) >= 24 && p[0] == 1 {
+						tid = binary.BigEndian.Uint32(p[20:])
+					} else if len(p) >= 16 {
+						tid = binary.BigEndian.Uint32(p[12:])
+					}
+				case "mdia":
+					eachBox(p, func(typ string, p []byte) {
+						if typ == "hdlr" && len(p) >= 12 && string(p[8:12]) == "vide" {
+							isVideo = true
+						}
+					})
+				}
+			})
+			if isVideo && !ok {
+				id = tid
+				ok = true
+			}
+		})
+	})
+	return
+}
+
+// moofで始まり、映像の最初のサンプルがキーフレームか
+// moofでなければ(初期化セグメントなど)どこで分けてもよいのでtrue
+func isKeyFragment(data []byte, trackId uint32) (key bool) {
+	if len(data) < 8 || string(data[4:8]) != "moof" {
+		return true
+	}
+	eachBox(data, func(typ string, moof []byte) {
+		if typ != "moof" {
+			return
+		}
+		eachBox(moof, func(typ string, traf []byte) {
+			if typ != "traf" {
+				return
+			}
+			var tid uint32
+			var defaultFlags uint32
+			var flags uint32
+			var found bool
+			eachBox(traf, func(typ string, p []byte) {
+				if len(p) < 8 {
+					return
+				}
+				tf := binary.BigEndian.Uint32(p) & 0xffffff
+				switch typ {
+				case "tfhd":
+					tid = binary.BigEndian.Uint32(p[4:])
+					i := 8
+					for _, f := range []struct {
+						bit  uint32
+						size int
+					}{{0x01, 8}, {0x02, 4}, {0x08, 4}, {0x10, 4}} {
+						if tf&f.bit != 0 {
+							i += f.size
+						}
+					}
+					if tf&0x20 != 0 && i+4 <= len(p) {
+						defaultFlags = binary.BigEndian.Uint32(p[i:])
+					}
+				case "trun":
+					if found {
+						return
+					}
+					count := binary.BigEndian.Uint32(p[4:])
+					i := 8
+					if tf&0x01 != 0 {
+						i += 4
+					}
+					if tf&0x04 != 0 {
+						if i+4 <= len(p) {
+							flags = binary.BigEndian.Uint32(p[i:])
+							found = true
+						}
+						return
+					}
+					if tf&0x400 != 0 && count > 0 {
+						if tf&0x100 != 0 {
+							i += 4
+						}
+						if tf&0x200 != 0 {
+							i += 4
+						}
+						if i+4 <= len(p) {
+							flags = binary.BigEndian.Uint32(p[i:])
+							found = true
+						}
+					}
+				}
+			})
+			if tid != trackId {
+				return
+			}
+			if !found {
+				flags = defaultFlags
+			}
+			// sample_is_non_sync_sample
+			key = flags&0x10000 == 0
+		})
+	})
+	return
+}
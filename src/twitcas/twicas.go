@@ -1,294 +1,342 @@
-package twitcas
-
-import (
-	"database/sql"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"net/url"
-	"os"
-	"os/exec"
-	"time"
-
-	"github.com/gorilla/websocket"
-	"github.com/himananiito/livedl/files"
-	"github.com/himananiito/livedl/httpbase"
-	"github.com/himananiito/livedl/procs/ffmpeg"
-	_ "github.com/mattn/go-sqlite3"
-)
-
-type Twitcas struct {
-	Conn *websocket.Conn
-}
-
-func connectStream(proto, host, mode string, id uint64, proxy string) (conn *websocket.Conn, err error) {
-	streamUrl := fmt.Sprintf(
-		//case A.InnerFrame:return"i";
-		//case A.Pframe:return"p";
-		//case A.DisposableProfile:return"bd";
-		//case A.Bframe:return"b";
-		//case A.Any:return"any";
-		//case A.KeyFrame:default:return"k"}
-		//"%s://%s/ws.app/stream/%d/fmp4/k/0/1?mode=%s",
-		"%s://%s/ws.app/stream/%d/fmp4/bd/1/1500?mode=%s",
-		proto, host, id, mode,
-	)
-	// fmt.Println(streamUrl)
-
-	var origin string
-	if proto == "wss" {
-		origin = fmt.Sprintf("https://%s", host)
-	} else {
-		origin = fmt.Sprintf("http://%s", host)
-	}
-
-	header := http.Header{}
-	header.Set("Origin", origin)
-	//header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/63.0.3239.132 Safari/537.36")
-	header.Set("User-Agent", httpbase.GetUserAgent())
-
-	timeout, _ := time.ParseDuration("10s")
-	dialer := websocket.Dialer{
-		HandshakeTimeout: timeout,
-	}
-	if proxy != "" {
-		dialer.Proxy = func(req *http.Request) (u *url.URL, err error) {
-			var proxyUrl string
-			if proto == "wss" {
-				proxyUrl = fmt.Sprintf("https://%s", proxy)
-			} else {
-				proxyUrl = fmt.Sprintf("http://%s", proxy)
-			}
-			return url.ParseRequestURI(proxyUrl)
-		}
-	}
-
-	conn, _, err = dialer.Dial(streamUrl, header)
-
-	return
-}
-
-func getStream(user, proxy string) (conn *websocket.Conn, movieId uint64, err error) {
-	url := fmt.Sprintf(
-		"https://twitcasting.tv/streamserver.php?target=%s&mode=client",
-		user,
-	)
-
-	type StreamServer struct {
-		Movie struct {
-			Id   uint64 `json:"id"`
-			Live bool   `json:"live"`
-		} `json:"movie"`
-		Fmp4 struct {
-			Host         string `json:"host"`
-			Proto        string `json:"proto"`
-			Source       bool   `json:"source"`
-			MobileSource bool   `json:"mobilesource"`
-		} `json:"fmp4"`
-	}
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return
-	}
-
-	client := new(http.Client)
-	client.Timeout, _ = time.ParseDuration("10s")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return
-	}
-
-	defer resp.Body.Close()
-	respBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-	//fmt.Printf("debug %s\n", string(respBytes))
-
-	data := new(StreamServer)
-
-	err = json.Unmarshal(respBytes, data)
-	if err != nil {
-		return
-	}
-
-	if !data.Movie.Live {
-		// movie not active
-		err = errors.New(user + " --> " + "Offline or User Not Found")
-		return
-	} else {
-		var mode string
-		if data.Fmp4.Source {
-			// StreamQuality.High
-			mode = "main"
-		} else if data.Fmp4.MobileSource {
-			// StreamQuality.Middle
-			mode = "mobilesource"
-		} else {
-			// StreamQuality.Low
-			mode = "base"
-		}
-
-		if data.Fmp4.Proto != "" && data.Fmp4.Host != "" && data.Movie.Id != 0 {
-			conn, err = connectStream(data.Fmp4.Proto, data.Fmp4.Host, mode, data.Movie.Id, proxy)
-			if err != nil {
-				return
-			}
-			movieId = data.Movie.Id
-		} else {
-			err = errors.New(user + " --> " + "No Stream Defined")
-			return
-		}
-	}
-
-	return
-}
-
-func createFileUser(user string, movieId uint64) (f *os.File, filename string, err error) {
-	user = files.ReplaceForbidden(user)
-	filename = fmt.Sprintf("%s_%d.mp4", user, movieId)
-	for i := 2; i < 1000; i++ {
-		_, err := os.Stat(filename)
-		if err != nil {
-			break
-		}
-		filename = fmt.Sprintf("%s_%d_%d.mp4", user, movieId, i)
-	}
-	f, err = os.Create(filename)
-	return
-}
-
-// FIXME: return codeの整理
-func TwitcasRecord(user, proxy string) (done, dbLocked bool) {
-	conn, movieId, err := getStream(user, proxy)
-	if err != nil {
-		fmt.Printf("@err getStream: %v\n", err)
-		return
-	}
-	if conn == nil {
-		fmt.Println("[FIXME] conn is nil")
-		return
-	}
-	defer conn.Close()
-
-	dbName := fmt.Sprintf("tmp/tcas-%v-lock.db", movieId)
-	files.MkdirByFileName(dbName)
-	db, err := sql.Open("sqlite3", dbName)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	defer db.Close()
-
-	_, err = db.Exec(`BEGIN EXCLUSIVE`)
-	if err != nil {
-		dbLocked = true
-		return
-	}
-	defer os.Remove(dbName)
-
-	//func Open(opt... string) (cmd *exec.Cmd, stdin io.WriteCloser, err error) {
-	var cmd *exec.Cmd
-	var stdin io.WriteCloser
-
-	var fileOpened bool
-
-	filenameBase := fmt.Sprintf("%s_%d.ts", user, movieId)
-	filenameBase = files.ReplaceForbidden(filenameBase) // fixed #8
-
-	closeFF := func() {
-		if stdin != nil {
-			stdin.Close()
-		}
-		if cmd != nil {
-			cmd.Wait()
-		}
-		stdin = nil
-		cmd = nil
-	}
-
-	openFF := func() (err error) {
-		closeFF()
-
-		filename, err := files.GetFileNameNext(filenameBase)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
-		c, in, err := ffmpeg.Open("-i", "-", "-c", "copy", "-y", filename)
-		if err != nil {
-			return
-		}
-		cmd = c
-		stdin = in
-
-		fileOpened = true
-		return
-	}
-
-	for {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		messageType, data, err := conn.ReadMessage()
-		if err != nil {
-			fmt.Printf("@err ReadMessage: %v\n\n", err)
-			return
-		}
-
-		if messageType == 2 {
-			if cmd == nil || stdin == nil {
-				if err = openFF(); err != nil {
-					fmt.Println(err)
-					return
-				}
-				defer closeFF()
-			}
-
-			if _, err := stdin.Write(data); err != nil {
-				fmt.Println(err)
-				return
-			}
-
-		} else if messageType == 1 {
-
-			type TextMessage struct {
-				Code int `json:"code"`
-			}
-			msg := new(TextMessage)
-			err = json.Unmarshal(data, msg)
-			if err != nil {
-				// json decode error
-				fmt.Printf("@err %v\n", err)
-				return
-			}
-			if (msg.Code == 100) || (msg.Code == 101) || (msg.Code == 110) {
-				// ignore
-			} else if msg.Code == 400 { // invalid_parameter
-				return
-			} else if msg.Code == 401 { // passcode_required
-				return
-			} else if msg.Code == 403 { //access_forbidden
-				return
-			} else if msg.Code == 500 { // offline
-				return
-			} else if msg.Code == 503 { // server_error
-				return
-			} else if msg.Code == 504 { // live_ended
-				break
-			} else {
-				fmt.Printf("@FIXME %v\n\n", string(data))
-				return
-			}
-		}
-	}
-
-	closeFF()
-
-	done = fileOpened
-	return
-}
+package twitcas
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/himananiito/livedl/diskguard"
+	"github.com/himananiito/livedl/files"
+	"github.com/himananiito/livedl/httpbase"
+	"github.com/himananiito/livedl/outname"
+	"github.com/himananiito/livedl/procs/ffmpeg"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Twitcas struct {
+	Conn *websocket.Conn
+}
+
+func connectStream(proto, host, mode string, id uint64) (conn *websocket.Conn, err error) {
+	streamUrl := fmt.Sprintf(
+		//case A.InnerFrame:return"i";
+		//case A.Pframe:return"p";
+		//case A.DisposableProfile:return"bd";
+		//case A.Bframe:return"b";
+		//case A.Any:return"any";
+		//case A.KeyFrame:default:return"k"}
+		//"%s://%s/ws.app/stream/%d/fmp4/k/0/1?mode=%s",
+		"%s://%s/ws.app/stream/%d/fmp4/bd/1/1500?mode=%s",
+		proto, host, id, mode,
+	)
+	// fmt.Println(streamUrl)
+
+	var origin string
+	if proto == "wss" {
+		origin = fmt.Sprintf("https://%s", host)
+	} else {
+		origin = fmt.Sprintf("http://%s", host)
+	}
+
+	header := http.Header{}
+	header.Set("Origin", origin)
+	//header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/63.0.3239.132 Safari/537.36")
+	header.Set("User-Agent", httpbase.GetUserAgent())
+
+	// proxyは-http-proxy(-http-proxy-tcas)に従う
+	conn, _, err = httpbase.DialWebsocket(streamUrl, header)
+
+	return
+}
+
+func getStream(user string) (conn *websocket.Conn, movieId uint64, err error) {
+	url := fmt.Sprintf(
+		"https://twitcasting.tv/streamserver.php?target=%s&mode=client",
+		user,
+	)
+
+	type StreamServer struct {
+		Movie struct {
+			Id   uint64 `json:"id"`
+			Live bool   `json:"live"`
+		} `json:"movie"`
+		Fmp4 struct {
+			Host         string `json:"host"`
+			Proto        string `json:"proto"`
+			Source       bool   `json:"source"`
+			MobileSource bool   `json:"mobilesource"`
+		} `json:"fmp4"`
+	}
+
+	code, respBytes, err, neterr := httpbase.GetBytes(url, nil)
+	if err == nil {
+		err = neterr
+	}
+	if err != nil {
+		return
+	}
+	if code != 200 {
+		err = fmt.Errorf("streamserver.php: StatusCode is %v", code)
+		return
+	}
+	//fmt.Printf("debug %s\n", string(respBytes))
+
+	data := new(StreamServer)
+
+	err = json.Unmarshal(respBytes, data)
+	if err != nil {
+		return
+	}
+
+	if !data.Movie.Live {
+		// movie not active
+		err = errors.New(user + " --> " + "Offline or User Not Found")
+		return
+	} else {
+		var mode string
+		if data.Fmp4.Source {
+			// StreamQuality.High
+			mode = "main"
+		} else if data.Fmp4.MobileSource {
+			// StreamQuality.Middle
+			mode = "mobilesource"
+		} else {
+			// StreamQuality.Low
+			mode = "base"
+		}
+
+		if data.Fmp4.Proto != "" && data.Fmp4.Host != "" && data.Movie.Id != 0 {
+			conn, err = connectStream(data.Fmp4.Proto, data.Fmp4.Host, mode, data.Movie.Id)
+			if err != nil {
+				return
+			}
+			movieId = data.Movie.Id
+		} else {
+			err = errors.New(user + " --> " + "No Stream Defined")
+			return
+		}
+	}
+
+	return
+}
+
+func createFileUser(user string, movieId uint64) (f *os.File, filename string, err error) {
+	user = files.ReplaceForbidden(user)
+	filename = fmt.Sprintf("%s_%d.mp4", user, movieId)
+	for i := 2; i < 1000; i++ {
+		_, err := os.Stat(filename)
+		if err != nil {
+			break
+		}
+		filename = fmt.Sprintf("%s_%d_%d.mp4", user, movieId, i)
+	}
+	f, err = os.Create(filename)
+	return
+}
+
+// FIXME: return codeの整理
+// interruptが閉じられたら停止する(-daemon)
+// splitDuration, splitSizeが指定されていればキーフレームの位置で出力を分割する
+func TwitcasRecord(user, format string, splitDuration time.Duration, splitSize int64, stdout io.Writer, interrupt <-chan struct{}) (done, dbLocked bool, fileNames []string) {
+	conn, movieId, err := getStream(user)
+	if err != nil {
+		fmt.Fprintf(stdout, "@err getStream: %v\n", err)
+		return
+	}
+	if conn == nil {
+		fmt.Fprintln(stdout, "[FIXME] conn is nil")
+		return
+	}
+	defer conn.Close()
+
+	if interrupt != nil {
+		chDone := make(chan struct{})
+		defer close(chDone)
+		go func() {
+			select {
+			case <-interrupt:
+				// ReadMessageをエラーで抜けさせる
+				conn.Close()
+			case <-chDone:
+			}
+		}()
+	}
+
+	dbName := fmt.Sprintf("tmp/tcas-%v-lock.db", movieId)
+	files.MkdirByFileName(dbName)
+	db, err := sql.Open("sqlite3", dbName)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`BEGIN EXCLUSIVE`)
+	if err != nil {
+		dbLocked = true
+		return
+	}
+	defer os.Remove(dbName)
+
+	//func Open(opt... string) (cmd *exec.Cmd, stdin io.WriteCloser, err error) {
+	var cmd *exec.Cmd
+	var stdin io.WriteCloser
+
+	var fileOpened bool
+
+	// fMP4の初期化セグメント。出力先を切り替えた時に先頭に書き込む
+	var initData []byte
+	var videoId uint32
+	var hasVideo bool
+
+	// 分割用
+	var openedAt time.Time
+	var written int64
+
+	if format == "" {
+		format = "?UNAME?_?PID?"
+	}
+	vars := outname.Vars{
+		"SERVICE": "tcas",
+		"PID":     fmt.Sprintf("%d", movieId),
+		"UNAME":   user,
+		"UID":     user,
+	}
+	vars.SetTime(time.Now())
+	filenameBase := outname.Path(format, vars) + ".ts" // fixed #8
+	files.MkdirByFileName(filenameBase)
+
+	closeFF := func() {
+		if stdin != nil {
+			stdin.Close()
+		}
+		if cmd != nil {
+			cmd.Wait()
+		}
+		stdin = nil
+		cmd = nil
+	}
+
+	openFF := func() (err error) {
+		closeFF()
+
+		name, err := files.GetFileNameNext(filenameBase)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			return
+		}
+
+		c, in, err := ffmpeg.Open("-i", "-", "-c", "copy", "-y", name)
+		if err != nil {
+			return
+		}
+		cmd = c
+		stdin = in
+		fileNames = append(fileNames, name)
+		openedAt = time.Now()
+		written = 0
+
+		fileOpened = true
+		return
+	}
+
+	defer closeFF()
+	for {
+		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			fmt.Fprintf(stdout, "@err ReadMessage: %v\n\n", err)
+			return
+		}
+
+		if messageType == 2 {
+			isInit := len(data) >= 8 && string(data[4:8]) == "ftyp"
+			if isInit {
+				initData = data
+				videoId, hasVideo = videoTrackId(data)
+			}
+
+			reopen := cmd == nil || stdin == nil
+			if written > 0 && ((splitDuration > 0 && time.Since(openedAt) >= splitDuration) ||
+				(splitSize > 0 && written+int64(len(data)) > splitSize)) {
+				if !hasVideo || isKeyFragment(data, videoId) {
+					reopen = true
+				}
+			}
+
+			// 空き容量が足りなければ予備の出力先で開き直す
+			if ok, free, _ := diskguard.Check(filenameBase); !ok {
+				diskguard.Warn(filenameBase, free)
+				name, ok := diskguard.Alternative(filenameBase)
+				if !ok {
+					break
+				}
+				filenameBase = name
+				reopen = true
+			}
+
+			if reopen {
+				if err = openFF(); err != nil {
+					fmt.Fprintln(stdout, err)
+					return
+				}
+				if initData != nil && !isInit {
+					if _, err := stdin.Write(initData); err != nil {
+						fmt.Fprintln(stdout, err)
+						return
+					}
+					written += int64(len(initData))
+				}
+			}
+
+			if _, err := stdin.Write(data); err != nil {
+				fmt.Fprintln(stdout, err)
+				return
+			}
+			written += int64(len(data))
+
+		} else if messageType == 1 {
+
+			type TextMessage struct {
+				Code int `json:"code"`
+			}
+			msg := new(TextMessage)
+			err = json.Unmarshal(data, msg)
+			if err != nil {
+				// json decode error
+				fmt.Fprintf(stdout, "@err %v\n", err)
+				return
+			}
+			if (msg.Code == 100) || (msg.Code == 101) || (msg.Code == 110) {
+				// ignore
+			} else if msg.Code == 400 { // invalid_parameter
+				return
+			} else if msg.Code == 401 { // passcode_required
+				return
+			} else if msg.Code == 403 { //access_forbidden
+				return
+			} else if msg.Code == 500 { // offline
+				return
+			} else if msg.Code == 503 { // server_error
+				return
+			} else if msg.Code == 504 { // live_ended
+				break
+			} else {
+				fmt.Fprintf(stdout, "@FIXME %v\n\n", string(data))
+				return
+			}
+		}
+	}
+
+	closeFF()
+
+	done = fileOpened
+	return
+}
@@ -1,436 +1,500 @@
-package youtube
-
-import (
-	"fmt"
-	//	"net/http"
-	//	"io/ioutil"
-	"bufio"
-	"context"
-	"encoding/json"
-	"html"
-	"os"
-	"os/signal"
-	"regexp"
-	"strings"
-	"sync"
-	"syscall"
-	"time"
-
-	"github.com/himananiito/livedl/files"
-	"github.com/himananiito/livedl/gorman"
-	"github.com/himananiito/livedl/httpbase"
-	"github.com/himananiito/livedl/objs"
-	"github.com/himananiito/livedl/procs"
-	"github.com/himananiito/livedl/procs/streamlink"
-	"github.com/himananiito/livedl/procs/youtube_dl"
-)
-
-var Cookie = "PREF=f1=50000000&f4=4000000&hl=en"
-var UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/69.0.3497.100 Safari/537.36"
-
-var split = func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	for i := 0; i < len(data); i++ {
-		if data[i] == '\n' {
-			return i + 1, data[:i+1], nil
-		}
-		if data[i] == '\r' {
-			if (i + 1) == len(data) {
-				return 0, nil, nil
-			}
-			if data[i+1] == '\n' {
-				return i + 2, data[:i+2], nil
-			}
-			return i + 1, data[:i+1], nil
-		}
-	}
-
-	if atEOF && len(data) > 0 {
-		return len(data), data, nil
-	}
-
-	return 0, nil, nil
-}
-
-func getChatContinuation(buff []byte) (isReplay bool, continuation string, err error) {
-
-	if ma := regexp.MustCompile(`(?s)\Wwindow\["ytInitialData"\]\p{Zs}*=\p{Zs}*({.*?})\p{Zs}*;`).FindSubmatch(buff); len(ma) > 1 {
-		var data interface{}
-		err = json.Unmarshal(ma[1], &data)
-		if err != nil {
-			err = fmt.Errorf("ytInitialData parse error")
-			return
-		}
-
-		//objs.PrintAsJson(data);
-
-		liveChatRenderer, ok := objs.Find(data,
-			"contents",
-			"twoColumnWatchNextResults",
-			"conversationBar",
-			"liveChatRenderer",
-		)
-		if !ok {
-			err = fmt.Errorf("liveChatRenderer not found")
-			return
-		}
-		isReplay, _ = objs.FindBool(liveChatRenderer, "isReplay")
-
-		subMenuItems, ok := objs.FindArray(liveChatRenderer,
-			"header",
-			"liveChatHeaderRenderer",
-			"viewSelector",
-			"sortFilterSubMenuRenderer",
-			"subMenuItems",
-		)
-		if !ok {
-			err = fmt.Errorf("subMenuItems not found")
-			return
-		}
-
-		for _, item := range subMenuItems {
-			title, _ := objs.FindString(item, "title")
-			//selected, _ := objs.FindBool(item, "selected")
-			c, _ := objs.FindString(item, "continuation", "reloadContinuationData", "continuation")
-
-			if (title != "") && (!strings.Contains(title, "Top")) {
-				continuation = c
-				return
-			}
-			continuation = c
-		}
-
-	} else {
-		err = fmt.Errorf("ytInitialData not found")
-		return
-	}
-
-	if continuation == "" {
-		err = fmt.Errorf("continuation not found")
-	}
-	return
-}
-
-func getInfo(buff []byte) (title, ucid, author string, err error) {
-	var data interface{}
-	re := regexp.MustCompile(`(?s)\Wytplayer\.config\p{Zs}*=\p{Zs}*({.*?})\p{Zs}*;`)
-	if ma := re.FindSubmatch(buff); len(ma) > 1 {
-		str := html.UnescapeString(string(ma[1]))
-		if err = json.Unmarshal([]byte(str), &data); err != nil {
-			err = fmt.Errorf("ytplayer parse error")
-			return
-		}
-	} else {
-		err = fmt.Errorf("ytplayer.config not found")
-		return
-	}
-
-	//objs.PrintAsJson(data); return
-
-	title, ok := objs.FindString(data, "args", "title")
-	if !ok {
-		err = fmt.Errorf("title not found")
-		return
-	}
-	ucid, _ = objs.FindString(data, "args", "ucid")
-	author, _ = objs.FindString(data, "args", "author")
-	return
-}
-
-func execStreamlink(gm *gorman.GoroutineManager, uri, name string) (notSupport bool, err error) {
-	cmd, stdout, stderr, err := streamlink.Open(uri, "best", "--retry-max", "10", "-o", name)
-	if err != nil {
-		return
-	}
-	defer stdout.Close()
-	defer stderr.Close()
-
-	chStdout := make(chan string, 10)
-	chStderr := make(chan string, 10)
-	chEof := make(chan struct{}, 2)
-
-	// stdout
-	gm.Go(func(c <-chan struct{}) int {
-		defer func() {
-			chEof <- struct{}{}
-		}()
-		scanner := bufio.NewScanner(stdout)
-		scanner.Split(split)
-
-		for scanner.Scan() {
-			chStdout <- scanner.Text()
-		}
-
-		return 0
-	})
-
-	// stderr
-	gm.Go(func(c <-chan struct{}) int {
-		defer func() {
-			chEof <- struct{}{}
-		}()
-		scanner := bufio.NewScanner(stderr)
-		scanner.Split(split)
-
-		for scanner.Scan() {
-			chStderr <- scanner.Text()
-		}
-
-		return 0
-	})
-
-	// outputs
-	gm.Go(func(c <-chan struct{}) int {
-		for {
-			var s string
-			select {
-			case s = <-chStdout:
-			case s = <-chStderr:
-			case <-chEof:
-				return 0
-			}
-
-			if strings.HasPrefix(s, "[cli][error]") {
-				fmt.Print(s)
-
-				notSupport = true
-				procs.Kill(cmd.Process.Pid)
-				break
-			} else if strings.HasPrefix(s, "Traceback (most recent call last):") {
-				fmt.Print(s)
-
-				notSupport = true
-				//procs.Kill(cmd.Process.Pid)
-				//break
-			} else {
-				fmt.Print(s)
-			}
-		}
-		return 0
-	})
-
-	cmd.Wait()
-
-	return
-}
-
-func execYoutube_dl(gm *gorman.GoroutineManager, uri, name string) (err error) {
-	defer func() {
-		part := name + ".part"
-		if _, test := os.Stat(part); test == nil {
-			if _, test := os.Stat(name); test != nil {
-				os.Rename(part, name)
-			}
-		}
-	}()
-
-	cmd, stdout, stderr, err := youtube_dl.Open("--no-mtime", "--no-color", "-o", name, uri)
-	if err != nil {
-		return
-	}
-	defer stdout.Close()
-	defer stderr.Close()
-
-	chStdout := make(chan string, 10)
-	chStderr := make(chan string, 10)
-	chEof := make(chan struct{}, 2)
-
-	// stdout
-	gm.Go(func(c <-chan struct{}) int {
-		defer func() {
-			chEof <- struct{}{}
-		}()
-		scanner := bufio.NewScanner(stdout)
-		scanner.Split(split)
-
-		for scanner.Scan() {
-			chStdout <- scanner.Text()
-		}
-
-		return 0
-	})
-
-	// stderr
-	gm.Go(func(c <-chan struct{}) int {
-		defer func() {
-			chEof <- struct{}{}
-		}()
-		scanner := bufio.NewScanner(stderr)
-		scanner.Split(split)
-
-		for scanner.Scan() {
-			chStderr <- scanner.Text()
-		}
-
-		return 0
-	})
-
-	// outputs
-	gm.Go(func(c <-chan struct{}) int {
-		var old int64
-		for {
-			var s string
-			select {
-			case s = <-chStdout:
-			case s = <-chStderr:
-			case <-chEof:
-				return 0
-			}
-
-			if strings.HasPrefix(s, "[https @ ") {
-				// ffmpeg unwanted logs
-			} else {
-				if strings.HasPrefix(s, "[download]") {
-					var now = time.Now().UnixNano()
-					if now-old > 2*1000*1000*1000 {
-						old = now
-					} else {
-						continue
-					}
-				}
-				fmt.Print(s)
-			}
-		}
-		return 0
-	})
-
-	cmd.Wait()
-	return
-}
-
-var COMMENT_DONE = 1000
-
-func Record(id string, ytNoStreamlink, ytNoYoutube_dl bool) (err error) {
-
-	uri := fmt.Sprintf("https://www.youtube.com/watch?v=%s", id)
-	code, buff, err, neterr := httpbase.GetBytes(uri, map[string]string{
-		"Cookie":     Cookie,
-		"User-Agent": UserAgent,
-	})
-	if err != nil {
-		return
-	}
-	if neterr != nil {
-		return
-	}
-	if code != 200 {
-		neterr = fmt.Errorf("Status code: %v\n", code)
-		return
-	}
-
-	title, ucid, author, err := getInfo(buff)
-	if err != nil {
-		return
-	}
-
-	if false {
-		fmt.Println(ucid)
-	}
-
-	isReplay, continuation, err := getChatContinuation(buff)
-
-	origName := fmt.Sprintf("%s-%s_%s.mp4", author, title, id)
-	origName = files.ReplaceForbidden(origName)
-	name, err := files.GetFileNameNext(origName)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	fmt.Println(name)
-
-	mtxComDone := &sync.Mutex{}
-	var commentDone bool
-
-	var gm *gorman.GoroutineManager
-	var gmCom *gorman.GoroutineManager
-
-	gm = gorman.WithChecker(func(c int) {
-		switch c {
-		case 0:
-		default:
-			gm.Cancel()
-			if gmCom != nil {
-				gmCom.Cancel()
-			}
-		}
-	})
-
-	gmCom = gorman.WithChecker(func(c int) {
-		switch c {
-		case 0:
-		case COMMENT_DONE:
-			func() {
-				mtxComDone.Lock()
-				defer mtxComDone.Unlock()
-				commentDone = true
-			}()
-		default:
-			gmCom.Cancel()
-		}
-	})
-
-	chInterrupt := make(chan os.Signal, 10)
-	signal.Notify(chInterrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-	defer signal.Stop(chInterrupt)
-
-	ctx, cancel := context.WithCancel(context.Background())
-
-	var interrupt bool
-	gm.Go(func(c <-chan struct{}) int {
-		select {
-		case <-chInterrupt:
-			interrupt = true
-		case <-c:
-		}
-
-		cancel()
-		gm.Cancel()
-		return 1
-	})
-
-	if continuation != "" {
-		gmCom.Go(func(c <-chan struct{}) int {
-			getComment(gmCom, ctx, c, isReplay, continuation, origName)
-			fmt.Printf("\ncomment done\n")
-			return COMMENT_DONE
-		})
-	}
-
-	gm.Go(func(c <-chan struct{}) int {
-		select {
-		case <-c:
-			cancel()
-		}
-		return 0
-	})
-
-	var retry bool
-	if !ytNoStreamlink {
-		retry, err = execStreamlink(gm, uri, name)
-	}
-	if !interrupt {
-		if err != nil || retry || (ytNoStreamlink && (!ytNoYoutube_dl)) {
-			execYoutube_dl(gm, uri, name)
-		}
-	}
-
-	if continuation != "" {
-		if isReplay {
-			if !commentDone {
-				fmt.Printf("\nwaiting comment\n")
-				gmCom.Wait()
-			} else {
-				gmCom.Wait()
-			}
-
-		} else {
-			gmCom.Cancel()
-			gmCom.Wait()
-		}
-	}
-
-	gm.Cancel()
-	gm.Wait()
-
-	return
-}
+package youtube
+
+import (
+	"fmt"
+	//	"net/http"
+	//	"io/ioutil"
+	"bufio"
+	"context"
+	"encoding/json"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/himananiito/livedl/files"
+	"github.com/himananiito/livedl/gorman"
+	"github.com/himananiito/livedl/httpbase"
+	"github.com/himananiito/livedl/objs"
+	"github.com/himananiito/livedl/outname"
+	"github.com/himananiito/livedl/procs"
+	"github.com/himananiito/livedl/procs/streamlink"
+	"github.com/himananiito/livedl/procs/youtube_dl"
+)
+
+// 共有のCookie(httpbase.Jar)にPREFが無ければ設定する
+var Cookie = "PREF=f1=50000000&f4=4000000&hl=en"
+
+func setPref() {
+	kv := strings.SplitN(Cookie, "=", 2)
+	if len(kv) == 2 && !httpbase.Jar.HasCookie("youtube.com", kv[0]) {
+		httpbase.Jar.SetDomainCookie("youtube.com", kv[0], kv[1])
+	}
+}
+
+// streamlink用
+func cookieArgs() (args []string) {
+	u, _ := url.Parse("https://www.youtube.com/")
+	for _, c := range httpbase.Jar.Cookies(u) {
+		args = append(args, "--http-cookie", c.Name+"="+c.Value)
+	}
+	return
+}
+
+// -http-proxy(-http-proxy-yt)
+func proxyArgs(name string) (args []string) {
+	if p := httpbase.ProxyURL("www.youtube.com"); p != nil {
+		args = []string{name, p.String()}
+	}
+	return
+}
+
+// youtube-dl用のcookies.txtを一時ファイルに書き出す
+func cookieFile() (name string, err error) {
+	f, err := ioutil.TempFile("", "livedl-cookies-*.txt")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	name = f.Name()
+	if _, err = httpbase.Jar.ExportNetscape(f, "youtube.com"); err != nil {
+		os.Remove(name)
+		name = ""
+	}
+	return
+}
+
+var UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/69.0.3497.100 Safari/537.36"
+
+var split = func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i := 0; i < len(data); i++ {
+		if data[i] == '\n' {
+			return i + 1, data[:i+1], nil
+		}
+		if data[i] == '\r' {
+			if (i + 1) == len(data) {
+				return 0, nil, nil
+			}
+			if data[i+1] == '\n' {
+				return i + 2, data[:i+2], nil
+			}
+			return i + 1, data[:i+1], nil
+		}
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+func getChatContinuation(buff []byte) (isReplay bool, continuation string, err error) {
+
+	if ma := regexp.MustCompile(`(?s)\Wwindow\["ytInitialData"\]\p{Zs}*=\p{Zs}*({.*?})\p{Zs}*;`).FindSubmatch(buff); len(ma) > 1 {
+		var data interface{}
+		err = json.Unmarshal(ma[1], &data)
+		if err != nil {
+			err = fmt.Errorf("ytInitialData parse error")
+			return
+		}
+
+		//objs.PrintAsJson(data);
+
+		liveChatRenderer, ok := objs.Find(data,
+			"contents",
+			"twoColumnWatchNextResults",
+			"conversationBar",
+			"liveChatRenderer",
+		)
+		if !ok {
+			err = fmt.Errorf("liveChatRenderer not found")
+			return
+		}
+		isReplay, _ = objs.FindBool(liveChatRenderer, "isReplay")
+
+		subMenuItems, ok := objs.FindArray(liveChatRenderer,
+			"header",
+			"liveChatHeaderRenderer",
+			"viewSelector",
+			"sortFilterSubMenuRenderer",
+			"subMenuItems",
+		)
+		if !ok {
+			err = fmt.Errorf("subMenuItems not found")
+			return
+		}
+
+		for _, item := range subMenuItems {
+			title, _ := objs.FindString(item, "title")
+			//selected, _ := objs.FindBool(item, "selected")
+			c, _ := objs.FindString(item, "continuation", "reloadContinuationData", "continuation")
+
+			if (title != "") && (!strings.Contains(title, "Top")) {
+				continuation = c
+				return
+			}
+			continuation = c
+		}
+
+	} else {
+		err = fmt.Errorf("ytInitialData not found")
+		return
+	}
+
+	if continuation == "" {
+		err = fmt.Errorf("continuation not found")
+	}
+	return
+}
+
+func getInfo(buff []byte) (title, ucid, author string, err error) {
+	var data interface{}
+	re := regexp.MustCompile(`(?s)\Wytplayer\.config\p{Zs}*=\p{Zs}*({.*?})\p{Zs}*;`)
+	if ma := re.FindSubmatch(buff); len(ma) > 1 {
+		str := html.UnescapeString(string(ma[1]))
+		if err = json.Unmarshal([]byte(str), &data); err != nil {
+			err = fmt.Errorf("ytplayer parse error")
+			return
+		}
+	} else {
+		err = fmt.Errorf("ytplayer.config not found")
+		return
+	}
+
+	//objs.PrintAsJson(data); return
+
+	title, ok := objs.FindString(data, "args", "title")
+	if !ok {
+		err = fmt.Errorf("title not found")
+		return
+	}
+	ucid, _ = objs.FindString(data, "args", "ucid")
+	author, _ = objs.FindString(data, "args", "author")
+	return
+}
+
+func execStreamlink(gm *gorman.GoroutineManager, uri, name string, out io.Writer) (notSupport bool, err error) {
+	args := append([]string{uri, "best", "--retry-max", "10", "-o", name}, cookieArgs()...)
+	args = append(args, proxyArgs("--http-proxy")...)
+	cmd, stdout, stderr, err := streamlink.Open(args...)
+	if err != nil {
+		return
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+
+	chStdout := make(chan string, 10)
+	chStderr := make(chan string, 10)
+	chEof := make(chan struct{}, 2)
+
+	// stdout
+	gm.Go("stdout", func(ctx context.Context) error {
+		defer func() {
+			chEof <- struct{}{}
+		}()
+		scanner := bufio.NewScanner(stdout)
+		scanner.Split(split)
+
+		for scanner.Scan() {
+			chStdout <- scanner.Text()
+		}
+
+		return nil
+	})
+
+	// stderr
+	gm.Go("stderr", func(ctx context.Context) error {
+		defer func() {
+			chEof <- struct{}{}
+		}()
+		scanner := bufio.NewScanner(stderr)
+		scanner.Split(split)
+
+		for scanner.Scan() {
+			chStderr <- scanner.Text()
+		}
+
+		return nil
+	})
+
+	// outputs
+	gm.Go("outputs", func(ctx context.Context) error {
+		for {
+			var s string
+			select {
+			case s = <-chStdout:
+			case s = <-chStderr:
+			case <-chEof:
+				return nil
+			}
+
+			if strings.HasPrefix(s, "[cli][error]") {
+				fmt.Fprint(out, s)
+
+				notSupport = true
+				procs.Kill(cmd.Process.Pid)
+				break
+			} else if strings.HasPrefix(s, "Traceback (most recent call last):") {
+				fmt.Fprint(out, s)
+
+				notSupport = true
+				//procs.Kill(cmd.Process.Pid)
+				//break
+			} else {
+				fmt.Fprint(out, s)
+			}
+		}
+		return nil
+	})
+
+	cmd.Wait()
+
+	return
+}
+
+func execYoutube_dl(gm *gorman.GoroutineManager, uri, name string, out io.Writer) (err error) {
+	defer func() {
+		part := name + ".part"
+		if _, test := os.Stat(part); test == nil {
+			if _, test := os.Stat(name); test != nil {
+				os.Rename(part, name)
+			}
+		}
+	}()
+
+	args := append([]string{"--no-mtime", "--no-color", "-o", name}, proxyArgs("--proxy")...)
+	if cookies, e := cookieFile(); e == nil {
+		defer os.Remove(cookies)
+		args = append(args, "--cookies", cookies)
+	}
+	cmd, stdout, stderr, err := youtube_dl.Open(append(args, uri)...)
+	if err != nil {
+		return
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+
+	chStdout := make(chan string, 10)
+	chStderr := make(chan string, 10)
+	chEof := make(chan struct{}, 2)
+
+	// stdout
+	gm.Go("stdout", func(ctx context.Context) error {
+		defer func() {
+			chEof <- struct{}{}
+		}()
+		scanner := bufio.NewScanner(stdout)
+		scanner.Split(split)
+
+		for scanner.Scan() {
+			chStdout <- scanner.Text()
+		}
+
+		return nil
+	})
+
+	// stderr
+	gm.Go("stderr", func(ctx context.Context) error {
+		defer func() {
+			chEof <- struct{}{}
+		}()
+		scanner := bufio.NewScanner(stderr)
+		scanner.Split(split)
+
+		for scanner.Scan() {
+			chStderr <- scanner.Text()
+		}
+
+		return nil
+	})
+
+	// outputs
+	gm.Go("outputs", func(ctx context.Context) error {
+		var old int64
+		for {
+			var s string
+			select {
+			case s = <-chStdout:
+			case s = <-chStderr:
+			case <-chEof:
+				return nil
+			}
+
+			if strings.HasPrefix(s, "[https @ ") {
+				// ffmpeg unwanted logs
+			} else {
+				if strings.HasPrefix(s, "[download]") {
+					var now = time.Now().UnixNano()
+					if now-old > 2*1000*1000*1000 {
+						old = now
+					} else {
+						continue
+					}
+				}
+				fmt.Fprint(out, s)
+			}
+		}
+	})
+
+	cmd.Wait()
+	return
+}
+
+var COMMENT_DONE = 1000
+
+// interruptが閉じられたら停止する(-daemon)
+func Record(id, format string, ytNoStreamlink, ytNoYoutube_dl bool, out io.Writer, interrupt <-chan struct{}) (err error) {
+
+	setPref()
+	uri := fmt.Sprintf("https://www.youtube.com/watch?v=%s", id)
+	code, buff, err, neterr := httpbase.GetBytes(uri, map[string]string{
+		"User-Agent": UserAgent,
+	})
+	if err != nil {
+		return
+	}
+	if neterr != nil {
+		return
+	}
+	if code != 200 {
+		neterr = fmt.Errorf("Status code: %v\n", code)
+		return
+	}
+
+	title, ucid, author, err := getInfo(buff)
+	if err != nil {
+		return
+	}
+
+	if false {
+		fmt.Fprintln(out, ucid)
+	}
+
+	isReplay, continuation, err := getChatContinuation(buff)
+
+	if format == "" {
+		format = "?UNAME?-?TITLE?_?PID?"
+	}
+	vars := outname.Vars{
+		"SERVICE": "youtube",
+		"PID":     id,
+		"UNAME":   author,
+		"UID":     ucid,
+		"TITLE":   title,
+	}
+	vars.SetTime(time.Now())
+	origName := outname.Path(format, vars) + ".mp4"
+	files.MkdirByFileName(origName)
+	name, err := files.GetFileNameNext(origName)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return
+	}
+
+	fmt.Fprintln(out, name)
+
+	mtxComDone := &sync.Mutex{}
+	var commentDone bool
+
+	var gm *gorman.GoroutineManager
+	var gmCom *gorman.GoroutineManager
+
+	// gmを止めるとgmComも止まる
+	gm = gorman.WithChecker(id, func(err error) {
+		if err != nil {
+			gm.Cancel(err)
+		}
+	})
+
+	gmCom = gm.Child("comment", func(err error) {
+		switch gorman.Code(err) {
+		case 0:
+		case COMMENT_DONE:
+			func() {
+				mtxComDone.Lock()
+				defer mtxComDone.Unlock()
+				commentDone = true
+			}()
+		default:
+			gmCom.Cancel(err)
+		}
+	})
+
+	chInterrupt := make(chan os.Signal, 10)
+	if interrupt == nil {
+		signal.Notify(chInterrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(chInterrupt)
+	}
+
+	// コメントのDBへの書き込み用。gmが止まるまでは止めない
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var interrupted bool
+	gm.Go("interrupt", func(c context.Context) error {
+		err := fmt.Errorf("interrupted")
+		select {
+		case <-chInterrupt:
+			interrupted = true
+		case <-interrupt:
+			interrupted = true
+		case <-c.Done():
+			err = gorman.Cause(c)
+		}
+
+		cancel()
+		gm.Cancel(err)
+		return err
+	})
+
+	if continuation != "" {
+		gmCom.Go("comment", func(c context.Context) error {
+			getComment(gmCom, ctx, c.Done(), isReplay, continuation, origName, out)
+			fmt.Fprintf(out, "\ncomment done\n")
+			return gorman.Fail(COMMENT_DONE, nil)
+		})
+	}
+
+	gm.Go("cancel", func(c context.Context) error {
+		<-c.Done()
+		cancel()
+		return nil
+	})
+
+	var retry bool
+	if !ytNoStreamlink {
+		retry, err = execStreamlink(gm, uri, name, out)
+	}
+	if !interrupted {
+		if err != nil || retry || (ytNoStreamlink && (!ytNoYoutube_dl)) {
+			execYoutube_dl(gm, uri, name, out)
+		}
+	}
+
+	if continuation != "" {
+		if isReplay {
+			if !commentDone {
+				fmt.Fprintf(out, "\nwaiting comment\n")
+				gmCom.Wait()
+			} else {
+				gmCom.Wait()
+			}
+
+		} else {
+			gmCom.Cancel(fmt.Errorf("recording finished"))
+			gmCom.Wait()
+		}
+	}
+
+	gm.Cancel(fmt.Errorf("recording finished"))
+	gm.Wait()
+
+	return
+}
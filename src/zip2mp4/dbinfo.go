@@ -0,0 +1,328 @@
+package zip2mp4
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 録画済みのdbの情報(-db-info)
+type DBInfo struct {
+	File      string                 `json:"file"`
+	Service   string                 `json:"service"`        // nico, youtube
+	Mode      string                 `json:"mode,omitempty"` // live, timeshift
+	Meta      map[string]interface{} `json:"meta,omitempty"`
+	FirstSeq  int64                  `json:"firstSeqno"`
+	LastSeq   int64                  `json:"lastSeqno"`
+	Chunks    int64                  `json:"chunks"`
+	Missing   int64                  `json:"missing"`
+	NotFound  int64                  `json:"notfound"`
+	Gaps      []Gap                  `json:"gaps"`
+	Bandwidth []BandwidthChange      `json:"bandwidth"`
+	Duration  float64                `json:"duration"` // 推定(秒)
+	Size      int64                  `json:"size"`     // 推定(バイト)
+	Comments  CommentInfo            `json:"comments"`
+}
+
+// 欠落しているチャンクの範囲。Kindはmissing(dbにない), notfound(404)
+type Gap struct {
+	From int64  `json:"from"`
+	To   int64  `json:"to"`
+	Kind string `json:"kind"`
+}
+
+type BandwidthChange struct {
+	SeqNo     int64   `json:"seqno"`
+	Position  float64 `json:"position"` // 先頭のチャンクからの再生時間(秒)
+	Bandwidth int     `json:"bandwidth"`
+}
+
+type CommentInfo struct {
+	Count     int64 `json:"count"`
+	FirstDate int64 `json:"firstDate,omitempty"` // unix time
+	LastDate  int64 `json:"lastDate,omitempty"`
+	FirstVpos int64 `json:"firstVpos"` // 1/100秒
+	LastVpos  int64 `json:"lastVpos"`
+}
+
+// PTSを読むのに十分なチャンクの先頭部分
+const infoHeadSize = 188 * 100
+
+func nicoDBInfo(db *sql.DB, info *DBInfo) (err error) {
+	info.Service = "nico"
+
+	rows, err := db.Query(`SELECT k, v FROM kvs`)
+	if err != nil {
+		return
+	}
+	info.Meta = map[string]interface{}{}
+	for rows.Next() {
+		var k string
+		var v interface{}
+		if err = rows.Scan(&k, &v); err != nil {
+			rows.Close()
+			return
+		}
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		info.Meta[k] = v
+	}
+	rows.Close()
+
+	rows, err = db.Query(fmt.Sprintf(`SELECT
+		seqno, IFNULL(notfound, 0), IFNULL(bandwidth, 0), IFNULL(size, IFNULL(length(data), 0)),
+		substr(data, 1, %d), position IS NOT NULL
+		FROM media ORDER BY seqno`, infoHeadSize))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var clock tsClock
+	var hasPosition bool
+	var pos, lastDur time.Duration
+	prevSeq := int64(-1)
+	prevBw := -1
+	// 404が続いている範囲(Gapsの添字)
+	nf := -1
+	for rows.Next() {
+		var seqno int64
+		var notfound bool
+		var bw int
+		var size int64
+		var head []byte
+		var position bool
+		if err = rows.Scan(&seqno, &notfound, &bw, &size, &head, &position); err != nil {
+			return
+		}
+		if position {
+			hasPosition = true
+		}
+		if prevSeq < 0 {
+			info.FirstSeq = seqno
+		} else if seqno > prevSeq+1 {
+			info.Missing += seqno - prevSeq - 1
+			info.Gaps = append(info.Gaps, Gap{From: prevSeq + 1, To: seqno - 1, Kind: "missing"})
+		}
+		info.LastSeq = seqno
+
+		if notfound || head == nil {
+			info.NotFound++
+			if nf >= 0 && info.Gaps[nf].To == prevSeq && prevSeq == seqno-1 {
+				info.Gaps[nf].To = seqno
+			} else {
+				info.Gaps = append(info.Gaps, Gap{From: seqno, To: seqno, Kind: "notfound"})
+				nf = len(info.Gaps) - 1
+			}
+			prevSeq = seqno
+			continue
+		}
+
+		var skip int64
+		if prevSeq >= 0 && seqno > prevSeq+1 {
+			skip = seqno - prevSeq - 1
+		}
+		prevSeq = seqno
+		pos = clock.next(head, skip)
+		lastDur = clock.prevDur
+
+		if bw != prevBw {
+			info.Bandwidth = append(info.Bandwidth, BandwidthChange{
+				SeqNo:     seqno,
+				Position:  pos.Seconds(),
+				Bandwidth: bw,
+			})
+			prevBw = bw
+		}
+		info.Chunks++
+		info.Size += size
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if info.Chunks > 0 {
+		info.Duration = (pos + lastDur).Seconds()
+	}
+
+	info.Mode = "live"
+	if status, _ := info.Meta["status"].(string); hasPosition || status == "ENDED" {
+		info.Mode = "timeshift"
+	}
+
+	err = db.QueryRow(`SELECT COUNT(*), IFNULL(MIN(date), 0), IFNULL(MAX(date), 0),
+		IFNULL(MIN(vpos), 0), IFNULL(MAX(vpos), 0) FROM comment`).Scan(
+		&info.Comments.Count,
+		&info.Comments.FirstDate,
+		&info.Comments.LastDate,
+		&info.Comments.FirstVpos,
+		&info.Comments.LastVpos,
+	)
+	return
+}
+
+func ytDBInfo(db *sql.DB, info *DBInfo) (err error) {
+	info.Service = "youtube"
+	info.Gaps = []Gap{}
+	info.Bandwidth = []BandwidthChange{}
+
+	var firstUsec, lastUsec int64
+	err = db.QueryRow(`SELECT COUNT(*), IFNULL(MIN(timestampUsec), 0), IFNULL(MAX(timestampUsec), 0),
+		IFNULL(MIN(videoOffsetTimeMsec), 0), IFNULL(MAX(videoOffsetTimeMsec), 0) FROM comment`).Scan(
+		&info.Comments.Count,
+		&firstUsec,
+		&lastUsec,
+		&info.Comments.FirstVpos,
+		&info.Comments.LastVpos,
+	)
+	if err != nil {
+		return
+	}
+	info.Comments.FirstDate = firstUsec / 1000000
+	info.Comments.LastDate = lastUsec / 1000000
+	// msec -> 1/100秒
+	info.Comments.FirstVpos /= 10
+	info.Comments.LastVpos /= 10
+	return
+}
+
+func GetDBInfo(fileName string) (info DBInfo, err error) {
+	if _, err = os.Stat(fileName); err != nil {
+		return
+	}
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	info.File = fileName
+	if strings.HasSuffix(fileName, ".yt.sqlite3") {
+		err = ytDBInfo(db, &info)
+	} else {
+		err = nicoDBInfo(db, &info)
+	}
+	if info.Gaps == nil {
+		info.Gaps = []Gap{}
+	}
+	return
+}
+
+func formatSec(sec float64) string {
+	s := int64(sec)
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, (s%3600)/60, s%60)
+}
+
+func formatBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
+// -db-info
+func PrintDBInfo(fileName string, asJson bool) (err error) {
+	info, err := GetDBInfo(fileName)
+	if err != nil {
+		return
+	}
+
+	if asJson {
+		b, e := json.MarshalIndent(info, "", "  ")
+		if e != nil {
+			return e
+		}
+		fmt.Println(string(b))
+		return
+	}
+
+	fmt.Printf("File:      %s\n", info.File)
+	if info.Mode != "" {
+		fmt.Printf("Service:   %s (%s)\n", info.Service, info.Mode)
+	} else {
+		fmt.Printf("Service:   %s\n", info.Service)
+	}
+
+	if len(info.Meta) > 0 {
+		fmt.Println("Meta:")
+		var keys []string
+		for k := range info.Meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := fmt.Sprint(info.Meta[k])
+			if f, ok := info.Meta[k].(float64); ok {
+				v = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+			if k == "beginTime" || k == "endTime" || k == "openTime" || k == "serverTime" {
+				var n int64
+				switch x := info.Meta[k].(type) {
+				case int64:
+					n = x
+				case float64:
+					n = int64(x)
+				}
+				if n > 0 {
+					// serverTimeはミリ秒
+					if n > 1e11 {
+						n /= 1000
+					}
+					v = fmt.Sprintf("%s (%s)", v, time.Unix(n, 0).Format("2006/01/02 15:04:05"))
+				}
+			}
+			v = strings.Replace(v, "\n", " ", -1)
+			if r := []rune(v); len(r) > 80 {
+				v = string(r[:80]) + "..."
+			}
+			fmt.Printf("  %-20s %s\n", k, v)
+		}
+	}
+
+	if info.Service == "nico" {
+		if info.Chunks+info.NotFound == 0 {
+			fmt.Println("SeqNo:     (no media)")
+		} else {
+			fmt.Printf("SeqNo:     %d - %d (%d chunks)\n", info.FirstSeq, info.LastSeq, info.Chunks)
+		}
+		fmt.Printf("Missing:   %d\n", info.Missing)
+		fmt.Printf("NotFound:  %d\n", info.NotFound)
+		for _, g := range info.Gaps {
+			if g.From == g.To {
+				fmt.Printf("  %-8s %d\n", g.Kind, g.From)
+			} else {
+				fmt.Printf("  %-8s %d - %d (%d)\n", g.Kind, g.From, g.To, g.To-g.From+1)
+			}
+		}
+		fmt.Println("Bandwidth:")
+		for _, b := range info.Bandwidth {
+			fmt.Printf("  %s SeqNo.%d %d\n", formatSec(b.Position), b.SeqNo, b.Bandwidth)
+		}
+		fmt.Printf("Duration:  %s (estimated)\n", formatSec(info.Duration))
+		fmt.Printf("Size:      %s (estimated)\n", formatBytes(info.Size))
+	}
+
+	c := info.Comments
+	if c.Count > 0 {
+		fmt.Printf("Comments:  %d (vpos %s - %s)\n", c.Count, formatSec(float64(c.FirstVpos)/100), formatSec(float64(c.LastVpos)/100))
+		fmt.Printf("           %s - %s\n",
+			time.Unix(c.FirstDate, 0).Format("2006/01/02 15:04:05"),
+			time.Unix(c.LastDate, 0).Format("2006/01/02 15:04:05"),
+		)
+	} else {
+		fmt.Println("Comments:  0")
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package zip2mp4
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/himananiito/livedl/files"
+	"github.com/himananiito/livedl/flvs"
+)
+
+// FLVをMP4(ext)に変換する
+// H.264/AACのMP4ならffmpegを使わない
+func ConvertFlv(fileName, ext string, stdout io.Writer) (outFiles []string, err error) {
+	if ext == "" || ext == "mp4" {
+		name, e := files.GetFileNameNext(files.ChangeExtention(fileName, "mp4"))
+		if e != nil {
+			err = e
+			return
+		}
+		err = flvs.ConvertMp4(fileName, name)
+		if err == nil {
+			fmt.Fprintf(stdout, "\nfinish: %s\n", name)
+			outFiles = append(outFiles, name)
+			return
+		}
+		os.Remove(name)
+		if err != flvs.ErrUnsupportedCodec {
+			return
+		}
+		fmt.Fprintf(stdout, "%v: use ffmpeg\n", err)
+		err = nil
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	zm := &ZipMp4{ZipName: fileName}
+	zm.OpenFFMpeg(ext)
+	zm.FFInput(f)
+	zm.CloseFFInput()
+	zm.Wait()
+	fmt.Fprintf(stdout, "\nfinish: %s\n", zm.Mp4NameOpened)
+
+	outFiles = zm.mp4List
+	return
+}
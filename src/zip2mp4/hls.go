@@ -0,0 +1,69 @@
+package zip2mp4
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+type hlsSegment struct {
+	name          string
+	pos           time.Duration
+	duration      time.Duration
+	discontinuity bool // 直前のチャンクから飛んでいる、またはBANDWIDTHが変わった
+}
+
+// VODのプレイリストを書き出す
+func writeVodPlaylist(fileName string, segments []hlsSegment) (err error) {
+	// 長さの分からないチャンクは平均にする
+	var total time.Duration
+	var known int
+	for _, s := range segments {
+		if s.duration > 0 {
+			total += s.duration
+			known++
+		}
+	}
+	fallback := time.Second
+	if known > 0 {
+		fallback = total / time.Duration(known)
+	}
+
+	var target float64
+	var body strings.Builder
+	for _, s := range segments {
+		d := s.duration
+		if d <= 0 {
+			d = fallback
+		}
+		if t := math.Ceil(d.Seconds()); t > target {
+			target = t
+		}
+		if s.discontinuity {
+			body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&body, "#EXTINF:%.3f,\n%s\n", d.Seconds(), s.name)
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "#EXTM3U\n")
+	fmt.Fprintf(f, "#EXT-X-VERSION:3\n")
+	fmt.Fprintf(f, "#EXT-X-TARGETDURATION:%.f\n", target)
+	fmt.Fprintf(f, "#EXT-X-MEDIA-SEQUENCE:0\n")
+	fmt.Fprintf(f, "#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprint(f, body.String())
+	_, err = fmt.Fprintf(f, "#EXT-X-ENDLIST\n")
+	return
+}
+
+// 録画済みのdbをHLS(index.m3u8と各々のチャンク)としてdirに書き出す
+func ConvertDBToHls(fileName, dir string, skipHb bool) (done bool, err error) {
+	return extractChunks(fileName, dir, skipHb, true, os.Stdout)
+}
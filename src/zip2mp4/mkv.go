@@ -0,0 +1,355 @@
+package zip2mp4
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/himananiito/livedl/mp42ts"
+	"github.com/himananiito/livedl/niconico"
+)
+
+// -conv-ext=mkv
+// チャンクの欠落やBANDWIDTHの変更でファイルを分けずに1つのMatroskaにする
+// 飛んだ所はタイムスタンプを詰めて続けて、チャプターを入れる
+
+type Chapter struct {
+	Start time.Duration
+	Title string
+}
+
+// チャンクごとの書き出し方
+type mkvChunk struct {
+	part   int
+	offset int64 // PTS, DTS, PCRに足す値(90kHz)
+}
+
+// 連続している区間の先頭。元の再生位置と詰めた後の再生位置
+type mkvSegment struct {
+	origPos time.Duration
+	newPos  time.Duration
+}
+
+// 出力するファイル。位置は詰めた後の再生位置
+type mkvPart struct {
+	start    time.Duration
+	end      time.Duration
+	chapters []Chapter
+}
+
+type mkvPlan struct {
+	chunks   map[int64]mkvChunk
+	segments []mkvSegment
+	parts    []mkvPart
+	endPos   time.Duration // 範囲の終了(元の再生位置)
+	hasEnd   bool          // 範囲の終了で止めた
+}
+
+// 先頭の音声が映像より前にあっても負にならないようにする
+const mkvBasePts = 10 * 90000
+
+const ptsMask = 1<<33 - 1
+
+func durationToPts(d time.Duration) int64 {
+	return int64(d / (time.Second / 90000))
+}
+
+// チャンクの先頭部分を読んで、詰めた後の再生位置と分割を決める
+// 元の再生位置は番組の開始から(programOffset)で、コメントのvposやRangeと比べる
+func planMkv(db *sql.DB, split Split, rng Range) (plan mkvPlan, err error) {
+	offset, err := programOffset(db)
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT
+		seqno, bandwidth, IFNULL(size, length(data)), substr(data, 1, %d) FROM media
+		WHERE IFNULL(notfound, 0) == 0 AND data IS NOT NULL
+		ORDER BY seqno`, infoHeadSize))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	plan.chunks = map[int64]mkvChunk{}
+
+	var clock tsClock
+	lastSeqNo := int64(-1)
+	prevIndex := int64(-1)
+	prevBw := -1
+
+	// 区間の先頭のPTSと詰めた後の再生位置
+	var segPts int64
+	var segHasPts bool
+	var segStart time.Duration
+
+	var newPos, prevNewPos, lastDur time.Duration
+	var partSize int64
+	for rows.Next() {
+		var seqno int64
+		var bw int
+		var size int64
+		var head []byte
+		if err = rows.Scan(&seqno, &bw, &size, &head); err != nil {
+			return
+		}
+
+		var skip int64
+		if lastSeqNo >= 0 && seqno > lastSeqNo+1 {
+			skip = seqno - lastSeqNo - 1
+		}
+		lastSeqNo = seqno
+		pos := clock.next(head, skip) + offset
+
+		if rng.past(seqno, pos) {
+			plan.endPos = pos
+			plan.hasEnd = true
+			break
+		}
+		if !rng.includes(seqno, pos, clock.prevDur) {
+			continue
+		}
+
+		pts, hasPts := mp42ts.FirstPts(head)
+		first := len(plan.segments) == 0
+		disc := !first && (seqno != prevIndex+1 || bw != prevBw)
+
+		if first || disc {
+			if !first {
+				d := lastDur
+				if d <= 0 {
+					d = clock.prevDur
+				}
+				segStart = prevNewPos + d
+			}
+			segPts = pts
+			segHasPts = hasPts
+			newPos = segStart
+			plan.segments = append(plan.segments, mkvSegment{origPos: pos, newPos: newPos})
+
+		} else {
+			if hasPts && segHasPts {
+				newPos = segStart + time.Duration((pts-segPts)&ptsMask)*time.Second/90000
+			} else {
+				newPos = prevNewPos + lastDur
+			}
+			if newPos > prevNewPos {
+				lastDur = newPos - prevNewPos
+			}
+		}
+
+		if first {
+			plan.parts = append(plan.parts, mkvPart{start: newPos})
+		} else if partSize > 0 && ((split.Duration > 0 && newPos-plan.parts[len(plan.parts)-1].start >= split.Duration) ||
+			(split.Size > 0 && partSize+size > split.Size)) {
+			plan.parts[len(plan.parts)-1].end = newPos
+			plan.parts = append(plan.parts, mkvPart{start: newPos})
+			partSize = 0
+		}
+		part := &plan.parts[len(plan.parts)-1]
+		if len(part.chapters) == 0 || disc {
+			part.chapters = append(part.chapters, Chapter{
+				Start: newPos - part.start,
+				Title: fmt.Sprintf("SeqNo.%d", seqno),
+			})
+		}
+
+		var offset int64
+		if segHasPts {
+			offset = (mkvBasePts + durationToPts(segStart) - segPts) & ptsMask
+		}
+		plan.chunks[seqno] = mkvChunk{part: len(plan.parts) - 1, offset: offset}
+
+		partSize += size
+		prevNewPos = newPos
+		prevIndex = seqno
+		prevBw = bw
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(plan.parts) > 0 {
+		d := lastDur
+		if d <= 0 {
+			d = clock.prevDur
+		}
+		plan.parts[len(plan.parts)-1].end = prevNewPos + d
+	}
+	return
+}
+
+// コメントのvposを詰めた後の再生位置にして、partの先頭からの位置にする
+func (plan *mkvPlan) mapVpos(part int, vpos int64) (int64, bool) {
+	t := time.Duration(vpos) * 10 * time.Millisecond
+	if plan.hasEnd && t >= plan.endPos {
+		return 0, false
+	}
+	i := sort.Search(len(plan.segments), func(i int) bool { return plan.segments[i].origPos > t }) - 1
+	if i < 0 {
+		return 0, false
+	}
+	seg := plan.segments[i]
+	newPos := seg.newPos + (t - seg.origPos)
+	// 飛んでいる間のコメントは次の区間の先頭にする
+	if i+1 < len(plan.segments) && newPos > plan.segments[i+1].newPos {
+		newPos = plan.segments[i+1].newPos
+	}
+
+	p := plan.parts[part]
+	if newPos < p.start || (part+1 < len(plan.parts) && newPos >= p.end) {
+		return 0, false
+	}
+	return int64((newPos - p.start) / (10 * time.Millisecond)), true
+}
+
+// ffmpegに渡すチャプター(FFMETADATA)
+func writeChapters(fileName string, chapters []Chapter, end time.Duration) (err error) {
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	for i, c := range chapters {
+		e := end
+		if i+1 < len(chapters) {
+			e = chapters[i+1].Start
+		}
+		fmt.Fprintf(&b, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			c.Start/time.Millisecond, e/time.Millisecond, c.Title)
+	}
+	return ioutil.WriteFile(fileName, []byte(b.String()), 0644)
+}
+
+func (z *ZipMp4) OpenFFMpegChapters(ext string, chapters []Chapter, end time.Duration) (err error) {
+	z.Wait()
+
+	f, err := ioutil.TempFile("", "livedl-chapters-*.txt")
+	if err != nil {
+		return
+	}
+	f.Close()
+	z.tmpFiles = append(z.tmpFiles, f.Name())
+	if err = writeChapters(f.Name(), chapters, end); err != nil {
+		return
+	}
+
+	z.openFFMpeg(ext,
+		"-f", "mpegts", "-i", "-",
+		"-f", "ffmetadata", "-i", f.Name(),
+		"-map", "0",
+		"-map_chapters", "1",
+	)
+	return
+}
+
+// MPEG-TSのPTS, DTS, PCRにoffsetを足す
+func tsShift(data []byte, offset int64) {
+	for i := 0; i+188 <= len(data); i += 188 {
+		pkt := data[i : i+188]
+		if pkt[0] != 0x47 {
+			return
+		}
+		p := 4
+		if pkt[3]&0x20 != 0 {
+			afLen := int(pkt[4])
+			// PCR_flag
+			if afLen >= 7 && pkt[5]&0x10 != 0 {
+				pcr := int64(pkt[6])<<25 | int64(pkt[7])<<17 | int64(pkt[8])<<9 | int64(pkt[9])<<1 | int64(pkt[10])>>7
+				pcr = (pcr + offset) & ptsMask
+				pkt[6] = byte(pcr >> 25)
+				pkt[7] = byte(pcr >> 17)
+				pkt[8] = byte(pcr >> 9)
+				pkt[9] = byte(pcr >> 1)
+				pkt[10] = pkt[10]&0x7f | byte(pcr<<7)
+			}
+			p += 1 + afLen
+		}
+		if pkt[1]&0x40 == 0 || pkt[3]&0x10 == 0 || p+19 > len(pkt) {
+			continue
+		}
+		pes := pkt[p:]
+		if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+			continue
+		}
+		if !(pes[3] == 0xbd || (0xc0 <= pes[3] && pes[3] <= 0xef)) {
+			continue
+		}
+		flags := pes[7] & 0xc0
+		if flags&0x80 != 0 {
+			shiftTimestamp(pes[9:14], offset)
+		}
+		if flags == 0xc0 {
+			shiftTimestamp(pes[14:19], offset)
+		}
+	}
+}
+
+func shiftTimestamp(b []byte, offset int64) {
+	t := int64(b[0]&0x0e)<<29 | int64(b[1])<<22 | int64(b[2]&0xfe)<<14 | int64(b[3])<<7 | int64(b[4])>>1
+	t = (t + offset) & ptsMask
+	b[0] = b[0]&0xf1 | byte(t>>29)&0x0e
+	b[1] = byte(t >> 22)
+	b[2] = byte(t>>14) | 0x01
+	b[3] = byte(t >> 7)
+	b[4] = byte(t<<1) | 0x01
+}
+
+// -conv-ext=mkvのConvertDB。brokenはチャンクの欠落やBANDWIDTHの変更があった場合
+func convertDBMkv(db *sql.DB, outName string, skipHb bool, split Split, rng Range) (broken bool, outFiles []string, err error) {
+	plan, err := planMkv(db, split, rng)
+	if err != nil {
+		return
+	}
+	if len(plan.parts) == 0 {
+		err = fmt.Errorf("no chunks to convert")
+		return
+	}
+	broken = len(plan.segments) > 1
+
+	zm := &ZipMp4{ZipName: outName}
+	defer zm.Wait()
+
+	rows, err := db.Query(niconico.SelMedia)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	part := -1
+	for rows.Next() {
+		var seqno int64
+		var bw int
+		var size int
+		var data []byte
+		if err = rows.Scan(&seqno, &bw, &size, &data); err != nil {
+			return
+		}
+		c, ok := plan.chunks[seqno]
+		if !ok {
+			continue
+		}
+		if c.part != part {
+			part = c.part
+			p := plan.parts[part]
+			if err = zm.OpenFFMpegChapters("mkv", p.chapters, p.end-p.start); err != nil {
+				return
+			}
+		}
+		tsShift(data, c.offset)
+		zm.FFInput(bytes.NewBuffer(data))
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	zm.Wait()
+
+	for i, name := range zm.mp4List {
+		i := i
+		niconico.WriteCommentMap(db, name, skipHb, func(vpos int64) (int64, bool) {
+			return plan.mapVpos(i, vpos)
+		})
+	}
+	outFiles = zm.mp4List
+	return
+}
@@ -0,0 +1,38 @@
+package zip2mp4
+
+import (
+	"testing"
+	"time"
+)
+
+// 途中から録画した生放送のコメントは、番組の開始からのvposを動画の先頭からにする
+func TestMkvMapVpos(t *testing.T) {
+	// 1時間後から2秒のチャンク。seqno 13が欠落していて、その間は詰める
+	db := testDB(t, []int64{10, 11, 12, 14}, map[int64]float64{10: 3600})
+	for _, tc := range []struct {
+		name string
+		rng  Range
+		vpos []int64 // 1/100秒
+		want []int64 // -1は書き出さない
+	}{
+		{"all", Range{}, []int64{359900, 360000, 360150, 360550, 360650, 360850}, []int64{-1, 0, 150, 550, 600, 650}},
+		{"from", Range{From: 3602 * time.Second}, []int64{360100, 360200, 360650}, []int64{-1, 0, 400}},
+		{"to", Range{To: 3604 * time.Second}, []int64{360100, 360350, 360400}, []int64{100, 350, -1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plan, err := planMkv(db, Split{}, tc.rng)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, vpos := range tc.vpos {
+				got, ok := plan.mapVpos(0, vpos)
+				if !ok {
+					got = -1
+				}
+				if got != tc.want[i] {
+					t.Errorf("vpos %d: %d, want %d", vpos, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package zip2mp4
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/himananiito/livedl/mp42ts"
+)
+
+// 出力ファイルの分割(-split-duration, -split-size)
+type Split struct {
+	Duration time.Duration // 0で無効
+	Size     int64         // 0で無効
+}
+
+func (s Split) Enabled() bool {
+	return s.Duration > 0 || s.Size > 0
+}
+
+// 書き出す範囲(-from, -to)。位置は番組の開始からの再生時間(programOffsetを足したもの)
+type Range struct {
+	From      time.Duration // 0で先頭から
+	To        time.Duration // 0で最後まで
+	FromSeqNo int64         // 0で無効
+	ToSeqNo   int64         // 0で無効
+}
+
+func (r Range) Enabled() bool {
+	return r.From > 0 || r.To > 0 || r.FromSeqNo > 0 || r.ToSeqNo > 0
+}
+
+// 範囲に入るチャンクか。Fromを含むチャンクから書き出す
+func (r Range) includes(seqno int64, pos, dur time.Duration) bool {
+	if r.FromSeqNo > 0 && seqno < r.FromSeqNo {
+		return false
+	}
+	if r.From > 0 && pos+dur <= r.From {
+		return false
+	}
+	return !r.past(seqno, pos)
+}
+
+// 範囲を過ぎたか
+func (r Range) past(seqno int64, pos time.Duration) bool {
+	return (r.ToSeqNo > 0 && seqno > r.ToSeqNo) || (r.To > 0 && pos >= r.To)
+}
+
+// tsClockの位置(先頭のチャンクが0)を番組の位置(コメントのvposと同じ基準)にするための差
+// media.positionが記録された最初のチャンクから求める。
+// 生放送はkvsのlivePosition(livePtsのチャンクの位置)から求める。どちらも無いdbは0
+func programOffset(db *sql.DB) (offset time.Duration, err error) {
+	var seqNo int64
+	var position float64
+	err = db.QueryRow(`SELECT seqno, position FROM media
+		WHERE position IS NOT NULL AND IFNULL(notfound, 0) == 0 AND data IS NOT NULL
+		ORDER BY seqno LIMIT 1`).Scan(&seqNo, &position)
+	if err == sql.ErrNoRows {
+		return liveOffset(db)
+	}
+	if err != nil {
+		return
+	}
+
+	// そのチャンクまでの再生位置
+	rows, err := db.Query(fmt.Sprintf(`SELECT seqno, substr(data, 1, %d) FROM media
+		WHERE IFNULL(notfound, 0) == 0 AND data IS NOT NULL AND seqno <= ?
+		ORDER BY seqno`, infoHeadSize), seqNo)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var clock tsClock
+	var pos time.Duration
+	lastSeqNo := int64(-1)
+	for rows.Next() {
+		var seqno int64
+		var head []byte
+		if err = rows.Scan(&seqno, &head); err != nil {
+			return
+		}
+		var skip int64
+		if lastSeqNo >= 0 && seqno > lastSeqNo+1 {
+			skip = seqno - lastSeqNo - 1
+		}
+		lastSeqNo = seqno
+		pos = clock.next(head, skip)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	offset = time.Duration(position*float64(time.Second)) - pos
+	return
+}
+
+// 生放送のdbのprogramOffset。先頭のチャンクのPTSとlivePtsの差から求める
+func liveOffset(db *sql.DB) (offset time.Duration, err error) {
+	var position float64
+	var livePts int64
+	err = db.QueryRow(`SELECT
+		(SELECT v FROM kvs WHERE k = "livePosition"),
+		(SELECT v FROM kvs WHERE k = "livePts")`).Scan(&position, &livePts)
+	if err != nil {
+		// 記録が無い
+		err = nil
+		return
+	}
+
+	var head []byte
+	err = db.QueryRow(fmt.Sprintf(`SELECT substr(data, 1, %d) FROM media
+		WHERE IFNULL(notfound, 0) == 0 AND data IS NOT NULL
+		ORDER BY seqno LIMIT 1`, infoHeadSize)).Scan(&head)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	pts, ok := mp42ts.FirstPts(head)
+	if !ok {
+		return
+	}
+
+	// 33bitで一周するので差を符号付きにする
+	diff := (pts - livePts) & (1<<33 - 1)
+	if diff >= 1<<32 {
+		diff -= 1 << 33
+	}
+	offset = time.Duration(position*float64(time.Second)) + time.Duration(diff)*time.Second/90000
+	return
+}
+
+// チャンクの先頭のPTSから再生位置を求める
+type tsClock struct {
+	prevPts  int64
+	prevDur  time.Duration
+	started  bool
+	position time.Duration
+}
+
+// チャンクの先頭の再生位置。skipは飛んだチャンクの数
+func (c *tsClock) next(data []byte, skip int64) time.Duration {
+	pts, ok := mp42ts.FirstPts(data)
+	if !ok {
+		if c.started {
+			c.position += c.prevDur * time.Duration(1+skip)
+		}
+		return c.position
+	}
+	if !c.started {
+		c.started = true
+		c.prevPts = pts
+		return c.position
+	}
+
+	// 33bitで一周する
+	diff := (pts - c.prevPts) & (1<<33 - 1)
+	d := time.Duration(diff) * time.Second / 90000
+	if 0 < d && d < time.Minute*time.Duration(1+skip) {
+		if skip == 0 {
+			c.prevDur = d
+		}
+	} else {
+		// 不連続な場合は直前のチャンクの長さから推定する
+		d = c.prevDur * time.Duration(1+skip)
+	}
+	c.prevPts = pts
+	c.position += d
+	return c.position
+}
@@ -0,0 +1,93 @@
+package zip2mp4
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 映像のPESの先頭だけのMPEG-TSパケット
+func tsPacket(pts int64) []byte {
+	pkt := make([]byte, 188)
+	pkt[0] = 0x47
+	pkt[1] = 0x41 // payload_unit_start_indicator, PID 0x100
+	pkt[3] = 0x10
+	pes := pkt[4:]
+	pes[2] = 1
+	pes[3] = 0xe0
+	pes[7] = 0x80
+	pes[8] = 5
+	pes[9] = 0x21 | byte(pts>>29)&0x0e
+	pes[10] = byte(pts >> 22)
+	pes[11] = byte(pts>>14) | 0x01
+	pes[12] = byte(pts >> 7)
+	pes[13] = byte(pts<<1) | 0x01
+	return pkt
+}
+
+// 2秒のチャンクをseqnoの分だけ作る。positionsはseqnoごとのmedia.position
+func testDB(t *testing.T, seqnos []int64, positions map[int64]float64) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE media (
+		seqno INTEGER PRIMARY KEY, position REAL, notfound INTEGER, bandwidth INTEGER, size INTEGER, data BLOB);
+		CREATE TABLE kvs (k TEXT PRIMARY KEY, v BLOB)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, seqno := range seqnos {
+		data := tsPacket(90000 + seqno*2*90000)
+		var position interface{}
+		if p, ok := positions[seqno]; ok {
+			position = p
+		}
+		if _, err := db.Exec(`INSERT INTO media (seqno, bandwidth, size, data, position) VALUES (?, 1, ?, ?, ?)`,
+			seqno, len(data), data, position); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestProgramOffset(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		seqnos    []int64
+		positions map[int64]float64
+		kvs       map[string]interface{}
+		want      time.Duration
+	}{
+		{"none", []int64{0, 1, 2}, nil, nil, 0},
+		{"timeshift", []int64{10, 11, 12}, map[int64]float64{10: 3600, 11: 3602, 12: 3604}, nil, 3600 * time.Second},
+		// 先頭のチャンクに位置が無いタイムシフト
+		{"timeshift from middle", []int64{5, 6, 7, 8}, map[int64]float64{7: 120}, nil, 116 * time.Second},
+		// 飛んだチャンクもPTSから数える
+		{"skipped", []int64{0, 1, 4, 5}, map[int64]float64{5: 70}, nil, 60 * time.Second},
+		// 途中から録画した生放送。seqno 11のチャンクが1時間後の位置
+		{"live", []int64{10, 11, 12}, nil,
+			map[string]interface{}{"livePosition": 3602.0, "livePts": 90000 + 11*2*90000}, 3600 * time.Second},
+		// 基準のPTSが一周する前
+		{"live wrapped", []int64{10, 11, 12}, nil,
+			map[string]interface{}{"livePosition": 3598.0, "livePts": 1<<33 - 90000}, 3620 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := testDB(t, tc.seqnos, tc.positions)
+			for k, v := range tc.kvs {
+				if _, err := db.Exec(`INSERT INTO kvs (k, v) VALUES (?, ?)`, k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			offset, err := programOffset(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != tc.want {
+				t.Errorf("offset %v, want %v", offset, tc.want)
+			}
+		})
+	}
+}
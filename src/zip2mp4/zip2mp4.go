@@ -1,575 +1,655 @@
-package zip2mp4
-
-import (
-	"archive/zip"
-	"bytes"
-	"database/sql"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"os"
-	"os/exec"
-	"regexp"
-	"sort"
-	"strconv"
-	"time"
-
-	"github.com/himananiito/livedl/files"
-	"github.com/himananiito/livedl/log4gui"
-	"github.com/himananiito/livedl/niconico"
-	"github.com/himananiito/livedl/procs/ffmpeg"
-	"github.com/himananiito/livedl/youtube"
-	_ "github.com/mattn/go-sqlite3"
-)
-
-type ZipMp4 struct {
-	ZipName       string
-	Mp4NameOpened string
-	mp4List       []string
-
-	FFMpeg  *exec.Cmd
-	FFStdin io.WriteCloser
-}
-
-var cmdListFF = []string{
-	"./bin/ffmpeg/ffmpeg",
-	"./bin/ffmpeg",
-	"./ffmpeg/ffmpeg",
-	"./ffmpeg",
-	"ffmpeg",
-}
-var cmdListMP42TS = []string{
-	"./bin/bento4/bin/mp42ts",
-	"./bento4/bin/mp42ts",
-	"./bento4/mp42ts",
-	"./bin/bento4/mp42ts",
-	"./bin/mp42ts",
-	"./mp42ts",
-	"mp42ts",
-}
-
-// return cmd = nil if cmd not exists
-func openProg(cmdList *[]string, stdinEn, stdoutEn, stdErrEn, consoleEn bool, args []string) (cmd *exec.Cmd, stdin io.WriteCloser, stdout, stderr io.ReadCloser) {
-
-	for i, cmdName := range *cmdList {
-		cmd = exec.Command(cmdName, args...)
-
-		var err error
-		if stdinEn {
-			stdin, err = cmd.StdinPipe()
-			if err != nil {
-				log.Fatalln(err)
-			}
-		}
-
-		if stdoutEn {
-			stdout, err = cmd.StdoutPipe()
-			if err != nil {
-				log.Fatalln(err)
-			}
-		} else {
-			if consoleEn {
-				cmd.Stdout = os.Stdout
-			}
-		}
-
-		if stdErrEn {
-			stderr, err = cmd.StderrPipe()
-			if err != nil {
-				log.Fatalln(err)
-			}
-		} else {
-			if consoleEn {
-				cmd.Stderr = os.Stderr
-			}
-		}
-
-		if err = cmd.Start(); err != nil {
-			continue
-		} else {
-			if i != 0 {
-				*cmdList = []string{cmdName}
-			}
-			//fmt.Printf("CMD: %#v\n", cmd.Args)
-			return
-		}
-	}
-	cmd = nil
-	return
-}
-func MergeVA(vFileName, aFileName, oFileName string) bool {
-	cmd, _, _, _ := openProg(&cmdListFF, false, false, false, true, []string{
-		"-i", vFileName,
-		"-i", aFileName,
-		"-c", "copy",
-		"-y",
-		oFileName,
-	})
-	if cmd == nil {
-		return false
-	}
-	if err := cmd.Wait(); err != nil {
-		fmt.Println(err)
-		return false
-	}
-	return true
-}
-func FFmpegExists() bool {
-	cmd, _, _, _ := openProg(&cmdListFF, false, false, false, false, []string{"-version"})
-	if cmd == nil {
-		return false
-	}
-	cmd.Wait()
-	return true
-}
-func GetFormat(fileName string) (vFormat, aFormat string) {
-	cmd, _, stdout, stderr := openProg(&cmdListFF, false, true, true, false, []string{"-i", fileName})
-	if cmd == nil {
-		return
-	}
-	b1, _ := ioutil.ReadAll(stdout)
-	b2, _ := ioutil.ReadAll(stderr)
-	cmd.Wait()
-
-	s := string(b1) + string(b2)
-	if ma := regexp.MustCompile(`(?i)Stream\s+#.+?:\s+Video:\s+(.*?),`).FindStringSubmatch(s); len(ma) > 0 {
-		vFormat = ma[1]
-	}
-	if ma := regexp.MustCompile(`(?i)Stream\s+#.+?:\s+Audio:\s+(.*?),`).FindStringSubmatch(s); len(ma) > 0 {
-		aFormat = ma[1]
-	}
-
-	return
-}
-func openFFMpeg(stdinEn, stdoutEn, stdErrEn, consoleEn bool, args []string) (cmd *exec.Cmd, stdin io.WriteCloser, stdout, stderr io.ReadCloser) {
-	return openProg(&cmdListFF, stdinEn, stdoutEn, stdErrEn, consoleEn, args)
-}
-func openMP42TS(consoleEn bool, args []string) (cmd *exec.Cmd) {
-	cmd, _, _, _ = openProg(&cmdListMP42TS, false, false, false, consoleEn, args)
-	return
-}
-func (z *ZipMp4) Wait() {
-
-	if z.FFStdin != nil {
-		z.FFStdin.Close()
-	}
-
-	if z.FFMpeg != nil {
-		if err := z.FFMpeg.Wait(); err != nil {
-			log.Fatalln(err)
-		}
-		z.FFMpeg = nil
-	}
-}
-func (z *ZipMp4) CloseFFInput() {
-	z.FFStdin.Close()
-}
-func (z *ZipMp4) OpenFFMpeg(ext string) {
-	//
-	z.Wait()
-
-	if ext == "" {
-		ext = "mp4"
-	}
-	name := files.ChangeExtention(z.ZipName, ext)
-	name, err := files.GetFileNameNext(name)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	z.Mp4NameOpened = name
-	z.mp4List = append(z.mp4List, name)
-
-	cmd, stdin, err := ffmpeg.Open(
-		"-i", "-",
-		"-c", "copy",
-		//"-movflags", "faststart", // test
-		"-y",
-		name,
-	)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	z.FFMpeg = cmd
-	z.FFStdin = stdin
-}
-
-func (z *ZipMp4) FFInputCombFromFile(videoFile, audioFile string) {
-
-	vTs := fmt.Sprintf("%s.ts", videoFile)
-	cmdV := openMP42TS(false, []string{
-		videoFile,
-		vTs,
-	})
-	if cmdV == nil {
-		fmt.Println("mp42ts not found OR command failed")
-		os.Exit(1)
-	}
-	defer os.Remove(vTs)
-
-	aTs := fmt.Sprintf("%s.ts", audioFile)
-	cmdA := openMP42TS(false, []string{
-		audioFile,
-		aTs,
-	})
-	if cmdA == nil {
-		fmt.Println("mp42ts not found OR command failed")
-		os.Exit(1)
-	}
-	defer os.Remove(aTs)
-
-	if err := cmdV.Wait(); err != nil {
-		log.Fatalln(err)
-	}
-	if err := cmdA.Wait(); err != nil {
-		log.Fatalln(err)
-	}
-
-	cmd, _, stdout, _ := openFFMpeg(false, true, false, false, []string{
-		"-i", vTs,
-		"-i", aTs,
-		"-c", "copy",
-		"-f", "mpegts",
-		"-",
-	})
-	if cmd == nil {
-		log.Fatalln("ffmpeg not installed")
-	}
-
-	z.FFInput(stdout)
-
-	if err := cmd.Wait(); err != nil {
-		log.Fatalln(err)
-	}
-}
-func (z *ZipMp4) FFInput(rdr io.Reader) {
-	if _, err := io.Copy(z.FFStdin, rdr); err != nil {
-		log.Fatalln(err)
-	}
-}
-
-type Index struct {
-	int
-}
-type Chunk struct {
-	VideoIndex *Index
-	AudioIndex *Index
-	VAIndex    *Index
-}
-
-func Convert(fileName string) (err error) {
-	zr, err := zip.OpenReader(fileName)
-	if err != nil {
-		return
-	}
-
-	chunks := make(map[int64]Chunk)
-
-	for i, r := range zr.File {
-		//fmt.Printf("X %v %v\n", i, r.Name)
-
-		if ma := regexp.MustCompile(`\Avideo-(\d+)\.\w+\z`).FindStringSubmatch(r.Name); len(ma) > 0 {
-			num, err := strconv.ParseInt(string(ma[1]), 10, 64)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if v, ok := chunks[num]; ok {
-				v.VideoIndex = &Index{i}
-				chunks[num] = v
-			} else {
-				chunks[num] = Chunk{VideoIndex: &Index{i}}
-			}
-
-			//fmt.Printf("V %v %v\n", i, r.Name)
-		} else if ma := regexp.MustCompile(`\Aaudio-(\d+)\.\w+\z`).FindStringSubmatch(r.Name); len(ma) > 0 {
-			num, err := strconv.ParseInt(string(ma[1]), 10, 64)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if v, ok := chunks[num]; ok {
-				v.AudioIndex = &Index{i}
-				chunks[num] = v
-			} else {
-				chunks[num] = Chunk{AudioIndex: &Index{i}}
-			}
-			//fmt.Printf("A %v %v\n", num, r.Name)
-		} else if ma := regexp.MustCompile(`\A(\d+)\.\w+\z`).FindStringSubmatch(r.Name); len(ma) > 0 {
-			num, err := strconv.ParseInt(string(ma[1]), 10, 64)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if v, ok := chunks[num]; ok {
-				v.VAIndex = &Index{i}
-				chunks[num] = v
-			} else {
-				chunks[num] = Chunk{VAIndex: &Index{i}}
-			}
-			//fmt.Printf("V+A %v %v\n", num, r.Name)
-		} else {
-			fmt.Printf("%v %v\n", i, r.Name)
-			log4gui.Info(fmt.Sprintf("Unsupported zip: %s", fileName))
-			os.Exit(1)
-		}
-	}
-
-	keys := make([]int64, 0, len(chunks))
-	for k := range chunks {
-		keys = append(keys, k)
-	}
-
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-
-	var tmpVideoName string
-	var tmpAudioName string
-
-	var zm *ZipMp4
-	defer func() {
-		if zm != nil {
-			zm.CloseFFInput()
-			zm.Wait()
-		}
-	}()
-
-	zm = &ZipMp4{ZipName: fileName}
-	zm.OpenFFMpeg("mp4")
-
-	prevIndex := int64(-1)
-	for _, key := range keys {
-		if prevIndex >= 0 {
-			if key != prevIndex+1 {
-				// [FIXME] reopen new mp4file?
-				//return fmt.Errorf("\n\nError: seq skipped: %d --> %d\n\n", prevIndex, key)
-
-				fmt.Printf("\nSeqNo. skipped: %d --> %d\n", prevIndex, key)
-				if zm != nil {
-					zm.CloseFFInput()
-					zm.Wait()
-				}
-				zm = &ZipMp4{ZipName: fileName}
-				zm.OpenFFMpeg("mp4")
-			}
-		}
-		prevIndex = key
-
-		if chunks[key].VAIndex != nil {
-			r, e := zr.File[chunks[key].VAIndex.int].Open()
-			if e != nil {
-				log.Fatalln(e)
-			}
-			zm.FFInput(r)
-			r.Close()
-
-		} else if chunks[key].VideoIndex != nil && chunks[key].AudioIndex != nil {
-
-			if tmpVideoName == "" {
-				f, e := ioutil.TempFile(".", "__temp-")
-				if e != nil {
-					log.Fatalln(e)
-				}
-				f.Close()
-				tmpVideoName = f.Name()
-			}
-			if tmpAudioName == "" {
-				f, e := ioutil.TempFile(".", "__temp-")
-				if e != nil {
-					log.Fatalln(e)
-				}
-				f.Close()
-				tmpAudioName = f.Name()
-			}
-
-			// open temporary file
-			tmpVideo, err := os.Create(tmpVideoName)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			tmpAudio, err := os.Create(tmpAudioName)
-			if err != nil {
-				log.Fatalln(err)
-			}
-
-			// copy Video to file
-			rv, e := zr.File[chunks[key].VideoIndex.int].Open()
-			if e != nil {
-				log.Fatalln(e)
-			}
-			if _, e := io.Copy(tmpVideo, rv); e != nil {
-				log.Fatalln(e)
-			}
-			rv.Close()
-			tmpVideo.Close()
-
-			// copy Audio to file
-			ra, e := zr.File[chunks[key].AudioIndex.int].Open()
-			if e != nil {
-				log.Fatalln(e)
-			}
-			if _, e := io.Copy(tmpAudio, ra); e != nil {
-				log.Fatalln(e)
-			}
-			ra.Close()
-			tmpAudio.Close()
-
-			// combine video + audio using ffmpeg(+mp42ts)
-			zm.FFInputCombFromFile(tmpVideoName, tmpAudioName)
-			os.Remove(tmpVideoName)
-			os.Remove(tmpAudioName)
-		} else {
-			if (chunks[key].VideoIndex == nil && chunks[key].AudioIndex != nil) ||
-				(chunks[key].VideoIndex != nil && chunks[key].AudioIndex == nil) {
-				fmt.Printf("\nIncomplete sequence. skipped: %d\n", key)
-				if zm != nil {
-					zm.CloseFFInput()
-					zm.Wait()
-				}
-				zm = &ZipMp4{ZipName: fileName}
-				zm.OpenFFMpeg("mp4")
-			}
-		}
-	}
-
-	zm.CloseFFInput()
-	zm.Wait()
-	fmt.Printf("\nfinish: %s\n", zm.Mp4NameOpened)
-
-	return
-}
-
-func ExtractChunks(fileName string, skipHb bool) (done bool, err error) {
-	db, err := sql.Open("sqlite3", fileName)
-	if err != nil {
-		return
-	}
-	defer db.Close()
-
-	niconico.WriteComment(db, fileName, skipHb)
-
-	rows, err := db.Query(niconico.SelMedia)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	dir := files.RemoveExtention(fileName)
-	if err = files.MkdirByFileName(dir + "/"); err != nil {
-		return
-	}
-	var printTime int64
-	for rows.Next() {
-		var seqno int64
-		var bw int
-		var size int
-		var data []byte
-		err = rows.Scan(&seqno, &bw, &size, &data)
-		if err != nil {
-			return
-		}
-		name := fmt.Sprintf("%s/%d.ts", dir, seqno)
-		// print
-		now := time.Now().Unix()
-		if now != printTime {
-			printTime = now
-			fmt.Println(name)
-		}
-
-		err = func() (e error) {
-			f, e := os.Create(name)
-			if e != nil {
-				return
-			}
-			defer f.Close()
-			_, e = f.Write(data)
-			return
-		}()
-		if err != nil {
-			return
-		}
-	}
-
-	done = true
-	return
-}
-
-func ConvertDB(fileName, ext string, skipHb bool) (done bool, nMp4s int, err error) {
-	db, err := sql.Open("sqlite3", fileName)
-	if err != nil {
-		return
-	}
-	defer db.Close()
-
-	niconico.WriteComment(db, fileName, skipHb)
-
-	var zm *ZipMp4
-	defer func() {
-		if zm != nil {
-			//zm.CloseFFInput()
-			zm.Wait()
-		}
-	}()
-
-	zm = &ZipMp4{ZipName: fileName}
-	zm.OpenFFMpeg(ext)
-
-	rows, err := db.Query(niconico.SelMedia)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	prevBw := -1
-	prevIndex := int64(-1)
-	for rows.Next() {
-		var seqno int64
-		var bw int
-		var size int
-		var data []byte
-		err = rows.Scan(&seqno, &bw, &size, &data)
-		if err != nil {
-			return
-		}
-
-		// チャンクが飛んでいる場合はファイルを分ける
-		// BANDWIDTHが変わる場合はファイルを分ける
-		if (prevIndex >= 0 && seqno != prevIndex+1) || (prevBw >= 0 && bw != prevBw) {
-			if bw != prevBw {
-				fmt.Printf("\nBandwitdh changed: %d --> %d\n\n", prevBw, bw)
-			} else {
-				fmt.Printf("\nSeqNo. skipped: %d --> %d\n\n", prevIndex, seqno)
-			}
-
-			//if zm != nil {
-			//	zm.CloseFFInput()
-			//	zm.Wait()
-			//}
-			zm.OpenFFMpeg(ext)
-		}
-		prevBw = bw
-		prevIndex = seqno
-
-		zm.FFInput(bytes.NewBuffer(data))
-	}
-
-	//zm.CloseFFInput()
-	zm.Wait()
-	fmt.Printf("\nfinish:\n")
-	for _, s := range zm.mp4List {
-		fmt.Println(s)
-	}
-	done = true
-	nMp4s = len(zm.mp4List)
-
-	return
-}
-
-func YtComment(fileName string) (done bool, err error) {
-	db, err := sql.Open("sqlite3", fileName)
-	if err != nil {
-		return
-	}
-	defer db.Close()
-
-	youtube.WriteComment(db, fileName)
-	return
-}
+package zip2mp4
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/himananiito/livedl/diskguard"
+	"github.com/himananiito/livedl/files"
+	"github.com/himananiito/livedl/log4gui"
+	"github.com/himananiito/livedl/mp42ts"
+	"github.com/himananiito/livedl/niconico"
+	"github.com/himananiito/livedl/outname"
+	"github.com/himananiito/livedl/procs/ffmpeg"
+	"github.com/himananiito/livedl/youtube"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type ZipMp4 struct {
+	ZipName       string
+	Mp4NameOpened string
+	mp4List       []string
+
+	FFMpeg  *exec.Cmd
+	FFStdin io.WriteCloser
+	ts      *mp42ts.Muxer // FFInputComb
+
+	tmpFiles []string // ffmpegの終了後に削除する
+}
+
+var cmdListFF = []string{
+	"./bin/ffmpeg/ffmpeg",
+	"./bin/ffmpeg",
+	"./ffmpeg/ffmpeg",
+	"./ffmpeg",
+	"ffmpeg",
+}
+
+// return cmd = nil if cmd not exists
+func openProg(cmdList *[]string, stdinEn, stdoutEn, stdErrEn, consoleEn bool, args []string) (cmd *exec.Cmd, stdin io.WriteCloser, stdout, stderr io.ReadCloser) {
+
+	for i, cmdName := range *cmdList {
+		cmd = exec.Command(cmdName, args...)
+
+		var err error
+		if stdinEn {
+			stdin, err = cmd.StdinPipe()
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		if stdoutEn {
+			stdout, err = cmd.StdoutPipe()
+			if err != nil {
+				log.Fatalln(err)
+			}
+		} else {
+			if consoleEn {
+				cmd.Stdout = os.Stdout
+			}
+		}
+
+		if stdErrEn {
+			stderr, err = cmd.StderrPipe()
+			if err != nil {
+				log.Fatalln(err)
+			}
+		} else {
+			if consoleEn {
+				cmd.Stderr = os.Stderr
+			}
+		}
+
+		if err = cmd.Start(); err != nil {
+			continue
+		} else {
+			if i != 0 {
+				*cmdList = []string{cmdName}
+			}
+			//fmt.Printf("CMD: %#v\n", cmd.Args)
+			return
+		}
+	}
+	cmd = nil
+	return
+}
+func MergeVA(vFileName, aFileName, oFileName string) bool {
+	cmd, _, _, _ := openProg(&cmdListFF, false, false, false, true, []string{
+		"-i", vFileName,
+		"-i", aFileName,
+		"-c", "copy",
+		"-y",
+		oFileName,
+	})
+	if cmd == nil {
+		return false
+	}
+	if err := cmd.Wait(); err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+func FFmpegExists() bool {
+	cmd, _, _, _ := openProg(&cmdListFF, false, false, false, false, []string{"-version"})
+	if cmd == nil {
+		return false
+	}
+	cmd.Wait()
+	return true
+}
+func GetFormat(fileName string) (vFormat, aFormat string) {
+	cmd, _, stdout, stderr := openProg(&cmdListFF, false, true, true, false, []string{"-i", fileName})
+	if cmd == nil {
+		return
+	}
+	b1, _ := ioutil.ReadAll(stdout)
+	b2, _ := ioutil.ReadAll(stderr)
+	cmd.Wait()
+
+	s := string(b1) + string(b2)
+	if ma := regexp.MustCompile(`(?i)Stream\s+#.+?:\s+Video:\s+(.*?),`).FindStringSubmatch(s); len(ma) > 0 {
+		vFormat = ma[1]
+	}
+	if ma := regexp.MustCompile(`(?i)Stream\s+#.+?:\s+Audio:\s+(.*?),`).FindStringSubmatch(s); len(ma) > 0 {
+		aFormat = ma[1]
+	}
+
+	return
+}
+func (z *ZipMp4) Wait() {
+
+	if z.FFStdin != nil {
+		z.FFStdin.Close()
+	}
+
+	if z.FFMpeg != nil {
+		if err := z.FFMpeg.Wait(); err != nil {
+			log.Fatalln(err)
+		}
+		z.FFMpeg = nil
+	}
+
+	for _, name := range z.tmpFiles {
+		os.Remove(name)
+	}
+	z.tmpFiles = nil
+}
+func (z *ZipMp4) CloseFFInput() {
+	z.FFStdin.Close()
+}
+func (z *ZipMp4) OpenFFMpeg(ext string) {
+	//
+	z.Wait()
+
+	z.openFFMpeg(ext, "-i", "-")
+}
+
+// inputsはffmpegの入力の指定
+func (z *ZipMp4) openFFMpeg(ext string, inputs ...string) {
+	if ext == "" {
+		ext = "mp4"
+	}
+	name := files.ChangeExtention(z.ZipName, ext)
+	name, err := files.GetFileNameNext(name)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	z.Mp4NameOpened = name
+	z.mp4List = append(z.mp4List, name)
+
+	args := append(inputs,
+		"-c", "copy",
+		//"-movflags", "faststart", // test
+		"-y",
+		name,
+	)
+	cmd, stdin, err := ffmpeg.Open(args...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	z.FFMpeg = cmd
+	z.FFStdin = stdin
+	z.ts = nil
+}
+
+// 映像と音声が別々のMP4をMPEG-TSにまとめて入力する
+func (z *ZipMp4) FFInputComb(video, audio []byte) {
+	if z.ts == nil {
+		z.ts = mp42ts.NewMuxer(z.FFStdin)
+	}
+	if err := z.ts.WriteMP4(video, audio); err != nil {
+		log.Fatalln(err)
+	}
+}
+func (z *ZipMp4) FFInput(rdr io.Reader) {
+	if _, err := io.Copy(z.FFStdin, rdr); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func readZipFile(f *zip.File) []byte {
+	r, err := f.Open()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return b
+}
+
+type Index struct {
+	int
+}
+type Chunk struct {
+	VideoIndex *Index
+	AudioIndex *Index
+	VAIndex    *Index
+}
+
+func Convert(fileName string, stdout io.Writer) (err error) {
+	zr, err := zip.OpenReader(fileName)
+	if err != nil {
+		return
+	}
+
+	chunks := make(map[int64]Chunk)
+
+	for i, r := range zr.File {
+		//fmt.Printf("X %v %v\n", i, r.Name)
+
+		if ma := regexp.MustCompile(`\Avideo-(\d+)\.\w+\z`).FindStringSubmatch(r.Name); len(ma) > 0 {
+			num, err := strconv.ParseInt(string(ma[1]), 10, 64)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if v, ok := chunks[num]; ok {
+				v.VideoIndex = &Index{i}
+				chunks[num] = v
+			} else {
+				chunks[num] = Chunk{VideoIndex: &Index{i}}
+			}
+
+			//fmt.Printf("V %v %v\n", i, r.Name)
+		} else if ma := regexp.MustCompile(`\Aaudio-(\d+)\.\w+\z`).FindStringSubmatch(r.Name); len(ma) > 0 {
+			num, err := strconv.ParseInt(string(ma[1]), 10, 64)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if v, ok := chunks[num]; ok {
+				v.AudioIndex = &Index{i}
+				chunks[num] = v
+			} else {
+				chunks[num] = Chunk{AudioIndex: &Index{i}}
+			}
+			//fmt.Printf("A %v %v\n", num, r.Name)
+		} else if ma := regexp.MustCompile(`\A(\d+)\.\w+\z`).FindStringSubmatch(r.Name); len(ma) > 0 {
+			num, err := strconv.ParseInt(string(ma[1]), 10, 64)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if v, ok := chunks[num]; ok {
+				v.VAIndex = &Index{i}
+				chunks[num] = v
+			} else {
+				chunks[num] = Chunk{VAIndex: &Index{i}}
+			}
+			//fmt.Printf("V+A %v %v\n", num, r.Name)
+		} else {
+			fmt.Fprintf(stdout, "%v %v\n", i, r.Name)
+			log4gui.Info(fmt.Sprintf("Unsupported zip: %s", fileName))
+			os.Exit(1)
+		}
+	}
+
+	keys := make([]int64, 0, len(chunks))
+	for k := range chunks {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var zm *ZipMp4
+	defer func() {
+		if zm != nil {
+			zm.CloseFFInput()
+			zm.Wait()
+		}
+	}()
+
+	zm = &ZipMp4{ZipName: fileName}
+	zm.OpenFFMpeg("mp4")
+
+	prevIndex := int64(-1)
+	for _, key := range keys {
+		if prevIndex >= 0 {
+			if key != prevIndex+1 {
+				// [FIXME] reopen new mp4file?
+				//return fmt.Errorf("\n\nError: seq skipped: %d --> %d\n\n", prevIndex, key)
+
+				fmt.Fprintf(stdout, "\nSeqNo. skipped: %d --> %d\n", prevIndex, key)
+				if zm != nil {
+					zm.CloseFFInput()
+					zm.Wait()
+				}
+				zm = &ZipMp4{ZipName: fileName}
+				zm.OpenFFMpeg("mp4")
+			}
+		}
+		prevIndex = key
+
+		if chunks[key].VAIndex != nil {
+			r, e := zr.File[chunks[key].VAIndex.int].Open()
+			if e != nil {
+				log.Fatalln(e)
+			}
+			zm.FFInput(r)
+			r.Close()
+
+		} else if chunks[key].VideoIndex != nil && chunks[key].AudioIndex != nil {
+
+			video := readZipFile(zr.File[chunks[key].VideoIndex.int])
+			audio := readZipFile(zr.File[chunks[key].AudioIndex.int])
+			zm.FFInputComb(video, audio)
+		} else {
+			if (chunks[key].VideoIndex == nil && chunks[key].AudioIndex != nil) ||
+				(chunks[key].VideoIndex != nil && chunks[key].AudioIndex == nil) {
+				fmt.Fprintf(stdout, "\nIncomplete sequence. skipped: %d\n", key)
+				if zm != nil {
+					zm.CloseFFInput()
+					zm.Wait()
+				}
+				zm = &ZipMp4{ZipName: fileName}
+				zm.OpenFFMpeg("mp4")
+			}
+		}
+	}
+
+	zm.CloseFFInput()
+	zm.Wait()
+	fmt.Fprintf(stdout, "\nfinish: %s\n", zm.Mp4NameOpened)
+
+	return
+}
+
+func ExtractChunks(fileName string, skipHb bool, stdout io.Writer) (done bool, err error) {
+	return extractChunks(fileName, files.RemoveExtention(fileName), skipHb, false, stdout)
+}
+
+// 各々のチャンクをdirに書き出す。playlistならindex.m3u8も書き出す(-d2hls)
+func extractChunks(fileName, dir string, skipHb, playlist bool, stdout io.Writer) (done bool, err error) {
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	if err = files.MkdirByFileName(dir + "/"); err != nil {
+		return
+	}
+
+	if playlist {
+		niconico.WriteComment(db, filepath.Join(dir, "index.xml"), skipHb)
+	} else {
+		niconico.WriteComment(db, fileName, skipHb)
+	}
+
+	rows, err := db.Query(niconico.SelMedia)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var segments []hlsSegment
+	var clock tsClock
+	prevBw := -1
+	prevIndex := int64(-1)
+	var printTime int64
+	for rows.Next() {
+		var seqno int64
+		var bw int
+		var size int
+		var data []byte
+		err = rows.Scan(&seqno, &bw, &size, &data)
+		if err != nil {
+			return
+		}
+		name := filepath.Join(dir, fmt.Sprintf("%d.ts", seqno))
+		// print
+		now := time.Now().Unix()
+		if now != printTime {
+			printTime = now
+			fmt.Fprintln(stdout, name)
+		}
+
+		err = func() (e error) {
+			f, e := os.Create(name)
+			if e != nil {
+				return
+			}
+			defer f.Close()
+			_, e = f.Write(data)
+			return
+		}()
+		if err != nil {
+			return
+		}
+
+		if playlist {
+			var skip int64
+			if prevIndex >= 0 && seqno > prevIndex+1 {
+				skip = seqno - prevIndex - 1
+			}
+			segments = append(segments, hlsSegment{
+				name:          fmt.Sprintf("%d.ts", seqno),
+				pos:           clock.next(data, skip),
+				discontinuity: (prevIndex >= 0 && seqno != prevIndex+1) || (prevBw >= 0 && bw != prevBw),
+			})
+			// 直前のチャンクの長さ
+			if n := len(segments); n >= 2 {
+				if segments[n-1].discontinuity {
+					segments[n-2].duration = clock.prevDur
+				} else {
+					segments[n-2].duration = segments[n-1].pos - segments[n-2].pos
+				}
+			}
+		}
+		prevBw = bw
+		prevIndex = seqno
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if playlist {
+		if n := len(segments); n > 0 {
+			segments[n-1].duration = clock.prevDur
+		}
+		name := filepath.Join(dir, "index.m3u8")
+		if err = writeVodPlaylist(name, segments); err != nil {
+			return
+		}
+		fmt.Fprintln(stdout, name)
+	}
+
+	done = true
+	return
+}
+
+// formatが指定されていれば、dbに保存された放送情報から出力ファイル名を作る
+// splitが指定されていれば、チャンクの境界で分割してコメントも分割したものごとに書き出す
+// rngが指定されていれば、その範囲のチャンクとコメントのみ書き出す
+// brokenはチャンクの欠落やBANDWIDTHの変更でファイルが分かれた場合
+func ConvertDB(fileName, ext, format string, skipHb bool, split Split, rng Range, stdout io.Writer) (done, broken bool, outFiles []string, err error) {
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	outName := outname.Rebase(fileName)
+	if format != "" {
+		vars, e := niconico.DBNameVars(db)
+		if e != nil {
+			err = e
+			return
+		}
+		outName = outname.Path(format, vars) + ".sqlite3"
+	}
+	files.MkdirByFileName(outName)
+
+	// 書き出す前に空き容量を確認する
+	if ok, free, _ := diskguard.Check(outName); !ok {
+		diskguard.Warn(outName, free)
+		name, ok := diskguard.Alternative(outName)
+		if !ok {
+			err = diskguard.ErrLowSpace
+			return
+		}
+		outName = name
+	}
+
+	if ext == "mkv" {
+		broken, outFiles, err = convertDBMkv(db, outName, skipHb, split, rng)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(stdout, "\nfinish:\n")
+		for _, s := range outFiles {
+			fmt.Fprintln(stdout, s)
+		}
+		done = true
+		return
+	}
+
+	// 範囲や分割の位置をコメントのvposと同じ番組の開始からにする
+	var offset time.Duration
+	if split.Enabled() || rng.Enabled() {
+		if offset, err = programOffset(db); err != nil {
+			return
+		}
+	} else {
+		niconico.WriteComment(db, outName, skipHb)
+	}
+
+	var zm *ZipMp4
+	defer func() {
+		if zm != nil {
+			//zm.CloseFFInput()
+			zm.Wait()
+		}
+	}()
+
+	// 分割したファイルごとの開始位置
+	var partStart []time.Duration
+	var clock tsClock
+	var partSize int64
+	// 範囲の終了位置。番組の開始より前のチャンクは負になる
+	var endPos time.Duration
+	var hasEnd bool
+
+	zm = &ZipMp4{ZipName: outName}
+
+	rows, err := db.Query(niconico.SelMedia)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	prevBw := -1
+	prevIndex := int64(-1)
+	lastSeqNo := int64(-1)
+	for rows.Next() {
+		var seqno int64
+		var bw int
+		var size int
+		var data []byte
+		err = rows.Scan(&seqno, &bw, &size, &data)
+		if err != nil {
+			return
+		}
+
+		var skip int64
+		if lastSeqNo >= 0 && seqno > lastSeqNo+1 {
+			skip = seqno - lastSeqNo - 1
+		}
+		lastSeqNo = seqno
+		pos := clock.next(data, skip) + offset
+
+		if rng.past(seqno, pos) {
+			endPos = pos
+			hasEnd = true
+			break
+		}
+		if !rng.includes(seqno, pos, clock.prevDur) {
+			continue
+		}
+
+		// チャンクが飛んでいる場合はファイルを分ける
+		// BANDWIDTHが変わる場合はファイルを分ける
+		if len(partStart) == 0 {
+			zm.OpenFFMpeg(ext)
+			partStart = append(partStart, pos)
+
+		} else if (prevIndex >= 0 && seqno != prevIndex+1) || (prevBw >= 0 && bw != prevBw) {
+			if bw != prevBw {
+				fmt.Fprintf(stdout, "\nBandwitdh changed: %d --> %d\n\n", prevBw, bw)
+			} else {
+				fmt.Fprintf(stdout, "\nSeqNo. skipped: %d --> %d\n\n", prevIndex, seqno)
+			}
+
+			//if zm != nil {
+			//	zm.CloseFFInput()
+			//	zm.Wait()
+			//}
+			zm.OpenFFMpeg(ext)
+			partStart = append(partStart, pos)
+			partSize = 0
+			broken = true
+
+		} else if partSize > 0 && ((split.Duration > 0 && pos-partStart[len(partStart)-1] >= split.Duration) ||
+			(split.Size > 0 && partSize+int64(len(data)) > split.Size)) {
+			// 指定の長さ・サイズで分ける
+			fmt.Fprintf(stdout, "\nSplit: SeqNo. %d\n\n", seqno)
+			zm.OpenFFMpeg(ext)
+			partStart = append(partStart, pos)
+			partSize = 0
+		}
+		prevBw = bw
+		prevIndex = seqno
+
+		zm.FFInput(bytes.NewBuffer(data))
+		partSize += int64(len(data))
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if len(partStart) == 0 {
+		err = fmt.Errorf("no chunks to convert: %s", fileName)
+		return
+	}
+
+	//zm.CloseFFInput()
+	zm.Wait()
+
+	if split.Enabled() || rng.Enabled() {
+		for i, name := range zm.mp4List {
+			from := int64(partStart[i] / (10 * time.Millisecond))
+			to := int64(-1)
+			if i+1 < len(partStart) {
+				to = int64(partStart[i+1] / (10 * time.Millisecond))
+			} else if hasEnd {
+				to = int64(endPos / (10 * time.Millisecond))
+			}
+			niconico.WriteCommentPart(db, name, skipHb, from, to)
+		}
+	}
+
+	fmt.Fprintf(stdout, "\nfinish:\n")
+	for _, s := range zm.mp4List {
+		fmt.Fprintln(stdout, s)
+	}
+	done = true
+	outFiles = zm.mp4List
+
+	return
+}
+
+func YtComment(fileName string) (done bool, err error) {
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	youtube.WriteComment(db, fileName)
+	return
+}